@@ -43,6 +43,10 @@ type Blob struct {
 	LzmaData []byte `protobuf:"bytes,4,opt,name=lzma_data" json:"lzma_data,omitempty"`
 	// Formerly used for bzip2 compressed data. Depreciated in 2010.
 	OBSOLETEBzip2Data []byte `protobuf:"bytes,5,opt,name=OBSOLETE_bzip2_data" json:"OBSOLETE_bzip2_data,omitempty"`
+	// LZ4 block (not frame) compressed data.
+	Lz4Data []byte `protobuf:"bytes,6,opt,name=lz4_data" json:"lz4_data,omitempty"`
+	// Zstandard compressed data.
+	ZstdData []byte `protobuf:"bytes,7,opt,name=zstd_data" json:"zstd_data,omitempty"`
 }
 
 func (m *Blob) Reset()         { *m = Blob{} }
@@ -98,6 +102,12 @@ func (this *Blob) Equal(that interface{}) bool {
 	if !bytes.Equal(this.OBSOLETEBzip2Data, that1.OBSOLETEBzip2Data) {
 		return false
 	}
+	if !bytes.Equal(this.Lz4Data, that1.Lz4Data) {
+		return false
+	}
+	if !bytes.Equal(this.ZstdData, that1.ZstdData) {
+		return false
+	}
 	return true
 }
 func (this *BlobHeader) Equal(that interface{}) bool {
@@ -135,7 +145,7 @@ func (this *Blob) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 9)
+	s := make([]string, 0, 11)
 	s = append(s, "&OSMPBF.Blob{")
 	if this.Raw != nil {
 		s = append(s, "Raw: "+valueToGoStringFileformat(this.Raw, "byte")+",\n")
@@ -150,6 +160,12 @@ func (this *Blob) GoString() string {
 	if this.OBSOLETEBzip2Data != nil {
 		s = append(s, "OBSOLETEBzip2Data: "+valueToGoStringFileformat(this.OBSOLETEBzip2Data, "byte")+",\n")
 	}
+	if this.Lz4Data != nil {
+		s = append(s, "Lz4Data: "+valueToGoStringFileformat(this.Lz4Data, "byte")+",\n")
+	}
+	if this.ZstdData != nil {
+		s = append(s, "ZstdData: "+valueToGoStringFileformat(this.ZstdData, "byte")+",\n")
+	}
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -234,6 +250,18 @@ func (m *Blob) MarshalTo(data []byte) (int, error) {
 		i = encodeVarintFileformat(data, i, uint64(len(m.OBSOLETEBzip2Data)))
 		i += copy(data[i:], m.OBSOLETEBzip2Data)
 	}
+	if m.Lz4Data != nil {
+		data[i] = 0x32
+		i++
+		i = encodeVarintFileformat(data, i, uint64(len(m.Lz4Data)))
+		i += copy(data[i:], m.Lz4Data)
+	}
+	if m.ZstdData != nil {
+		data[i] = 0x3a
+		i++
+		i = encodeVarintFileformat(data, i, uint64(len(m.ZstdData)))
+		i += copy(data[i:], m.ZstdData)
+	}
 	return i, nil
 }
 
@@ -315,6 +343,14 @@ func (m *Blob) Size() (n int) {
 		l = len(m.OBSOLETEBzip2Data)
 		n += 1 + l + sovFileformat(uint64(l))
 	}
+	if m.Lz4Data != nil {
+		l = len(m.Lz4Data)
+		n += 1 + l + sovFileformat(uint64(l))
+	}
+	if m.ZstdData != nil {
+		l = len(m.ZstdData)
+		n += 1 + l + sovFileformat(uint64(l))
+	}
 	return n
 }
 
@@ -504,6 +540,62 @@ func (m *Blob) Unmarshal(data []byte) error {
 			}
 			m.OBSOLETEBzip2Data = append([]byte{}, data[iNdEx:postIndex]...)
 			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Lz4Data", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileformat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthFileformat
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Lz4Data = append([]byte{}, data[iNdEx:postIndex]...)
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ZstdData", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileformat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthFileformat
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ZstdData = append([]byte{}, data[iNdEx:postIndex]...)
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipFileformat(data[iNdEx:])
@@ -4,9 +4,9 @@ import (
 	"fmt"
 )
 
-// There are a few different designs which make sense for individual blocks. The
-// one which is implemented here takes 16 bits for the lower bits of the ID and
-// 16 for a 4x4 grid of bits for the grid squares.
+// There are a few different designs which make sense for individual blocks.
+// The default one takes 16 bits for the lower bits of the ID and 16 for a 4x4
+// grid of bits for the grid squares.
 //
 // This can be represented in two ways, as a packed 32-bit int:
 // `((id << 16) | val)` or as an array of 16-bit values of length (1<<16). It's
@@ -17,15 +17,18 @@ import (
 // Inspiration for this comes from Daniel Lemire's "Roaring Bitmaps", simply
 // extended to handle values: https://github.com/lemire/RoaringBitmap
 //
-// Other designs worth considering:
+// Other designs are implemented as well, and the one to use is chosen by the
+// size of the grid:
 //
 //   1. 28 bits for the ID, plus 4 bits (2x2) for the grid. This doesn't allow
 //      as much fan-out for each process, but would be more efficient for sparse
-//      blocks.
+//      blocks. It's packed into 32-bit ints in the same way as the default.
 //
 //   2. 28 bits for the ID, plus 36 bits (6x6) for the grid, packed into a
 //      64-bit int. This allows more detail, but the grid size isn't a power of
-//      two, which makes it less useful.
+//      two, which makes it less useful. The values can't be packed into 64-bit
+//      ints, and an array of 2^28 of them would be far larger than any list of
+//      pairs, so these blocks only have a list-of-pairs mode.
 //
 const (
 	BLOCK_IDX_BITS = 16
@@ -37,53 +40,225 @@ const (
 	BLOCK_PACKING_MASK = 1 // = (1 << BLOCK_VAL_BITS) - 1
 )
 
-// The Block structure handles a single block, either packed as "list-of-pairs"
-// or an array of 16-bit ints (packed into 32-bit ints).
-type Block struct {
-	// Length tracks either the number of pairs present in the list-of-pairs mode
-	// or, if > BLOCK_FULL_LENGTH, indicates that the Block is in array mode.
-	Length uint32
+// BlockEncoding describes how the (id, val) pairs in a Block are packed. Blocks
+// can only be merged or copied with other Blocks of the same encoding.
+type BlockEncoding struct {
+	Name string
 
-	// Frozen is true if the Block is immutable.
-	Frozen bool
+	// Number of bits for the lower bits of the ID, and for the grid bitfield.
+	IdxBits, ValBits uint
 
-	// Values contains the packed list-of-pairs or array of grid bitfields.
-	Values []uint32
+	IdxMask uint32
+	ValMask uint64
+
+	// Wide encodings pack pairs into 64-bit ints, and have no array mode.
+	Wide bool
+
+	// For 32-bit encodings, the length of the Values array in array mode and
+	// how many values are packed into each 32-bit int.
+	fullLength uint32
+	packingBits uint
+	packingMask uint32
+}
+
+func newBlockEncoding(name string, idxBits, valBits uint, wide bool) *BlockEncoding {
+	e := &BlockEncoding{
+		Name: name,
+		IdxBits: idxBits,
+		ValBits: valBits,
+		IdxMask: uint32((uint64(1) << idxBits) - 1),
+		ValMask: (uint64(1) << valBits) - 1,
+		Wide: wide,
+	}
+	if !wide {
+		perWord := uint32(32 / valBits)
+		for (uint32(1) << e.packingBits) < perWord {
+			e.packingBits += 1
+		}
+		e.packingMask = perWord - 1
+		e.fullLength = uint32((uint64(1) << idxBits) / uint64(perWord))
+	}
+	return e
 }
 
-// NewAccumulationBlock returns a full pre-allocated block. This means it will
-// not need to grow as new values are added to it. It is intended for use as an
+var (
+	ENCODING_16_16 = newBlockEncoding("16/16", BLOCK_IDX_BITS, BLOCK_VAL_BITS, false)
+	ENCODING_28_4 = newBlockEncoding("28/4", 28, 4, false)
+	ENCODING_28_36 = newBlockEncoding("28/36", 28, 36, true)
+)
+
+// EncodingForGrid returns the most compact encoding which has a bit for each
+// square of a gridSize x gridSize grid.
+func EncodingForGrid(gridSize int) (*BlockEncoding, error) {
+	squares := uint(gridSize * gridSize)
+	for _, e := range []*BlockEncoding{ENCODING_28_4, ENCODING_16_16, ENCODING_28_36} {
+		if squares <= e.ValBits {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("No block encoding is available for a %dx%d grid, the largest is 6x6.", gridSize, gridSize)
+}
+
+// DEFAULT_ENCODING is the encoding used for the grid that the tool splits each
+// tile into.
+var DEFAULT_ENCODING = mustEncodingForGrid(GRID_SIZE)
+
+func mustEncodingForGrid(gridSize int) *BlockEncoding {
+	e, err := EncodingForGrid(gridSize)
+	if err != nil {
+		panic(err.Error())
+	}
+	return e
+}
+
+// NewAccumulationBlock returns a block which is intended for use as an
 // accumulation buffer, so that blocks can be copied from it and it can be reset
-// to accumulate the next. This avoids the need for reallocations and reduces GC
-// pressure.
-func NewAccumulationBlock() *Block {
-	return &Block{
-		Length: 0,
-		Frozen: false,
-		Values: make([]uint32, BLOCK_FULL_LENGTH)}
+// to accumulate the next. It keeps hold of its memory when reset, which avoids
+// the need for reallocations and reduces GC pressure.
+func (e *BlockEncoding) NewAccumulationBlock() Block {
+	if e.Wide {
+		return &WideBlock{enc: e}
+	}
+
+	// small blocks are pre-allocated in full, but it's not worth holding on to
+	// hundreds of megabytes for the larger ones unless they're needed.
+	size := e.fullLength
+	if size > BLOCK_FULL_LENGTH {
+		size = BLOCK_FULL_LENGTH
+	}
+	return &PackedBlock{enc: e, Values: make([]uint32, 0, size)}
 }
 
 // NewEmptyBlock returns a new, empty, frozen block. This should be okay to do
 // lookups on, but is otherwise a "null" value.
-func NewEmptyBlock() *Block {
-	return &Block{
-		Length: 0,
-		Frozen: true,
-		Values: make([]uint32, 0)}
+func (e *BlockEncoding) NewEmptyBlock() Block {
+	if e.Wide {
+		return &WideBlock{enc: e, frozen: true}
+	}
+	return &PackedBlock{enc: e, frozen: true}
+}
+
+// NewAccumulationBlock returns an accumulation block in the default encoding.
+func NewAccumulationBlock() Block {
+	return DEFAULT_ENCODING.NewAccumulationBlock()
 }
 
-// Copy copies a block, allocating only the memory needed to represent what's in
-// the block. The new block is frozen, and cannot be mutated.
-func (b *Block) Copy() *Block {
-	nb := new(Block)
-	nb.Length = b.Length
-	nb.Frozen = true
+// NewEmptyBlock returns an empty, frozen block in the default encoding.
+func NewEmptyBlock() Block {
+	return DEFAULT_ENCODING.NewEmptyBlock()
+}
+
+// Block holds the grid bitfields for a range of (1 << IdxBits) IDs.
+type Block interface {
+	// Append an (id, val) pair onto the end of the block. The id must be
+	// greater than any other id appended to this block before. The val must fit
+	// into the values allowed in this block.
+	Append(id uint32, val uint64)
+
+	// Lookup an ID, returning the value (grid bitfield) associated with it, or
+	// zero if the ID wasn't found.
+	Lookup(id uint32) uint64
+
+	// Take the last appended value off the Block, returning it. This is
+	// intended to be used rarely, and may not be implemented efficiently.
+	UnAppend() (idx uint32, val uint64)
+
+	// Reset the block to an empty state, without reallocating any memory.
+	Reset()
+
+	// Copy copies a block, allocating only the memory needed to represent
+	// what's in the block. The new block is frozen, and cannot be mutated.
+	Copy() Block
+
+	// CopyFrom another block of the same encoding. This can be used to
+	// "unfreeze" a frozen Block by copying it into an accumulation Block.
+	CopyFrom(b2 Block)
+
+	// Iterator returns an Iterator pointing to the beginning of the Block.
+	Iterator() Iterator
 
-	if b.Length > BLOCK_FULL_LENGTH {
-		nb.Values = make([]uint32, BLOCK_FULL_LENGTH)
+	// ResetAndMergeFrom resets the receiver accumulation block and fills it
+	// with the OR-ed together records of block1 and block2.
+	ResetAndMergeFrom(block1, block2 Block)
+
+	// Len returns the number of pairs in the Block, or the maximum number of
+	// IDs when the Block is in array mode.
+	Len() uint32
+
+	// Frozen is true if the Block is immutable.
+	Frozen() bool
+
+	// MemoryUsage returns the approximate number of bytes used by the Block.
+	MemoryUsage() int
+
+	Encoding() *BlockEncoding
+
+	// Used by Iterator to walk over the records in the Block.
+	valid(idx int) bool
+	index(idx int) uint32
+	value(idx int) uint64
+	next(idx int) int
+}
+
+func checkAppend(b Block, id uint32, val uint64) {
+	e := b.Encoding()
+	if id > e.IdxMask {
+		panic(fmt.Sprintf("ID value %d is too large for this block, max is %d.", id, e.IdxMask))
+	}
+	if val > e.ValMask {
+		panic(fmt.Sprintf("Val value %d is too large for this block, max is %d.", val, e.ValMask))
+	}
+	if b.Frozen() {
+		panic("Attempt to append to a frozen Block, which is not allowed.")
+	}
+}
+
+// The PackedBlock structure handles a single block in a 32-bit encoding, either
+// packed as "list-of-pairs" or an array of values (packed into 32-bit ints).
+type PackedBlock struct {
+	// length tracks either the number of pairs present in the list-of-pairs
+	// mode or, if > fullLength, indicates that the Block is in array mode.
+	length uint32
+
+	frozen bool
+
+	// Values contains the packed list-of-pairs or array of grid bitfields.
+	Values []uint32
+
+	enc *BlockEncoding
+}
+
+func (b *PackedBlock) Len() uint32 {
+	return b.length
+}
+
+func (b *PackedBlock) Frozen() bool {
+	return b.frozen
+}
+
+func (b *PackedBlock) Encoding() *BlockEncoding {
+	return b.enc
+}
+
+func (b *PackedBlock) MemoryUsage() int {
+	return 4 * cap(b.Values)
+}
+
+func (b *PackedBlock) arrayMode() bool {
+	return b.length > b.enc.fullLength
+}
+
+func (b *PackedBlock) Copy() Block {
+	nb := new(PackedBlock)
+	nb.length = b.length
+	nb.frozen = true
+	nb.enc = b.enc
+
+	if b.arrayMode() {
+		nb.Values = make([]uint32, b.enc.fullLength)
 
 	} else {
-		nb.Values = make([]uint32, b.Length)
+		nb.Values = make([]uint32, b.length)
 	}
 
 	copy(nb.Values, b.Values)
@@ -91,77 +266,71 @@ func (b *Block) Copy() *Block {
 	return nb
 }
 
-func writePacked(arr []uint32, id, val uint32) {
-	hilo := id & BLOCK_PACKING_MASK
-	idx := id >> BLOCK_PACKING_BITS
-	arr[idx] = arr[idx] | (val << (hilo * BLOCK_VAL_BITS))
+func (b *PackedBlock) writePacked(arr []uint32, id uint32, val uint64) {
+	hilo := id & b.enc.packingMask
+	idx := id >> b.enc.packingBits
+	arr[idx] = arr[idx] | (uint32(val) << (hilo * uint32(b.enc.ValBits)))
 }
 
-// Append an (id, val) pair onto the end of the block. The id must be unique,
-// and greater than any other id appended to this block before. The val must fit
-// into the values allowed in this block (i.e: BLOCK_VAL_BITS bits).
-func (b *Block) Append(id uint32, val uint32) {
-	// sanity checking
-	if id > BLOCK_IDX_MASK {
-		panic(fmt.Sprintf("ID value %d is too large for this block, max is %d.", id, BLOCK_IDX_MASK))
-	}
-	if val > BLOCK_VAL_MASK {
-		panic(fmt.Sprintf("Val value %d is too large for this block, max is %d.", val, BLOCK_VAL_MASK))
-	}
-	if b.Frozen {
-		panic("Attempt to append to a frozen Block, which is not allowed.")
-	}
+func (b *PackedBlock) readPacked(id uint32) uint64 {
+	hilo := id & b.enc.packingMask
+	idx := id >> b.enc.packingBits
+	return uint64(b.Values[idx] >> (hilo * uint32(b.enc.ValBits))) & b.enc.ValMask
+}
+
+func (b *PackedBlock) Append(id uint32, val uint64) {
+	checkAppend(b, id, val)
+	e := b.enc
 
-	if b.Length > BLOCK_FULL_LENGTH {
+	if b.arrayMode() {
 		// block is in array mode
-		if id >= b.Length {
-			panic(fmt.Sprintf("Unable to push %d into array-mode block of size %d.", id, b.Length))
+		if id >= b.length {
+			panic(fmt.Sprintf("Unable to push %d into array-mode block of size %d.", id, b.length))
 		}
 
-		writePacked(b.Values, id, val)
+		b.writePacked(b.Values, id, val)
 
-	} else if b.Length < BLOCK_FULL_LENGTH {
+	} else if b.length < e.fullLength {
 		// block is in list-of-pair mode
-		b.Values[b.Length] = (id << BLOCK_VAL_BITS) | val
-		b.Length += 1
+		b.Values = append(b.Values[:b.length], (id << e.ValBits) | uint32(val))
+		b.length += 1
 
 	} else {
 		// block _was_ in list-of-pair mode, but now needs
 		// to transition to array mode.
-		var tmp [BLOCK_FULL_LENGTH]uint32
-		for _, kv := range b.Values {
-			k := kv >> BLOCK_VAL_BITS
-			v := kv & BLOCK_VAL_MASK
+		tmp := make([]uint32, e.fullLength)
+		for _, kv := range b.Values[:b.length] {
+			k := kv >> e.ValBits
+			v := uint64(kv) & e.ValMask
 
-			writePacked(tmp[:], k, v)
+			b.writePacked(tmp, k, v)
 		}
 
-		writePacked(tmp[:], id, val)
+		b.writePacked(tmp, id, val)
 
-		copy(b.Values, tmp[:])
-		b.Length = 1 << BLOCK_IDX_BITS
+		b.Values = tmp
+		b.length = uint32((uint64(1) << e.IdxBits))
 	}
 }
 
-// Reset the block to an empty state. Note that it doesn't reallocate any
-// memory.
-func (b *Block) Reset() {
-	if b.Frozen {
+func (b *PackedBlock) Reset() {
+	if b.frozen {
 		panic("Attempt to reset a frozen Block, which is not allowed.")
 	}
 
-	b.Length = 0
+	b.length = 0
 	// zero out the slice. this shouldn't really be necessary, but is probably
 	// worth keeping until at least more sure that the rest of the code is
 	// working.
 	for i := range b.Values {
 		b.Values[i] = 0
 	}
+	b.Values = b.Values[:0]
 }
 
 // Simple binary search on the upper bits of the Values array, used when the
 // Block is in list-of-pairs mode.
-func search(arr []uint32, lb uint32) uint32 {
+func search(arr []uint32, lb uint32, valBits uint) uint32 {
 	if len(arr) == 0 {
 		return 0
 	} else if len(arr) == 1 {
@@ -169,35 +338,30 @@ func search(arr []uint32, lb uint32) uint32 {
 	}
 
 	mididx := len(arr) / 2
-	mid := arr[mididx] >> BLOCK_VAL_BITS
+	mid := arr[mididx] >> valBits
 
 	if lb < mid {
-		return search(arr[:mididx], lb)
+		return search(arr[:mididx], lb, valBits)
 	} else {
-		return search(arr[mididx:], lb)
+		return search(arr[mididx:], lb, valBits)
 	}
 }
 
-// Lookup an ID, returning the value (grid bitfield) associated with it, or
-// zero if the ID wasn't found.
-func (b *Block) Lookup(id uint32) uint32 {
+func (b *PackedBlock) Lookup(id uint32) uint64 {
 	// sanity checking
-	if id > BLOCK_IDX_MASK {
-		panic(fmt.Sprintf("Lookup value %d is larger than max %d.", id, BLOCK_IDX_MASK))
+	if id > b.enc.IdxMask {
+		panic(fmt.Sprintf("Lookup value %d is larger than max %d.", id, b.enc.IdxMask))
 	}
 
-	if b.Length > BLOCK_FULL_LENGTH {
-		// in array mode
-		hilo := id & BLOCK_PACKING_MASK
-		idx := id >> BLOCK_PACKING_BITS
-		return (b.Values[idx] >> (hilo * BLOCK_VAL_BITS)) & BLOCK_VAL_MASK
+	if b.arrayMode() {
+		return b.readPacked(id)
 
 	} else {
 		// in list-of-pairs mode
-		lb := search(b.Values[:b.Length], id)
+		lb := search(b.Values[:b.length], id, b.enc.ValBits)
 
-		if (lb >> BLOCK_VAL_BITS) == id {
-			return lb & BLOCK_VAL_MASK
+		if (lb >> b.enc.ValBits) == id {
+			return uint64(lb) & b.enc.ValMask
 
 		} else {
 			return 0
@@ -205,27 +369,26 @@ func (b *Block) Lookup(id uint32) uint32 {
 	}
 }
 
-// Take the last appended value off the Block, returning it. Note that this
-// won't trigger a "shrink" of the Block back to list-of-pair mode if it's in
-// array mode, and is intended to be used rarely - it's not implemented
-// particularly efficiently.
-func (b *Block) UnAppend() (idx, val uint32) {
-	if b.Frozen {
+// UnAppend won't trigger a "shrink" of the Block back to list-of-pair mode if
+// it's in array mode.
+func (b *PackedBlock) UnAppend() (idx uint32, val uint64) {
+	if b.frozen {
 		panic("Attempt to unappend from a frozen Block, which is not allowed.")
 	}
+	e := b.enc
 
-	if b.Length > BLOCK_FULL_LENGTH {
+	if b.arrayMode() {
 		// block is in array mode
 		// TODO: find a better algorithm than brute force backward search for this?
 		// UnAppend is pretty rare...
 	Loop:
-		for i := BLOCK_FULL_LENGTH - 1; i >= 0; i -= 1 {
+		for i := int(e.fullLength) - 1; i >= 0; i -= 1 {
 			v := b.Values[i]
 			if v > 0 {
-				for j := BLOCK_PACKING_MASK; j >= 0; j -= 1 {
-					vj := (v >> (uint(j) * BLOCK_VAL_BITS)) & BLOCK_VAL_MASK
+				for j := int(e.packingMask); j >= 0; j -= 1 {
+					vj := uint64(v >> (uint(j) * e.ValBits)) & e.ValMask
 					if vj > 0 {
-						idx = uint32((i << BLOCK_PACKING_BITS) | j)
+						idx = uint32((i << e.packingBits) | j)
 						val = vj
 						break Loop
 					}
@@ -234,122 +397,252 @@ func (b *Block) UnAppend() (idx, val uint32) {
 		}
 		// NOTE: won't trigger a "shrink" from array mode back to list-of-pair mode.
 
-	} else if b.Length > 0 {
+	} else if b.length > 0 {
 		// block is in list-of-pair mode
-		b.Length -= 1
-		kv := b.Values[b.Length]
-		idx = kv >> BLOCK_VAL_BITS
-		val = kv & BLOCK_VAL_MASK
+		b.length -= 1
+		kv := b.Values[b.length]
+		b.Values = b.Values[:b.length]
+		idx = kv >> e.ValBits
+		val = uint64(kv) & e.ValMask
 	}
 
-	if idx > BLOCK_IDX_MASK {
-		panic(fmt.Sprintf("Block index %d out of range, max is %d.", idx, BLOCK_IDX_MASK))
+	if idx > e.IdxMask {
+		panic(fmt.Sprintf("Block index %d out of range, max is %d.", idx, e.IdxMask))
 	}
-	if val > BLOCK_VAL_MASK {
-		panic(fmt.Sprintf("Block value %d out of range, max is %d.", val, BLOCK_VAL_MASK))
+	if val > e.ValMask {
+		panic(fmt.Sprintf("Block value %d out of range, max is %d.", val, e.ValMask))
 	}
 
 	return
 }
 
-// CopyFrom another block. This can be used to "unfreeze" a frozen Block by
-// copying it into an accumulation Block.
-func (b *Block) CopyFrom(b2 *Block) {
-	if b.Frozen {
+func (b *PackedBlock) CopyFrom(block2 Block) {
+	if b.frozen {
 		panic("Attempt to copy into a frozen Block, which is not allowed.")
 	}
-
-	b.Reset()
-
-	if len(b.Values) < len(b2.Values) {
-		panic(fmt.Sprintf("Unable to copy %d bytes into smaller Block of %d bytes.", len(b2.Values), len(b.Values)))
+	b2, ok := block2.(*PackedBlock)
+	if !ok || b2.enc != b.enc {
+		panic(fmt.Sprintf("Unable to copy a %s Block into a %s Block.", block2.Encoding().Name, b.enc.Name))
 	}
 
-	copy(b.Values, b2.Values)
-	b.Length = b2.Length
-}
+	b.Reset()
 
-// Iterator allows read-only access to the values in a Block by a uniform
-// interface, which is used in the Block merging functions.
-type Iterator struct {
-	block *Block
-	idx int
+	b.Values = append(b.Values, b2.Values...)
+	b.length = b2.length
 }
 
-// Valid returns true when the Iterator is valid; when Index and Value can
-// be called.
-func (i Iterator) Valid() bool {
-	return uint32(i.idx) < i.block.Length
+func (b *PackedBlock) valid(idx int) bool {
+	return uint32(idx) < b.length
 }
 
-// Index returns the ID of the record that the Iterator is currently pointing
-// to. The Iterator *must* be Valid, or this might cause a panic.
-func (i Iterator) Index() uint32 {
-	if i.block.Length > BLOCK_FULL_LENGTH {
-		// array mode
-		return uint32(i.idx)
+func (b *PackedBlock) index(idx int) uint32 {
+	if b.arrayMode() {
+		return uint32(idx)
 
 	} else {
-		// list-of-pairs mode
-		return i.block.Values[i.idx] >> BLOCK_VAL_BITS
+		return b.Values[idx] >> b.enc.ValBits
 	}
 }
 
-// Value returns the value of the record that the Iterator is currently pointing
-// to. The Iterator *must* be Valid, or this might cause a panic.
-func (i Iterator) Value() uint32 {
-	if i.block.Length > BLOCK_FULL_LENGTH {
-		// array mode
-		hilo := uint32(i.idx) & BLOCK_PACKING_MASK
-		idx := i.idx >> BLOCK_PACKING_BITS
-		return (i.block.Values[idx] >> (hilo * BLOCK_VAL_BITS)) & BLOCK_VAL_MASK
+func (b *PackedBlock) value(idx int) uint64 {
+	if b.arrayMode() {
+		return b.readPacked(uint32(idx))
 
 	} else {
-		// list-of-pairs mode
-		return i.block.Values[i.idx] & BLOCK_VAL_MASK
+		return uint64(b.Values[idx]) & b.enc.ValMask
 	}
 }
 
-// Next increments the Iterator to point to the next record. You should check
-// whether the Iterator is still Valid after calling this.
-func (i Iterator) Next() Iterator {
-	if i.block.Length > BLOCK_FULL_LENGTH {
-		// array mode
-		idx := i.idx >> BLOCK_PACKING_BITS
-		for j := idx; j < BLOCK_FULL_LENGTH; j += 1 {
-			v := i.block.Values[j]
+func (b *PackedBlock) next(i int) int {
+	e := b.enc
+
+	if b.arrayMode() {
+		idx := i >> e.packingBits
+		for j := idx; j < int(e.fullLength); j += 1 {
+			v := b.Values[j]
 			if v > 0 {
-				for k := 0; k <= BLOCK_PACKING_MASK; k += 1 {
-					vj := (v >> (uint(k) * BLOCK_VAL_BITS)) & BLOCK_VAL_MASK
+				for k := 0; k <= int(e.packingMask); k += 1 {
+					vj := uint64(v >> (uint(k) * e.ValBits)) & e.ValMask
 					if vj > 0 {
-						ii := (j << BLOCK_PACKING_BITS) | k
-						if ii > i.idx {
-							return Iterator{block: i.block, idx: ii}
+						ii := (j << e.packingBits) | k
+						if ii > i {
+							return ii
 						}
 					}
 				}
 			}
 		}
 
-		return Iterator{block: i.block, idx: (1 << BLOCK_IDX_BITS)}
+		return 1 << e.IdxBits
 
 	} else {
-		// list-of-pairs mode
-		return Iterator{block: i.block, idx: i.idx + 1}
+		return i + 1
 	}
 }
 
-// Iterator returns an Iterator pointing to the beginning of the Block.
-func (b *Block) Iterator() Iterator {
+func (b *PackedBlock) Iterator() Iterator {
 	return Iterator{block: b, idx: 0}
 }
 
-// ResetAndMergeFrom resets the receiver accumulation block and fills it with
+func (b *PackedBlock) ResetAndMergeFrom(block1, block2 Block) {
+	resetAndMergeFrom(b, block1, block2)
+}
+
+// The WideBlock structure handles a single block in a 64-bit encoding, packed
+// as a "list-of-pairs".
+type WideBlock struct {
+	frozen bool
+
+	// Values contains the packed list-of-pairs.
+	Values []uint64
+
+	enc *BlockEncoding
+}
+
+func (b *WideBlock) Len() uint32 {
+	return uint32(len(b.Values))
+}
+
+func (b *WideBlock) Frozen() bool {
+	return b.frozen
+}
+
+func (b *WideBlock) Encoding() *BlockEncoding {
+	return b.enc
+}
+
+func (b *WideBlock) MemoryUsage() int {
+	return 8 * cap(b.Values)
+}
+
+func (b *WideBlock) Copy() Block {
+	nb := &WideBlock{frozen: true, enc: b.enc}
+	nb.Values = make([]uint64, len(b.Values))
+	copy(nb.Values, b.Values)
+	return nb
+}
+
+func (b *WideBlock) Append(id uint32, val uint64) {
+	checkAppend(b, id, val)
+	b.Values = append(b.Values, (uint64(id) << b.enc.ValBits) | val)
+}
+
+func (b *WideBlock) Reset() {
+	if b.frozen {
+		panic("Attempt to reset a frozen Block, which is not allowed.")
+	}
+	b.Values = b.Values[:0]
+}
+
+func (b *WideBlock) Lookup(id uint32) uint64 {
+	if id > b.enc.IdxMask {
+		panic(fmt.Sprintf("Lookup value %d is larger than max %d.", id, b.enc.IdxMask))
+	}
+
+	// find the last pair with an ID less than or equal to the one we want.
+	lo, hi := 0, len(b.Values)
+	for hi - lo > 1 {
+		mid := (lo + hi) / 2
+		if uint32(b.Values[mid] >> b.enc.ValBits) <= id {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo < len(b.Values) && uint32(b.Values[lo] >> b.enc.ValBits) == id {
+		return b.Values[lo] & b.enc.ValMask
+	}
+	return 0
+}
+
+func (b *WideBlock) UnAppend() (idx uint32, val uint64) {
+	if b.frozen {
+		panic("Attempt to unappend from a frozen Block, which is not allowed.")
+	}
+
+	if n := len(b.Values); n > 0 {
+		kv := b.Values[n-1]
+		b.Values = b.Values[:n-1]
+		idx = uint32(kv >> b.enc.ValBits)
+		val = kv & b.enc.ValMask
+	}
+	return
+}
+
+func (b *WideBlock) CopyFrom(block2 Block) {
+	if b.frozen {
+		panic("Attempt to copy into a frozen Block, which is not allowed.")
+	}
+	b2, ok := block2.(*WideBlock)
+	if !ok || b2.enc != b.enc {
+		panic(fmt.Sprintf("Unable to copy a %s Block into a %s Block.", block2.Encoding().Name, b.enc.Name))
+	}
+
+	b.Values = append(b.Values[:0], b2.Values...)
+}
+
+func (b *WideBlock) valid(idx int) bool {
+	return idx < len(b.Values)
+}
+
+func (b *WideBlock) index(idx int) uint32 {
+	return uint32(b.Values[idx] >> b.enc.ValBits)
+}
+
+func (b *WideBlock) value(idx int) uint64 {
+	return b.Values[idx] & b.enc.ValMask
+}
+
+func (b *WideBlock) next(idx int) int {
+	return idx + 1
+}
+
+func (b *WideBlock) Iterator() Iterator {
+	return Iterator{block: b, idx: 0}
+}
+
+func (b *WideBlock) ResetAndMergeFrom(block1, block2 Block) {
+	resetAndMergeFrom(b, block1, block2)
+}
+
+// Iterator allows read-only access to the values in a Block by a uniform
+// interface, which is used in the Block merging functions.
+type Iterator struct {
+	block Block
+	idx int
+}
+
+// Valid returns true when the Iterator is valid; when Index and Value can
+// be called.
+func (i Iterator) Valid() bool {
+	return i.block.valid(i.idx)
+}
+
+// Index returns the ID of the record that the Iterator is currently pointing
+// to. The Iterator *must* be Valid, or this might cause a panic.
+func (i Iterator) Index() uint32 {
+	return i.block.index(i.idx)
+}
+
+// Value returns the value of the record that the Iterator is currently pointing
+// to. The Iterator *must* be Valid, or this might cause a panic.
+func (i Iterator) Value() uint64 {
+	return i.block.value(i.idx)
+}
+
+// Next increments the Iterator to point to the next record. You should check
+// whether the Iterator is still Valid after calling this.
+func (i Iterator) Next() Iterator {
+	return Iterator{block: i.block, idx: i.block.next(i.idx)}
+}
+
+// resetAndMergeFrom resets the receiver accumulation block and fills it with
 // data from block1 and block2. In other words; if (id, val) was a record in
 // either block1 or block2, then (id, val | c) will be a record in the receiver
 // for some constant c (it might be OR-ed with something from the other Block).
 // This is done in a single pass, so should be relatively efficient.
-func (b *Block) ResetAndMergeFrom(block1, block2 *Block) {
+func resetAndMergeFrom(b, block1, block2 Block) {
 	b.Reset()
 
 	it1 := block1.Iterator()
@@ -12,8 +12,8 @@ func TestAppend(t *testing.T) {
 
 	for _, kv := range tests {
 		b := NewAccumulationBlock()
-		if b.Length != 0 {
-			t.Errorf("Expected length = 0, but length = %d", b.Length)
+		if b.Len() != 0 {
+			t.Errorf("Expected length = 0, but length = %d", b.Len())
 		}
 
 		v := b.Lookup(kv[0])
@@ -21,13 +21,13 @@ func TestAppend(t *testing.T) {
 			t.Errorf("Lookup on empty array should be empty, not %d.", v)
 		}
 
-		b.Append(kv[0], kv[1])
-		if b.Length != 1 {
-			t.Errorf("Expected length = 1, but length = %d", b.Length)
+		b.Append(kv[0], uint64(kv[1]))
+		if b.Len() != 1 {
+			t.Errorf("Expected length = 1, but length = %d", b.Len())
 		}
 
 		v = b.Lookup(kv[0])
-		if v != kv[1] {
+		if v != uint64(kv[1]) {
 			t.Errorf("After append, lookup should return %d, not %d.", kv[1], v)
 		}
 	}
@@ -38,19 +38,19 @@ func TestArrayMode(t *testing.T) {
 
 	for i := 0; i <= BLOCK_IDX_MASK; i += 1 {
 		j := uint32(i)
-		b.Append(j, j)
-		if b.Length < j {
-			t.Fatalf("Expected length >= %d, but was %d.", j, b.Length)
+		b.Append(j, uint64(j))
+		if b.Len() < j {
+			t.Fatalf("Expected length >= %d, but was %d.", j, b.Len())
 		}
 		v := b.Lookup(j)
-		if v != j {
+		if v != uint64(j) {
 			t.Fatalf("Unable to fetch value %d which we just appended, got %d instead.", j, v)
 		}
 	}
 
 	for i := 0; i <= BLOCK_IDX_MASK; i += 1 {
 		v := b.Lookup(uint32(i))
-		if v != uint32(i) {
+		if v != uint64(i) {
 			t.Errorf("Unable to fetch value %d which was appended previously, got %d instead.", i, v)
 		}
 	}
@@ -61,17 +61,17 @@ func TestCopy(t *testing.T) {
 
 	for i := 0; i <= BLOCK_IDX_MASK; i += 1 {
 		j := uint32(i)
-		b.Append(j, j)
+		b.Append(j, uint64(j))
 	}
 
 	c := b.Copy()
-	if c.Frozen != true {
+	if c.Frozen() != true {
 		t.Fatalf("Expected copy of block to be frozen, but it isn't.")
 	}
 
 	for i := 0; i <= BLOCK_IDX_MASK; i += 1 {
 		v := c.Lookup(uint32(i))
-		if v != uint32(i) {
+		if v != uint64(i) {
 			t.Errorf("Unable to fetch value %d which was appended and copied, got %d instead.", i, v)
 		}
 	}
@@ -82,18 +82,18 @@ func TestCopyStride(t *testing.T) {
 
 	for i := 0; i < (1 << BLOCK_IDX_BITS); i += 10 {
 		j := uint32(i)
-		b.Append(j, uint32(i & BLOCK_VAL_MASK))
-		b.Append(j, uint32((i + 1) & BLOCK_VAL_MASK))
+		b.Append(j, uint64(i & BLOCK_VAL_MASK))
+		b.Append(j, uint64((i + 1) & BLOCK_VAL_MASK))
 	}
 
 	c := b.Copy()
-	if c.Frozen != true {
+	if c.Frozen() != true {
 		t.Fatalf("Expected copy of block to be frozen, but it isn't.")
 	}
 
 	for i := 0; i < (1 << BLOCK_IDX_BITS); i += 10 {
 		v := c.Lookup(uint32(i))
-		expected := uint32(((i + 1) | i) & BLOCK_VAL_MASK)
+		expected := uint64(((i + 1) | i) & BLOCK_VAL_MASK)
 		if v != expected {
 			t.Errorf("Unable to fetch value %d which was appended and copied, got %d instead.", expected, v)
 		}
@@ -102,7 +102,7 @@ func TestCopyStride(t *testing.T) {
 
 func TestNewEmptyBlock(t *testing.T) {
 	b := NewEmptyBlock()
-	if b.Frozen != true {
+	if b.Frozen() != true {
 		t.Errorf("Expected empty block to be frozen, but wasn't.")
 	}
 	for i := 0; i < BLOCK_FULL_LENGTH; i += 1 {
@@ -133,22 +133,22 @@ func TestCopyFrom(t *testing.T) {
 
 	for i := 0; i < (1 << BLOCK_IDX_BITS); i += 10 {
 		j := uint32(i)
-		a.Append(j, uint32(i & BLOCK_VAL_MASK))
+		a.Append(j, uint64(i & BLOCK_VAL_MASK))
 	}
 
 	c := a.Copy()
-	if c.Frozen != true {
-		t.Fatalf("Expected c to be frozen, as it is a copy, but c.Frozen=%q.", c.Frozen)
+	if c.Frozen() != true {
+		t.Fatalf("Expected c to be frozen, as it is a copy, but c.Frozen()=%t.", c.Frozen())
 	}
 
 	b.CopyFrom(c)
-	if c.Frozen != true {
-		t.Fatalf("Expected b not to be frozen, as it is a copy-from, but b.Frozen=%q.", b.Frozen)
+	if c.Frozen() != true {
+		t.Fatalf("Expected b not to be frozen, as it is a copy-from, but b.Frozen()=%t.", b.Frozen())
 	}
 
 	for i := 0; i < (1 << BLOCK_IDX_BITS); i += 10 {
 		j := uint32(i)
-		expected := uint32(i & BLOCK_VAL_MASK)
+		expected := uint64(i & BLOCK_VAL_MASK)
 		val := b.Lookup(j)
 		if val != expected {
 			t.Fatalf("Expected lookup(%d) to return %d, but got %d instead.", j, expected, val)
@@ -159,7 +159,10 @@ func TestCopyFrom(t *testing.T) {
 func TestIterator(t *testing.T) {
 	block := NewAccumulationBlock()
 
-	vals := [...][2]uint32{
+	vals := [...]struct {
+		idx uint32
+		val uint64
+	}{
 		{ 2, 15},
 		{ 7,  1},
 		{ 8, 10},
@@ -167,7 +170,7 @@ func TestIterator(t *testing.T) {
 	}
 
 	for _, a := range vals {
-		block.Append(a[0], a[1])
+		block.Append(a.idx, a.val)
 	}
 
 	itr := block.Iterator()
@@ -175,11 +178,11 @@ func TestIterator(t *testing.T) {
 		if !itr.Valid() {
 			t.Fatalf("Expected (step %d) iterator to be valid.", i)
 		}
-		if itr.Index() != a[0] {
-			t.Fatalf("Expected (step %d) iterator to have Index %d, but was %d.", i, a[0], itr.Index())
+		if itr.Index() != a.idx {
+			t.Fatalf("Expected (step %d) iterator to have Index %d, but was %d.", i, a.idx, itr.Index())
 		}
-		if itr.Value() != a[1] {
-			t.Fatalf("Expected (step %d) iterator to have Value %d, but was %d.", i, a[1], itr.Value())
+		if itr.Value() != a.val {
+			t.Fatalf("Expected (step %d) iterator to have Value %d, but was %d.", i, a.val, itr.Value())
 		}
 		itr = itr.Next()
 	}
@@ -192,13 +195,13 @@ func TestIteratorDense(t *testing.T) {
 	block := NewAccumulationBlock()
 
 	for i := 1; i < (1 << BLOCK_IDX_BITS); i += 3 {
-		block.Append(uint32(i), uint32(i) & BLOCK_VAL_MASK)
+		block.Append(uint32(i), uint64(i) & BLOCK_VAL_MASK)
 	}
 
 	itr := block.Iterator()
 	for i := 1; i < (1 << BLOCK_IDX_BITS); i += 3 {
 		idx := uint32(i)
-		val := uint32(i) & BLOCK_VAL_MASK
+		val := uint64(i) & BLOCK_VAL_MASK
 
 		if !itr.Valid() {
 			t.Fatalf("Expected (step %d) iterator to be valid.", i)
@@ -222,8 +225,8 @@ func TestResetAndMergeFrom(t *testing.T) {
 
 	for i := 0; i < (1 << BLOCK_IDX_BITS); i += 2 {
 		j := uint32(i)
-		a.Append(j, j & BLOCK_VAL_MASK)
-		b.Append(j+1, (j+1) & BLOCK_VAL_MASK)
+		a.Append(j, uint64(j) & BLOCK_VAL_MASK)
+		b.Append(j+1, uint64(j+1) & BLOCK_VAL_MASK)
 	}
 
 	c := NewAccumulationBlock()
@@ -231,10 +234,94 @@ func TestResetAndMergeFrom(t *testing.T) {
 
 	for i := 0; i < (1 << BLOCK_IDX_BITS); i += 1 {
 		j := uint32(i)
-		expected := j & BLOCK_VAL_MASK
+		expected := uint64(j) & BLOCK_VAL_MASK
 		val := c.Lookup(j)
 		if val != expected {
 			t.Fatalf("Expected lookup %d to return %d, but got %d.", j, expected, val)
 		}
 	}
 }
+
+func TestEncodingForGrid(t *testing.T) {
+	tests := []struct {
+		gridSize int
+		enc *BlockEncoding
+	}{
+		{2, ENCODING_28_4},
+		{3, ENCODING_16_16},
+		{4, ENCODING_16_16},
+		{6, ENCODING_28_36},
+	}
+
+	for _, test := range tests {
+		enc, err := EncodingForGrid(test.gridSize)
+		if err != nil {
+			t.Fatalf("Unable to get encoding for grid size %d: %s", test.gridSize, err.Error())
+		}
+		if enc != test.enc {
+			t.Errorf("Expected grid size %d to use encoding %s, but got %s.", test.gridSize, test.enc.Name, enc.Name)
+		}
+	}
+
+	if _, err := EncodingForGrid(8); err == nil {
+		t.Errorf("Expected an error for an 8x8 grid, which is too large.")
+	}
+}
+
+// testEncodings are small enough to exercise the transition to array mode
+// quickly, as well as the real encodings.
+var testEncodings = []*BlockEncoding{
+	ENCODING_16_16,
+	ENCODING_28_4,
+	ENCODING_28_36,
+	newBlockEncoding("8/4", 8, 4, false),
+	newBlockEncoding("10/8", 10, 8, false),
+}
+
+func TestEncodings(t *testing.T) {
+	for _, enc := range testEncodings {
+		a := enc.NewAccumulationBlock()
+		b := enc.NewAccumulationBlock()
+
+		// a gets every other ID, b every third, up to a limit small enough to
+		// fill the small encodings and overflow into array mode.
+		max := uint32(1 << 10)
+		if max >= enc.IdxMask {
+			max = enc.IdxMask - 1
+		}
+		for i := uint32(1); i <= max; i += 1 {
+			if i % 2 == 0 {
+				a.Append(i, uint64(i) & enc.ValMask)
+			}
+			if i % 3 == 0 {
+				b.Append(i, (uint64(i) << 1) & enc.ValMask)
+			}
+		}
+		// and the largest value in the highest ID.
+		a.Append(enc.IdxMask, enc.ValMask)
+
+		c := enc.NewAccumulationBlock()
+		c.ResetAndMergeFrom(a.Copy(), b.Copy())
+
+		for i := uint32(1); i <= max; i += 1 {
+			expected := uint64(0)
+			if i % 2 == 0 {
+				expected |= uint64(i) & enc.ValMask
+			}
+			if i % 3 == 0 {
+				expected |= (uint64(i) << 1) & enc.ValMask
+			}
+			if val := c.Lookup(i); val != expected {
+				t.Fatalf("Encoding %s: expected lookup %d to return %d, but got %d.", enc.Name, i, expected, val)
+			}
+		}
+		if val := c.Lookup(enc.IdxMask); val != enc.ValMask {
+			t.Errorf("Encoding %s: expected lookup %d to return %d, but got %d.", enc.Name, enc.IdxMask, enc.ValMask, val)
+		}
+
+		idx, val := a.UnAppend()
+		if idx != enc.IdxMask || val != enc.ValMask {
+			t.Errorf("Encoding %s: expected to unappend (%d, %d), but got (%d, %d).", enc.Name, enc.IdxMask, enc.ValMask, idx, val)
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A checkpoint is the state of a Sorter part-way through the first pass, along
+// with the position of the next blob to read, so that a crashed or interrupted
+// pass can be resumed. Everything is written as varints, with IDs delta coded
+// in ascending order, and followed by a CRC32 of the whole lot.
+const (
+	CHECKPOINT_MAGIC = "neatlacoche-checkpoint"
+	CHECKPOINT_VERSION = 9
+)
+
+type checkpointWriter struct {
+	w *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (cw *checkpointWriter) uvarint(v uint64) {
+	if cw.err == nil {
+		n := binary.PutUvarint(cw.buf[:], v)
+		_, cw.err = cw.w.Write(cw.buf[:n])
+	}
+}
+
+func (cw *checkpointWriter) varint(v int64) {
+	if cw.err == nil {
+		n := binary.PutVarint(cw.buf[:], v)
+		_, cw.err = cw.w.Write(cw.buf[:n])
+	}
+}
+
+// multiBlock writes the non-zero (ID, value) pairs, value first so that a zero
+// value can mark the end.
+func (cw *checkpointWriter) multiBlock(mb *MultiBlock) {
+	last := int64(0)
+	mb.Each(func(id int64, val uint64) {
+		cw.uvarint(val)
+		cw.uvarint(uint64(id - last))
+		last = id
+	})
+	cw.uvarint(0)
+}
+
+func (cw *checkpointWriter) masks(m map[int64]uint64) {
+	ids := sortedKeys(len(m), func(f func(int64)) {
+		for id := range m {
+			f(id)
+		}
+	})
+	cw.uvarint(uint64(len(ids)))
+	last := int64(0)
+	for _, id := range ids {
+		cw.varint(id - last)
+		cw.uvarint(m[id])
+		last = id
+	}
+}
+
+func (cw *checkpointWriter) parents(m map[int64][]int64) {
+	ids := sortedKeys(len(m), func(f func(int64)) {
+		for id := range m {
+			f(id)
+		}
+	})
+	cw.uvarint(uint64(len(ids)))
+	last := int64(0)
+	for _, id := range ids {
+		cw.varint(id - last)
+		cw.uvarint(uint64(len(m[id])))
+		for _, parent := range m[id] {
+			cw.varint(parent)
+		}
+		last = id
+	}
+}
+
+func (cw *checkpointWriter) members(m map[int64][]memberRef) {
+	ids := sortedKeys(len(m), func(f func(int64)) {
+		for id := range m {
+			f(id)
+		}
+	})
+	cw.uvarint(uint64(len(ids)))
+	last := int64(0)
+	for _, id := range ids {
+		cw.varint(id - last)
+		cw.uvarint(uint64(len(m[id])))
+		for _, member := range m[id] {
+			cw.uvarint(uint64(member.Type))
+			cw.varint(member.Id)
+		}
+		last = id
+	}
+}
+
+func (cw *checkpointWriter) seams(m map[int64][]waySeam) {
+	ids := sortedKeys(len(m), func(f func(int64)) {
+		for id := range m {
+			f(id)
+		}
+	})
+	cw.uvarint(uint64(len(ids)))
+	last := int64(0)
+	for _, id := range ids {
+		cw.varint(id - last)
+		cw.uvarint(uint64(len(m[id])))
+		for _, seam := range m[id] {
+			cw.uvarint(seam.Mask)
+			cw.uvarint(uint64(len(seam.Refs)))
+			var ref int64
+			for i, n := range seam.Refs {
+				cw.varint(n - ref)
+				cw.uvarint(seam.RefMasks[i])
+				ref = n
+			}
+		}
+		last = id
+	}
+}
+
+func (cw *checkpointWriter) relSeams(m map[int64][]relSeam) {
+	ids := sortedKeys(len(m), func(f func(int64)) {
+		for id := range m {
+			f(id)
+		}
+	})
+	cw.uvarint(uint64(len(ids)))
+	last := int64(0)
+	for _, id := range ids {
+		cw.varint(id - last)
+		cw.uvarint(uint64(len(m[id])))
+		for _, seam := range m[id] {
+			cw.uvarint(seam.Mask)
+			if seam.HasRelations {
+				cw.uvarint(1)
+			} else {
+				cw.uvarint(0)
+			}
+			cw.uvarint(uint64(len(seam.Members)))
+			for i, member := range seam.Members {
+				cw.uvarint(uint64(member.Type))
+				cw.varint(member.Id)
+				cw.uvarint(seam.MemberMasks[i])
+			}
+		}
+		last = id
+	}
+}
+
+func (cw *checkpointWriter) history(h NodeHistory) {
+	ids := sortedKeys(len(h), func(f func(int64)) {
+		for id := range h {
+			f(id)
+		}
+	})
+
+	cw.uvarint(uint64(len(ids)))
+	last := int64(0)
+	for _, id := range ids {
+		cw.varint(id - last)
+		cw.uvarint(uint64(len(h[id])))
+		var timestamp int64
+		for _, v := range h[id] {
+			cw.varint(v.Timestamp - timestamp)
+			cw.uvarint(v.Mask)
+			timestamp = v.Timestamp
+		}
+		last = id
+	}
+}
+
+func (cw *checkpointWriter) outOfRange(stats *OutOfRangeStats) {
+	cw.uvarint(uint64(stats.Clamped))
+	cw.uvarint(uint64(stats.Polar))
+	cw.uvarint(uint64(stats.Rejected))
+	cw.uvarint(uint64(len(stats.Examples)))
+	for _, id := range stats.Examples {
+		cw.varint(id)
+	}
+}
+
+// sortedKeys collects the keys of a map, given a function to iterate over them,
+// in ascending order.
+func sortedKeys(n int, each func(func(int64))) []int64 {
+	ids := make([]int64, 0, n)
+	each(func(id int64) {
+		ids = append(ids, id)
+	})
+	sort.Sort(int64slice(ids))
+	return ids
+}
+
+type checkpointReader struct {
+	r *bufio.Reader
+	crc uint32
+	one [1]byte
+	err error
+
+	// If set, the MultiBlocks which are read are kept within its budget.
+	spill *BlockSpill
+}
+
+// ReadByte reads through the buffer, keeping a checksum of everything read.
+func (cr *checkpointReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.one[0] = b
+		cr.crc = crc32.Update(cr.crc, crc32.IEEETable, cr.one[:])
+	}
+	return b, err
+}
+
+func (cr *checkpointReader) uvarint() uint64 {
+	if cr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(cr)
+	cr.err = err
+	return v
+}
+
+func (cr *checkpointReader) varint() int64 {
+	if cr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(cr)
+	cr.err = err
+	return v
+}
+
+func (cr *checkpointReader) multiBlock() *MultiBlock {
+	mb := NewMultiBlock()
+	mb.Spill = cr.spill
+	id := int64(0)
+	for cr.err == nil {
+		val := cr.uvarint()
+		if val == 0 {
+			break
+		}
+		id += int64(cr.uvarint())
+		if id < mb.LastId || val > mb.Encoding.ValMask {
+			cr.err = fmt.Errorf("Bad value %d for ID %d.", val, id)
+			break
+		}
+		mb.Append(id, val)
+	}
+	return mb
+}
+
+func (cr *checkpointReader) outOfRange() OutOfRangeStats {
+	var stats OutOfRangeStats
+	stats.Clamped = int64(cr.uvarint())
+	stats.Polar = int64(cr.uvarint())
+	stats.Rejected = int64(cr.uvarint())
+	for n := cr.uvarint(); n > 0 && cr.err == nil; n -= 1 {
+		stats.Examples = append(stats.Examples, cr.varint())
+	}
+	return stats
+}
+
+func (cr *checkpointReader) history() NodeHistory {
+	h := make(NodeHistory)
+	id := int64(0)
+	for n := cr.uvarint(); n > 0 && cr.err == nil; n -= 1 {
+		id += cr.varint()
+		var versions []nodeVersion
+		var timestamp int64
+		for k := cr.uvarint(); k > 0 && cr.err == nil; k -= 1 {
+			timestamp += cr.varint()
+			versions = append(versions, nodeVersion{Timestamp: timestamp, Mask: cr.uvarint()})
+		}
+		h[id] = versions
+	}
+	return h
+}
+
+func (cr *checkpointReader) masks() map[int64]uint64 {
+	m := make(map[int64]uint64)
+	id := int64(0)
+	for n := cr.uvarint(); n > 0 && cr.err == nil; n -= 1 {
+		id += cr.varint()
+		m[id] = cr.uvarint()
+	}
+	return m
+}
+
+func (cr *checkpointReader) seams() map[int64][]waySeam {
+	m := make(map[int64][]waySeam)
+	id := int64(0)
+	for n := cr.uvarint(); n > 0 && cr.err == nil; n -= 1 {
+		id += cr.varint()
+		var seams []waySeam
+		for k := cr.uvarint(); k > 0 && cr.err == nil; k -= 1 {
+			seam := waySeam{Id: id, Mask: cr.uvarint()}
+			var ref int64
+			for r := cr.uvarint(); r > 0 && cr.err == nil; r -= 1 {
+				ref += cr.varint()
+				seam.Refs = append(seam.Refs, ref)
+				seam.RefMasks = append(seam.RefMasks, cr.uvarint())
+			}
+			seams = append(seams, seam)
+		}
+		m[id] = seams
+	}
+	return m
+}
+
+func (cr *checkpointReader) relSeams() map[int64][]relSeam {
+	m := make(map[int64][]relSeam)
+	id := int64(0)
+	for n := cr.uvarint(); n > 0 && cr.err == nil; n -= 1 {
+		id += cr.varint()
+		var seams []relSeam
+		for k := cr.uvarint(); k > 0 && cr.err == nil; k -= 1 {
+			seam := relSeam{Id: id, Mask: cr.uvarint()}
+			seam.HasRelations = cr.uvarint() != 0
+			for r := cr.uvarint(); r > 0 && cr.err == nil; r -= 1 {
+				typ := cr.uvarint()
+				seam.Members = append(seam.Members, memberRef{Type: OSMPBF.Relation_MemberType(typ), Id: cr.varint()})
+				seam.MemberMasks = append(seam.MemberMasks, cr.uvarint())
+			}
+			seams = append(seams, seam)
+		}
+		m[id] = seams
+	}
+	return m
+}
+
+func (cr *checkpointReader) parents() map[int64][]int64 {
+	m := make(map[int64][]int64)
+	id := int64(0)
+	for n := cr.uvarint(); n > 0 && cr.err == nil; n -= 1 {
+		id += cr.varint()
+		var parents []int64
+		for k := cr.uvarint(); k > 0 && cr.err == nil; k -= 1 {
+			parents = append(parents, cr.varint())
+		}
+		m[id] = parents
+	}
+	return m
+}
+
+func (cr *checkpointReader) members() map[int64][]memberRef {
+	m := make(map[int64][]memberRef)
+	id := int64(0)
+	for n := cr.uvarint(); n > 0 && cr.err == nil; n -= 1 {
+		id += cr.varint()
+		var members []memberRef
+		for k := cr.uvarint(); k > 0 && cr.err == nil; k -= 1 {
+			typ := cr.uvarint()
+			members = append(members, memberRef{Type: OSMPBF.Relation_MemberType(typ), Id: cr.varint()})
+		}
+		m[id] = members
+	}
+	return m
+}
+
+// Checkpoint writes the state of the Sorter to w, so that it can be carried on
+// by ResumeSorter from the blob at offset, which is the index'th in the file.
+// It must be called between Appends. Everything appended so far is collected
+// from the workers, which are then restarted, so it shouldn't be called too
+// often.
+func (s *Sorter) Checkpoint(w io.Writer, offset int64, index int) error {
+	if s.Relations != nil {
+		return fmt.Errorf("Unable to checkpoint a Sorter which has already finished.")
+	}
+
+	// the workers only answer once they've finished the block they're working
+	// on, so this includes every block appended so far.
+	err := s.collect(s.partial)
+	if err != nil {
+		return err
+	}
+	s.startWorkers(s.lastKind)
+
+	crc := crc32.NewIEEE()
+	cw := &checkpointWriter{w: bufio.NewWriter(io.MultiWriter(w, crc))}
+
+	_, cw.err = cw.w.WriteString(CHECKPOINT_MAGIC)
+	cw.uvarint(CHECKPOINT_VERSION)
+	for _, v := range []float64{s.xRange[0], s.xRange[1], s.yRange[0], s.yRange[1], s.clipX[0], s.clipX[1], s.clipY[0], s.clipY[1]} {
+		cw.uvarint(math.Float64bits(v))
+	}
+	cw.uvarint(uint64(s.policy))
+	cw.uvarint(uint64(tilingSchemeIndex(s.scheme)))
+	if s.timeAware {
+		cw.uvarint(1)
+	} else {
+		cw.uvarint(0)
+	}
+	if s.historical {
+		cw.uvarint(1)
+	} else {
+		cw.uvarint(0)
+	}
+	cw.uvarint(uint64(offset))
+	cw.uvarint(uint64(index))
+	cw.uvarint(uint64(s.lastKind))
+
+	// the nodes are only complete once the Sorter has moved on to ways, and the
+	// ways once it's on relations.
+	if s.lastKind > PKIND_NODE {
+		cw.multiBlock(s.Nodes)
+	}
+	if s.lastKind > PKIND_WAY {
+		cw.multiBlock(s.Ways)
+	}
+	cw.multiBlock(s.partial)
+	cw.multiBlock(s.Polar)
+	cw.outOfRange(&s.OutOfRange)
+	cw.history(s.nodeHistory)
+
+	cw.masks(s.extraNodes)
+	cw.multiBlock(s.wayExtraNodes)
+	cw.seams(s.waySeams)
+	cw.masks(s.extraWays)
+	cw.parents(s.relParents)
+	cw.members(s.relMembers)
+	cw.relSeams(s.relSeams)
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	if cw.err == nil {
+		cw.err = binary.Write(w, binary.BigEndian, crc.Sum32())
+	}
+	if cw.err != nil {
+		return fmt.Errorf("Unable to write checkpoint: %s", cw.err.Error())
+	}
+
+	return nil
+}
+
+// ResumeSorter reads a checkpoint written by Sorter.Checkpoint and starts up a
+// Sorter in the same state. The offset and index of the next blob to read are
+// returned, and should be passed to PBFReader.SeekBlob. The Sorter must cover
+// the same range as the one which wrote the checkpoint.
+//
+// Only the memory budget and spill directory are taken from the options, as
+// they can be different for each run. The rest were fixed when the first pass
+// was started, and are carried on from the checkpoint.
+func ResumeSorter(ctx context.Context, r io.Reader, numProcs int, xRange, yRange [2]float64, opts SorterOptions) (*Sorter, int64, int, error) {
+	cr := &checkpointReader{r: bufio.NewReader(r)}
+
+	for i := 0; i < len(CHECKPOINT_MAGIC) && cr.err == nil; i += 1 {
+		var b byte
+		b, cr.err = cr.ReadByte()
+		if cr.err == nil && b != CHECKPOINT_MAGIC[i] {
+			return nil, 0, 0, fmt.Errorf("Not a checkpoint file.")
+		}
+	}
+	if version := cr.uvarint(); cr.err == nil && version != CHECKPOINT_VERSION {
+		return nil, 0, 0, fmt.Errorf("Checkpoint version %d is not supported, expected version %d.", version, CHECKPOINT_VERSION)
+	}
+
+	var ranges [4]float64
+	for i := range ranges {
+		ranges[i] = math.Float64frombits(cr.uvarint())
+	}
+	if cr.err == nil && ranges != [4]float64{xRange[0], xRange[1], yRange[0], yRange[1]} {
+		return nil, 0, 0, fmt.Errorf("Checkpoint covers x=%v, y=%v, but expected x=%v, y=%v.", ranges[0:2], ranges[2:4], xRange, yRange)
+	}
+
+	// the clip ranges were given when the first pass was started, so they're
+	// carried on from the checkpoint.
+	var clip [4]float64
+	for i := range clip {
+		clip[i] = math.Float64frombits(cr.uvarint())
+	}
+
+	s := newSorter(ctx, numProcs, xRange, yRange)
+	if opts.MemoryBudget > 0 {
+		spill, err := NewBlockSpill(opts.SpillDir, opts.MemoryBudget)
+		if err != nil {
+			s.cancel()
+			return nil, 0, 0, err
+		}
+		s.spill, cr.spill = spill, spill
+		s.partial.Spill, s.Polar.Spill, s.wayExtraNodes.Spill = spill, spill, spill
+	}
+	s.clipX = [2]float64{clip[0], clip[1]}
+	s.clipY = [2]float64{clip[2], clip[3]}
+	s.policy = OutOfRangePolicy(cr.uvarint())
+	if scheme := cr.uvarint(); cr.err == nil {
+		if scheme >= uint64(len(tilingSchemes)) {
+			cr.err = fmt.Errorf("Unknown tiling scheme %d.", scheme)
+		} else {
+			s.scheme = tilingSchemes[scheme]
+		}
+	}
+	s.timeAware = cr.uvarint() != 0
+	s.historical = cr.uvarint() != 0
+	offset := int64(cr.uvarint())
+	index := int(cr.uvarint())
+	s.lastKind = int(cr.uvarint())
+	if cr.err == nil && (s.lastKind < PKIND_NODE || s.lastKind > PKIND_REL) {
+		cr.err = fmt.Errorf("Unknown kind %d.", s.lastKind)
+	}
+
+	if s.lastKind > PKIND_NODE {
+		s.Nodes = cr.multiBlock()
+	}
+	if s.lastKind > PKIND_WAY {
+		s.Ways = cr.multiBlock()
+	}
+	s.partial = cr.multiBlock()
+	s.Polar = cr.multiBlock()
+	s.OutOfRange = cr.outOfRange()
+	history := cr.history()
+	if s.timeAware && s.lastKind <= PKIND_WAY {
+		s.nodeHistory = history
+	}
+
+	s.extraNodes = cr.masks()
+	s.wayExtraNodes = cr.multiBlock()
+	s.waySeams = cr.seams()
+	s.extraWays = cr.masks()
+	s.relParents = cr.parents()
+	s.relMembers = cr.members()
+	s.relSeams = cr.relSeams()
+
+	var checksum uint32
+	if cr.err == nil {
+		cr.err = binary.Read(cr.r, binary.BigEndian, &checksum)
+	}
+	if cr.err == nil && checksum != cr.crc {
+		cr.err = fmt.Errorf("Checksum mismatch, expected %08x but got %08x.", checksum, cr.crc)
+	}
+	if cr.err == io.EOF {
+		cr.err = io.ErrUnexpectedEOF
+	}
+	if cr.err != nil {
+		s.cancel()
+		if s.spill != nil {
+			s.spill.Close()
+		}
+		return nil, 0, 0, fmt.Errorf("Unable to read checkpoint: %s", cr.err.Error())
+	}
+
+	s.startWorkers(s.lastKind)
+
+	return s, offset, index, nil
+}
+
+// SaveCheckpoint writes a checkpoint of the Sorter to a file. The file is
+// replaced atomically, so that there's always a complete checkpoint to resume
+// from, even if this is interrupted.
+func SaveCheckpoint(file_name string, s *Sorter, offset int64, index int) error {
+	err := os.MkdirAll(filepath.Dir(file_name), 0755)
+	if err != nil {
+		return fmt.Errorf("Unable to create directory for checkpoint %q: %s", file_name, err.Error())
+	}
+
+	tmp_name := file_name + ".tmp"
+	file, err := os.Create(tmp_name)
+	if err != nil {
+		return fmt.Errorf("Unable to create checkpoint %q: %s", tmp_name, err.Error())
+	}
+
+	err = s.Checkpoint(file, offset, index)
+	if err == nil {
+		err = file.Sync()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp_name, file_name)
+	}
+	if err != nil {
+		os.Remove(tmp_name)
+		return err
+	}
+
+	return nil
+}
+
+// LoadCheckpoint resumes a Sorter from a checkpoint file written by
+// SaveCheckpoint. See ResumeSorter.
+func LoadCheckpoint(ctx context.Context, file_name string, numProcs int, xRange, yRange [2]float64, opts SorterOptions) (*Sorter, int64, int, error) {
+	file, err := os.Open(file_name)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+
+	return ResumeSorter(ctx, file, numProcs, xRange, yRange, opts)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"github.com/mapzen/neatlacoche/fixture"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendAll reads the blocks of the file from the reader's current position
+// into the Sorter, returning them.
+func appendAll(t *testing.T, reader *PBFReader, sorter *Sorter) []BlockOrError {
+	var blocks []BlockOrError
+	err := readBlocks(context.Background(), reader, func(block BlockOrError) error {
+		blocks = append(blocks, block)
+		return sorter.Append(block.Primitives)
+	})
+	if err != nil {
+		t.Fatalf("Unable to sort blocks: %s", err.Error())
+	}
+	return blocks
+}
+
+func openTestInput(t *testing.T, in string) *PBFReader {
+	reader, err := NewPBFReader(in)
+	if err != nil {
+		t.Fatalf("Unable to open %q: %s", in, err.Error())
+	}
+	if _, err = reader.ReadHeaderBlock(); err != nil {
+		t.Fatalf("Unable to read header of %q: %s", in, err.Error())
+	}
+	return reader
+}
+
+func TestCheckpointResume(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	writeTestInput(t, in)
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+
+	reader := openTestInput(t, in)
+	expected, _ := NewSorter(context.Background(), 2, x_range, y_range)
+	blocks := appendAll(t, reader, expected)
+	reader.Close()
+	if err := expected.Finish(); err != nil {
+		t.Fatalf("Unable to finish sorting: %s", err.Error())
+	}
+	defer expected.Close()
+
+	// checkpoint after each blob in turn, and resume from there.
+	for i, block := range blocks {
+		if block.Next == 0 {
+			continue
+		}
+
+		reader := openTestInput(t, in)
+		sorter, _ := NewSorter(context.Background(), 2, x_range, y_range)
+		for _, b := range blocks[:i+1] {
+			if err := sorter.Append(b.Primitives); err != nil {
+				t.Fatalf("Unable to append block: %s", err.Error())
+			}
+		}
+		var buf bytes.Buffer
+		if err := sorter.Checkpoint(&buf, block.Next, block.Index + 1); err != nil {
+			t.Fatalf("Unable to checkpoint after blob %d: %s", block.Index, err.Error())
+		}
+		sorter.Close()
+
+		sorter, offset, index, err := ResumeSorter(context.Background(), &buf, 2, x_range, y_range, SorterOptions{})
+		if err != nil {
+			t.Fatalf("Unable to resume after blob %d: %s", block.Index, err.Error())
+		}
+		if offset != block.Next || index != block.Index + 1 {
+			t.Errorf("Expected to resume from blob %d at %d, but got blob %d at %d.", block.Index + 1, block.Next, index, offset)
+		}
+		if err = reader.SeekBlob(offset, index); err != nil {
+			t.Fatalf("Unable to seek to blob %d: %s", index, err.Error())
+		}
+		appendAll(t, reader, sorter)
+		reader.Close()
+		if err = sorter.Finish(); err != nil {
+			t.Fatalf("Unable to finish sorting: %s", err.Error())
+		}
+
+		for id := int64(1); id <= 3; id += 1 {
+			if a, b := sorter.Nodes.Lookup(id), expected.Nodes.Lookup(id); a != b {
+				t.Errorf("Resumed after blob %d, node %d is in %d, but expected %d.", block.Index, id, a, b)
+			}
+			if a, b := sorter.Ways.Lookup(id), expected.Ways.Lookup(id); a != b {
+				t.Errorf("Resumed after blob %d, way %d is in %d, but expected %d.", block.Index, id, a, b)
+			}
+			if a, b := sorter.Relations.Lookup(id), expected.Relations.Lookup(id); a != b {
+				t.Errorf("Resumed after blob %d, relation %d is in %d, but expected %d.", block.Index, id, a, b)
+			}
+		}
+		sorter.Close()
+	}
+}
+
+func TestCheckpointCorrupt(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	writeTestInput(t, in)
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+
+	reader := openTestInput(t, in)
+	defer reader.Close()
+	sorter, _ := NewSorter(context.Background(), 2, x_range, y_range)
+	defer sorter.Close()
+	blocks := appendAll(t, reader, sorter)
+
+	var buf bytes.Buffer
+	last := blocks[len(blocks)-1]
+	if err := sorter.Checkpoint(&buf, last.Next, last.Index + 1); err != nil {
+		t.Fatalf("Unable to checkpoint: %s", err.Error())
+	}
+	data := buf.Bytes()
+
+	resumed, _, _, err := ResumeSorter(context.Background(), bytes.NewReader(data), 2, x_range, y_range, SorterOptions{})
+	if err != nil {
+		t.Fatalf("Unable to resume from checkpoint: %s", err.Error())
+	}
+	resumed.Close()
+
+	other_x, other_y := Tile{2, 1, 1}.Extent()
+	if _, _, _, err := ResumeSorter(context.Background(), bytes.NewReader(data), 2, other_x, other_y, SorterOptions{}); err == nil {
+		t.Errorf("Expected an error resuming a checkpoint for a different tile.")
+	}
+
+	truncated := data[:len(data) - 5]
+	if _, _, _, err := ResumeSorter(context.Background(), bytes.NewReader(truncated), 2, x_range, y_range, SorterOptions{}); err == nil {
+		t.Errorf("Expected an error resuming from a truncated checkpoint.")
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt) - 6] ^= 0x40
+	if _, _, _, err := ResumeSorter(context.Background(), bytes.NewReader(corrupt), 2, x_range, y_range, SorterOptions{}); err == nil {
+		t.Errorf("Expected an error resuming from a corrupt checkpoint.")
+	}
+}
+
+func TestTimeAwareCheckpoint(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	header := &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}
+	w, err := NewPBFWriter(in, header)
+	if err != nil {
+		t.Fatalf("Unable to create input file: %s", err.Error())
+	}
+
+	// node 1 is dragged from the south-west to the north-east and back, while
+	// node 2 stays put next to it.
+	for v, lon := range []int64{-100e9, 100e9, -100e9} {
+		lat := lon * 4 / 10
+		w.WriteNode(&Node{Id: 1, Lon: lon, Lat: lat, Info: Info{Version: int32(v + 1), Timestamp: 1000 * int64(v + 1), Visible: true}})
+	}
+	w.WriteNode(&Node{Id: 2, Lon: -99e9, Lat: -40e9, Info: Info{Version: 1, Timestamp: 1000, Visible: true}})
+
+	// way 1 is only created once node 1 is back, but the first version of way
+	// 2 was around while node 1 was away.
+	w.WriteWay(&Way{Id: 1, Refs: []int64{1, 2}, Info: Info{Version: 1, Timestamp: 4000, Visible: true}})
+	w.WriteWay(&Way{Id: 2, Refs: []int64{1}, Info: Info{Version: 1, Timestamp: 1500, Visible: true}})
+	w.WriteWay(&Way{Id: 2, Refs: []int64{1, 2}, Info: Info{Version: 2, Timestamp: 3500, Visible: true}})
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close input file: %s", err.Error())
+	}
+
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+	grid := tileGrid{scheme: WEB_MERCATOR, xRange: x_range, yRange: y_range, clipX: x_range, clipY: y_range}
+	south_west, _ := grid.Mask(-100, -40)
+	north_east, _ := grid.Mask(100, 40)
+
+	// checkpoint once the nodes are done, so that the history has to survive
+	// it.
+	reader := openTestInput(t, in)
+	var blocks []BlockOrError
+	err = readBlocks(context.Background(), reader, func(block BlockOrError) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	reader.Close()
+	if err != nil || len(blocks) != 2 {
+		t.Fatalf("Expected a block of nodes and one of ways, but got %d blocks, %v.", len(blocks), err)
+	}
+
+	sorter, _ := NewSorterWithOptions(context.Background(), 2, x_range, y_range, SorterOptions{TimeAware: true})
+	if err = sorter.Append(blocks[0].Primitives); err != nil {
+		t.Fatalf("Unable to append the nodes: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	if err = sorter.Checkpoint(&buf, blocks[0].Next, blocks[0].Index + 1); err != nil {
+		t.Fatalf("Unable to checkpoint: %s", err.Error())
+	}
+	sorter.Close()
+
+	sorter, _, _, err = ResumeSorter(context.Background(), &buf, 2, x_range, y_range, SorterOptions{})
+	if err != nil {
+		t.Fatalf("Unable to resume: %s", err.Error())
+	}
+	defer sorter.Close()
+	if err = sorter.Append(blocks[1].Primitives); err != nil {
+		t.Fatalf("Unable to append the ways: %s", err.Error())
+	}
+	if err = sorter.Finish(); err != nil {
+		t.Fatalf("Unable to finish sorting: %s", err.Error())
+	}
+
+	if mask := sorter.Ways.Lookup(1); mask != south_west {
+		t.Errorf("Expected way 1 to only be in the south-west, %x, but got %x.", south_west, mask)
+	}
+	if mask := sorter.Ways.Lookup(2); mask != south_west | north_east {
+		t.Errorf("Expected way 2 to be in the south-west and north-east, %x, but got %x.", south_west | north_east, mask)
+	}
+	if mask := sorter.Nodes.Lookup(1); mask != south_west | north_east {
+		t.Errorf("Expected node 1 to be everywhere it's been, %x, but got %x.", south_west | north_east, mask)
+	}
+}
+
+func TestCheckpointMemoryBudget(t *testing.T) {
+	// the elements are far enough apart that each one has its own block.
+	opts := fixture.DefaultOptions()
+	opts.IdSpacing = 100000
+	data, err := fixture.Bytes(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	if err = os.WriteFile(in, data, 0644); err != nil {
+		t.Fatalf("Unable to write fixture: %s", err.Error())
+	}
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+
+	reader := openTestInput(t, in)
+	expected, _ := NewSorterWithOptions(context.Background(), 2, x_range, y_range, SorterOptions{Historical: true})
+	blocks := appendAll(t, reader, expected)
+	reader.Close()
+	if err = expected.Finish(); err != nil {
+		t.Fatalf("Unable to finish sorting: %s", err.Error())
+	}
+	defer expected.Close()
+
+	// checkpoint after the first block of ways, so that the nodes and
+	// everything in progress are read back from it.
+	i := 0
+	for len(blocks[i].Primitives.Primitivegroup[0].Ways) == 0 || blocks[i].Next == 0 {
+		i += 1
+	}
+	sorter, _ := NewSorterWithOptions(context.Background(), 2, x_range, y_range, SorterOptions{Historical: true})
+	for _, b := range blocks[:i+1] {
+		if err = sorter.Append(b.Primitives); err != nil {
+			t.Fatalf("Unable to append block: %s", err.Error())
+		}
+	}
+	var buf bytes.Buffer
+	if err = sorter.Checkpoint(&buf, blocks[i].Next, blocks[i].Index + 1); err != nil {
+		t.Fatalf("Unable to checkpoint: %s", err.Error())
+	}
+	sorter.Close()
+
+	// the budget is given again when resuming, as it might be different.
+	sorter, offset, index, err := ResumeSorter(context.Background(), &buf, 2, x_range, y_range, SorterOptions{MemoryBudget: 16, SpillDir: dir})
+	if err != nil {
+		t.Fatalf("Unable to resume: %s", err.Error())
+	}
+	if sorter.spill == nil || sorter.Nodes == nil || sorter.Nodes.Spill != sorter.spill || sorter.partial.Spill != sorter.spill {
+		sorter.Close()
+		t.Fatalf("Expected the resumed MultiBlocks to be kept within the memory budget.")
+	}
+	reader = openTestInput(t, in)
+	if err = reader.SeekBlob(offset, index); err != nil {
+		t.Fatalf("Unable to seek to blob %d: %s", index, err.Error())
+	}
+	appendAll(t, reader, sorter)
+	reader.Close()
+	if err = sorter.Finish(); err != nil {
+		t.Fatalf("Unable to finish sorting: %s", err.Error())
+	}
+
+	if sorter.spill.Evictions == 0 {
+		t.Errorf("Expected blocks to be spilled with a 16 byte budget.")
+	}
+	if a, b := dumpSorter(sorter), dumpSorter(expected); !bytes.Equal(a, b) {
+		t.Errorf("Expected the same results after resuming with a memory budget, but got:\n%s\ninstead of:\n%s", a, b)
+	}
+
+	sorter.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "spill-*")); len(files) > 0 {
+		t.Errorf("Expected the spill file to be removed, but found %v.", files)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes, so that scripts can tell what went wrong.
+const (
+	EXIT_OK = 0
+	EXIT_FAILURE = 1
+	EXIT_USAGE = 2
+
+	// As shells report a process killed by SIGINT.
+	EXIT_INTERRUPTED = 130
+)
+
+// command is one of the subcommands, each of which has its own flags.
+type command struct {
+	Name string
+	Args string
+	Summary string
+	Flags func(fs *flag.FlagSet)
+	Run func(ctx context.Context, args []string, stdout io.Writer) error
+}
+
+var commands = []*command{
+	{
+		Name: "split",
+		Args: "<input.osm.pbf or - for stdin>",
+		Summary: "Split a history file into tiles.",
+		Flags: func(fs *flag.FlagSet) {
+			workersFlag(fs)
+			outDirFlag(fs, "Directory to write the output tiles to")
+			fs.IntVar(zoom, "zoom", GRID_ZOOM_STEP, fmt.Sprintf("Zoom level of the output tiles, must be a multiple of %d", GRID_ZOOM_STEP))
+			fs.StringVar(bbox, "bbox", "", "Only tile this region, given as left,bottom,right,top in degrees, rather than the bbox in the input's header")
+			fs.StringVar(tiling, "tiling", WEB_MERCATOR.Name(), fmt.Sprintf("Tiling scheme to use, one of %v", tilingSchemeNames()))
+			fs.Var(&out_of_range, "out-of-range", "What to do with nodes which can't be projected onto the grid; reject, clamp to the edge, or write to a polar file")
+			fs.BoolVar(keep_intermediate, "keep-intermediate", false, "Keep the tiles at zoom levels above the output zoom")
+			fs.DurationVar(checkpoint_interval, "checkpoint-interval", 0, "How often to checkpoint the first pass over each tile, or zero not to")
+			fs.BoolVar(resume, "resume", false, "Resume the first pass over each tile from its checkpoint, if it has one")
+			fs.BoolVar(time_aware, "time-aware", false, "Only put each version of a way in the tiles its nodes were in at the time, rather than everywhere they've ever been")
+			fs.BoolVar(updatable, "updatable", false, "Keep an index of the tiles each element was split into, so that diffs can be applied later with the update command")
+			fs.DurationVar(progress_interval, "progress-interval", time.Minute, "How often to log the progress of each pass, or zero not to")
+			fs.StringVar(progress_json, "progress-json", "", "Also write the progress reports to this file, as a JSON object per line")
+			fs.Var(memory_budget, "memory-budget", "Approximate size of the sorted grid squares to keep in memory, such as 24G, beyond which they're spilled to a file in the output directory, or zero for no limit")
+			fs.StringVar(metrics_listen, "metrics-listen", "", "Address to serve Prometheus metrics on at /metrics while splitting, such as localhost:9100")
+		},
+		Run: runSplit,
+	},
+	{
+		Name: "update",
+		Args: "<diff directory>",
+		Summary: "Apply the .osc or .osc.gz replication diffs in a directory to tiles split with -updatable.",
+		Flags: func(fs *flag.FlagSet) {
+			outDirFlag(fs, "Directory containing the tiles to update")
+			fs.StringVar(db_file, "db-file", "", "Also store the full history of the elements in the diffs in this LevelDB database")
+		},
+		Run: func(ctx context.Context, args []string, stdout io.Writer) error {
+			if len(args) != 1 {
+				return usageError("Expected one directory of diffs.")
+			}
+			var db *Database
+			if *db_file != "" {
+				var err error
+				db, err = OpenDatabase(*db_file)
+				if err != nil {
+					return fmt.Errorf("Unable to open database %q: %s", *db_file, err.Error())
+				}
+				defer db.Close()
+			}
+			err := ApplyDiffs(ctx, args[0], *out_dir, db)
+			if err == nil {
+				fmt.Fprintf(stdout, "All done.\n")
+			}
+			return err
+		},
+	},
+	{
+		Name: "inspect",
+		Args: "<file.osm.pbf>",
+		Summary: "List the blobs and blocks of a PBF file, and check they're in the order needed to split it.",
+		Flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(header_only, "header-only", false, "Only show the file's header")
+		},
+		Run: runInspect,
+	},
+	{
+		Name: "stats",
+		Args: "<file.osm.pbf>...",
+		Summary: "Count the elements and versions of each kind in PBF files.",
+		Run: runStats,
+	},
+	{
+		Name: "lookup",
+		Args: "<node/ID, way/ID or relation/ID>...",
+		Summary: "List the tiles which elements were split into, using the indexes kept by -updatable.",
+		Flags: func(fs *flag.FlagSet) {
+			outDirFlag(fs, "Directory containing the tiles")
+		},
+		Run: runLookup,
+	},
+	{
+		Name: "verify",
+		Args: "",
+		Summary: "Check that every tile is readable, in order, and has the nodes and members of its ways and relations.",
+		Flags: func(fs *flag.FlagSet) {
+			outDirFlag(fs, "Directory containing the tiles")
+		},
+		Run: runVerify,
+	},
+	{
+		Name: "serve",
+		Args: "",
+		Summary: "Serve the tiles over HTTP, as /Z/X/Y.osm.pbf.",
+		Flags: func(fs *flag.FlagSet) {
+			outDirFlag(fs, "Directory containing the tiles")
+			fs.StringVar(listen, "listen", "localhost:8080", "Address to listen on")
+		},
+		Run: runServe,
+	},
+}
+
+// Flags used by the commands. They're registered by each command which uses
+// them, and keep their zero values otherwise.
+var cpuprofile = new(string)
+var workers = new(int)
+var out_dir = new(string)
+var zoom = new(int)
+var bbox = new(string)
+var tiling = new(string)
+var keep_intermediate = new(bool)
+var checkpoint_interval = new(time.Duration)
+var resume = new(bool)
+var time_aware = new(bool)
+var updatable = new(bool)
+var listen = new(string)
+var header_only = new(bool)
+var progress_interval = new(time.Duration)
+var progress_json = new(string)
+var metrics_listen = new(string)
+var memory_budget = new(ByteSize)
+var db_file = new(string)
+
+var out_of_range = OUT_OF_RANGE_REJECT
+
+func workersFlag(fs *flag.FlagSet) {
+	fs.IntVar(workers, "workers", 0, "Number of workers sorting each kind of element, or 0 for one per CPU")
+}
+
+func outDirFlag(fs *flag.FlagSet, usage string) {
+	fs.StringVar(out_dir, "out-dir", ".", usage)
+}
+
+// numWorkers returns the number of workers the Sorter should use.
+func numWorkers() int {
+	if *workers > 0 {
+		return *workers
+	}
+	return runtime.NumCPU()
+}
+
+// usageError is returned by commands for bad arguments, which exit with
+// EXIT_USAGE rather than EXIT_FAILURE.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(w, "\nUse \"%s <command> -h\" for the flags of each command.\n", filepath.Base(os.Args[0]))
+}
+
+// runCommand runs the subcommand named by the first argument, and returns the
+// exit code for the process.
+func runCommand(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return EXIT_USAGE
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		printUsage(stdout)
+		return EXIT_OK
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(stderr, "Unknown command %q.\n\n", args[0])
+		printUsage(stderr)
+		return EXIT_USAGE
+	}
+
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s %s [flags] %s\n\n%s\n\nFlags:\n", filepath.Base(os.Args[0]), cmd.Name, cmd.Args, cmd.Summary)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(cpuprofile, "cpuprofile", "", "Write CPU profile to this file")
+	if cmd.Flags != nil {
+		cmd.Flags(fs)
+	}
+	err := fs.Parse(args[1:])
+	if err == flag.ErrHelp {
+		return EXIT_OK
+	} else if err != nil {
+		return EXIT_USAGE
+	}
+
+	if *cpuprofile != "" {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			fmt.Fprintf(stderr, "Unable to write to CPU profile %q: %s\n", *cpuprofile, err.Error())
+			return EXIT_FAILURE
+		}
+		defer f.Close()
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+
+	err = cmd.Run(ctx, fs.Args(), stdout)
+	var usage_err usageError
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.As(err, &usage_err):
+		fmt.Fprintf(stderr, "%s\n\n", err.Error())
+		fs.Usage()
+		return EXIT_USAGE
+	case errors.Is(err, context.Canceled) || ctx.Err() != nil:
+		// errors don't always wrap the context's, but any error after an
+		// interrupt is probably because of it.
+		fmt.Fprintf(stderr, "Interrupted: %s\n", err.Error())
+		return EXIT_INTERRUPTED
+	}
+	fmt.Fprintf(stderr, "%s\n", err.Error())
+	return EXIT_FAILURE
+}
+
+func runSplit(ctx context.Context, args []string, stdout io.Writer) error {
+	// the input is read from the standard input if the file name is "-".
+	if len(args) != 1 {
+		return usageError("Expected one input file, or - for the standard input.")
+	}
+	if *zoom < GRID_ZOOM_STEP || *zoom % GRID_ZOOM_STEP != 0 {
+		return usageError(fmt.Sprintf("Zoom %d is not supported, it must be a positive multiple of %d.", *zoom, GRID_ZOOM_STEP))
+	}
+
+	scheme, err := TilingSchemeByName(*tiling)
+	if err != nil {
+		return usageError(err.Error())
+	}
+
+	var region *Region
+	if *bbox != "" {
+		region, err = ParseRegion(*bbox)
+		if err != nil {
+			return usageError(err.Error())
+		}
+	}
+
+	if *metrics_listen != "" {
+		stop, err := serveMetrics(*metrics_listen)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	if *progress_json != "" {
+		f, err := os.Create(*progress_json)
+		if err != nil {
+			return fmt.Errorf("Unable to write progress to %q: %s", *progress_json, err.Error())
+		}
+		defer f.Close()
+		progress_output = f
+		defer func() { progress_output = nil }()
+	}
+
+	opts := SplitOptions{
+		SorterOptions: SorterOptions{
+			OutOfRange: out_of_range,
+			Scheme: scheme,
+			TimeAware: *time_aware,
+			MemoryBudget: int(*memory_budget),
+			SpillDir: *out_dir,
+		},
+		CheckpointInterval: *checkpoint_interval,
+		Resume: *resume,
+		KeepIntermediate: *keep_intermediate,
+		Updatable: *updatable,
+	}
+	err = SplitRegion(ctx, args[0], region, *zoom, *out_dir, opts)
+	if err == nil {
+		fmt.Fprintf(stdout, "All done.\n")
+	}
+	return err
+}
+
+func runInspect(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return usageError("Expected one file to inspect.")
+	}
+	if !*header_only {
+		return InspectFile(ctx, args[0], stdout)
+	}
+
+	header, err := readHeaderBlock(args[0])
+	if err != nil {
+		return fmt.Errorf("Unable to read header block of %q: %s", args[0], err.Error())
+	}
+	printHeader(stdout, header)
+	return nil
+}
+
+func printHeader(w io.Writer, header *OSMPBF.HeaderBlock) {
+	fmt.Fprintf(w, "  Required features: %s\n", strings.Join(header.RequiredFeatures, ", "))
+	fmt.Fprintf(w, "  Optional features: %s\n", strings.Join(header.OptionalFeatures, ", "))
+	if region := RegionFromHeader(header.Bbox); region != nil {
+		fmt.Fprintf(w, "  Bbox: %s\n", region)
+	}
+	if header.Writingprogram != nil {
+		fmt.Fprintf(w, "  Writing program: %s\n", header.GetWritingprogram())
+	}
+	if header.Source != nil {
+		fmt.Fprintf(w, "  Source: %s\n", header.GetSource())
+	}
+	if header.OsmosisReplicationTimestamp != nil {
+		fmt.Fprintf(w, "  Replication timestamp: %s\n", time.Unix(header.GetOsmosisReplicationTimestamp(), 0).UTC().Format(time.RFC3339))
+	}
+	if header.OsmosisReplicationSequenceNumber != nil {
+		fmt.Fprintf(w, "  Replication sequence number: %d\n", header.GetOsmosisReplicationSequenceNumber())
+	}
+	if header.OsmosisReplicationBaseUrl != nil {
+		fmt.Fprintf(w, "  Replication base URL: %s\n", header.GetOsmosisReplicationBaseUrl())
+	}
+}
+
+func runStats(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return usageError("Expected at least one file.")
+	}
+	for _, file_name := range args {
+		stats, err := ReadFileStats(ctx, file_name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s:\n", file_name)
+		stats.Print(stdout)
+	}
+	return nil
+}
+
+// parseElementRef parses a reference to an element, like "way/123".
+func parseElementRef(s string) (kind int, id int64, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 {
+		for k, name := range PKIND_NAMES {
+			if parts[0] == name || parts[0] == name[:1] {
+				id, err = strconv.ParseInt(parts[1], 10, 64)
+				if err == nil {
+					return k, id, nil
+				}
+			}
+		}
+	}
+	return 0, 0, usageError(fmt.Sprintf("Bad element %q, expected something like node/123.", s))
+}
+
+func runLookup(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return usageError("Expected at least one element.")
+	}
+	kinds := make([]int, len(args))
+	ids := make([]int64, len(args))
+	for i, arg := range args {
+		var err error
+		kinds[i], ids[i], err = parseElementRef(arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	state, err := LoadTilingState(*out_dir)
+	if err != nil {
+		return fmt.Errorf("Unable to load the tiling state, were the tiles split with -updatable? %s", err.Error())
+	}
+
+	u := newUpdater(*out_dir, state)
+	defer u.close()
+	for i, kind := range kinds {
+		id := ids[i]
+		leaves, err := u.leaves(kind, id)
+		if err != nil {
+			return err
+		}
+		tiles := make([]string, 0, len(leaves))
+		for _, tile := range leaves.sorted() {
+			tiles = append(tiles, tile.String())
+		}
+		fmt.Fprintf(stdout, "%s/%d: %s\n", PKIND_NAMES[kind], id, strings.Join(tiles, " "))
+	}
+	return nil
+}
+
+func runVerify(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return usageError("Didn't expect any arguments.")
+	}
+
+	var tiles []string
+	err := filepath.Walk(*out_dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".osm.pbf") {
+			tiles = append(tiles, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	bad := 0
+	for _, file_name := range tiles {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		problems, err := VerifyTile(ctx, file_name)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, problem := range problems {
+			fmt.Fprintf(stdout, "%s: %s\n", file_name, problem)
+		}
+		if len(problems) > 0 {
+			bad += 1
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("Found problems in %d of %d tiles.", bad, len(tiles))
+	}
+	fmt.Fprintf(stdout, "All %d tiles are OK.\n", len(tiles))
+	return nil
+}
+
+func runServe(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return usageError("Didn't expect any arguments.")
+	}
+
+	server := &http.Server{Addr: *listen, Handler: tileHandler(*out_dir)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Serving the tiles in %q on %s.\n", *out_dir, *listen)
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed && ctx.Err() != nil {
+		// being interrupted is how the server is meant to stop.
+		return nil
+	}
+	return err
+}
+
+// tileHandler serves the tiles in the directory, and nothing else in it.
+func tileHandler(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tile Tile
+		var rest string
+		n, _ := fmt.Sscanf(r.URL.Path, "/%d/%d/%d%s", &tile.Z, &tile.X, &tile.Y, &rest)
+		if n != 4 || rest != ".osm.pbf" || tile.FileName("/") != filepath.FromSlash(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		http.ServeFile(w, r, tile.FileName(dir))
+	})
+}
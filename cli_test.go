@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommandExitCodes(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, EXIT_USAGE},
+		{[]string{"help"}, EXIT_OK},
+		{[]string{"frobnicate"}, EXIT_USAGE},
+		{[]string{"split"}, EXIT_USAGE},
+		{[]string{"split", "-zoom", "3", "in.osm.pbf"}, EXIT_USAGE},
+		{[]string{"split", "-no-such-flag", "in.osm.pbf"}, EXIT_USAGE},
+		{[]string{"split", "-h"}, EXIT_OK},
+		{[]string{"lookup", "-out-dir", t.TempDir(), "node/1"}, EXIT_FAILURE},
+		{[]string{"lookup", "bogus"}, EXIT_USAGE},
+		{[]string{"stats", filepath.Join(t.TempDir(), "missing.osm.pbf")}, EXIT_FAILURE},
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		if code := runCommand(context.Background(), test.args, &stdout, &stderr); code != test.code {
+			t.Errorf("Expected %v to exit with %d, but got %d: %s", test.args, test.code, code, stderr.String())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+	var stdout, stderr bytes.Buffer
+	if code := runCommand(ctx, []string{"split", "-out-dir", dir, in}, &stdout, &stderr); code != EXIT_INTERRUPTED {
+		t.Errorf("Expected an interrupted split to exit with %d, but got %d.", EXIT_INTERRUPTED, code)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+	out := filepath.Join(dir, "out")
+	defer func() { *updatable, *workers = false, 0 }()
+
+	run := func(args ...string) string {
+		var stdout, stderr bytes.Buffer
+		if code := runCommand(context.Background(), args, &stdout, &stderr); code != EXIT_OK {
+			t.Fatalf("Expected %v to succeed, but got exit code %d: %s", args, code, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	run("split", "-out-dir", out, "-zoom", "4", "-workers", "2", "-updatable", in)
+
+	// node 1 is in its own tile, and the tiles of the way and relation it's in.
+	if s := run("lookup", "-out-dir", out, "node/1", "w/2"); s != "node/1: 4/3/9 4/8/7 4/12/6\nway/2: 4/3/9 4/8/7\n" {
+		t.Errorf("Unexpected lookup output: %q", s)
+	}
+
+	if s := run("verify", "-out-dir", out); !strings.Contains(s, "All 3 tiles are OK.") {
+		t.Errorf("Unexpected verify output: %q", s)
+	}
+
+	s := run("stats", in)
+	if !strings.Contains(s, "nodes     6 versions of 3 IDs from 1 to 3, 3 deleted") ||
+		!strings.Contains(s, "relations 2 versions of 2 IDs from 1 to 2, 0 deleted") {
+		t.Errorf("Unexpected stats output: %q", s)
+	}
+
+	if s := run("inspect", "-header-only", in); !strings.Contains(s, "HistoricalInformation\n") {
+		t.Errorf("Unexpected inspect output: %q", s)
+	}
+
+	// the server only serves the tiles.
+	server := httptest.NewServer(tileHandler(out))
+	defer server.Close()
+	for path, status := range map[string]int{"/4/8/7.osm.pbf": http.StatusOK, "/4/8/5.osm.pbf": http.StatusNotFound, "/state.txt": http.StatusNotFound} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Unable to get %s: %s", path, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Expected status %d for %s, but got %d.", status, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestVerifyTile(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "bad.osm.pbf")
+	w, err := NewPBFWriter(file_name, NewHeaderBlock(nil, true))
+	if err != nil {
+		t.Fatalf("Unable to create tile: %s", err.Error())
+	}
+	w.WriteNode(&Node{Id: 2, Info: Info{Version: 1, Visible: true}})
+	w.WriteNode(&Node{Id: 1, Info: Info{Version: 1, Visible: true}})
+	w.WriteWay(&Way{Id: 1, Refs: []int64{1, 3}, Info: Info{Version: 1, Visible: true}})
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close tile: %s", err.Error())
+	}
+
+	problems, err := VerifyTile(context.Background(), file_name)
+	if err != nil || len(problems) != 2 ||
+		!strings.Contains(problems[0], "node 1 v1 is out of order") || !strings.Contains(problems[1], "node 3 is used") {
+		t.Errorf("Expected node 1 to be out of order and node 3 missing, but got %q, %v.", problems, err)
+	}
+}
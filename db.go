@@ -3,10 +3,23 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"io"
 )
 
+// The database holds the full history of each element, for applying updates
+// to. It's too slow for the bulk first pass, so it's loaded incrementally, by
+// the update command with -db-file storing every diff it applies. The diffs
+// are still placed in tiles using the tiles themselves, not the database.
+//
+// Keys are a flag byte for the kind of record, followed by the big-endian ID
+// and, for element records, the big-endian version, so that all the versions
+// of an element are next to each other in version order. Values are varint
+// coded. The names of users are only kept in the user records, which are put
+// along with each element, and filled in from there when an element is read.
 const (
 	dbFlagNode           byte = iota
 	dbFlagWay            byte = iota
@@ -19,13 +32,22 @@ const (
 	dbFlagUser           byte = iota
 )
 
+// ErrNotFound is returned by the Get methods when there's no such record.
+var ErrNotFound = leveldb.ErrNotFound
+
 type Database struct {
 	db *leveldb.DB
 }
 
 type Batch struct {
-	batch                *leveldb.Batch
-	keyWriter, valWriter bytes.Buffer
+	batch     *leveldb.Batch
+	valWriter bytes.Buffer
+}
+
+// Changeset is what's known about a changeset from the elements in it.
+type Changeset struct {
+	Id  int64
+	Uid int32
 }
 
 func OpenDatabase(db_file_name string) (db *Database, err error) {
@@ -65,27 +87,527 @@ func (ew *errWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
-func (b *Batch) PutNode(id int64, version, lon, lat int32) error {
-	k_ew := &errWriter{w: &b.keyWriter}
-	v_ew := &errWriter{w: &b.valWriter}
+// dbKey returns the key of a record. Changeset and user records don't have a
+// version, so it's left off if it's negative.
+func dbKey(flag byte, id int64, version int32) []byte {
+	key := make([]byte, 1, 13)
+	key[0] = flag
+	key = binary.BigEndian.AppendUint64(key, uint64(id))
+	if version >= 0 {
+		key = binary.BigEndian.AppendUint32(key, uint32(version))
+	}
+	return key
+}
+
+// dbKeyVersion returns the version from the key of an element record.
+func dbKeyVersion(key []byte) int32 {
+	return int32(binary.BigEndian.Uint32(key[len(key)-4:]))
+}
 
-	binary.Write(k_ew, binary.BigEndian, dbFlagNode)
-	binary.Write(k_ew, binary.BigEndian, id)
-	binary.Write(k_ew, binary.BigEndian, version)
-	if k_ew.err != nil {
-		return k_ew.err
+// valueWriter varint codes a record's value.
+type valueWriter struct {
+	ew  *errWriter
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (vw *valueWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(vw.buf[:], v)
+	vw.ew.Write(vw.buf[:n])
+}
+
+func (vw *valueWriter) varint(v int64) {
+	n := binary.PutVarint(vw.buf[:], v)
+	vw.ew.Write(vw.buf[:n])
+}
+
+func (vw *valueWriter) string(s string) {
+	vw.uvarint(uint64(len(s)))
+	io.WriteString(vw.ew, s)
+}
+
+// info writes everything but the version, which is in the key, and the user
+// name, which is in the user record.
+func (vw *valueWriter) info(i *Info) {
+	vw.varint(i.Timestamp)
+	vw.varint(i.Changeset)
+	vw.varint(int64(i.Uid))
+	if i.Visible {
+		vw.uvarint(1)
+	} else {
+		vw.uvarint(0)
 	}
+}
 
-	binary.Write(v_ew, binary.LittleEndian, lon)
-	binary.Write(v_ew, binary.LittleEndian, lat)
-	if v_ew.err != nil {
-		return v_ew.err
+func (vw *valueWriter) tags(tags []Tag) {
+	vw.uvarint(uint64(len(tags)))
+	for _, t := range tags {
+		vw.string(t.Key)
+		vw.string(t.Value)
 	}
+}
 
-	b.keyWriter.Reset()
+// valueReader decodes a value written by valueWriter, keeping the first error.
+type valueReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (vr *valueReader) uvarint() uint64 {
+	if vr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(vr.r)
+	vr.err = err
+	return v
+}
+
+func (vr *valueReader) varint() int64 {
+	if vr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(vr.r)
+	vr.err = err
+	return v
+}
+
+func (vr *valueReader) string() string {
+	n := vr.uvarint()
+	if vr.err != nil {
+		return ""
+	}
+	if n > uint64(vr.r.Len()) {
+		vr.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	buf := make([]byte, n)
+	_, vr.err = io.ReadFull(vr.r, buf)
+	return string(buf)
+}
+
+func (vr *valueReader) info(version int32) Info {
+	i := Info{Version: version}
+	i.Timestamp = vr.varint()
+	i.Changeset = vr.varint()
+	i.Uid = int32(vr.varint())
+	i.Visible = vr.uvarint() != 0
+	return i
+}
+
+func (vr *valueReader) tags() []Tag {
+	var tags []Tag
+	for n := vr.uvarint(); n > 0 && vr.err == nil; n -= 1 {
+		tags = append(tags, Tag{Key: vr.string(), Value: vr.string()})
+	}
+	return tags
+}
+
+// put adds the record with the value written by f to the batch.
+func (b *Batch) put(key []byte, f func(vw *valueWriter)) error {
 	b.valWriter.Reset()
+	vw := &valueWriter{ew: &errWriter{w: &b.valWriter}}
+	f(vw)
+	if vw.ew.err != nil {
+		return vw.ew.err
+	}
 
-	b.batch.Put(b.keyWriter.Bytes(), b.valWriter.Bytes())
+	b.batch.Put(key, b.valWriter.Bytes())
+	return nil
+}
+
+// user adds the user record for an element's user name, if it has one. Each
+// version updates it, so the record has the latest name which was put.
+func (b *Batch) user(i *Info) error {
+	if i.User == "" {
+		return nil
+	}
+	return b.PutUser(i.Uid, i.User)
+}
+
+// PutNode adds a version of a node, and the name of its user.
+func (b *Batch) PutNode(n *Node) error {
+	err := b.put(dbKey(dbFlagNode, n.Id, n.Info.Version), func(vw *valueWriter) {
+		vw.info(&n.Info)
+		vw.varint(n.Lon)
+		vw.varint(n.Lat)
+		vw.tags(n.Tags)
+	})
+	if err != nil {
+		return err
+	}
+	return b.user(&n.Info)
+}
+
+// PutWay adds a version of a way, along with its way-nodes and the name of its
+// user.
+func (b *Batch) PutWay(w *Way) error {
+	err := b.put(dbKey(dbFlagWay, w.Id, w.Info.Version), func(vw *valueWriter) {
+		vw.info(&w.Info)
+		vw.tags(w.Tags)
+	})
+	if err == nil {
+		err = b.user(&w.Info)
+	}
+	if err != nil {
+		return err
+	}
+	return b.PutWayNodes(w.Id, w.Info.Version, w.Refs)
+}
+
+// PutWayNodes adds the node refs of a version of a way.
+func (b *Batch) PutWayNodes(id int64, version int32, refs []int64) error {
+	return b.put(dbKey(dbFlagWayNode, id, version), func(vw *valueWriter) {
+		vw.uvarint(uint64(len(refs)))
+		var last int64
+		for _, ref := range refs {
+			vw.varint(ref - last)
+			last = ref
+		}
+	})
+}
+
+// PutRelation adds a version of a relation, along with its members and the
+// name of its user.
+func (b *Batch) PutRelation(r *Relation) error {
+	err := b.put(dbKey(dbFlagRelation, r.Id, r.Info.Version), func(vw *valueWriter) {
+		vw.info(&r.Info)
+		vw.tags(r.Tags)
+	})
+	if err == nil {
+		err = b.user(&r.Info)
+	}
+	if err != nil {
+		return err
+	}
+	return b.PutMembers(r.Id, r.Info.Version, r.Members)
+}
+
+var dbMemberTypes = []OSMPBF.Relation_MemberType{OSMPBF.Relation_NODE, OSMPBF.Relation_WAY, OSMPBF.Relation_RELATION}
+
+func dbMemberFlag(typ OSMPBF.Relation_MemberType) byte {
+	switch typ {
+	case OSMPBF.Relation_WAY:
+		return dbFlagMemberWay
+	case OSMPBF.Relation_RELATION:
+		return dbFlagMemberRelation
+	default:
+		return dbFlagMemberNode
+	}
+}
+
+// PutMembers adds the members of a version of a relation. Each type of member
+// has its own record, and each member keeps its index in the relation, so that
+// the order can be put back together.
+func (b *Batch) PutMembers(id int64, version int32, members []Member) error {
+	for _, typ := range dbMemberTypes {
+		var indexes []int
+		for i, m := range members {
+			if m.Type == typ {
+				indexes = append(indexes, i)
+			}
+		}
+		if len(indexes) == 0 {
+			continue
+		}
+
+		err := b.put(dbKey(dbMemberFlag(typ), id, version), func(vw *valueWriter) {
+			vw.uvarint(uint64(len(indexes)))
+			for _, i := range indexes {
+				vw.uvarint(uint64(i))
+				vw.varint(members[i].Id)
+				vw.string(members[i].Role)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// PutChange adds every element of a diff, and the changesets they're in.
+func (b *Batch) PutChange(c *OsmChange) error {
+	changesets := make(map[int64]int32)
+	for i := range c.Nodes {
+		if err := b.PutNode(&c.Nodes[i]); err != nil {
+			return err
+		}
+		changesets[c.Nodes[i].Info.Changeset] = c.Nodes[i].Info.Uid
+	}
+	for i := range c.Ways {
+		if err := b.PutWay(&c.Ways[i]); err != nil {
+			return err
+		}
+		changesets[c.Ways[i].Info.Changeset] = c.Ways[i].Info.Uid
+	}
+	for i := range c.Relations {
+		if err := b.PutRelation(&c.Relations[i]); err != nil {
+			return err
+		}
+		changesets[c.Relations[i].Info.Changeset] = c.Relations[i].Info.Uid
+	}
+	for id, uid := range changesets {
+		if id == 0 {
+			continue
+		}
+		if err := b.PutChangeset(&Changeset{Id: id, Uid: uid}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// PutChangeset adds a changeset.
+func (b *Batch) PutChangeset(c *Changeset) error {
+	return b.put(dbKey(dbFlagChangeSet, c.Id, -1), func(vw *valueWriter) {
+		vw.varint(int64(c.Uid))
+	})
+}
+
+// PutUser adds the name of a user.
+func (b *Batch) PutUser(uid int32, name string) error {
+	return b.put(dbKey(dbFlagUser, int64(uid), -1), func(vw *valueWriter) {
+		vw.string(name)
+	})
+}
+
+// get reads the value of a record, and decodes it with f.
+func (db *Database) get(key []byte, f func(vr *valueReader)) error {
+	val, err := db.db.Get(key, nil)
+	if err != nil {
+		return err
+	}
+	return db.decode(key, val, f)
+}
+
+func (db *Database) decode(key, val []byte, f func(vr *valueReader)) error {
+	vr := &valueReader{r: bytes.NewReader(val)}
+	f(vr)
+	if vr.err == nil && vr.r.Len() != 0 {
+		vr.err = fmt.Errorf("%d bytes left over.", vr.r.Len())
+	}
+	if vr.err != nil {
+		return fmt.Errorf("Unable to decode database record %x: %s", key, vr.err.Error())
+	}
+	return nil
+}
+
+// versions calls f with the key and value of each version of an element's
+// records, in version order.
+func (db *Database) versions(flag byte, id int64, f func(key, val []byte) error) error {
+	iter := db.db.NewIterator(util.BytesPrefix(dbKey(flag, id, -1)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		err := f(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// user fills in the user name of an element from its user record, if there is
+// one.
+func (db *Database) user(i *Info) error {
+	name, err := db.GetUser(i.Uid)
+	if err == nil {
+		i.User = name
+	} else if err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// GetNode returns a version of a node.
+func (db *Database) GetNode(id int64, version int32) (*Node, error) {
+	key := dbKey(dbFlagNode, id, version)
+	val, err := db.db.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return db.decodeNode(id, key, val)
+}
+
+func (db *Database) decodeNode(id int64, key, val []byte) (*Node, error) {
+	n := &Node{Id: id}
+	err := db.decode(key, val, func(vr *valueReader) {
+		n.Info = vr.info(dbKeyVersion(key))
+		n.Lon = vr.varint()
+		n.Lat = vr.varint()
+		n.Tags = vr.tags()
+	})
+	if err == nil {
+		err = db.user(&n.Info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// NodeVersions returns all the versions of a node, in version order.
+func (db *Database) NodeVersions(id int64) ([]*Node, error) {
+	var nodes []*Node
+	err := db.versions(dbFlagNode, id, func(key, val []byte) error {
+		n, err := db.decodeNode(id, key, val)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// GetWay returns a version of a way, with its refs.
+func (db *Database) GetWay(id int64, version int32) (*Way, error) {
+	key := dbKey(dbFlagWay, id, version)
+	val, err := db.db.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return db.decodeWay(id, key, val)
+}
+
+func (db *Database) decodeWay(id int64, key, val []byte) (*Way, error) {
+	w := &Way{Id: id}
+	err := db.decode(key, val, func(vr *valueReader) {
+		w.Info = vr.info(dbKeyVersion(key))
+		w.Tags = vr.tags()
+	})
+	if err == nil {
+		w.Refs, err = db.GetWayNodes(id, w.Info.Version)
+	}
+	if err == nil {
+		err = db.user(&w.Info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// WayVersions returns all the versions of a way, in version order.
+func (db *Database) WayVersions(id int64) ([]*Way, error) {
+	var ways []*Way
+	err := db.versions(dbFlagWay, id, func(key, val []byte) error {
+		w, err := db.decodeWay(id, key, val)
+		if err != nil {
+			return err
+		}
+		ways = append(ways, w)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ways, nil
+}
+
+// GetWayNodes returns the node refs of a version of a way.
+func (db *Database) GetWayNodes(id int64, version int32) ([]int64, error) {
+	var refs []int64
+	err := db.get(dbKey(dbFlagWayNode, id, version), func(vr *valueReader) {
+		var ref int64
+		for n := vr.uvarint(); n > 0 && vr.err == nil; n -= 1 {
+			ref += vr.varint()
+			refs = append(refs, ref)
+		}
+	})
+	return refs, err
+}
+
+// GetRelation returns a version of a relation, with its members.
+func (db *Database) GetRelation(id int64, version int32) (*Relation, error) {
+	key := dbKey(dbFlagRelation, id, version)
+	val, err := db.db.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return db.decodeRelation(id, key, val)
+}
+
+func (db *Database) decodeRelation(id int64, key, val []byte) (*Relation, error) {
+	r := &Relation{Id: id}
+	err := db.decode(key, val, func(vr *valueReader) {
+		r.Info = vr.info(dbKeyVersion(key))
+		r.Tags = vr.tags()
+	})
+	if err == nil {
+		r.Members, err = db.GetMembers(id, r.Info.Version)
+	}
+	if err == nil {
+		err = db.user(&r.Info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RelationVersions returns all the versions of a relation, in version order.
+func (db *Database) RelationVersions(id int64) ([]*Relation, error) {
+	var rels []*Relation
+	err := db.versions(dbFlagRelation, id, func(key, val []byte) error {
+		r, err := db.decodeRelation(id, key, val)
+		if err != nil {
+			return err
+		}
+		rels = append(rels, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rels, nil
+}
+
+// GetMembers returns the members of a version of a relation, in order. A
+// relation without members has no member records, so it's not an error if
+// there aren't any.
+func (db *Database) GetMembers(id int64, version int32) ([]Member, error) {
+	indexed := make(map[int]Member)
+	for _, typ := range dbMemberTypes {
+		typ := typ
+		err := db.get(dbKey(dbMemberFlag(typ), id, version), func(vr *valueReader) {
+			for n := vr.uvarint(); n > 0 && vr.err == nil; n -= 1 {
+				i := int(vr.uvarint())
+				indexed[i] = Member{Type: typ, Id: vr.varint(), Role: vr.string()}
+			}
+		})
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+
+	members := make([]Member, len(indexed))
+	for i, m := range indexed {
+		if i >= len(members) {
+			return nil, fmt.Errorf("Member index %d of relation %d v%d is out of range.", i, id, version)
+		}
+		members[i] = m
+	}
+	return members, nil
+}
+
+// GetChangeset returns a changeset.
+func (db *Database) GetChangeset(id int64) (*Changeset, error) {
+	c := &Changeset{Id: id}
+	err := db.get(dbKey(dbFlagChangeSet, id, -1), func(vr *valueReader) {
+		c.Uid = int32(vr.varint())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetUser returns the name of a user.
+func (db *Database) GetUser(uid int32) (name string, err error) {
+	err = db.get(dbKey(dbFlagUser, int64(uid), -1), func(vr *valueReader) {
+		name = vr.string()
+	})
+	return
+}
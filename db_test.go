@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDatabase(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Unable to open database: %s", err.Error())
+	}
+	defer db.Close()
+
+	nodes := []*Node{
+		{Id: 1, Lon: 1e9, Lat: -2e9, Tags: []Tag{{"name", "foo"}}, Info: Info{Version: 1, Timestamp: 1000, Changeset: 11, Uid: 7, User: "bob", Visible: true}},
+		{Id: 1, Lon: 3e9, Lat: -4e9, Info: Info{Version: 2, Timestamp: 2000, Changeset: 12, Uid: 7, User: "bob"}},
+		{Id: 2, Lon: -5e9, Lat: 6e9, Info: Info{Version: 1, Timestamp: 1000, Changeset: 11, Uid: 7, User: "bob", Visible: true}},
+	}
+	way := &Way{Id: 1, Refs: []int64{2, 1, 2}, Tags: []Tag{{"highway", "path"}}, Info: Info{Version: 3, Timestamp: 3000, Changeset: 13, Uid: 7, User: "bob", Visible: true}}
+	rel := &Relation{
+		Id: 1,
+		Members: []Member{{OSMPBF.Relation_WAY, 1, "outer"}, {OSMPBF.Relation_NODE, 2, "label"}, {OSMPBF.Relation_RELATION, 5, ""}, {OSMPBF.Relation_WAY, 3, "inner"}},
+		Info: Info{Version: 1, Timestamp: 4000, Changeset: 14, Uid: 7, User: "bob", Visible: true},
+	}
+
+	b := db.StartBatch()
+	for _, n := range nodes {
+		if err = b.PutNode(n); err != nil {
+			t.Fatalf("Unable to put node: %s", err.Error())
+		}
+	}
+	if err = b.PutWay(way); err != nil {
+		t.Fatalf("Unable to put way: %s", err.Error())
+	}
+	if err = b.PutRelation(rel); err != nil {
+		t.Fatalf("Unable to put relation: %s", err.Error())
+	}
+	if err = b.PutChangeset(&Changeset{Id: 11, Uid: 7}); err != nil {
+		t.Fatalf("Unable to put changeset: %s", err.Error())
+	}
+	if err = db.Write(b); err != nil {
+		t.Fatalf("Unable to write batch: %s", err.Error())
+	}
+
+	n, err := db.GetNode(1, 2)
+	if err != nil || !reflect.DeepEqual(n, nodes[1]) {
+		t.Errorf("Expected node %+v, but got %+v, %v.", nodes[1], n, err)
+	}
+	versions, err := db.NodeVersions(1)
+	if err != nil || !reflect.DeepEqual(versions, nodes[:2]) {
+		t.Errorf("Expected node versions %+v, but got %+v, %v.", nodes[:2], versions, err)
+	}
+	if _, err = db.GetNode(2, 2); err != ErrNotFound {
+		t.Errorf("Expected a missing node version to be not found, but got %v.", err)
+	}
+
+	w, err := db.GetWay(1, 3)
+	if err != nil || !reflect.DeepEqual(w, way) {
+		t.Errorf("Expected way %+v, but got %+v, %v.", way, w, err)
+	}
+	refs, err := db.GetWayNodes(1, 3)
+	if err != nil || !reflect.DeepEqual(refs, way.Refs) {
+		t.Errorf("Expected way nodes %v, but got %v, %v.", way.Refs, refs, err)
+	}
+
+	rels, err := db.RelationVersions(1)
+	if err != nil || len(rels) != 1 || !reflect.DeepEqual(rels[0], rel) {
+		t.Errorf("Expected relation %+v, but got %+v, %v.", rel, rels, err)
+	}
+	if rels, err = db.RelationVersions(2); err != nil || len(rels) != 0 {
+		t.Errorf("Expected no versions of relation 2, but got %+v, %v.", rels, err)
+	}
+
+	c, err := db.GetChangeset(11)
+	if err != nil || *c != (Changeset{Id: 11, Uid: 7}) {
+		t.Errorf("Expected changeset 11 by user 7, but got %+v, %v.", c, err)
+	}
+
+	// a version which can't be decoded is an error, without the versions
+	// before it.
+	if err = db.db.Put(dbKey(dbFlagNode, 1, 3), []byte{0xff}, nil); err != nil {
+		t.Fatalf("Unable to put corrupt node: %s", err.Error())
+	}
+	if versions, err = db.NodeVersions(1); err == nil || versions != nil {
+		t.Errorf("Expected an error and no versions for a corrupt node, but got %+v, %v.", versions, err)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+)
+
+// Info is the metadata attached to each version of an element. It is decoded
+// from either an OSMPBF.Info or a column of an OSMPBF.DenseInfo, with all the
+// string table references and delta coding resolved.
+type Info struct {
+	Version int32
+
+	// Timestamp in milliseconds since the epoch, already scaled by the
+	// block's date_granularity.
+	Timestamp int64
+
+	Changeset int64
+	Uid int32
+	User string
+
+	// Visible is false for versions which were created by deleting the element.
+	Visible bool
+}
+
+type Tag struct {
+	Key, Value string
+}
+
+// Node is a single version of a node. The location is held in nanodegrees,
+// already scaled by the block's granularity and offsets.
+type Node struct {
+	Id int64
+	Lon, Lat int64
+	Tags []Tag
+	Info Info
+}
+
+type Way struct {
+	Id int64
+	Refs []int64
+	Tags []Tag
+	Info Info
+}
+
+type Member struct {
+	Type OSMPBF.Relation_MemberType
+	Id int64
+	Role string
+}
+
+type Relation struct {
+	Id int64
+	Members []Member
+	Tags []Tag
+	Info Info
+}
+
+// Defaults for the optional PrimitiveBlock fields, as given in
+// osmformat.proto.
+const (
+	DEFAULT_GRANULARITY int32 = 100
+	DEFAULT_DATE_GRANULARITY int32 = 1000
+)
+
+// blockDecoder holds the per-block state needed to turn the raw protobuf
+// structures into Nodes, Ways and Relations.
+type blockDecoder struct {
+	strings [][]byte
+	granularity, dateGranularity int64
+	latOffset, lonOffset int64
+
+	// historical is true when the file header has the "HistoricalInformation"
+	// feature. Otherwise there's no visible flag, and everything is visible.
+	historical bool
+}
+
+func newBlockDecoder(p *OSMPBF.PrimitiveBlock, historical bool) *blockDecoder {
+	d := &blockDecoder{
+		strings: p.Strings,
+		granularity: int64(DEFAULT_GRANULARITY),
+		dateGranularity: int64(DEFAULT_DATE_GRANULARITY),
+		historical: historical,
+	}
+	if p.Granularity != nil {
+		d.granularity = int64(*p.Granularity)
+	}
+	if p.DateGranularity != nil {
+		d.dateGranularity = int64(*p.DateGranularity)
+	}
+	if p.LatOffset != nil {
+		d.latOffset = *p.LatOffset
+	}
+	if p.LonOffset != nil {
+		d.lonOffset = *p.LonOffset
+	}
+	return d
+}
+
+func (d *blockDecoder) str(idx int64) (string, error) {
+	if idx < 0 || idx >= int64(len(d.strings)) {
+		return "", fmt.Errorf("String table index %d out of range, table has %d entries.", idx, len(d.strings))
+	}
+	return string(d.strings[idx]), nil
+}
+
+func (d *blockDecoder) tags(keys, vals []uint32) ([]Tag, error) {
+	if len(keys) != len(vals) {
+		return nil, fmt.Errorf("Mismatched number of keys (%d) and values (%d).", len(keys), len(vals))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	tags := make([]Tag, len(keys))
+	for i := range keys {
+		k, err := d.str(int64(keys[i]))
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.str(int64(vals[i]))
+		if err != nil {
+			return nil, err
+		}
+		tags[i] = Tag{Key: k, Value: v}
+	}
+	return tags, nil
+}
+
+func (d *blockDecoder) info(i *OSMPBF.Info) (Info, error) {
+	if i == nil {
+		return Info{Visible: true}, nil
+	}
+
+	user, err := d.str(int64(i.UserSid))
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{
+		Version: i.Version,
+		Timestamp: i.Timestamp * d.dateGranularity,
+		Changeset: i.Changeset,
+		Uid: i.Uid,
+		User: user,
+		Visible: i.Visible || !d.historical,
+	}, nil
+}
+
+func (d *blockDecoder) lon(raw int64) int64 {
+	return d.lonOffset + d.granularity * raw
+}
+
+func (d *blockDecoder) lat(raw int64) int64 {
+	return d.latOffset + d.granularity * raw
+}
+
+func (d *blockDecoder) nodes(g *OSMPBF.PrimitiveGroup) ([]Node, error) {
+	nodes := make([]Node, 0, len(g.Nodes) + len(g.Dense.Id))
+
+	for _, n := range g.Nodes {
+		tags, err := d.tags(n.Keys, n.Vals)
+		if err != nil {
+			return nil, err
+		}
+		info, err := d.info(n.Info)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, Node{Id: n.Id, Lon: d.lon(n.Lon), Lat: d.lat(n.Lat), Tags: tags, Info: info})
+	}
+
+	dense := &g.Dense
+	if len(dense.Id) == 0 {
+		return nodes, nil
+	}
+	if len(dense.Lon) != len(dense.Id) || len(dense.Lat) != len(dense.Id) {
+		return nil, fmt.Errorf("Dense nodes have %d IDs, but %d lons and %d lats.", len(dense.Id), len(dense.Lon), len(dense.Lat))
+	}
+
+	di := &dense.Denseinfo
+	hasInfo := len(di.Version) > 0
+	if hasInfo && (len(di.Version) != len(dense.Id) || len(di.Timestamp) != len(dense.Id) ||
+		len(di.Changeset) != len(dense.Id) || len(di.Uid) != len(dense.Id) || len(di.UserSid) != len(dense.Id)) {
+		return nil, fmt.Errorf("Dense info columns do not match the %d dense node IDs.", len(dense.Id))
+	}
+	hasVisible := len(di.Visible) > 0
+	if hasVisible && len(di.Visible) != len(dense.Id) {
+		return nil, fmt.Errorf("Dense info has %d visible flags for %d dense node IDs.", len(di.Visible), len(dense.Id))
+	}
+
+	var id, lon, lat, timestamp, changeset int64
+	var uid, user_sid int32
+	kv := 0
+
+	for i := range dense.Id {
+		id += dense.Id[i]
+		lon += dense.Lon[i]
+		lat += dense.Lat[i]
+
+		n := Node{Id: id, Lon: d.lon(lon), Lat: d.lat(lat), Info: Info{Visible: true}}
+
+		// keys_vals is a list of (key, val) string table indices for each node,
+		// with each node's list terminated by a zero.
+		for kv < len(dense.KeysVals) && dense.KeysVals[kv] != 0 {
+			if kv + 1 >= len(dense.KeysVals) {
+				return nil, fmt.Errorf("Dense node %d has a key without a value.", id)
+			}
+			k, err := d.str(int64(dense.KeysVals[kv]))
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.str(int64(dense.KeysVals[kv+1]))
+			if err != nil {
+				return nil, err
+			}
+			n.Tags = append(n.Tags, Tag{Key: k, Value: v})
+			kv += 2
+		}
+		kv += 1
+
+		if hasInfo {
+			timestamp += di.Timestamp[i]
+			changeset += di.Changeset[i]
+			uid += di.Uid[i]
+			user_sid += di.UserSid[i]
+
+			user, err := d.str(int64(user_sid))
+			if err != nil {
+				return nil, err
+			}
+
+			n.Info = Info{
+				Version: di.Version[i],
+				Timestamp: timestamp * d.dateGranularity,
+				Changeset: changeset,
+				Uid: uid,
+				User: user,
+				Visible: true,
+			}
+		}
+		if hasVisible && d.historical {
+			n.Info.Visible = di.Visible[i]
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
+
+func (d *blockDecoder) ways(g *OSMPBF.PrimitiveGroup) ([]Way, error) {
+	ways := make([]Way, 0, len(g.Ways))
+
+	for _, w := range g.Ways {
+		tags, err := d.tags(w.Keys, w.Vals)
+		if err != nil {
+			return nil, err
+		}
+		info, err := d.info(w.Info)
+		if err != nil {
+			return nil, err
+		}
+
+		refs := make([]int64, len(w.Refs))
+		var ref int64
+		for i, delta := range w.Refs {
+			ref += delta
+			refs[i] = ref
+		}
+
+		ways = append(ways, Way{Id: w.Id, Refs: refs, Tags: tags, Info: info})
+	}
+
+	return ways, nil
+}
+
+func (d *blockDecoder) relations(g *OSMPBF.PrimitiveGroup) ([]Relation, error) {
+	rels := make([]Relation, 0, len(g.Relations))
+
+	for _, r := range g.Relations {
+		if r.Id == nil {
+			return nil, fmt.Errorf("Relation without an ID.")
+		}
+		if len(r.Memids) != len(r.Types) || len(r.Memids) != len(r.RolesSid) {
+			return nil, fmt.Errorf("Relation %d has %d member IDs, %d types and %d roles.", *r.Id, len(r.Memids), len(r.Types), len(r.RolesSid))
+		}
+
+		tags, err := d.tags(r.Keys, r.Vals)
+		if err != nil {
+			return nil, err
+		}
+		info, err := d.info(r.Info)
+		if err != nil {
+			return nil, err
+		}
+
+		members := make([]Member, len(r.Memids))
+		var memid int64
+		for i, delta := range r.Memids {
+			memid += delta
+			role, err := d.str(int64(r.RolesSid[i]))
+			if err != nil {
+				return nil, err
+			}
+			members[i] = Member{Type: r.Types[i], Id: memid, Role: role}
+		}
+
+		rels = append(rels, Relation{Id: *r.Id, Members: members, Tags: tags, Info: info})
+	}
+
+	return rels, nil
+}
+
+// DecodeBlock unpacks all the elements in a PrimitiveBlock, resolving string
+// table references and delta coding, and scaling coordinates and timestamps
+// by the granularities given in the block.
+func DecodeBlock(p *OSMPBF.PrimitiveBlock, historical bool) (nodes []Node, ways []Way, rels []Relation, err error) {
+	d := newBlockDecoder(p, historical)
+
+	for i := range p.Primitivegroup {
+		g := &p.Primitivegroup[i]
+
+		var n []Node
+		n, err = d.nodes(g)
+		if err != nil {
+			return
+		}
+		nodes = append(nodes, n...)
+
+		var w []Way
+		w, err = d.ways(g)
+		if err != nil {
+			return
+		}
+		ways = append(ways, w...)
+
+		var r []Relation
+		r, err = d.relations(g)
+		if err != nil {
+			return
+		}
+		rels = append(rels, r...)
+	}
+
+	return
+}
+
+// hasFeature returns true if the header block lists the feature as either
+// required or optional.
+func hasFeature(header *OSMPBF.HeaderBlock, feature string) bool {
+	for _, f := range header.RequiredFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	for _, f := range header.OptionalFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
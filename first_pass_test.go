@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"github.com/mapzen/neatlacoche/fixture"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update_golden = flag.Bool("update", false, "Rewrite the golden files in testdata with the current results.")
+
+// The fixture histories which the first pass is checked against, each with a
+// golden file of the grid squares it sorts their elements into.
+func goldenFixtures() map[string]fixture.Options {
+	dense := fixture.DefaultOptions()
+
+	mixed := fixture.DefaultOptions()
+	mixed.Seed = 2
+	mixed.BlockSize = 7
+	mixed.MixedBlocks = true
+
+	granularity := fixture.DefaultOptions()
+	granularity.Seed = 3
+	granularity.Granularity = 1000
+	granularity.LonOffset = -50e9
+	granularity.LatOffset = 45e9
+	granularity.DateGranularity = 60000
+
+	// all near (0, 0), so that nearly every way crosses from one square to
+	// another.
+	plain := fixture.DefaultOptions()
+	plain.Seed = 4
+	plain.Dense = false
+	plain.Deleted = 0.5
+	plain.Region = [4]float64{-1, -1, 1, 1}
+
+	// most nodes are deleted, and nowhere near (0, 0), so that a deleted
+	// version which was put where it's written would be in a square of its
+	// own.
+	deletes := fixture.DefaultOptions()
+	deletes.Seed = 5
+	deletes.Deleted = 0.8
+	deletes.Region = [4]float64{-60, -50, -10, -10}
+
+	// as osmium writes them, which can't be projected at all.
+	undefined := deletes
+	undefined.Seed = 6
+	undefined.Dense = false
+	undefined.UndefinedDeletes = true
+
+	return map[string]fixture.Options{
+		"dense": dense,
+		"mixed": mixed,
+		"granularity": granularity,
+		"plain": plain,
+		"deletes": deletes,
+		"undefined": undefined,
+	}
+}
+
+// dumpSorter lists the grid squares of every element, one per line.
+func dumpSorter(s *Sorter) []byte {
+	var buf bytes.Buffer
+	for kind, mb := range []*MultiBlock{s.Nodes, s.Ways, s.Relations} {
+		mb.Each(func(id int64, val uint64) {
+			fmt.Fprintf(&buf, "%s %d %#x\n", PKIND_NAMES[kind], id, val)
+		})
+	}
+	return buf.Bytes()
+}
+
+func TestFirstPassGolden(t *testing.T) {
+	for name, opts := range goldenFixtures() {
+		t.Run(name, func(t *testing.T) {
+			h := fixture.Generate(opts)
+			data, err := h.Encode(opts)
+			if err != nil {
+				t.Fatalf("Unable to encode fixture: %s", err.Error())
+			}
+			in := filepath.Join(t.TempDir(), name + ".osm.pbf")
+			if err = os.WriteFile(in, data, 0644); err != nil {
+				t.Fatalf("Unable to write fixture: %s", err.Error())
+			}
+
+			// the nodes should decode to where the fixture put them, whatever
+			// the granularity and offsets.
+			nodes, _, _ := readTile(t, in)
+			locations := h.NodeLocations(opts)
+			seen := make(map[int64]int)
+			for _, n := range nodes {
+				if !n.Info.Visible {
+					continue
+				}
+				expected := locations[n.Id][seen[n.Id]]
+				if n.Lon != expected[0] || n.Lat != expected[1] {
+					t.Errorf("Node %d v%d decoded at (%d, %d), but expected (%d, %d).", n.Id, n.Info.Version, n.Lon, n.Lat, expected[0], expected[1])
+				}
+				seen[n.Id] += 1
+			}
+
+			sorter, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+			if err != nil {
+				t.Fatalf("First pass failed: %s", err.Error())
+			}
+			defer sorter.Close()
+			result := dumpSorter(sorter)
+
+			// deleted versions don't have a location, so a node which was only
+			// ever deleted isn't in any square, unless it's used by a way or
+			// relation which is, and none are out of range.
+			used := make(map[int64]bool)
+			for _, w := range h.Ways {
+				for _, ref := range w.Refs {
+					used[ref] = true
+				}
+			}
+			for _, r := range h.Relations {
+				for _, m := range r.Members {
+					if m.Type == OSMPBF.Relation_NODE {
+						used[m.Id] = true
+					}
+				}
+			}
+			for _, n := range nodes {
+				if _, ok := locations[n.Id]; !ok && !used[n.Id] && sorter.Nodes.Lookup(n.Id) != 0 {
+					t.Errorf("Node %d has no visible versions, but is in squares %#x.", n.Id, sorter.Nodes.Lookup(n.Id))
+				}
+			}
+			if sorter.OutOfRange.Total() != 0 {
+				t.Errorf("Expected no nodes out of range, but got %+v.", sorter.OutOfRange)
+			}
+
+			golden := filepath.Join("testdata", "first_pass", name + ".golden")
+			if *update_golden {
+				if err = os.MkdirAll(filepath.Dir(golden), 0755); err == nil {
+					err = os.WriteFile(golden, result, 0644)
+				}
+				if err != nil {
+					t.Fatalf("Unable to update %q: %s", golden, err.Error())
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Unable to read %q, run with -update to create it: %s", golden, err.Error())
+			}
+			if !bytes.Equal(result, expected) {
+				t.Errorf("First pass of %q doesn't match %q, got:\n%s", name, golden, result)
+			}
+		})
+	}
+}
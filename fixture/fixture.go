@@ -0,0 +1,509 @@
+// Package fixture generates small, deterministic OSM history files in PBF
+// format, for tests. The same options always give the same bytes, so that the
+// results of processing them can be compared against golden files.
+//
+// It only depends on the OSMPBF package, rather than on neatlacoche's own
+// reader and writer, so that it can be used to test them.
+package fixture
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Info is the metadata of a version of an element. Timestamps are in
+// milliseconds, but are only written to the nearest DateGranularity.
+type Info struct {
+	Version int32
+	Timestamp int64
+	Changeset int64
+	Uid int32
+	User string
+	Visible bool
+}
+
+// UNDEFINED_COORDINATE is osmium's location for deleted nodes, in degrees. It's
+// the largest int32 in its units of 100 nanodegrees, so it can't be projected.
+const UNDEFINED_COORDINATE = 214.7483647
+
+type Tag struct {
+	Key, Value string
+}
+
+// Node is a version of a node, with its location in degrees. Deleted versions
+// don't have a location, so they're written at 0, 0 as most writers do, or at
+// UNDEFINED_COORDINATE as osmium does.
+type Node struct {
+	Id int64
+	Lon, Lat float64
+	Tags []Tag
+	Info Info
+}
+
+type Way struct {
+	Id int64
+	Refs []int64
+	Tags []Tag
+	Info Info
+}
+
+type Member struct {
+	Type OSMPBF.Relation_MemberType
+	Id int64
+	Role string
+}
+
+type Relation struct {
+	Id int64
+	Members []Member
+	Tags []Tag
+	Info Info
+}
+
+// History is all the versions of every element, in the order they're written
+// to the file; nodes, ways and then relations, each by ID and then version.
+type History struct {
+	Nodes []Node
+	Ways []Way
+	Relations []Relation
+}
+
+// Options control what's generated, and how it's encoded.
+type Options struct {
+	// Seed for the random choices, so that a different seed gives a different
+	// history with the same shape.
+	Seed int64
+
+	// How many elements of each kind there are, and the most versions each
+	// one has. The last version is deleted with the given probability.
+	Nodes, Ways, Relations int
+	MaxVersions int
+	Deleted float64
+
+	// Deleted versions of nodes are at 0, 0 unless this is set, when they're
+	// at UNDEFINED_COORDINATE.
+	UndefinedDeletes bool
+
+	// The gap between the IDs of each kind, which start from 1. Zero is the
+	// same as 1, and a large gap spreads the elements over many Blocks.
+	IdSpacing int64
+
+	// Where the nodes are, as left, bottom, right and top in degrees. Each
+	// version of a node is somewhere different, so ways cross tile boundaries
+	// unless the region is very small.
+	Region [4]float64
+
+	// Number of elements in each block. If MixedBlocks is set then the blocks
+	// carry on across kinds, so that there are blocks with the last nodes and
+	// the first ways, and so on.
+	BlockSize int
+	MixedBlocks bool
+
+	// How the blocks are encoded. Zero means the format's default, and Dense
+	// writes nodes as DenseNodes.
+	Granularity int32
+	LonOffset, LatOffset int64
+	DateGranularity int32
+	Dense bool
+}
+
+// DefaultOptions gives a few of each kind of element, all over the world.
+func DefaultOptions() Options {
+	return Options{
+		Seed: 1,
+		Nodes: 40,
+		Ways: 15,
+		Relations: 5,
+		MaxVersions: 3,
+		Deleted: 0.2,
+		Region: [4]float64{-179, -80, 179, 80},
+		BlockSize: 8,
+		Dense: true,
+	}
+}
+
+// Generate makes a random history with the given options.
+func Generate(opts Options) *History {
+	r := rand.New(rand.NewSource(opts.Seed))
+	h := &History{}
+	users := []string{"alice", "bob", "carol", "dave"}
+
+	// each version of an element is a day after the last, starting from a
+	// fixed date, so that the timestamps don't depend on when it's run.
+	var changeset int64
+	versions := func(f func(info Info)) {
+		n := 1 + r.Intn(opts.MaxVersions)
+		deleted := r.Float64() < opts.Deleted
+		ts := int64(1262304000000) + r.Int63n(1000) * 86400000
+		for v := 1; v <= n; v += 1 {
+			changeset += 1
+			uid := r.Intn(len(users))
+			f(Info{
+				Version: int32(v),
+				Timestamp: ts,
+				Changeset: changeset,
+				Uid: int32(uid + 1),
+				User: users[uid],
+				Visible: !(deleted && v == n),
+			})
+			ts += 86400000
+		}
+	}
+	spacing := opts.IdSpacing
+	if spacing < 1 {
+		spacing = 1
+	}
+	// the ID of the i'th element of a kind, counting from 1.
+	nth := func(i int64) int64 {
+		return 1 + (i - 1) * spacing
+	}
+	tags := func(kind string, id int64) []Tag {
+		return []Tag{{"name", fmt.Sprintf("%s %d", kind, id)}}
+	}
+
+	for i := int64(1); i <= int64(opts.Nodes); i += 1 {
+		id := nth(i)
+		versions(func(info Info) {
+			n := Node{Id: id, Info: info}
+			if info.Visible {
+				n.Lon = opts.Region[0] + r.Float64() * (opts.Region[2] - opts.Region[0])
+				n.Lat = opts.Region[1] + r.Float64() * (opts.Region[3] - opts.Region[1])
+				n.Tags = tags("node", id)
+			} else if opts.UndefinedDeletes {
+				n.Lon, n.Lat = UNDEFINED_COORDINATE, UNDEFINED_COORDINATE
+			}
+			h.Nodes = append(h.Nodes, n)
+		})
+	}
+
+	for i := int64(1); i <= int64(opts.Ways); i += 1 {
+		id := nth(i)
+		versions(func(info Info) {
+			w := Way{Id: id, Info: info}
+			if info.Visible && opts.Nodes > 0 {
+				for k := 2 + r.Intn(4); k > 0; k -= 1 {
+					w.Refs = append(w.Refs, nth(1 + r.Int63n(int64(opts.Nodes))))
+				}
+				w.Tags = tags("way", id)
+			}
+			h.Ways = append(h.Ways, w)
+		})
+	}
+
+	for i := int64(1); i <= int64(opts.Relations); i += 1 {
+		id := nth(i)
+		versions(func(info Info) {
+			rel := Relation{Id: id, Info: info}
+			if info.Visible {
+				for k := 1 + r.Intn(4); k > 0; k -= 1 {
+					m := Member{Role: []string{"", "outer", "inner"}[r.Intn(3)]}
+					switch {
+					case r.Intn(2) == 0 && opts.Ways > 0:
+						m.Type, m.Id = OSMPBF.Relation_WAY, nth(1 + r.Int63n(int64(opts.Ways)))
+					case r.Intn(4) == 0 && i > 1:
+						m.Type, m.Id = OSMPBF.Relation_RELATION, nth(1 + r.Int63n(i - 1))
+					case opts.Nodes > 0:
+						m.Type, m.Id = OSMPBF.Relation_NODE, nth(1 + r.Int63n(int64(opts.Nodes)))
+					default:
+						continue
+					}
+					rel.Members = append(rel.Members, m)
+				}
+				rel.Tags = tags("relation", id)
+			}
+			h.Relations = append(h.Relations, rel)
+		})
+	}
+
+	return h
+}
+
+// Encode writes the history as a PBF file, split into blocks as the options
+// say.
+func (h *History) Encode(opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+
+	header := &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}
+	if opts.Dense {
+		header.RequiredFeatures = append(header.RequiredFeatures, "DenseNodes")
+	}
+	data, err := header.Marshal()
+	if err == nil {
+		err = writeBlob(&buf, "OSMHeader", data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block_size := opts.BlockSize
+	if block_size < 1 {
+		block_size = 8000
+	}
+
+	// the elements are written in order, starting a new block when the last
+	// one is full, or when the kind changes if blocks aren't mixed.
+	e := newEncoder(opts)
+	count, last_kind := 0, 0
+	next := func(kind int) error {
+		if count == block_size || (kind != last_kind && !opts.MixedBlocks && count > 0) {
+			if err := e.flush(&buf); err != nil {
+				return err
+			}
+			count = 0
+		}
+		count += 1
+		last_kind = kind
+		return nil
+	}
+	for i := range h.Nodes {
+		if err = next(0); err != nil {
+			return nil, err
+		}
+		e.node(&h.Nodes[i])
+	}
+	for i := range h.Ways {
+		if err = next(1); err != nil {
+			return nil, err
+		}
+		e.way(&h.Ways[i])
+	}
+	for i := range h.Relations {
+		if err = next(2); err != nil {
+			return nil, err
+		}
+		e.relation(&h.Relations[i])
+	}
+	if count > 0 {
+		if err = e.flush(&buf); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Bytes generates a history and encodes it.
+func Bytes(opts Options) ([]byte, error) {
+	return Generate(opts).Encode(opts)
+}
+
+// encoder builds one PrimitiveBlock at a time.
+type encoder struct {
+	opts Options
+	granularity, dateGranularity int64
+
+	strings [][]byte
+	stringIdx map[string]uint32
+	nodes []OSMPBF.Node
+	dense OSMPBF.DenseNodes
+	ways []OSMPBF.Way
+	rels []OSMPBF.Relation
+
+	// the last dense node, as they're delta coded.
+	lastId, lastLon, lastLat, lastTimestamp, lastChangeset int64
+	lastUid, lastUserSid int32
+}
+
+func newEncoder(opts Options) *encoder {
+	e := &encoder{opts: opts, granularity: 100, dateGranularity: 1000}
+	if opts.Granularity != 0 {
+		e.granularity = int64(opts.Granularity)
+	}
+	if opts.DateGranularity != 0 {
+		e.dateGranularity = int64(opts.DateGranularity)
+	}
+	e.reset()
+	return e
+}
+
+func (e *encoder) reset() {
+	e.strings = [][]byte{[]byte{}}
+	e.stringIdx = map[string]uint32{"": 0}
+	e.nodes, e.dense, e.ways, e.rels = nil, OSMPBF.DenseNodes{}, nil, nil
+	e.lastId, e.lastLon, e.lastLat, e.lastTimestamp, e.lastChangeset = 0, 0, 0, 0, 0
+	e.lastUid, e.lastUserSid = 0, 0
+}
+
+func (e *encoder) str(s string) uint32 {
+	if idx, ok := e.stringIdx[s]; ok {
+		return idx
+	}
+	idx := uint32(len(e.strings))
+	e.strings = append(e.strings, []byte(s))
+	e.stringIdx[s] = idx
+	return idx
+}
+
+func (e *encoder) tags(tags []Tag) (keys, vals []uint32) {
+	for _, t := range tags {
+		keys = append(keys, e.str(t.Key))
+		vals = append(vals, e.str(t.Value))
+	}
+	return
+}
+
+func (e *encoder) info(i *Info) *OSMPBF.Info {
+	return &OSMPBF.Info{
+		Version: i.Version,
+		Timestamp: i.Timestamp / e.dateGranularity,
+		Changeset: i.Changeset,
+		Uid: i.Uid,
+		UserSid: e.str(i.User),
+		Visible: i.Visible,
+	}
+}
+
+// coord converts degrees to the block's units.
+func (e *encoder) coord(deg float64, offset int64) int64 {
+	return int64(math.Round((deg * 1e9 - float64(offset)) / float64(e.granularity)))
+}
+
+func (e *encoder) node(n *Node) {
+	lon, lat := e.coord(n.Lon, e.opts.LonOffset), e.coord(n.Lat, e.opts.LatOffset)
+	if !e.opts.Dense {
+		keys, vals := e.tags(n.Tags)
+		e.nodes = append(e.nodes, OSMPBF.Node{Id: n.Id, Keys: keys, Vals: vals, Info: e.info(&n.Info), Lon: lon, Lat: lat})
+		return
+	}
+
+	d := &e.dense
+	d.Id = append(d.Id, n.Id - e.lastId)
+	d.Lon = append(d.Lon, lon - e.lastLon)
+	d.Lat = append(d.Lat, lat - e.lastLat)
+	e.lastId, e.lastLon, e.lastLat = n.Id, lon, lat
+	for _, t := range n.Tags {
+		d.KeysVals = append(d.KeysVals, int32(e.str(t.Key)), int32(e.str(t.Value)))
+	}
+	d.KeysVals = append(d.KeysVals, 0)
+
+	di := &d.Denseinfo
+	timestamp := n.Info.Timestamp / e.dateGranularity
+	user_sid := int32(e.str(n.Info.User))
+	di.Version = append(di.Version, n.Info.Version)
+	di.Timestamp = append(di.Timestamp, timestamp - e.lastTimestamp)
+	di.Changeset = append(di.Changeset, n.Info.Changeset - e.lastChangeset)
+	di.Uid = append(di.Uid, n.Info.Uid - e.lastUid)
+	di.UserSid = append(di.UserSid, user_sid - e.lastUserSid)
+	di.Visible = append(di.Visible, n.Info.Visible)
+	e.lastTimestamp, e.lastChangeset, e.lastUid, e.lastUserSid = timestamp, n.Info.Changeset, n.Info.Uid, user_sid
+}
+
+func (e *encoder) way(w *Way) {
+	keys, vals := e.tags(w.Tags)
+	way := OSMPBF.Way{Id: w.Id, Keys: keys, Vals: vals, Info: e.info(&w.Info)}
+	var last int64
+	for _, ref := range w.Refs {
+		way.Refs = append(way.Refs, ref - last)
+		last = ref
+	}
+	e.ways = append(e.ways, way)
+}
+
+func (e *encoder) relation(r *Relation) {
+	keys, vals := e.tags(r.Tags)
+	id := r.Id
+	rel := OSMPBF.Relation{Id: &id, Keys: keys, Vals: vals, Info: e.info(&r.Info)}
+	var last int64
+	for _, m := range r.Members {
+		rel.RolesSid = append(rel.RolesSid, int32(e.str(m.Role)))
+		rel.Memids = append(rel.Memids, m.Id - last)
+		rel.Types = append(rel.Types, m.Type)
+		last = m.Id
+	}
+	e.rels = append(e.rels, rel)
+}
+
+// flush writes the block built so far, and starts a new one.
+func (e *encoder) flush(buf *bytes.Buffer) error {
+	granularity, date_granularity := int32(e.granularity), int32(e.dateGranularity)
+	lon_offset, lat_offset := e.opts.LonOffset, e.opts.LatOffset
+	p := &OSMPBF.PrimitiveBlock{Granularity: &granularity, DateGranularity: &date_granularity}
+	if lon_offset != 0 || lat_offset != 0 {
+		p.LonOffset, p.LatOffset = &lon_offset, &lat_offset
+	}
+	p.Strings = e.strings
+
+	if len(e.nodes) > 0 {
+		p.Primitivegroup = append(p.Primitivegroup, OSMPBF.PrimitiveGroup{Nodes: e.nodes})
+	}
+	if len(e.dense.Id) > 0 {
+		p.Primitivegroup = append(p.Primitivegroup, OSMPBF.PrimitiveGroup{Dense: e.dense})
+	}
+	if len(e.ways) > 0 {
+		p.Primitivegroup = append(p.Primitivegroup, OSMPBF.PrimitiveGroup{Ways: e.ways})
+	}
+	if len(e.rels) > 0 {
+		p.Primitivegroup = append(p.Primitivegroup, OSMPBF.PrimitiveGroup{Relations: e.rels})
+	}
+
+	data, err := p.Marshal()
+	if err == nil {
+		err = writeBlob(buf, "OSMData", data)
+	}
+	e.reset()
+	return err
+}
+
+// writeBlob compresses the data with zlib and frames it with its BlobHeader.
+func writeBlob(buf *bytes.Buffer, blob_type string, data []byte) error {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	blob := OSMPBF.Blob{RawSize: int32(len(data)), ZlibData: compressed.Bytes()}
+	blob_data, err := blob.Marshal()
+	if err != nil {
+		return err
+	}
+	header := OSMPBF.BlobHeader{Type: blob_type, Datasize: int32(len(blob_data))}
+	header_data, err := header.Marshal()
+	if err != nil {
+		return err
+	}
+
+	binary.Write(buf, binary.BigEndian, uint32(len(header_data)))
+	buf.Write(header_data)
+	buf.Write(blob_data)
+	return nil
+}
+
+// NodeLocations returns the location of each version of each node which is
+// visible, in nanodegrees as they'll be decoded from the file, which can be
+// used to work out the expected results independently. Deleted versions don't
+// have a location, so they're left out.
+func (h *History) NodeLocations(opts Options) map[int64][][2]int64 {
+	e := newEncoder(opts)
+	locations := make(map[int64][][2]int64)
+	for _, n := range h.Nodes {
+		if !n.Info.Visible {
+			continue
+		}
+		lon := opts.LonOffset + e.granularity * e.coord(n.Lon, opts.LonOffset)
+		lat := opts.LatOffset + e.granularity * e.coord(n.Lat, opts.LatOffset)
+		locations[n.Id] = append(locations[n.Id], [2]int64{lon, lat})
+	}
+	return locations
+}
+
+// WayIds returns the IDs of the ways, in order.
+func (h *History) WayIds() []int64 {
+	seen := make(map[int64]bool)
+	var ids []int64
+	for _, w := range h.Ways {
+		if !seen[w.Id] {
+			seen[w.Id] = true
+			ids = append(ids, w.Id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
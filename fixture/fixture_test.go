@@ -0,0 +1,73 @@
+package fixture
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeterministic(t *testing.T) {
+	opts := DefaultOptions()
+	a, err := Bytes(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	b, err := Bytes(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("Expected the same options to give the same bytes.")
+	}
+
+	opts.Seed = 2
+	c, err := Bytes(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	if bytes.Equal(a, c) {
+		t.Errorf("Expected a different seed to give different bytes.")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Deleted = 1
+	h := Generate(opts)
+
+	// every element is deleted at its last version, and they're in order of ID
+	// and version.
+	last_id, last_version, deleted := int64(0), int32(0), 0
+	for _, n := range h.Nodes {
+		if n.Id < last_id || (n.Id == last_id && n.Info.Version != last_version + 1) {
+			t.Fatalf("Node %d v%d is out of order, after %d v%d.", n.Id, n.Info.Version, last_id, last_version)
+		}
+		if !n.Info.Visible {
+			deleted += 1
+			if n.Lon != 0 || n.Lat != 0 {
+				t.Errorf("Expected deleted node %d v%d to have no location, but it's at (%f, %f).", n.Id, n.Info.Version, n.Lon, n.Lat)
+			}
+		}
+		last_id, last_version = n.Id, n.Info.Version
+	}
+
+	opts.UndefinedDeletes = true
+	for _, n := range Generate(opts).Nodes {
+		if !n.Info.Visible && (n.Lon != UNDEFINED_COORDINATE || n.Lat != UNDEFINED_COORDINATE) {
+			t.Errorf("Expected deleted node %d v%d to be at the undefined coordinate, but it's at (%f, %f).", n.Id, n.Info.Version, n.Lon, n.Lat)
+		}
+	}
+	if deleted != opts.Nodes {
+		t.Errorf("Expected %d deleted nodes, but got %d.", opts.Nodes, deleted)
+	}
+
+	for _, w := range h.Ways {
+		for _, ref := range w.Refs {
+			if ref < 1 || ref > int64(opts.Nodes) {
+				t.Errorf("Way %d uses node %d, which doesn't exist.", w.Id, ref)
+			}
+		}
+	}
+	if len(h.WayIds()) != opts.Ways {
+		t.Errorf("Expected %d ways, but got %d.", opts.Ways, len(h.WayIds()))
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"io"
+	"math"
+	"os"
+)
+
+// BlobInfo describes one of the blobs in a PBF file, and the block in it.
+type BlobInfo struct {
+	Index int
+	Offset int64
+	Type string
+	Stats BlobStats
+
+	// Only one of these is set, depending on the type of the blob, and neither
+	// is if it couldn't be decoded.
+	Header *OSMPBF.HeaderBlock
+	Block *BlockInfo
+
+	// Anything wrong with the blob. Problems stop the file being split, but
+	// warnings are only unusual.
+	Problems, Warnings []string
+}
+
+// GroupInfo describes one of the groups in a PrimitiveBlock.
+type GroupInfo struct {
+	// One of "nodes", "dense nodes", "ways", "relations", "changesets" or
+	// "empty".
+	Kind string
+	Count int
+}
+
+// idVersion identifies a version of an element, which are ordered by ID and
+// then version.
+type idVersion struct {
+	Id int64
+	Version int32
+}
+
+func (a idVersion) before(b idVersion) bool {
+	return a.Id < b.Id || (a.Id == b.Id && a.Version < b.Version)
+}
+
+// BlockInfo describes the contents of a PrimitiveBlock.
+type BlockInfo struct {
+	Groups []GroupInfo
+
+	// Number of nodes, ways and relations, as from primCount, and the range of
+	// IDs of each, indexed by PKIND_*.
+	Counts [3]int
+	MinId, MaxId [3]int64
+
+	// Number of elements of each kind which come before the one in front of
+	// them, in (ID, version) order.
+	Unordered [3]int
+
+	// The first and last element of each kind, to check against the blocks
+	// either side.
+	first, last [3]idVersion
+
+	Granularity int32
+	LatOffset, LonOffset int64
+	DateGranularity int32
+}
+
+func newBlockInfo(p *OSMPBF.PrimitiveBlock) *BlockInfo {
+	b := &BlockInfo{
+		Granularity: p.GetGranularity(),
+		LatOffset: p.GetLatOffset(),
+		LonOffset: p.GetLonOffset(),
+		DateGranularity: p.GetDateGranularity(),
+	}
+	b.Counts[PKIND_NODE], b.Counts[PKIND_WAY], b.Counts[PKIND_REL] = primCount(p)
+	for kind := range b.MinId {
+		b.MinId[kind], b.MaxId[kind] = math.MaxInt64, math.MinInt64
+	}
+
+	for _, g := range p.Primitivegroup {
+		switch {
+		case len(g.Nodes) > 0:
+			b.Groups = append(b.Groups, GroupInfo{"nodes", len(g.Nodes)})
+			for _, n := range g.Nodes {
+				b.id(PKIND_NODE, n.Id, n.GetInfo().GetVersion())
+			}
+		case len(g.Dense.Id) > 0:
+			b.Groups = append(b.Groups, GroupInfo{"dense nodes", len(g.Dense.Id)})
+			var id int64
+			versions := g.Dense.Denseinfo.Version
+			for i, delta := range g.Dense.Id {
+				id += delta
+				var version int32
+				if i < len(versions) {
+					version = versions[i]
+				}
+				b.id(PKIND_NODE, id, version)
+			}
+		case len(g.Ways) > 0:
+			b.Groups = append(b.Groups, GroupInfo{"ways", len(g.Ways)})
+			for _, w := range g.Ways {
+				b.id(PKIND_WAY, w.Id, w.GetInfo().GetVersion())
+			}
+		case len(g.Relations) > 0:
+			b.Groups = append(b.Groups, GroupInfo{"relations", len(g.Relations)})
+			for _, r := range g.Relations {
+				b.id(PKIND_REL, r.GetId(), r.GetInfo().GetVersion())
+			}
+		case len(g.Changesets) > 0:
+			b.Groups = append(b.Groups, GroupInfo{"changesets", len(g.Changesets)})
+		default:
+			b.Groups = append(b.Groups, GroupInfo{"empty", 0})
+		}
+	}
+	return b
+}
+
+func (b *BlockInfo) id(kind int, id int64, version int32) {
+	v := idVersion{id, version}
+	if b.MaxId[kind] == math.MinInt64 {
+		b.first[kind] = v
+	} else if v.before(b.last[kind]) {
+		b.Unordered[kind] += 1
+	}
+	b.last[kind] = v
+
+	if id < b.MinId[kind] {
+		b.MinId[kind] = id
+	}
+	if id > b.MaxId[kind] {
+		b.MaxId[kind] = id
+	}
+}
+
+// Kinds returns the kinds of element in the block, in the order which the
+// reader splits them into.
+func (b *BlockInfo) Kinds() []int {
+	var kinds []int
+	for kind, count := range b.Counts {
+		if count > 0 {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// InspectPBF reads the blobs of a PBF file one at a time, calling f with what's
+// in each. As well as describing the blobs, it checks that the blocks are in
+// the order which the Sorter needs; all the nodes, then the ways and then the
+// relations, each in order of ID and version. The versions of an element can
+// be split across blocks, so a block can start with the same ID as the last
+// one ended with.
+func InspectPBF(ctx context.Context, r io.Reader, f func(*BlobInfo) error) error {
+	var offset int64
+	last_kind := PKIND_NODE
+	last := idVersion{Id: math.MinInt64}
+
+	for index := 0; ; index += 1 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		header, size, err := readBlobHeader(r)
+		if err == io.EOF && size == 0 {
+			return nil
+		} else if err != nil {
+			return &BlobError{Offset: offset, Index: index, Err: err}
+		}
+		buf := make([]byte, header.Datasize)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return &BlobError{Offset: offset, Index: index, Err: fmt.Errorf("Unable to read blob: %s", err.Error())}
+		}
+
+		info := &BlobInfo{Index: index, Offset: offset, Type: header.Type}
+		offset += size + int64(header.Datasize)
+
+		switch {
+		case header.Type == "OSMHeader":
+			h := new(OSMPBF.HeaderBlock)
+			info.Stats, err = decodeBlob(buf, h)
+			if err == nil {
+				info.Header = h
+			}
+			if index != 0 {
+				info.Problems = append(info.Problems, "The header should be the first blob.")
+			}
+
+		case header.Type == "OSMData":
+			p := new(OSMPBF.PrimitiveBlock)
+			info.Stats, err = decodeBlob(buf, p)
+			if err == nil {
+				info.Block = newBlockInfo(p)
+			}
+			if index == 0 {
+				info.Problems = append(info.Problems, "The first blob should be the header.")
+			}
+
+		default:
+			info.Warnings = append(info.Warnings, fmt.Sprintf("Unknown blob type %q, which will be skipped.", header.Type))
+		}
+		if err != nil {
+			info.Problems = append(info.Problems, err.Error())
+		}
+
+		if info.Block != nil {
+			kinds := info.Block.Kinds()
+			if len(kinds) > 1 {
+				info.Warnings = append(info.Warnings, "The block mixes kinds of element, so it will be split up.")
+			}
+			for _, kind := range kinds {
+				first := info.Block.first[kind]
+				if kind < last_kind {
+					info.Problems = append(info.Problems, fmt.Sprintf("The block has %ss after %ss, but they must be in the order nodes, ways, relations.", PKIND_NAMES[kind], PKIND_NAMES[last_kind]))
+				} else if kind == last_kind && first.before(last) {
+					info.Problems = append(info.Problems, fmt.Sprintf("The block's %ss start at %d v%d, which is before the last block's %d v%d.", PKIND_NAMES[kind], first.Id, first.Version, last.Id, last.Version))
+				}
+				if n := info.Block.Unordered[kind]; n > 0 {
+					info.Problems = append(info.Problems, fmt.Sprintf("The block has %d %ss which aren't in order of ID and version.", n, PKIND_NAMES[kind]))
+				}
+				if kind >= last_kind {
+					last_kind, last = kind, info.Block.last[kind]
+				}
+			}
+		}
+
+		if err = f(info); err != nil {
+			return err
+		}
+	}
+}
+
+// Print writes a description of the blob, with a line for each group in its
+// block, followed by its problems and warnings.
+func (b *BlobInfo) Print(w io.Writer) {
+	fmt.Fprintf(w, "Blob %d at offset %d: %s", b.Index, b.Offset, b.Type)
+	if b.Stats.Compression != "" {
+		fmt.Fprintf(w, ", %s, %d bytes compressed, %d raw", b.Stats.Compression, b.Stats.CompressedSize, b.Stats.RawSize)
+	}
+	fmt.Fprintf(w, "\n")
+
+	if b.Block != nil {
+		for i, g := range b.Block.Groups {
+			fmt.Fprintf(w, "  Group %d: %d %s\n", i, g.Count, g.Kind)
+		}
+		for _, kind := range b.Block.Kinds() {
+			fmt.Fprintf(w, "  %d %ss, IDs %d to %d\n", b.Block.Counts[kind], PKIND_NAMES[kind], b.Block.MinId[kind], b.Block.MaxId[kind])
+		}
+		fmt.Fprintf(w, "  Granularity %d, lat offset %d, lon offset %d, date granularity %d\n",
+			b.Block.Granularity, b.Block.LatOffset, b.Block.LonOffset, b.Block.DateGranularity)
+	}
+	for _, p := range b.Problems {
+		fmt.Fprintf(w, "  PROBLEM: %s\n", p)
+	}
+	for _, warning := range b.Warnings {
+		fmt.Fprintf(w, "  Warning: %s\n", warning)
+	}
+}
+
+// InspectFile prints the header and every blob of a file, and returns an error
+// if any of them have problems.
+func InspectFile(ctx context.Context, file_name string, w io.Writer) error {
+	file, err := os.Open(file_name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	blobs, problems, warnings := 0, 0, 0
+	err = InspectPBF(ctx, bufio.NewReaderSize(file, 1 << 20), func(b *BlobInfo) error {
+		b.Print(w)
+		if b.Header != nil {
+			printHeader(w, b.Header)
+		}
+		blobs += 1
+		problems += len(b.Problems)
+		warnings += len(b.Warnings)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to inspect %q: %s", file_name, err.Error())
+	}
+
+	fmt.Fprintf(w, "%d blobs, with %d problems and %d warnings.\n", blobs, problems, warnings)
+	if problems > 0 {
+		return fmt.Errorf("Found %d problems in %q.", problems, file_name)
+	}
+	return nil
+}
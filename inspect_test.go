@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspectPBF(t *testing.T) {
+	var buf bytes.Buffer
+	write := func(blob_type string, m interface{ Marshal() ([]byte, error) }) {
+		data, err := m.Marshal()
+		if err == nil {
+			err = writeBlob(&buf, blob_type, data)
+		}
+		if err != nil {
+			t.Fatalf("Unable to write blob: %s", err.Error())
+		}
+	}
+
+	// a mixed block, which the reader can split, then a node block after the
+	// ways and one which goes back in IDs.
+	granularity := int32(1000)
+	write("OSMHeader", NewHeaderBlock(nil, true))
+	write("OSMData", &OSMPBF.PrimitiveBlock{
+		Granularity: &granularity,
+		Primitivegroup: []OSMPBF.PrimitiveGroup{
+			{Dense: OSMPBF.DenseNodes{Id: []int64{5, 1, 1}}},
+			{Ways: []OSMPBF.Way{{Id: 1}, {Id: 3}}},
+		},
+	})
+	write("OSMData", &OSMPBF.PrimitiveBlock{Primitivegroup: []OSMPBF.PrimitiveGroup{{Nodes: []OSMPBF.Node{{Id: 10}}}}})
+	write("OSMData", &OSMPBF.PrimitiveBlock{Primitivegroup: []OSMPBF.PrimitiveGroup{{Ways: []OSMPBF.Way{{Id: 2}}}}})
+	write("Unknown", &OSMPBF.PrimitiveBlock{})
+
+	var blobs []*BlobInfo
+	err := InspectPBF(context.Background(), &buf, func(b *BlobInfo) error {
+		blobs = append(blobs, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to inspect: %s", err.Error())
+	}
+	if len(blobs) != 5 {
+		t.Fatalf("Expected 5 blobs, but got %d.", len(blobs))
+	}
+
+	if blobs[0].Header == nil || blobs[0].Offset != 0 || len(blobs[0].Problems) != 0 {
+		t.Errorf("Unexpected header blob: %+v", blobs[0])
+	}
+
+	b := blobs[1].Block
+	if b == nil || len(b.Groups) != 2 || b.Groups[0] != (GroupInfo{"dense nodes", 3}) || b.Granularity != 1000 || b.DateGranularity != 1000 {
+		t.Fatalf("Unexpected mixed block: %+v", b)
+	}
+	if b.MinId[PKIND_NODE] != 5 || b.MaxId[PKIND_NODE] != 7 || b.MinId[PKIND_WAY] != 1 || b.MaxId[PKIND_WAY] != 3 {
+		t.Errorf("Unexpected ID ranges for the mixed block: %v to %v.", b.MinId, b.MaxId)
+	}
+	if blobs[1].Offset <= 0 || blobs[1].Stats.Compression != "zlib" || len(blobs[1].Warnings) != 1 || len(blobs[1].Problems) != 0 {
+		t.Errorf("Expected a warning about mixed kinds, but got %+v.", blobs[1])
+	}
+
+	if len(blobs[2].Problems) != 1 || !strings.Contains(blobs[2].Problems[0], "nodes after ways") {
+		t.Errorf("Expected nodes after ways to be a problem, but got %q.", blobs[2].Problems)
+	}
+	if len(blobs[3].Problems) != 1 || !strings.Contains(blobs[3].Problems[0], "start at 2") {
+		t.Errorf("Expected way IDs going backwards to be a problem, but got %q.", blobs[3].Problems)
+	}
+	if len(blobs[4].Warnings) != 1 || blobs[4].Block != nil {
+		t.Errorf("Expected a warning about the unknown blob, but got %+v.", blobs[4])
+	}
+}
+
+func TestInspectFile(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	writeTestInput(t, in)
+
+	var out bytes.Buffer
+	if err := InspectFile(context.Background(), in, &out); err != nil {
+		t.Fatalf("Expected no problems, but got %s", err.Error())
+	}
+	if s := out.String(); !strings.Contains(s, "6 nodes, IDs 1 to 3") || !strings.Contains(s, "with 0 problems and 0 warnings") {
+		t.Errorf("Unexpected output: %s", s)
+	}
+}
+
+func TestInspectSplitVersions(t *testing.T) {
+	// more versions of node 1 than fit in a block, so that they're split
+	// across two.
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	header := &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}
+	w, err := NewPBFWriter(in, header)
+	if err != nil {
+		t.Fatalf("Unable to create input file: %s", err.Error())
+	}
+	for v := int32(1); v <= MAX_BLOCK_ENTITIES + 1; v += 1 {
+		if err = w.WriteNode(&Node{Id: 1, Info: Info{Version: v, Visible: true}}); err != nil {
+			t.Fatalf("Unable to write node: %s", err.Error())
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close input file: %s", err.Error())
+	}
+
+	var out bytes.Buffer
+	if err := InspectFile(context.Background(), in, &out); err != nil {
+		t.Errorf("Expected versions split across blocks not to be a problem, but got %s", err.Error())
+	}
+
+	// but the versions still have to be in order, within and between blocks.
+	var buf bytes.Buffer
+	write := func(p *OSMPBF.PrimitiveBlock) {
+		data, err := p.Marshal()
+		if err == nil {
+			err = writeBlob(&buf, "OSMData", data)
+		}
+		if err != nil {
+			t.Fatalf("Unable to write blob: %s", err.Error())
+		}
+	}
+	version := func(v int32) *OSMPBF.Info {
+		return &OSMPBF.Info{Version: v}
+	}
+	write(&OSMPBF.PrimitiveBlock{Primitivegroup: []OSMPBF.PrimitiveGroup{{Ways: []OSMPBF.Way{{Id: 1, Info: version(2)}, {Id: 1, Info: version(3)}}}}})
+	write(&OSMPBF.PrimitiveBlock{Primitivegroup: []OSMPBF.PrimitiveGroup{{Ways: []OSMPBF.Way{{Id: 1, Info: version(4)}, {Id: 1, Info: version(3)}}}}})
+	write(&OSMPBF.PrimitiveBlock{Primitivegroup: []OSMPBF.PrimitiveGroup{{Ways: []OSMPBF.Way{{Id: 1, Info: version(2)}}}}})
+
+	var blobs []*BlobInfo
+	err = InspectPBF(context.Background(), &buf, func(b *BlobInfo) error {
+		// there's no header here, which is a problem of its own.
+		if b.Index == 0 {
+			b.Problems = b.Problems[1:]
+		}
+		blobs = append(blobs, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to inspect: %s", err.Error())
+	}
+	if len(blobs) != 3 || len(blobs[0].Problems) != 0 {
+		t.Fatalf("Expected 3 blobs, the first without problems, but got %+v.", blobs)
+	}
+	if len(blobs[1].Problems) != 1 || !strings.Contains(blobs[1].Problems[0], "1 ways which aren't in order") {
+		t.Errorf("Expected a version going backwards in a block to be a problem, but got %q.", blobs[1].Problems)
+	}
+	if len(blobs[2].Problems) != 1 || !strings.Contains(blobs[2].Problems[0], "start at 1 v2, which is before the last block's 1 v3") {
+		t.Errorf("Expected a version going backwards between blocks to be a problem, but got %q.", blobs[2].Problems)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+)
+
+// lz4DecodeBlock decompresses an LZ4 block (not the framed format) into dst,
+// which must be exactly the size of the uncompressed data, as given by the
+// blob's raw_size.
+//
+// A block is a series of sequences, each of which is a token byte, with the
+// number of literals in the high nibble and the match length (less 4) in the
+// low nibble, then the literals, then a little-endian 2 byte offset back into
+// the output to copy the match from. A nibble of 15 means the length carries on
+// in the following bytes, for as long as they're 255. The last sequence has
+// only literals.
+func lz4DecodeBlock(dst, src []byte) error {
+	di, si := 0, 0
+
+	// length reads the rest of a length which didn't fit into its nibble.
+	length := func(n int) (int, error) {
+		if n < 15 {
+			return n, nil
+		}
+		for {
+			if si >= len(src) {
+				return 0, fmt.Errorf("LZ4 block is truncated.")
+			}
+			b := src[si]
+			si += 1
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+
+	for si < len(src) {
+		token := src[si]
+		si += 1
+
+		literals, err := length(int(token >> 4))
+		if err != nil {
+			return err
+		}
+		if literals > len(src) - si {
+			return fmt.Errorf("LZ4 block is truncated.")
+		}
+		if literals > len(dst) - di {
+			return fmt.Errorf("LZ4 block is larger than the expected %d bytes.", len(dst))
+		}
+		di += copy(dst[di:], src[si:si + literals])
+		si += literals
+
+		if si == len(src) {
+			break
+		}
+
+		if si + 2 > len(src) {
+			return fmt.Errorf("LZ4 block is truncated.")
+		}
+		offset := int(src[si]) | int(src[si+1]) << 8
+		si += 2
+		if offset == 0 || offset > di {
+			return fmt.Errorf("LZ4 block has a bad match offset %d at %d.", offset, di)
+		}
+
+		match, err := length(int(token & 15))
+		if err != nil {
+			return err
+		}
+		match += 4
+		if match > len(dst) - di {
+			return fmt.Errorf("LZ4 block is larger than the expected %d bytes.", len(dst))
+		}
+
+		// the match can overlap the bytes it's writing, which repeats them, so
+		// it has to be copied a byte at a time.
+		for i := 0; i < match; i += 1 {
+			dst[di + i] = dst[di - offset + i]
+		}
+		di += match
+	}
+
+	if di != len(dst) {
+		return fmt.Errorf("LZ4 block is %d bytes, but expected %d.", di, len(dst))
+	}
+
+	return nil
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
-	"flag"
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"github.com/mapzen/neatlacoche/OSMPBF"
 	"log"
 	"os"
-	"runtime"
-	"runtime/pprof"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 // FirstPass over the input file to figure out which grid square each node, way,
@@ -14,72 +20,601 @@ import (
 // details about the item, and used in the second pass to actually create the
 // file. This ensures that the output files are ordered, same as the input file,
 // and means we're not building a huge database.
-func FirstPass(file_name string) (*Sorter, error) {
+//
+// Each item is sorted into a grid of squares covering the given tile, as the
+// options say. If they have a clip region, then only the nodes inside it are
+// sorted into the grid, along with anything needed to complete the ways and
+// relations which use them. Whether the input has deleted versions is taken
+// from its header, rather than the options.
+func FirstPass(ctx context.Context, file_name string, tile Tile, opts SorterOptions, checkpoint CheckpointOptions) (*Sorter, error) {
 	reader, err := NewPBFReader(file_name)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to open %q: %s\n", file_name, err.Error())
 	}
 	defer reader.Close()
 
-	// ReadHeaderBlock does some internal checks so, at this stage,
-	// we don't actually need the information in it.
-	_, err = reader.ReadHeaderBlock()
+	return firstPass(ctx, reader, file_name, tile, opts, checkpoint)
+}
+
+// CheckpointOptions say where and how often the first pass over a tile is
+// checkpointed. The zero value doesn't checkpoint at all.
+type CheckpointOptions struct {
+	// If given, the Sorter's state is saved here every Interval, if that's
+	// non-zero, and the pass is resumed from it if Resume is set.
+	File string
+	Interval time.Duration
+	Resume bool
+}
+
+// firstPass sorts the data from the reader, which might be a stream. It's only
+// read once, and file_name is used to read the same data again if that's needed
+// to complete the ways.
+func firstPass(ctx context.Context, reader *PBFReader, file_name string, tile Tile, opts SorterOptions, checkpoint CheckpointOptions) (*Sorter, error) {
+	// ReadHeaderBlock does some internal checks so, at this stage, all we
+	// need from it is whether there are deleted versions.
+	header, err := reader.ReadHeaderBlock()
 	if err != nil {
 		return nil, fmt.Errorf("Unable to read header block: %s", err.Error())
 	}
 
-	// The Sorter object sorts each item into one of several grid squares - at the
-	// moment hard-coded to the world extent.
-	merc_extent := [2]float64{-20037508.34, 20037508.34}
-	sorter, err := NewSorter(runtime.NumCPU(), merc_extent, merc_extent)
+	// The Sorter object sorts each item into one of several grid squares over
+	// the extent of the tile.
+	if opts.Scheme == nil {
+		opts.Scheme = WEB_MERCATOR
+	}
+	x_range, y_range := opts.Scheme.Extent(tile)
+	opts.Historical = hasFeature(header, "HistoricalInformation")
+	checkpoint_file := checkpoint.File
+	var sorter *Sorter
+	if checkpoint.Resume && checkpoint_file != "" {
+		var offset int64
+		var index int
+		sorter, offset, index, err = LoadCheckpoint(ctx, checkpoint_file, numWorkers(), x_range, y_range, opts)
+		if err == nil {
+			err = reader.SeekBlob(offset, index)
+			if err != nil {
+				sorter.Close()
+				return nil, err
+			}
+			log.Printf("Resuming the first pass of tile %s from blob %d.\n", tile, index)
+
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Unable to resume from checkpoint %q: %s", checkpoint_file, err.Error())
+		}
+	}
+	if sorter == nil {
+		sorter, err = NewSorterWithOptions(ctx, numWorkers(), x_range, y_range, opts)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to construct a Sorter object: %s", err.Error())
+		}
+	}
+
+	last_checkpoint := time.Now()
+	compression := make(map[string]*BlobStats)
+	progress := newProgress(tile, "first pass", reader, sorter.MemoryUsage)
+	err = readBlocks(ctx, reader, func(block BlockOrError) error {
+		err := sorter.Append(block.Primitives)
+		if err != nil {
+			return err
+		}
+		progress.Block(block)
+
+		// only count each blob once, at its last block.
+		if block.Next != 0 {
+			total, ok := compression[block.Stats.Compression]
+			if !ok {
+				total = &BlobStats{Compression: block.Stats.Compression}
+				compression[block.Stats.Compression] = total
+			}
+			total.CompressedSize += block.Stats.CompressedSize
+			total.RawSize += block.Stats.RawSize
+		}
+
+		// checkpoints can only be taken at the end of a blob.
+		if checkpoint_file != "" && checkpoint.Interval > 0 && block.Next != 0 &&
+			time.Since(last_checkpoint) >= checkpoint.Interval {
+			err = SaveCheckpoint(checkpoint_file, sorter, block.Next, block.Index + 1)
+			last_checkpoint = time.Now()
+		}
+		return err
+	})
+	if err == nil {
+		err = sorter.Finish()
+	}
+	if err == nil {
+		progress.Done()
+	}
+	if err == nil && sorter.NeedsWayCompletion() {
+		err = completeWays(ctx, file_name, tile, sorter)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Unable to construct a Sorter object: %s", err.Error())
+		sorter.Close()
+		return nil, err
+	}
+
+	for _, name := range sortedNames(compression) {
+		total := compression[name]
+		log.Printf("Tile %s: %d bytes of %s compressed blobs, %d bytes uncompressed, ratio %.2f.\n", tile, total.CompressedSize, name, total.RawSize, total.Ratio())
+	}
+	if sorter.OutOfRange.Total() > 0 {
+		log.Printf("Tile %s: %s.\n", tile, &sorter.OutOfRange)
+	}
+	if sorter.spill != nil && sorter.spill.Evictions > 0 {
+		log.Printf("Tile %s: %d blocks were spilled to disk to stay within the memory budget, and read back %d times.\n", tile, sorter.spill.Evictions, sorter.spill.Loads)
+	}
+
+	// the first pass is complete, so the checkpoint isn't needed any more.
+	if checkpoint_file != "" {
+		err = os.Remove(checkpoint_file)
+		if err != nil && !os.IsNotExist(err) {
+			sorter.Close()
+			return nil, fmt.Errorf("Unable to remove checkpoint %q: %s", checkpoint_file, err.Error())
+		}
+	}
+
+	return sorter, nil
+}
+
+func sortedNames(m map[string]*BlobStats) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
+
+// readBlocks calls f for each block in the file, in order. It stops at the
+// first error, either from the reader or from f, or when the context is
+// cancelled, and all the reader's goroutines are stopped before it returns.
+// Errors from f are wrapped in a BlobError to say where the block came from.
+func readBlocks(ctx context.Context, reader *PBFReader, f func(BlockOrError) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	blocks := reader.ReadBlocks(ctx)
+
+	// the channel is only closed once the goroutines have stopped, so that the
+	// reader can be used again, or closed, as soon as this returns.
+	defer func() {
+		cancel()
+		for range blocks {
+		}
+	}()
 
-	// Read through the file, keeping any error for the end. It's running a bunch
-	// of goroutines in the reader and the Sorter, and shutting that down properly
-	// and cleanly is a TODO.
-	for block_or_error := range reader.ReadBlocks() {
+	for block_or_error := range blocks {
 		if block_or_error.Err != nil {
-			err = block_or_error.Err
-		} else if err == nil {
-			sorter.Append(block_or_error.Primitives)
+			atomic.AddInt64(&metrics.DecodeErrors, 1)
+			return block_or_error.Err
 		}
+		if block_or_error.Next != 0 {
+			atomic.AddInt64(&metrics.BlobsRead, 1)
+		}
+		err := f(block_or_error)
+		if err != nil {
+			return &BlobError{Offset: block_or_error.Offset, Index: block_or_error.Index, Err: err}
+		}
+	}
+
+	// the reader closes its channel early if the context was cancelled, which
+	// mustn't be mistaken for reaching the end of the file.
+	return ctx.Err()
+}
+
+// completeWays re-reads the input file so that the Sorter can find the nodes of
+// ways which have been put into extra grid squares because of the relations
+// they're in.
+func completeWays(ctx context.Context, file_name string, tile Tile, sorter *Sorter) error {
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		return fmt.Errorf("Unable to open %q: %s\n", file_name, err.Error())
 	}
+	defer reader.Close()
 
+	_, err = reader.ReadHeaderBlock()
+	if err != nil {
+		return fmt.Errorf("Unable to read header block: %s", err.Error())
+	}
+
+	progress := newProgress(tile, "way completion", reader, sorter.MemoryUsage)
+	err = readBlocks(ctx, reader, func(block BlockOrError) error {
+		sorter.CompleteWays(block.Primitives)
+		progress.Block(block)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sorter.FinishWayCompletion()
+	progress.Done()
+
+	return nil
+}
+
+// tileSet is the collection of output files, one per grid square of the parent
+// tile, which are opened lazily as the first element for each square is
+// written.
+type tileSet struct {
+	outDir string
+	parent Tile
+	scheme TilingScheme
+	header *OSMPBF.HeaderBlock
+	writers [GRID_SIZE * GRID_SIZE]*PBFWriter
+
+	// Writer for the nodes which couldn't be projected onto the grid, if the
+	// policy is to keep them separately.
+	polar *PBFWriter
+}
+
+func (t *tileSet) polarWriter() (*PBFWriter, error) {
+	if t.polar == nil {
+		file_name := t.parent.PolarFileName(t.outDir)
+		err := os.MkdirAll(filepath.Dir(file_name), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create directory for polar file %q: %s", file_name, err.Error())
+		}
+		w, err := NewPBFWriter(file_name, t.header)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create polar file %q: %s", file_name, err.Error())
+		}
+		t.polar = w
+	}
+	return t.polar, nil
+}
+
+func (t *tileSet) writer(square int) (*PBFWriter, error) {
+	if t.writers[square] == nil {
+		file_name := t.parent.Child(square).FileName(t.outDir)
+		err := os.MkdirAll(filepath.Dir(file_name), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create directory for tile %q: %s", file_name, err.Error())
+		}
+		header := *t.header
+		header.Bbox = t.scheme.Bounds(t.parent.Child(square)).HeaderBBox()
+		w, err := NewPBFWriter(file_name, &header)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create tile %q: %s", file_name, err.Error())
+		}
+		t.writers[square] = w
+	}
+	return t.writers[square], nil
+}
+
+// each calls f with the writer for every grid square set in the mask, in
+// ascending order.
+func (t *tileSet) each(mask uint64, f func(w *PBFWriter) error) error {
+	for square := 0; square < len(t.writers); square += 1 {
+		if mask & (uint64(1) << uint(square)) != 0 {
+			w, err := t.writer(square)
+			if err != nil {
+				return err
+			}
+			err = f(w)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Tiles returns the child tiles which have had something written to them.
+func (t *tileSet) Tiles() []Tile {
+	var tiles []Tile
+	for square, w := range t.writers {
+		if w != nil {
+			tiles = append(tiles, t.parent.Child(square))
+		}
+	}
+	return tiles
+}
+
+func (t *tileSet) Close() error {
+	var err error
+	for i, w := range t.writers {
+		if w != nil {
+			cerr := w.Close()
+			if err == nil {
+				err = cerr
+			}
+			t.writers[i] = nil
+		}
+	}
+	if t.polar != nil {
+		cerr := t.polar.Close()
+		if err == nil {
+			err = cerr
+		}
+		t.polar = nil
+	}
+	return err
+}
+
+// writeBlock copies each element of the block to every grid square which the
+// Sorter assigned it to.
+func (t *tileSet) writeBlock(p *OSMPBF.PrimitiveBlock, sorter *Sorter, historical bool) error {
+	nodes, ways, rels, err := DecodeBlock(p, historical)
+	if err != nil {
+		return err
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		err = t.each(sorter.Nodes.Lookup(n.Id), func(w *PBFWriter) error { return w.WriteNode(n) })
+		if err != nil {
+			return err
+		}
+
+		if sorter.Polar.Lookup(n.Id) != 0 {
+			w, err := t.polarWriter()
+			if err == nil {
+				err = w.WriteNode(n)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range ways {
+		way := &ways[i]
+		err = t.each(sorter.Ways.Lookup(way.Id), func(w *PBFWriter) error { return w.WriteWay(way) })
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range rels {
+		r := &rels[i]
+		err = t.each(sorter.Relations.Lookup(r.Id), func(w *PBFWriter) error { return w.WriteRelation(r) })
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SecondPass re-reads the input file and writes each element, in the same
+// order as the input, to the output file for every grid square which the
+// FirstPass assigned it to. Each grid square is a child of the tile, and the
+// child tiles which were written are returned.
+func SecondPass(ctx context.Context, file_name string, sorter *Sorter, tile Tile, out_dir string) ([]Tile, error) {
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %q: %s\n", file_name, err.Error())
+	}
+	defer reader.Close()
+
+	header, err := reader.ReadHeaderBlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read header block: %s", err.Error())
+	}
+	historical := hasFeature(header, "HistoricalInformation")
+
+	// each tile's header gets its own bbox, but otherwise they're the same as
+	// the input's, including where to carry on replicating from.
+	out_header := NewHeaderBlock(nil, historical)
+	out_header.OptionalFeatures = header.OptionalFeatures
+	out_header.Source = header.Source
+	out_header.OsmosisReplicationTimestamp = header.OsmosisReplicationTimestamp
+	out_header.OsmosisReplicationSequenceNumber = header.OsmosisReplicationSequenceNumber
+	out_header.OsmosisReplicationBaseUrl = header.OsmosisReplicationBaseUrl
+	tiles := &tileSet{outDir: out_dir, parent: tile, scheme: sorter.scheme, header: out_header}
+
+	progress := newProgress(tile, "second pass", reader, sorter.MemoryUsage)
+	err = readBlocks(ctx, reader, func(block BlockOrError) error {
+		progress.Block(block)
+		return tiles.writeBlock(block.Primitives, sorter, historical)
+	})
+
+	written := tiles.Tiles()
+	cerr := tiles.Close()
+	if err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return nil, err
 	}
+	progress.Done()
 
-	return sorter, nil
+	return written, nil
 }
 
-var cpuprofile = flag.String("cpuprofile", "", "Write CPU profile to this file")
+// SplitOptions are the settings for splitting a tile, which the split command
+// takes from its flags.
+type SplitOptions struct {
+	// How each tile is sorted into its grid squares. The clip region is only
+	// used for the first tile.
+	SorterOptions
 
-// Used to stuff all this into a LevelDB, but that was pretty slow. Might want
-// to try that again later for handling updates, though.
-//var db_file_name = flag.String("db-file", "my.db", "LevelDB database to use")
+	// How often to checkpoint the first pass over each tile, if at all, and
+	// whether to resume from the checkpoints already there.
+	CheckpointInterval time.Duration
+	Resume bool
 
-func main() {
-	flag.Parse()
+	// Keep the tiles at zoom levels above the target, rather than removing
+	// them once they've been split.
+	KeepIntermediate bool
 
-	file_name := flag.Arg(0)
+	// Keep an index of the tiles each element was split into, so that diffs
+	// can be applied later.
+	Updatable bool
+}
+
+// SplitTile splits the file containing the data for a tile into the tiles of
+// its grid squares, and then keeps splitting those until they reach the target
+// zoom level. Each split needs a first and second pass over the data, but the
+// files get smaller as the tiles do.
+//
+// If the file name is "-" then the data is streamed from the standard input,
+// which can only be read once. It's copied to the tile's own file as it's read
+// by the first pass, and the later passes read that copy.
+//
+// If the options have a clip region, then only the data inside it is split out
+// of the tile's file, as in FirstPass. The tiles it's split into only have data
+// from the region, so they don't need clipping.
+//
+// If the options are Updatable, the grid squares of each tile's elements are
+// kept in index files next to it, so that ApplyDiffs can find them again.
+func SplitTile(ctx context.Context, file_name string, tile Tile, zoom int, out_dir string, opts SplitOptions) error {
+	checkpoint := CheckpointOptions{Interval: opts.CheckpointInterval, Resume: opts.Resume}
+	if opts.CheckpointInterval > 0 || opts.Resume {
+		checkpoint.File = tile.CheckpointFileName(out_dir)
+	}
 
-	if *cpuprofile != "" {
-		f, err := os.Create(*cpuprofile)
+	var sorter *Sorter
+	var err error
+	if file_name == "-" {
+		file_name = tile.FileName(out_dir)
+		sorter, err = streamFirstPass(ctx, stdin, file_name, tile, opts.SorterOptions, checkpoint)
+		if !opts.KeepIntermediate {
+			defer os.Remove(file_name)
+		}
+
+	} else {
+		sorter, err = FirstPass(ctx, file_name, tile, opts.SorterOptions, checkpoint)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed during the first pass of tile %s: %s", tile, err.Error())
+	}
+
+	children, err := SecondPass(ctx, file_name, sorter, tile, out_dir)
+	if err == nil && opts.Updatable {
+		err = saveIndexes(sorter, tile, out_dir)
+	}
+	sorter.Close()
+	if err != nil {
+		return fmt.Errorf("Failed during the second pass of tile %s: %s", tile, err.Error())
+	}
+
+	child_opts := opts
+	child_opts.Clip = nil
+	for _, child := range children {
+		if child.Z < zoom {
+			child_file_name := child.FileName(out_dir)
+			err = SplitTile(ctx, child_file_name, child, zoom, out_dir, child_opts)
+			if err != nil {
+				return err
+			}
+
+			if !opts.KeepIntermediate {
+				err = os.Remove(child_file_name)
+				if err != nil {
+					return fmt.Errorf("Unable to remove intermediate tile %q: %s", child_file_name, err.Error())
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// SplitRegion splits the input into tiles at the given zoom, covering only the
+// region. If that's nil, then the bbox in the input's header is used, and if
+// that's missing too then the whole world is tiled. Rather than starting from
+// the whole world, the splitting starts from the smallest tile which covers the
+// region, so that the first passes aren't spent on grid squares which nothing
+// will be sorted into.
+//
+// If the options are Updatable, the state file is written once the splitting is
+// done, which says where the input's replication sequence was up to.
+func SplitRegion(ctx context.Context, file_name string, region *Region, zoom int, out_dir string, opts SplitOptions) error {
+	if opts.Scheme == nil {
+		opts.Scheme = WEB_MERCATOR
+	}
+	var header *OSMPBF.HeaderBlock
+	if region == nil || opts.Updatable {
+		var err error
+		if file_name == "-" {
+			header, err = PeekHeaderBlock(stdin)
+		} else {
+			header, err = readHeaderBlock(file_name)
+		}
 		if err != nil {
-			log.Fatalf("Unable to write to CPU profile %q: %s\n", *cpuprofile, err.Error())
+			return fmt.Errorf("Unable to read header block: %s", err.Error())
 		}
-		defer f.Close()
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
 	}
+	if region == nil {
+		region = RegionFromHeader(header.Bbox)
+	}
+
+	tile := Tile{0, 0, 0}
+	if region != nil {
+		tile = region.Tile(opts.Scheme, zoom)
+		log.Printf("Tiling the region %s, starting from tile %s.\n", region, tile)
+	}
+
+	opts.Clip = region
+	err := SplitTile(ctx, file_name, tile, zoom, out_dir, opts)
+	if err != nil || !opts.Updatable {
+		return err
+	}
+
+	state := &TilingState{
+		SequenceNumber: header.GetOsmosisReplicationSequenceNumber(),
+		Root: tile,
+		Clip: region,
+		Zoom: zoom,
+		Scheme: opts.Scheme,
+		OutOfRange: opts.OutOfRange,
+	}
+	if header.OsmosisReplicationTimestamp != nil {
+		state.Timestamp = time.Unix(header.GetOsmosisReplicationTimestamp(), 0).UTC()
+	}
+	return SaveTilingState(out_dir, state)
+}
 
-	sorter, err := FirstPass(file_name)
+func readHeaderBlock(file_name string) (*OSMPBF.HeaderBlock, error) {
+	reader, err := NewPBFReader(file_name)
 	if err != nil {
-		log.Fatalf("Failed during the first pass: %s\n", err.Error())
+		return nil, err
 	}
-	defer sorter.Close()
+	defer reader.Close()
+
+	return reader.ReadHeaderBlock()
+}
+
+// streamFirstPass runs the first pass over data from a stream, copying it to
+// the file as it goes.
+func streamFirstPass(ctx context.Context, stream io.Reader, file_name string, tile Tile, opts SorterOptions, checkpoint CheckpointOptions) (*Sorter, error) {
+	err := os.MkdirAll(filepath.Dir(file_name), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create directory for %q: %s", file_name, err.Error())
+	}
+	file, err := os.Create(file_name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create %q to copy the input to: %s", file_name, err.Error())
+	}
+
+	reader := NewPBFStreamReader(io.TeeReader(stream, file))
+	sorter, err := firstPass(ctx, reader, file_name, tile, opts, checkpoint)
+	reader.Close()
+
+	cerr := file.Close()
+	if err == nil && cerr != nil {
+		sorter.Close()
+		err = fmt.Errorf("Unable to write copy of the input to %q: %s", file_name, cerr.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sorter, nil
+}
+
+// The standard input, buffered so that its header block can be peeked at
+// before it's read.
+var stdin = bufio.NewReaderSize(os.Stdin, 1 << 20)
+
+func main() {
+	// Stop everything cleanly on the first interrupt, a second one will kill
+	// the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	fmt.Printf("All done.\n")
+	code := runCommand(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
 }
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"github.com/mapzen/neatlacoche/fixture"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readTile decodes all the elements in a PBF file written by the second pass.
+func readTile(t *testing.T, file_name string) (nodes []Node, ways []Way, rels []Relation) {
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		t.Fatalf("Unable to open %q: %s", file_name, err.Error())
+	}
+	defer reader.Close()
+
+	header, err := reader.ReadHeaderBlock()
+	if err != nil {
+		t.Fatalf("Unable to read header of %q: %s", file_name, err.Error())
+	}
+
+	for block_or_error := range reader.ReadBlocks(context.Background()) {
+		if block_or_error.Err != nil {
+			t.Fatalf("Unable to read block from %q: %s", file_name, block_or_error.Err.Error())
+		}
+		n, w, r, err := DecodeBlock(block_or_error.Primitives, hasFeature(header, "HistoricalInformation"))
+		if err != nil {
+			t.Fatalf("Unable to decode block from %q: %s", file_name, err.Error())
+		}
+		nodes = append(nodes, n...)
+		ways = append(ways, w...)
+		rels = append(rels, r...)
+	}
+	return
+}
+
+// writeTestInput writes a small history file with three nodes, in different
+// grid squares, and some ways and relations which use them.
+func writeTestInput(t *testing.T, in string) {
+	header := &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}
+	w, err := NewPBFWriter(in, header)
+	if err != nil {
+		t.Fatalf("Unable to create input file: %s", err.Error())
+	}
+
+	// node 1 is in the south-west, node 2 in the north-east and node 3 just
+	// north-east of (0, 0). each has two versions, the second deleting it.
+	locations := [][2]int64{{-100e9, -40e9}, {100e9, 40e9}, {10e9, 10e9}}
+	for i, loc := range locations {
+		for v := int32(1); v <= 2; v += 1 {
+			n := Node{
+				Id: int64(i + 1),
+				Lon: loc[0],
+				Lat: loc[1],
+				Tags: []Tag{{"name", "foo"}},
+				Info: Info{Version: v, Timestamp: 1000 * int64(v), Changeset: 10 + int64(v), Uid: 1, User: "bob", Visible: v == 1},
+			}
+			if err = w.WriteNode(&n); err != nil {
+				t.Fatalf("Unable to write node: %s", err.Error())
+			}
+		}
+	}
+	w.WriteWay(&Way{Id: 1, Refs: []int64{1, 2}, Info: Info{Version: 1, Visible: true}})
+	w.WriteWay(&Way{Id: 2, Refs: []int64{3}, Info: Info{Version: 1, Visible: true}})
+	w.WriteRelation(&Relation{Id: 1, Members: []Member{{OSMPBF.Relation_WAY, 2, "outer"}}, Info: Info{Version: 1, Visible: true}})
+	w.WriteRelation(&Relation{Id: 2, Members: []Member{{OSMPBF.Relation_NODE, 1, ""}, {OSMPBF.Relation_WAY, 2, ""}}, Info: Info{Version: 1, Visible: true}})
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close input file: %s", err.Error())
+	}
+
+}
+
+func TestSecondPass(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+
+	sorter, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	defer sorter.Close()
+
+	out := filepath.Join(dir, "out")
+	os.Mkdir(out, 0755)
+	tiles, err := SecondPass(context.Background(), in, sorter, Tile{0, 0, 0}, out)
+	if err != nil {
+		t.Fatalf("Second pass failed: %s", err.Error())
+	}
+	if len(tiles) != 3 {
+		t.Errorf("Expected 3 tiles to be written, but got %v.", tiles)
+	}
+
+	// the square containing node 3 should have both its versions, with all
+	// their metadata, and the way which uses it. node 1 is also there, as
+	// relation 2 is.
+	nodes, ways, rels := readTile(t, filepath.Join(out, "2", "2", "1.osm.pbf"))
+	if len(nodes) != 4 {
+		t.Fatalf("Expected 4 node versions in tile 2/2/1, but got %d.", len(nodes))
+	}
+	for i, n := range nodes[2:] {
+		expected := Info{Version: int32(i + 1), Timestamp: 1000 * int64(i + 1), Changeset: 11 + int64(i), Uid: 1, User: "bob", Visible: i == 0}
+		if n.Id != 3 || n.Info != expected || len(n.Tags) != 1 || n.Tags[0] != (Tag{"name", "foo"}) {
+			t.Errorf("Unexpected node in tile 2/2/1: %+v", n)
+		}
+	}
+	if len(ways) != 1 || ways[0].Id != 2 {
+		t.Errorf("Expected way 2 in tile 2/2/1, but got %+v.", ways)
+	}
+	if len(rels) != 2 || rels[0].Id != 1 || len(rels[0].Members) != 1 || rels[0].Members[0].Role != "outer" {
+		t.Errorf("Expected relations 1 & 2 in tile 2/2/1, but got %+v.", rels)
+	}
+
+	// way 1 crosses from node 1's square into node 2's, so both nodes need to
+	// be in both squares. way 2 is in relation 2, which is also in node 1's
+	// square, so way 2 and node 3 need to be there too. relation 1 shouldn't be
+	// there, as none of its members are.
+	nodes, ways, rels = readTile(t, filepath.Join(out, "2", "0", "2.osm.pbf"))
+	ids := []int64{}
+	for _, n := range nodes {
+		ids = append(ids, n.Id)
+	}
+	if len(ids) != 6 || ids[0] != 1 || ids[2] != 2 || ids[4] != 3 {
+		t.Errorf("Expected both versions of nodes 1, 2 & 3 in tile 2/0/2, but got %v.", ids)
+	}
+	if len(ways) != 2 {
+		t.Errorf("Expected ways 1 & 2 in tile 2/0/2, but got %+v.", ways)
+	}
+	if len(rels) != 1 || rels[0].Id != 2 {
+		t.Errorf("Expected only relation 2 in tile 2/0/2, but got %+v.", rels)
+	}
+
+	// squares which nothing was sorted into shouldn't be created at all.
+	if _, err = os.Stat(filepath.Join(out, "2", "3", "0.osm.pbf")); !os.IsNotExist(err) {
+		t.Errorf("Expected no output for empty tile 2/3/0.")
+	}
+}
+
+func TestSplitTile(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+
+	out := filepath.Join(dir, "out")
+	if err := SplitTile(context.Background(), in, Tile{0, 0, 0}, 4, out, SplitOptions{}); err != nil {
+		t.Fatalf("Split failed: %s", err.Error())
+	}
+
+	// node 3 is at (10, 10), which is in tile 4/8/7.
+	nodes, ways, _ := readTile(t, filepath.Join(out, "4", "8", "7.osm.pbf"))
+	if len(nodes) == 0 || nodes[len(nodes)-1].Id != 3 {
+		t.Errorf("Expected node 3 in tile 4/8/7, but got %+v.", nodes)
+	}
+	if len(ways) != 1 || ways[0].Id != 2 {
+		t.Errorf("Expected way 2 in tile 4/8/7, but got %+v.", ways)
+	}
+
+	// the intermediate zoom 2 tiles should have been removed.
+	if _, err := os.Stat(filepath.Join(out, "2")); err != nil {
+		t.Fatalf("Expected zoom 2 directory to exist: %s", err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(out, "2", "2", "1.osm.pbf")); !os.IsNotExist(err) {
+		t.Errorf("Expected intermediate tile 2/2/1 to be removed.")
+	}
+}
+
+func TestPolarFile(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	w, err := NewPBFWriter(in, NewHeaderBlock(nil, true))
+	if err != nil {
+		t.Fatalf("Unable to create input file: %s", err.Error())
+	}
+	w.WriteNode(&Node{Id: 1, Lon: 10e9, Lat: 10e9, Info: Info{Version: 1, Visible: true}})
+	w.WriteNode(&Node{Id: 2, Lon: 10e9, Lat: 89e9, Info: Info{Version: 1, Visible: true}})
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close input file: %s", err.Error())
+	}
+
+	sorter, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{OutOfRange: OUT_OF_RANGE_POLAR}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	defer sorter.Close()
+	if sorter.OutOfRange.Polar != 1 || sorter.OutOfRange.Total() != 1 {
+		t.Errorf("Expected one node in the polar file, but got %s.", &sorter.OutOfRange)
+	}
+
+	out := filepath.Join(dir, "out")
+	if _, err = SecondPass(context.Background(), in, sorter, Tile{0, 0, 0}, out); err != nil {
+		t.Fatalf("Second pass failed: %s", err.Error())
+	}
+	nodes, _, _ := readTile(t, Tile{0, 0, 0}.PolarFileName(out))
+	if len(nodes) != 1 || nodes[0].Id != 2 {
+		t.Errorf("Expected node 2 in the polar file, but got %+v.", nodes)
+	}
+}
+
+func TestSplitRegion(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+
+	// only node 3 is inside the region, which is all in tile 2/2/1.
+	out := filepath.Join(dir, "out")
+	if err := SplitRegion(context.Background(), in, &Region{5, 5, 15, 15}, 4, out, SplitOptions{}); err != nil {
+		t.Fatalf("Split failed: %s", err.Error())
+	}
+
+	nodes, ways, rels := readTile(t, filepath.Join(out, "4", "8", "7.osm.pbf"))
+	if len(nodes) == 0 || nodes[len(nodes)-1].Id != 3 {
+		t.Errorf("Expected node 3 in tile 4/8/7, but got %+v.", nodes)
+	}
+	if len(ways) != 1 || ways[0].Id != 2 {
+		t.Errorf("Expected way 2 in tile 4/8/7, but got %+v.", ways)
+	}
+	if len(rels) != 2 {
+		t.Errorf("Expected relations 1 & 2 in tile 4/8/7, but got %+v.", rels)
+	}
+
+	// nothing should have been split out anywhere else.
+	tiles, err := filepath.Glob(filepath.Join(out, "*", "*", "*.osm.pbf"))
+	if err != nil {
+		t.Fatalf("Unable to list output tiles: %s", err.Error())
+	}
+	if len(tiles) != 1 {
+		t.Errorf("Expected only tile 4/8/7 to be written, but got %v.", tiles)
+	}
+}
+
+// slowSource counts the reads of a blobSource which are in progress, and
+// those which are started once it's been stopped.
+type slowSource struct {
+	blobSource
+	active, late int64
+	stopped int32
+}
+
+func (s *slowSource) enter() {
+	atomic.AddInt64(&s.active, 1)
+	if atomic.LoadInt32(&s.stopped) != 0 {
+		atomic.AddInt64(&s.late, 1)
+	}
+	time.Sleep(time.Millisecond)
+}
+
+func (s *slowSource) next() (OSMPBF.BlobHeader, int64, int64, func() ([]byte, error), error) {
+	s.enter()
+	defer atomic.AddInt64(&s.active, -1)
+	header, blob_offset, next_offset, data, err := s.blobSource.next()
+	if data != nil {
+		inner := data
+		data = func() ([]byte, error) {
+			s.enter()
+			defer atomic.AddInt64(&s.active, -1)
+			return inner()
+		}
+	}
+	return header, blob_offset, next_offset, data, err
+}
+
+func TestReadBlocksStops(t *testing.T) {
+	opts := fixture.DefaultOptions()
+	opts.BlockSize = 1
+	data, err := fixture.Bytes(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	if err = os.WriteFile(in, data, 0644); err != nil {
+		t.Fatalf("Unable to write fixture: %s", err.Error())
+	}
+
+	reader, err := NewPBFReader(in)
+	if err != nil {
+		t.Fatalf("Unable to open %q: %s", in, err.Error())
+	}
+	defer reader.Close()
+	if _, err = reader.ReadHeaderBlock(); err != nil {
+		t.Fatalf("Unable to read header: %s", err.Error())
+	}
+	source := &slowSource{blobSource: reader.blobs}
+	reader.blobs = source
+
+	// nothing is read from the file once readBlocks has returned, so that the
+	// reader can be seeked or closed straight away.
+	stop := errors.New("stop")
+	err = readBlocks(context.Background(), reader, func(block BlockOrError) error {
+		return stop
+	})
+	atomic.StoreInt32(&source.stopped, 1)
+	if !errors.Is(err, stop) {
+		t.Errorf("Expected the error from the first block, but got %v.", err)
+	}
+	if active := atomic.LoadInt64(&source.active); active != 0 {
+		t.Errorf("Expected no reads in progress once stopped, but there were %d.", active)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if late := atomic.LoadInt64(&source.late); late != 0 {
+		t.Errorf("Expected no reads once stopped, but there were %d.", late)
+	}
+}
+
+func TestFirstPassOptions(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+
+	// the settings come from the options, whatever the split command's flags
+	// were left as.
+	*time_aware, *memory_budget, *out_dir = true, 16, dir
+	defer func() { *time_aware, *memory_budget, *out_dir = false, 0, "" }()
+	sorter, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	if sorter.timeAware || sorter.spill != nil || sorter.scheme != WEB_MERCATOR || !sorter.historical {
+		t.Errorf("Expected the default options, with deleted versions from the header, but got time-aware %v, spill %v, scheme %s and historical %v.",
+			sorter.timeAware, sorter.spill != nil, sorter.scheme.Name(), sorter.historical)
+	}
+	sorter.Close()
+
+	sorter, err = FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{Scheme: GEOGRAPHIC, TimeAware: true}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	if !sorter.timeAware || sorter.scheme != GEOGRAPHIC {
+		t.Errorf("Expected a time-aware, geographic Sorter, but got time-aware %v and scheme %s.", sorter.timeAware, sorter.scheme.Name())
+	}
+	sorter.Close()
+}
+
+func TestFirstPassErrors(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := FirstPass(ctx, in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected first pass to be cancelled, but got %v.", err)
+	}
+
+	// chop the end off the last blob, which should be reported with its
+	// position in the file.
+	info, err := os.Stat(in)
+	if err != nil {
+		t.Fatalf("Unable to stat input file: %s", err.Error())
+	}
+	if err = os.Truncate(in, info.Size() - 10); err != nil {
+		t.Fatalf("Unable to truncate input file: %s", err.Error())
+	}
+	_, err = FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	var blob_err *BlobError
+	if !errors.As(err, &blob_err) {
+		t.Fatalf("Expected a BlobError from a truncated file, but got %v.", err)
+	}
+	if blob_err.Index < 1 || blob_err.Offset <= 0 {
+		t.Errorf("Expected the error to be in a data blob, but got index %d at offset %d.", blob_err.Index, blob_err.Offset)
+	}
+}
+
+func TestStreamInput(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+	data, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatalf("Unable to read input file: %s", err.Error())
+	}
+
+	expected, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	defer expected.Close()
+
+	// a bytes.Reader can seek, so hide that to make sure it's not needed.
+	copy_name := filepath.Join(dir, "copy", "in.osm.pbf")
+	stream := struct{ io.Reader }{bytes.NewReader(data)}
+	sorter, err := streamFirstPass(context.Background(), stream, copy_name, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass from a stream failed: %s", err.Error())
+	}
+	defer sorter.Close()
+
+	for id := int64(1); id <= 3; id += 1 {
+		if a, b := sorter.Nodes.Lookup(id), expected.Nodes.Lookup(id); a != b {
+			t.Errorf("Node %d from a stream is in %d, but expected %d.", id, a, b)
+		}
+		if a, b := sorter.Relations.Lookup(id), expected.Relations.Lookup(id); a != b {
+			t.Errorf("Relation %d from a stream is in %d, but expected %d.", id, a, b)
+		}
+	}
+
+	copied, err := os.ReadFile(copy_name)
+	if err != nil {
+		t.Fatalf("Unable to read copy of the stream: %s", err.Error())
+	}
+	if !bytes.Equal(copied, data) {
+		t.Errorf("Expected the copy of the stream to be the same as the input, but it had %d bytes rather than %d.", len(copied), len(data))
+	}
+
+	// streams can skip forward, but not back.
+	file_reader := openTestInput(t, in)
+	var blocks []BlockOrError
+	readBlocks(context.Background(), file_reader, func(block BlockOrError) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	file_reader.Close()
+
+	reader := NewPBFStreamReader(struct{ io.Reader }{bytes.NewReader(data)})
+	if _, err = reader.ReadHeaderBlock(); err != nil {
+		t.Fatalf("Unable to read header from a stream: %s", err.Error())
+	}
+	if err = reader.SeekBlob(blocks[1].Next, blocks[1].Index + 1); err != nil {
+		t.Fatalf("Unable to skip forward in a stream: %s", err.Error())
+	}
+	var ids []int64
+	err = readBlocks(context.Background(), reader, func(block BlockOrError) error {
+		_, _, rels, err := DecodeBlock(block.Primitives, false)
+		for _, r := range rels {
+			ids = append(ids, r.Id)
+		}
+		return err
+	})
+	if err != nil || len(ids) != 2 {
+		t.Errorf("Expected to read relations 1 & 2 after skipping, but got %v, %v.", ids, err)
+	}
+	if err = reader.SeekBlob(blocks[0].Next, blocks[0].Index + 1); err == nil {
+		t.Errorf("Expected an error seeking backwards in a stream.")
+	}
+}
+
+func TestSplitGranularity(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	file, err := os.Create(in)
+	if err != nil {
+		t.Fatalf("Unable to create input file: %s", err.Error())
+	}
+	for i, m := range []interface{ Marshal() ([]byte, error) }{
+		NewHeaderBlock(nil, false),
+		encodeNodes(granularityNodes, 1000, -50e9, 45e9, true),
+	} {
+		data, err := m.Marshal()
+		if err == nil {
+			err = writeBlob(file, []string{"OSMHeader", "OSMData"}[i], data)
+		}
+		if err != nil {
+			t.Fatalf("Unable to write input file: %s", err.Error())
+		}
+	}
+	file.Close()
+
+	out := filepath.Join(dir, "out")
+	if err = SplitTile(context.Background(), in, Tile{0, 0, 0}, 2, out, SplitOptions{}); err != nil {
+		t.Fatalf("Split failed: %s", err.Error())
+	}
+
+	// node 1 is at (-100, -40), which is in tile 2/0/2, and it should come out
+	// with the same location.
+	nodes, _, _ := readTile(t, filepath.Join(out, "2", "0", "2.osm.pbf"))
+	if len(nodes) != 1 || nodes[0].Id != 1 || nodes[0].Lon != -100e9 || nodes[0].Lat != -40e9 {
+		t.Errorf("Expected node 1 at (-100, -40) in tile 2/0/2, but got %+v.", nodes)
+	}
+}
+
+func TestSplitGranularityRoundTrip(t *testing.T) {
+	// a granularity finer than the default, and offsets which aren't a
+	// multiple of it, so that the locations can only be written back exactly
+	// at a finer granularity.
+	opts := fixture.DefaultOptions()
+	opts.Seed = 5
+	opts.Granularity = 7
+	opts.LonOffset = 13
+	opts.LatOffset = -29
+	h := fixture.Generate(opts)
+	data, err := h.Encode(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	if err = os.WriteFile(in, data, 0644); err != nil {
+		t.Fatalf("Unable to write fixture: %s", err.Error())
+	}
+
+	out := filepath.Join(dir, "out")
+	if err = SplitTile(context.Background(), in, Tile{0, 0, 0}, 2, out, SplitOptions{}); err != nil {
+		t.Fatalf("Split failed: %s", err.Error())
+	}
+
+	locations := h.NodeLocations(opts)
+	count := 0
+	for x := 0; x < 4; x += 1 {
+		for y := 0; y < 4; y += 1 {
+			file_name := filepath.Join(out, "2", strconv.Itoa(x), strconv.Itoa(y) + ".osm.pbf")
+			if _, err := os.Stat(file_name); err != nil {
+				continue
+			}
+			nodes, _, _ := readTile(t, file_name)
+			for _, n := range nodes {
+				if !n.Info.Visible {
+					continue
+				}
+				// only the last version of a node can be deleted, so the
+				// visible ones are all there.
+				expected := locations[n.Id][n.Info.Version - 1]
+				if n.Lon != expected[0] || n.Lat != expected[1] {
+					t.Errorf("Node %d v%d in tile 2/%d/%d is at (%d, %d), but expected (%d, %d).", n.Id, n.Info.Version, x, y, n.Lon, n.Lat, expected[0], expected[1])
+				}
+				count += 1
+			}
+		}
+	}
+	if count == 0 {
+		t.Errorf("Expected some nodes in the tiles, but found none.")
+	}
+}
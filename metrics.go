@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// Metrics counts what the splitter is doing, so that long runs can be watched
+// from dashboards. The counters are only ever added to, with sync/atomic, by
+// whichever goroutine does the work, and are served in the Prometheus text
+// format by -metrics-listen.
+type Metrics struct {
+	// Blobs read by readBlocks, in every pass, and the ones which couldn't be
+	// read or decoded.
+	BlobsRead int64
+	DecodeErrors int64
+
+	// Elements appended to a Sorter, indexed by PKIND_*.
+	Elements [3]int64
+
+	// Out of range nodes, by what was done with them.
+	Clamped, Polar, Rejected int64
+
+	// Refs of way versions which needed extra grid squares for the way to be
+	// complete.
+	ExtraNodes int64
+
+	// Workers offering themselves on a Sorter's workQueue, waiting for a
+	// block.
+	IdleWorkers int64
+}
+
+var metrics Metrics
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	write := func(name, kind, help string, values ...interface{}) error {
+		n, err := fmt.Fprintf(w, "# HELP neatlacoche_%s %s\n# TYPE neatlacoche_%s %s\n", name, help, name, kind)
+		total += int64(n)
+		for i := 0; err == nil && i < len(values); i += 2 {
+			n, err = fmt.Fprintf(w, "neatlacoche_%s%s %v\n", name, values[i], values[i + 1])
+			total += int64(n)
+		}
+		return err
+	}
+	load := atomic.LoadInt64
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	for _, err := range []error{
+		write("blobs_read_total", "counter", "Blobs read from the input, in every pass.",
+			"", load(&m.BlobsRead)),
+		write("decode_errors_total", "counter", "Blobs which couldn't be read or decoded.",
+			"", load(&m.DecodeErrors)),
+		write("elements_total", "counter", "Elements sorted into grid squares, counting every version.",
+			`{kind="node"}`, load(&m.Elements[PKIND_NODE]),
+			`{kind="way"}`, load(&m.Elements[PKIND_WAY]),
+			`{kind="relation"}`, load(&m.Elements[PKIND_REL])),
+		write("out_of_range_nodes_total", "counter", "Node versions which couldn't be projected onto the grid, by what was done with them.",
+			`{action="clamp"}`, load(&m.Clamped),
+			`{action="polar"}`, load(&m.Polar),
+			`{action="reject"}`, load(&m.Rejected)),
+		write("extra_nodes_total", "counter", "Way nodes which needed extra grid squares for the way to be complete, counted for each version of the way.",
+			"", load(&m.ExtraNodes)),
+		write("work_queue_idle_workers", "gauge", "Workers waiting on the Sorter's work queue for a block.",
+			"", load(&m.IdleWorkers)),
+		write("heap_bytes", "gauge", "Bytes of allocated heap objects.",
+			"", mem.HeapAlloc),
+	} {
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// serveMetrics starts serving the metrics on /metrics at the address, and
+// returns a function to stop it. The listener is opened before it returns, so
+// that a bad address is an error straight away.
+func serveMetrics(addr string) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for metrics on %q: %s", addr, err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	return func() { srv.Close() }, nil
+}
+
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteTo(w)
+	})
+}
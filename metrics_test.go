@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mapzen/neatlacoche/fixture"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	// some of the nodes are too near the poles to be projected.
+	opts := fixture.DefaultOptions()
+	opts.Region = [4]float64{-179, -89, 179, 89}
+	h := fixture.Generate(opts)
+	data, err := h.Encode(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	if err = os.WriteFile(in, data, 0644); err != nil {
+		t.Fatalf("Unable to write fixture: %s", err.Error())
+	}
+	rejected := int64(0)
+	for _, n := range h.Nodes {
+		if n.Info.Visible && math.Abs(n.Lat) > 85.0511 {
+			rejected += 1
+		}
+	}
+	if rejected == 0 {
+		t.Fatalf("Expected some nodes near the poles.")
+	}
+
+	before := metrics.snapshot()
+	sorter, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	sorter.Close()
+	after := metrics.snapshot()
+
+	if n := after.Elements[PKIND_NODE] - before.Elements[PKIND_NODE]; n != int64(len(h.Nodes)) {
+		t.Errorf("Expected %d nodes to be counted, but got %d.", len(h.Nodes), n)
+	}
+	if n := after.Elements[PKIND_REL] - before.Elements[PKIND_REL]; n != int64(len(h.Relations)) {
+		t.Errorf("Expected %d relations to be counted, but got %d.", len(h.Relations), n)
+	}
+	if n := after.Rejected - before.Rejected; n != rejected {
+		t.Errorf("Expected %d rejected nodes, but got %d.", rejected, n)
+	}
+	if after.BlobsRead <= before.BlobsRead || after.ExtraNodes <= before.ExtraNodes {
+		t.Errorf("Expected blobs and extra nodes to be counted, but got %+v then %+v.", before, after)
+	}
+	if after.IdleWorkers != 0 {
+		t.Errorf("Expected no idle workers once the Sorter is closed, but got %d.", after.IdleWorkers)
+	}
+
+	server := httptest.NewServer(metricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to get metrics: %s", err.Error())
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Unable to read metrics: %s", err.Error())
+	}
+	for _, line := range []string{
+		"# TYPE neatlacoche_blobs_read_total counter\n",
+		fmt.Sprintf("neatlacoche_out_of_range_nodes_total{action=\"reject\"} %d\n", after.Rejected),
+		"# TYPE neatlacoche_heap_bytes gauge\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Expected metrics to contain %q, but got:\n%s", line, body)
+		}
+	}
+}
+
+// snapshot returns a copy of the metrics.
+func (m *Metrics) snapshot() Metrics {
+	var s Metrics
+	for _, c := range []struct{ dst, src *int64 }{
+		{&s.BlobsRead, &m.BlobsRead},
+		{&s.DecodeErrors, &m.DecodeErrors},
+		{&s.Elements[0], &m.Elements[0]},
+		{&s.Elements[1], &m.Elements[1]},
+		{&s.Elements[2], &m.Elements[2]},
+		{&s.Clamped, &m.Clamped},
+		{&s.Polar, &m.Polar},
+		{&s.Rejected, &m.Rejected},
+		{&s.ExtraNodes, &m.ExtraNodes},
+		{&s.IdleWorkers, &m.IdleWorkers},
+	} {
+		*c.dst = atomic.LoadInt64(c.src)
+	}
+	return s
+}
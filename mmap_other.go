@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// mmapFile reads the whole file onto the heap, on platforms which don't have
+// mmap.
+func mmapFile(file_name string) ([]byte, error) {
+	return os.ReadFile(file_name)
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -20,46 +20,82 @@ import (
 //   3. We don't care about the version, only the ID. This means we can collapse
 //      several contiguous records together.
 //
-//   4. We are outputting to a small number (BLOCK_VAL_BITS) of output grid
-//      squares, so we can compress that down - see Block for more info about
-//      that.
+//   4. We are outputting to a small number (ValBits of the encoding) of output
+//      grid squares, so we can compress that down - see Block for more info
+//      about that.
 //
 type MultiBlock struct {
-	// Map the top (64 - BLOCK_IDX_BITS) bits of the ID to the block containing
+	// Map the top (64 - IdxBits) bits of the ID to the block containing
 	// them. Because of reason (2), we expect that there will be relatively few
 	// of these, and therefore the map structure will be small relative to the
 	// Blocks pointed to. Blocks in this map are "frozen" and cannot be changed.
-	Blocks map[int64]*Block
+	Blocks map[int64]Block
 
 	// Because of reasons (1) and (3), we accumulate data into a pre-allocated
 	// "current" block, which is the only mutable block. This one grows with the
 	// appended data until an ID is seen which is not in this block. At that
 	// point we know that the block is complete and it is added to the Blocks
 	// map.
-	Current *Block
+	Current Block
 
 	// Last ID and value (OR-ed collection of grid squares) seen. This is used
 	// mainly to collapse down versions of the same ID efficiently.
 	LastId int64
-	LastVal uint32
+	LastVal uint64
+
+	// How the Blocks are packed, which must be the same for all of them.
+	Encoding *BlockEncoding
+
+	// If set, the frozen Blocks are kept within the Spill's memory budget, and
+	// might be on disk rather than in memory.
+	Spill *BlockSpill
+
+	// Set if the frozen Blocks are in memory which the MultiBlock doesn't own,
+	// such as a file mapped by OpenMappedMultiBlock, so that Merge copies them
+	// rather than taking them.
+	mapped bool
 }
 
+// NewMultiBlock returns an empty MultiBlock in the default encoding.
 func NewMultiBlock() *MultiBlock {
+	return NewMultiBlockWithEncoding(DEFAULT_ENCODING)
+}
+
+// NewMultiBlockWithEncoding returns an empty MultiBlock, using the given
+// encoding for its Blocks.
+func NewMultiBlockWithEncoding(enc *BlockEncoding) *MultiBlock {
 	return &MultiBlock{
-		Blocks: make(map[int64]*Block),
-		Current: NewAccumulationBlock(),
+		Blocks: make(map[int64]Block),
+		Current: enc.NewAccumulationBlock(),
 		LastId: 0,
 		LastVal: 0,
+		Encoding: enc,
 	}
 }
 
+// NewMultiBlockFromMap builds a MultiBlock from an unordered map of IDs to grid
+// square bitfields, sorting the IDs first so that they can be appended.
+func NewMultiBlockFromMap(vals map[int64]uint64) *MultiBlock {
+	ids := make([]int64, 0, len(vals))
+	for id, _ := range vals {
+		ids = append(ids, id)
+	}
+	sort.Sort(int64slice(ids))
+
+	m := NewMultiBlock()
+	for _, id := range ids {
+		m.Append(id, vals[id])
+	}
+	return m
+}
+
 // Append an (ID, grid square) to the data structure.
-func (m *MultiBlock) Append(id int64, val uint32) {
+func (m *MultiBlock) Append(id int64, val uint64) {
 	if id < m.LastId {
 		panic(fmt.Sprintf("ID %d < last ID %d, but IDs must be in order!", id, m.LastId))
 	}
-	if val > BLOCK_VAL_MASK {
-		panic(fmt.Sprintf("Can't append a value of %d, max is %d.", val, BLOCK_VAL_MASK))
+	if val > m.Encoding.ValMask {
+		panic(fmt.Sprintf("Can't append a value of %d, max is %d.", val, m.Encoding.ValMask))
 	}
 
 	// Reason (3) - just collapse all the items with the same ID down into a
@@ -70,16 +106,16 @@ func (m *MultiBlock) Append(id int64, val uint32) {
 	} else {
 		// The ID is different (must be greater - see previous checks on id), so we
 		// first need to flush the data in the Last* variables to the Current block.
-		m.Current.Append(uint32(m.LastId & BLOCK_IDX_MASK), m.LastVal)
+		m.Current.Append(uint32(m.LastId) & m.Encoding.IdxMask, m.LastVal)
 
 		// Then we check if the Current block needs to be pushed back onto the
 		// Blocks map.
-		upper := int64(id >> BLOCK_IDX_BITS)
-		lastUpper := int64(m.LastId >> BLOCK_IDX_BITS)
+		upper := id >> m.Encoding.IdxBits
+		lastUpper := m.LastId >> m.Encoding.IdxBits
 		if upper != lastUpper {
 			block := m.Current.Copy()
 			m.Current.Reset()
-			m.Blocks[lastUpper] = block
+			m.freeze(lastUpper, block)
 		}
 
 		// Finally, assign the Last* variables to the new values.
@@ -88,6 +124,15 @@ func (m *MultiBlock) Append(id int64, val uint32) {
 	}
 }
 
+// freeze puts a frozen Block into the Blocks map, and gives it to the Spill to
+// keep track of if there is one.
+func (m *MultiBlock) freeze(upper int64, block Block) {
+	if m.Spill != nil {
+		block = m.Spill.add(block)
+	}
+	m.Blocks[upper] = block
+}
+
 // Use the maximum int64 value as a marker that the multi-block is currently
 // 'pushed', and can't be appended to. The 'pushed' status should be
 // temporary, but using the max value ensures that other operations won't
@@ -99,10 +144,10 @@ const maxLastId = int64((^uint64(0)) >> 1)
 // more uniform and easier to perform some operations on.
 func (m *MultiBlock) pushCurrent() {
 	// push LastId/LastVal into the end of the current block
-	m.Current.Append(uint32(m.LastId & BLOCK_IDX_MASK), m.LastVal)
+	m.Current.Append(uint32(m.LastId) & m.Encoding.IdxMask, m.LastVal)
 
 	// push the Current block onto the Blocks map
-	lastUpper := int64(m.LastId >> BLOCK_IDX_BITS)
+	lastUpper := m.LastId >> m.Encoding.IdxBits
 	block := m.Current.Copy()
 	m.Current.Reset()
 	m.Blocks[lastUpper] = block
@@ -148,9 +193,9 @@ func (m *MultiBlock) unPushCurrent() {
 		lastKey := blockKeys[len(blockKeys)-1]
 		lastBlock := m.Blocks[lastKey]
 		delete(m.Blocks, lastKey)
-		m.Current.CopyFrom(lastBlock)
+		m.Current.CopyFrom(unspill(lastBlock))
 		lastIdx, lastVal := m.Current.UnAppend()
-		m.LastId = (lastKey << BLOCK_IDX_BITS) | int64(lastIdx)
+		m.LastId = (lastKey << m.Encoding.IdxBits) | int64(lastIdx)
 		m.LastVal = lastVal
 
 	} else {
@@ -161,14 +206,14 @@ func (m *MultiBlock) unPushCurrent() {
 
 // Lookup a value in the data structure, returning the grid square bitfield
 // value, or zero if the ID cannot be found.
-func (m *MultiBlock) Lookup(id int64) uint32 {
+func (m *MultiBlock) Lookup(id int64) uint64 {
 	if id == m.LastId {
 		return m.LastVal
 	}
 
-	upper := id >> BLOCK_IDX_BITS
-	lastUpper := int64(m.LastId >> BLOCK_IDX_BITS)
-	blockIdx := uint32(id & BLOCK_IDX_MASK)
+	upper := id >> m.Encoding.IdxBits
+	lastUpper := m.LastId >> m.Encoding.IdxBits
+	blockIdx := uint32(id) & m.Encoding.IdxMask
 
 	if upper == lastUpper {
 		return m.Current.Lookup(blockIdx)
@@ -180,11 +225,36 @@ func (m *MultiBlock) Lookup(id int64) uint32 {
 	return 0
 }
 
+// Each calls f for every ID with a non-zero value, in ascending ID order.
+func (m *MultiBlock) Each(f func(id int64, val uint64)) {
+	each := func(upper int64, block Block) {
+		for itr := block.Iterator(); itr.Valid(); itr = itr.Next() {
+			if val := itr.Value(); val != 0 {
+				f((upper << m.Encoding.IdxBits) | int64(itr.Index()), val)
+			}
+		}
+	}
+
+	// the frozen blocks all come before the Current one, which doesn't include
+	// LastId until another ID is appended.
+	for _, upper := range m.sortedBlockKeys() {
+		each(upper, m.Blocks[upper])
+	}
+	each(m.LastId >> m.Encoding.IdxBits, m.Current)
+	if m.LastVal != 0 {
+		f(m.LastId, m.LastVal)
+	}
+}
+
 // Merge the mb2 data structure into the receiver (mb). This can be done
 // efficiently, as both are in sorted order. Note that this operation will
 // destroy mb2.
 func (mb *MultiBlock) Merge(mb2 *MultiBlock) {
-	new_block := NewAccumulationBlock()
+	if mb.Encoding != mb2.Encoding {
+		panic(fmt.Sprintf("Unable to merge a %s MultiBlock into a %s MultiBlock.", mb2.Encoding.Name, mb.Encoding.Name))
+	}
+
+	new_block := mb.Encoding.NewAccumulationBlock()
 	mb.pushCurrent()
 	mb2.pushCurrent()
 
@@ -192,11 +262,17 @@ func (mb *MultiBlock) Merge(mb2 *MultiBlock) {
 		if block, ok := mb.Blocks[upper]; ok {
 			// existing block, merge the two blocks
 			new_block.ResetAndMergeFrom(block, block2)
-			mb.Blocks[upper] = new_block.Copy()
+			unspill(block)
+			unspill(block2)
+			mb.freeze(upper, new_block.Copy())
 
 		} else {
-			// no existing block, can just take the other
-			mb.Blocks[upper] = block2
+			// no existing block, can just take the other, unless it's mapped
+			// and so will go away when mb2 is closed.
+			if mb2.mapped {
+				block2 = block2.Copy()
+			}
+			mb.freeze(upper, block2)
 		}
 	}
 
@@ -204,8 +280,17 @@ func (mb *MultiBlock) Merge(mb2 *MultiBlock) {
 
 	// blank the merged multi-block, since we might have taken some of its
 	// internal structures.
-	mb2.Blocks = map[int64]*Block{}
-	mb2.Current = NewEmptyBlock()
+	mb2.Blocks = map[int64]Block{}
+	mb2.Current = mb2.Encoding.NewEmptyBlock()
 	mb2.LastId = 0
 	mb2.LastVal = 0
 }
+
+// MemoryUsage returns the approximate number of bytes used by the Blocks.
+func (m *MultiBlock) MemoryUsage() int {
+	total := m.Current.MemoryUsage()
+	for _, block := range m.Blocks {
+		total += block.MemoryUsage()
+	}
+	return total
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unsafe"
+)
+
+// The on-disk format for a MultiBlock stores each frozen Block in its native
+// encoding, so that it can either be read back onto the heap or mapped straight
+// into memory and used in place. Everything is little-endian and aligned to 8
+// bytes:
+//
+//   header: magic (8 bytes), version, IdxBits, ValBits, flags (uint32 each),
+//           number of blocks (uint64).
+//   index:  one entry per block, in ascending key order; key (int64), length
+//           as in Block.Len (uint32), number of words (uint32), offset of the
+//           words from the start of the file (uint64).
+//   data:   the words of each block; uint32 for packed encodings and uint64
+//           for wide ones, padded out to 8 bytes.
+//   footer: CRC32 of everything before it (uint32), and 4 bytes of padding.
+//
+const (
+	MULTI_BLOCK_MAGIC = "NLCMBLK\x00"
+	MULTI_BLOCK_VERSION = 1
+
+	multiBlockHeaderSize = 32
+	multiBlockIndexEntrySize = 24
+	multiBlockFooterSize = 8
+
+	multiBlockFlagWide = 1
+)
+
+// The blocks of a file can only be used in place if the file's byte order is
+// the same as the machine's.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// blockWords returns the words of a frozen Block which need to be stored, in
+// whichever of the two slices matches its encoding.
+func blockWords(block Block) (packed []uint32, wide []uint64) {
+	switch b := block.(type) {
+	case *PackedBlock:
+		if b.arrayMode() {
+			return b.Values[:b.enc.fullLength], nil
+		}
+		return b.Values[:b.length], nil
+	case *WideBlock:
+		return nil, b.Values
+	case *spilledBlock:
+		return blockWords(b.spill.get(b))
+	}
+	panic(fmt.Sprintf("Unknown Block type %T.", block))
+}
+
+func align8(n int64) int64 {
+	return (n + 7) &^ 7
+}
+
+// WriteTo writes the MultiBlock to w in the on-disk format, returning the
+// number of bytes written.
+func (m *MultiBlock) WriteTo(w io.Writer) (int64, error) {
+	// pushing the Current block means all the data is in frozen Blocks, which
+	// is restored afterwards so that the MultiBlock can carry on being used.
+	m.pushCurrent()
+	defer m.unPushCurrent()
+	keys := m.sortedBlockKeys()
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	var n int64
+	buf := make([]byte, 0, 4096)
+
+	// flush writes out the buffer when it's full, or when forced.
+	var err error
+	flush := func(force bool) {
+		if err == nil && (force || len(buf) > cap(buf) - 8) {
+			var k int
+			k, err = bw.Write(buf)
+			n += int64(k)
+			buf = buf[:0]
+		}
+	}
+	put32 := func(v uint32) {
+		buf = binary.LittleEndian.AppendUint32(buf, v)
+		flush(false)
+	}
+	put64 := func(v uint64) {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+		flush(false)
+	}
+
+	var flags uint32
+	if m.Encoding.Wide {
+		flags |= multiBlockFlagWide
+	}
+	buf = append(buf, MULTI_BLOCK_MAGIC...)
+	put32(MULTI_BLOCK_VERSION)
+	put32(uint32(m.Encoding.IdxBits))
+	put32(uint32(m.Encoding.ValBits))
+	put32(flags)
+	put64(uint64(len(keys)))
+
+	offset := int64(multiBlockHeaderSize + multiBlockIndexEntrySize * len(keys))
+	for _, key := range keys {
+		block := m.Blocks[key]
+		packed, wide := blockWords(block)
+		words, size := len(packed), int64(4 * len(packed))
+		if m.Encoding.Wide {
+			words, size = len(wide), int64(8 * len(wide))
+		}
+		put64(uint64(key))
+		put32(block.Len())
+		put32(uint32(words))
+		put64(uint64(offset))
+		offset = align8(offset + size)
+	}
+
+	for _, key := range keys {
+		packed, wide := blockWords(m.Blocks[key])
+		for _, v := range packed {
+			put32(v)
+		}
+		if len(packed) % 2 == 1 {
+			put32(0)
+		}
+		for _, v := range wide {
+			put64(v)
+		}
+	}
+
+	flush(true)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		var footer [multiBlockFooterSize]byte
+		binary.LittleEndian.PutUint32(footer[:], crc.Sum32())
+		var k int
+		k, err = w.Write(footer[:])
+		n += int64(k)
+	}
+	if err != nil {
+		return n, fmt.Errorf("Unable to write MultiBlock: %s", err.Error())
+	}
+
+	return n, nil
+}
+
+// ReadFrom replaces the contents of the MultiBlock with data in the on-disk
+// format read from r, returning the number of bytes read. The data is copied
+// onto the heap, and the MultiBlock can be appended to afterwards.
+func (m *MultiBlock) ReadFrom(r io.Reader) (int64, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(r)
+	if err != nil {
+		return n, fmt.Errorf("Unable to read MultiBlock: %s", err.Error())
+	}
+
+	mb, err := decodeMultiBlock(buf.Bytes(), false, true)
+	if err != nil {
+		return n, err
+	}
+	*m = *mb
+
+	return n, nil
+}
+
+// encodingFor returns the encoding with the given parameters, which is one of
+// the standard ones if possible so that MultiBlocks can be merged with it.
+func encodingFor(idxBits, valBits uint, wide bool) (*BlockEncoding, error) {
+	for _, e := range []*BlockEncoding{ENCODING_16_16, ENCODING_28_4, ENCODING_28_36} {
+		if e.IdxBits == idxBits && e.ValBits == valBits && e.Wide == wide {
+			return e, nil
+		}
+	}
+
+	word := uint(32)
+	if wide {
+		word = 64
+	}
+	if idxBits < 1 || valBits < 1 || idxBits > 31 || idxBits + valBits > word {
+		return nil, fmt.Errorf("Unsupported %d/%d block encoding.", idxBits, valBits)
+	}
+	return newBlockEncoding(fmt.Sprintf("%d/%d", idxBits, valBits), idxBits, valBits, wide), nil
+}
+
+// checkMultiBlockSum checks data in the on-disk format against the checksum in
+// its footer, which means reading all of it.
+func checkMultiBlockSum(data []byte) error {
+	body := data[:len(data) - multiBlockFooterSize]
+	if expected, actual := binary.LittleEndian.Uint32(data[len(body):]), crc32.ChecksumIEEE(body); expected != actual {
+		return fmt.Errorf("MultiBlock checksum mismatch, expected %08x but got %08x.", expected, actual)
+	}
+	return nil
+}
+
+// decodeMultiBlock checks and unpacks data in the on-disk format. If alias is
+// true, then the Blocks use the data in place, and it must be kept unchanged
+// for as long as the MultiBlock is in use. The checksum is only checked if
+// verify is true, but the header and index are always checked, so that the
+// Blocks are never outside the data.
+func decodeMultiBlock(data []byte, alias, verify bool) (*MultiBlock, error) {
+	if len(data) < multiBlockHeaderSize + multiBlockFooterSize || string(data[:8]) != MULTI_BLOCK_MAGIC {
+		return nil, fmt.Errorf("Not a MultiBlock file.")
+	}
+	le := binary.LittleEndian
+
+	body := data[:len(data) - multiBlockFooterSize]
+	if verify {
+		if err := checkMultiBlockSum(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if version := le.Uint32(data[8:]); version != MULTI_BLOCK_VERSION {
+		return nil, fmt.Errorf("MultiBlock version %d is not supported, expected version %d.", version, MULTI_BLOCK_VERSION)
+	}
+	enc, err := encodingFor(uint(le.Uint32(data[12:])), uint(le.Uint32(data[16:])), le.Uint32(data[20:]) & multiBlockFlagWide != 0)
+	if err != nil {
+		return nil, err
+	}
+	num_blocks := le.Uint64(data[24:])
+	if num_blocks > uint64(len(body) - multiBlockHeaderSize) / multiBlockIndexEntrySize {
+		return nil, fmt.Errorf("MultiBlock has %d blocks, which is more than can fit in the file.", num_blocks)
+	}
+
+	m := &MultiBlock{Blocks: make(map[int64]Block, num_blocks), Current: enc.NewAccumulationBlock(), Encoding: enc}
+	var last_key int64
+	for i := 0; i < int(num_blocks); i += 1 {
+		entry := data[multiBlockHeaderSize + i * multiBlockIndexEntrySize:]
+		key := int64(le.Uint64(entry))
+		length := le.Uint32(entry[8:])
+		words := int64(le.Uint32(entry[12:]))
+		offset := le.Uint64(entry[16:])
+
+		if i > 0 && key <= last_key {
+			return nil, fmt.Errorf("MultiBlock keys are out of order, %d follows %d.", key, last_key)
+		}
+		last_key = key
+
+		size := int64(4)
+		if enc.Wide {
+			size = 8
+		}
+		if offset % 8 != 0 || offset > uint64(len(body)) || words * size > int64(len(body)) - int64(offset) {
+			return nil, fmt.Errorf("MultiBlock block %d has %d words at offset %d, which is outside the file.", key, words, offset)
+		}
+		raw := body[offset:offset + uint64(words * size)]
+
+		if enc.Wide {
+			if int64(length) != words {
+				return nil, fmt.Errorf("MultiBlock block %d has length %d, but %d words.", key, length, words)
+			}
+			m.Blocks[key] = &WideBlock{frozen: true, enc: enc, Values: decodeWords64(raw, alias)}
+
+		} else {
+			array_mode := length > enc.fullLength
+			if (array_mode && (uint64(length) != uint64(1) << enc.IdxBits || words != int64(enc.fullLength))) ||
+				(!array_mode && int64(length) != words) {
+				return nil, fmt.Errorf("MultiBlock block %d has length %d, but %d words.", key, length, words)
+			}
+			m.Blocks[key] = &PackedBlock{frozen: true, enc: enc, length: length, Values: decodeWords32(raw, alias)}
+		}
+	}
+
+	// the last block holds the last ID, which goes back into the Current block
+	// so that Lookup and Append work the same as before it was written.
+	m.unPushCurrent()
+
+	return m, nil
+}
+
+func decodeWords32(raw []byte, alias bool) []uint32 {
+	n := len(raw) / 4
+	if n == 0 {
+		return nil
+	}
+	if alias && littleEndian {
+		return unsafe.Slice((*uint32)(unsafe.Pointer(&raw[0])), n)
+	}
+	words := make([]uint32, n)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(raw[4*i:])
+	}
+	return words
+}
+
+func decodeWords64(raw []byte, alias bool) []uint64 {
+	n := len(raw) / 8
+	if n == 0 {
+		return nil
+	}
+	if alias && littleEndian {
+		return unsafe.Slice((*uint64)(unsafe.Pointer(&raw[0])), n)
+	}
+	words := make([]uint64, n)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(raw[8*i:])
+	}
+	return words
+}
+
+// MappedMultiBlock is a MultiBlock loaded from a file written by WriteTo, with
+// its Blocks used directly from a read-only memory map of the file rather than
+// copied onto the heap. Only the last Block is copied, so that it can be used
+// as the Current block; Lookup and Append work as usual. The mapped Blocks are
+// never changed: merging into a MappedMultiBlock makes new Blocks for any which
+// are merged, and merging one into another MultiBlock copies its Blocks. It
+// must be closed once it's no longer needed, after which the MultiBlock can't
+// be used, although any MultiBlock it was merged into still can.
+type MappedMultiBlock struct {
+	*MultiBlock
+	data []byte
+}
+
+// OpenMappedMultiBlock maps a MultiBlock file into memory. On platforms
+// without mmap, the file is read onto the heap instead.
+//
+// The checksum covers the whole file, so checking it would read in every page
+// before the first Lookup. It's left to Verify instead, and only the header
+// and index are checked here.
+func OpenMappedMultiBlock(file_name string) (*MappedMultiBlock, error) {
+	data, err := mmapFile(file_name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to map MultiBlock %q: %s", file_name, err.Error())
+	}
+
+	mb, err := decodeMultiBlock(data, true, false)
+	if err != nil {
+		munmapFile(data)
+		return nil, err
+	}
+
+	mb.mapped = true
+	return &MappedMultiBlock{MultiBlock: mb, data: data}, nil
+}
+
+// Verify checks the whole file against its checksum, reading all of it.
+func (m *MappedMultiBlock) Verify() error {
+	if m.data == nil {
+		return fmt.Errorf("Unable to verify a closed MultiBlock.")
+	}
+	return checkMultiBlockSum(m.data)
+}
+
+func (m *MappedMultiBlock) Close() error {
+	m.MultiBlock = nil
+	data := m.data
+	m.data = nil
+	if data == nil {
+		return nil
+	}
+	return munmapFile(data)
+}
@@ -1,16 +1,23 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestMultiBlock(t *testing.T) {
 	mb := NewMultiBlock()
 
 	for i := 0; i < 100 * BLOCK_FULL_LENGTH; i += 10 {
-		mb.Append(int64(i), uint32(i & BLOCK_VAL_MASK))
-		mb.Append(int64(i), uint32((i + 1) & BLOCK_VAL_MASK))
+		mb.Append(int64(i), uint64(i & BLOCK_VAL_MASK))
+		mb.Append(int64(i), uint64((i + 1) & BLOCK_VAL_MASK))
 
 		val := mb.Lookup(int64(i))
-		expected := uint32(((i + 1) | i) & BLOCK_VAL_MASK)
+		expected := uint64(((i + 1) | i) & BLOCK_VAL_MASK)
 		if val != expected {
 			t.Fatalf("After just writing, expected %d at index %d, but got %d instead.", expected, i, val)
 		}
@@ -18,7 +25,7 @@ func TestMultiBlock(t *testing.T) {
 
 	for i := 0; i < 100 * BLOCK_FULL_LENGTH; i += 10 {
 		val := mb.Lookup(int64(i))
-		expected := uint32(((i + 1) | i) & BLOCK_VAL_MASK)
+		expected := uint64(((i + 1) | i) & BLOCK_VAL_MASK)
 		if val != expected {
 			t.Fatalf("In second loop, expected %d at index %d, but got %d instead.", expected, i, val)
 		}
@@ -70,3 +77,245 @@ func TestMultiBlockMerge(t *testing.T) {
 	}
 }
 */
+
+func TestMultiBlockEncodings(t *testing.T) {
+	for _, enc := range testEncodings {
+		mb := NewMultiBlockWithEncoding(enc)
+		ids, vals := idDistribution("extract", enc, 10000)
+		for i, id := range ids {
+			mb.Append(id, vals[i])
+		}
+
+		for i, id := range ids {
+			if val := mb.Lookup(id); val != vals[i] {
+				t.Fatalf("Encoding %s: expected lookup %d to return %d, but got %d.", enc.Name, id, vals[i], val)
+			}
+		}
+	}
+}
+
+func TestMultiBlockWriteRead(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, enc := range testEncodings {
+		for _, kind := range []string{"extract", "planet"} {
+			mb := NewMultiBlockWithEncoding(enc)
+			ids, vals := idDistribution(kind, enc, 100000)
+			for i, id := range ids {
+				mb.Append(id, vals[i])
+			}
+
+			var buf bytes.Buffer
+			if _, err := mb.WriteTo(&buf); err != nil {
+				t.Fatalf("Encoding %s: unable to write %s MultiBlock: %s", enc.Name, kind, err.Error())
+			}
+			data := buf.Bytes()
+
+			// writing shouldn't have disturbed the original.
+			mb.Append(ids[len(ids)-1] + 1, 1)
+
+			read := new(MultiBlock)
+			if _, err := read.ReadFrom(bytes.NewReader(data)); err != nil {
+				t.Fatalf("Encoding %s: unable to read %s MultiBlock: %s", enc.Name, kind, err.Error())
+			}
+			read.Append(ids[len(ids)-1] + 1, 1)
+
+			file_name := filepath.Join(dir, fmt.Sprintf("%d_%d_%s", enc.IdxBits, enc.ValBits, kind))
+			if err := os.WriteFile(file_name, data, 0644); err != nil {
+				t.Fatalf("Unable to write %q: %s", file_name, err.Error())
+			}
+			mapped, err := OpenMappedMultiBlock(file_name)
+			if err != nil {
+				t.Fatalf("Encoding %s: unable to map %s MultiBlock: %s", enc.Name, kind, err.Error())
+			}
+			if err = mapped.Verify(); err != nil {
+				t.Errorf("Encoding %s: unable to verify mapped %s MultiBlock: %s", enc.Name, kind, err.Error())
+			}
+
+			for i, id := range ids {
+				for _, m := range []*MultiBlock{mb, read, mapped.MultiBlock} {
+					if val := m.Lookup(id); val != vals[i] {
+						t.Fatalf("Encoding %s: expected lookup %d in %s MultiBlock to return %d, but got %d.", enc.Name, id, kind, vals[i], val)
+					}
+				}
+			}
+			if val := read.Lookup(ids[len(ids)-1] + 1); val != 1 {
+				t.Errorf("Encoding %s: expected to be able to append after reading, but got %d.", enc.Name, val)
+			}
+			if err = mapped.Close(); err != nil {
+				t.Errorf("Unable to close mapped MultiBlock: %s", err.Error())
+			}
+		}
+	}
+}
+
+func TestMappedMultiBlockMerge(t *testing.T) {
+	dir := t.TempDir()
+	ids, vals := idDistribution("extract", DEFAULT_ENCODING, 10000)
+	mb := NewMultiBlock()
+	for i, id := range ids {
+		mb.Append(id, vals[i])
+	}
+	file_name := filepath.Join(dir, "mapped")
+	if err := writeIndexFile(file_name, mb); err != nil {
+		t.Fatalf("Unable to write MultiBlock: %s", err.Error())
+	}
+
+	// the merged MultiBlock has to outlive the mapped one.
+	mapped, err := OpenMappedMultiBlock(file_name)
+	if err != nil {
+		t.Fatalf("Unable to map MultiBlock: %s", err.Error())
+	}
+	merged := NewMultiBlock()
+	merged.Append(ids[0], 1 << 15)
+	merged.Merge(mapped.MultiBlock)
+	if err = mapped.Close(); err != nil {
+		t.Fatalf("Unable to close mapped MultiBlock: %s", err.Error())
+	}
+
+	for i, id := range ids {
+		expected := vals[i]
+		if i == 0 {
+			expected = expected | 1 << 15
+		}
+		if val := merged.Lookup(id); val != expected {
+			t.Fatalf("Expected lookup %d in the merged MultiBlock to return %d, but got %d.", id, expected, val)
+		}
+	}
+}
+
+func TestMultiBlockReadCorrupt(t *testing.T) {
+	mb := NewMultiBlock()
+	for i := int64(1); i < 1000; i += 3 {
+		mb.Append(i, 1)
+	}
+	var buf bytes.Buffer
+	if _, err := mb.WriteTo(&buf); err != nil {
+		t.Fatalf("Unable to write MultiBlock: %s", err.Error())
+	}
+	data := buf.Bytes()
+
+	for _, i := range []int{0, 12, 40, len(data) / 2, len(data) - 8} {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x10
+		if _, err := new(MultiBlock).ReadFrom(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("Expected an error reading a MultiBlock with byte %d corrupted.", i)
+		}
+	}
+	if _, err := new(MultiBlock).ReadFrom(bytes.NewReader(data[:len(data) - 1])); err == nil {
+		t.Errorf("Expected an error reading a truncated MultiBlock.")
+	}
+
+	// mapping only checks the header and index, so a corrupt block is only
+	// found by Verify, but a corrupt header is found straight away.
+	dir := t.TempDir()
+	for _, i := range []int{12, len(data) / 2} {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x10
+		file_name := filepath.Join(dir, fmt.Sprintf("corrupt_%d", i))
+		if err := os.WriteFile(file_name, corrupt, 0644); err != nil {
+			t.Fatalf("Unable to write %q: %s", file_name, err.Error())
+		}
+
+		mapped, err := OpenMappedMultiBlock(file_name)
+		if i == 12 {
+			if err == nil {
+				t.Errorf("Expected an error mapping a MultiBlock with a corrupt header.")
+				mapped.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected to be able to map a MultiBlock with a corrupt block, but got: %s", err.Error())
+		}
+		if err = mapped.Verify(); err == nil {
+			t.Errorf("Expected an error verifying a MultiBlock with byte %d corrupted.", i)
+		}
+		mapped.Close()
+	}
+}
+
+// idDistribution returns n ascending IDs with grid values, in a pattern that
+// looks like real data. Extracts have runs of IDs, each run from the same
+// area, with large gaps between them. The planet has nearly all the IDs, with
+// the values changing every so often.
+func idDistribution(kind string, enc *BlockEncoding, n int) ([]int64, []uint64) {
+	r := rand.New(rand.NewSource(1))
+	ids := make([]int64, n)
+	vals := make([]uint64, n)
+
+	squares := int(enc.ValBits)
+	if squares > 16 {
+		squares = 16
+	}
+
+	var id int64
+	var val uint64
+	for i := 0; i < n; i += 1 {
+		switch kind {
+		case "extract":
+			if r.Intn(20) == 0 {
+				id += 1 + int64(r.ExpFloat64() * 2000)
+				val = uint64(1) << uint(r.Intn(squares))
+			} else {
+				id += 1
+			}
+
+		case "planet":
+			id += 1 + int64(r.Intn(2))
+			if r.Intn(100) == 0 {
+				val = uint64(1) << uint(r.Intn(squares))
+			}
+			if val == 0 {
+				val = 1
+			}
+		}
+		ids[i] = id
+		vals[i] = val
+	}
+
+	return ids, vals
+}
+
+func benchmarkMultiBlock(b *testing.B, lookup bool) {
+	const n = 1000000
+
+	for _, enc := range []*BlockEncoding{ENCODING_16_16, ENCODING_28_4, ENCODING_28_36} {
+		for _, kind := range []string{"extract", "planet"} {
+			ids, vals := idDistribution(kind, enc, n)
+
+			b.Run(enc.Name + "/" + kind, func(b *testing.B) {
+				var mb *MultiBlock
+				build := func() {
+					mb = NewMultiBlockWithEncoding(enc)
+					for i, id := range ids {
+						mb.Append(id, vals[i])
+					}
+				}
+
+				if lookup {
+					build()
+					b.ResetTimer()
+					for i := 0; i < b.N; i += 1 {
+						mb.Lookup(ids[i % n])
+					}
+
+				} else {
+					for i := 0; i < b.N; i += 1 {
+						build()
+					}
+				}
+
+				b.ReportMetric(float64(mb.MemoryUsage()) / float64(n), "bytes/id")
+			})
+		}
+	}
+}
+
+func BenchmarkMultiBlockAppend(b *testing.B) {
+	benchmarkMultiBlock(b, false)
+}
+
+func BenchmarkMultiBlockLookup(b *testing.B) {
+	benchmarkMultiBlock(b, true)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// nodeVersion is the mask of a node's grid squares from the timestamp of one of
+// its versions, in milliseconds, until the timestamp of the next.
+type nodeVersion struct {
+	Timestamp int64
+	Mask uint64
+}
+
+type nodeVersions []nodeVersion
+
+func (a nodeVersions) Len() int {
+	return len(a)
+}
+func (a nodeVersions) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a nodeVersions) Less(i, j int) bool {
+	return a[i].Timestamp < a[j].Timestamp
+}
+
+// NodeHistory holds the masks of each version of the nodes which have moved
+// between grid squares, so that each version of a way can be matched with
+// where its nodes were at the time. Nodes which have stayed in the same squares
+// aren't kept, as their mask in the collapsed MultiBlock is already exact.
+type NodeHistory map[int64][]nodeVersion
+
+// MaskDuring returns the masks of the versions of the node which were current
+// at any time from the timestamp from until to, ORed together. If the node
+// isn't in the history, or didn't exist at the time, then ok is false and the
+// collapsed mask should be used instead.
+func (h NodeHistory) MaskDuring(id, from, to int64) (mask uint64, ok bool) {
+	versions, found := h[id]
+	if !found {
+		return 0, false
+	}
+
+	// a way version which is immediately replaced still needs its nodes.
+	if to <= from {
+		to = from + 1
+	}
+
+	for i, v := range versions {
+		end := int64(math.MaxInt64)
+		if i + 1 < len(versions) {
+			end = versions[i + 1].Timestamp
+		}
+		if v.Timestamp < to && end > from {
+			mask = mask | v.Mask
+			ok = true
+		}
+	}
+	return
+}
+
+// merge adds the versions from another history, as the versions of a node can
+// be split between workers.
+func (h NodeHistory) merge(o NodeHistory) {
+	for id, versions := range o {
+		merged := append(h[id], versions...)
+		sort.Stable(nodeVersions(merged))
+		h[id] = merged
+	}
+}
@@ -1,58 +1,113 @@
 package main
 
 import (
+	"context"
 	"github.com/mapzen/neatlacoche/OSMPBF"
-	"github.com/paulmach/go.geo"
 	"fmt"
+	"sync/atomic"
 )
 
 type nodeWorker struct {
 	Nodes *MultiBlock
-	XRange, YRange [2]float64
+	Grid tileGrid
 	Id int
+
+	// What to do with nodes which can't be projected, the IDs of those which
+	// went in the polar file, and counts of them all.
+	Policy OutOfRangePolicy
+	Polar *MultiBlock
+	OutOfRange OutOfRangeStats
+
+	// Set if the input has deleted versions. They have no location, or a dummy
+	// one, so they aren't put in any grid square.
+	Historical bool
+
+	// Only kept in time-aware mode. The versions of the nodes which have moved
+	// between grid squares, and the versions of the last node seen so far.
+	// Nodes at the start or end of a block are always kept, as the rest of
+	// their versions might be seen by another worker.
+	History NodeHistory
+	lastId int64
+	lastVersions []nodeVersion
+	lastBoundary bool
 }
 
-func nodeWorkerLoop(workQueue chan chan *OSMPBF.PrimitiveBlock, quitChan chan bool, i int, xRange, yRange [2]float64, resultChan chan chan *MultiBlock) {
+func nodeWorkerLoop(ctx context.Context, workQueue chan chan *OSMPBF.PrimitiveBlock, quitChan chan bool, i int, grid tileGrid, policy OutOfRangePolicy, timeAware, historical bool, resultChan chan chan *workerResult, spill *BlockSpill) {
 	w := &nodeWorker{
 		Nodes: NewMultiBlock(),
-		XRange: xRange,
-		YRange: yRange,
+		Grid: grid,
 		Id: i,
+		Policy: policy,
+		Polar: NewMultiBlock(),
+		Historical: historical,
+	}
+	if timeAware {
+		w.History = make(NodeHistory)
 	}
+	w.Nodes.Spill, w.Polar.Spill = spill, spill
 	requestQueue := make(chan *OSMPBF.PrimitiveBlock)
 
 	for {
+		atomic.AddInt64(&metrics.IdleWorkers, 1)
 		select {
 		case workQueue <- requestQueue:
 		case ch := <-resultChan:
-			ch <- w.Nodes
+			w.flushHistory()
+			ch <- &workerResult{Elements: w.Nodes, Polar: w.Polar, OutOfRange: w.OutOfRange, History: w.History}
 
 		case <-quitChan:
+			atomic.AddInt64(&metrics.IdleWorkers, -1)
+			return
+
+		case <-ctx.Done():
+			atomic.AddInt64(&metrics.IdleWorkers, -1)
 			return
 		}
+		atomic.AddInt64(&metrics.IdleWorkers, -1)
 
 		select {
 		case work := <-requestQueue:
 			w.processNodeRequest(work)
 
 		case ch := <-resultChan:
-			ch <- w.Nodes
+			w.flushHistory()
+			ch <- &workerResult{Elements: w.Nodes, Polar: w.Polar, OutOfRange: w.OutOfRange, History: w.History}
 
 		case <-quitChan:
 			return
+
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
 func (w *nodeWorker) processNodeRequest(b *OSMPBF.PrimitiveBlock) {
+	// timestamps are kept in milliseconds and locations in nanodegrees, as in
+	// Node, whatever the block's granularity and offsets.
+	date_granularity := int64(b.GetDateGranularity())
+	granularity := int64(b.GetGranularity())
+	lon_offset, lat_offset := b.GetLonOffset(), b.GetLatOffset()
+	first := true
+
 	for _, g := range b.Primitivegroup {
 		for _, n := range g.Nodes {
-			w.putNode(n.Id, int32(n.Lon), int32(n.Lat))
+			var mask uint64
+			if !w.Historical || n.Info == nil || n.Info.Visible {
+				mask = w.putNode(n.Id, lon_offset + granularity * n.Lon, lat_offset + granularity * n.Lat)
+			}
+			if w.History != nil {
+				w.putVersion(n.Id, n.Info.GetTimestamp() * date_granularity, mask, first)
+				first = false
+			}
 		}
 
 		var id int64 = 0
 		var lon int64 = 0
 		var lat int64 = 0
+		var timestamp int64 = 0
+		timestamps := g.Dense.Denseinfo.Timestamp
+		visible := g.Dense.Denseinfo.Visible
 
 		var last_i = 0
 		for i, delta_id := range g.Dense.Id {
@@ -65,35 +120,92 @@ func (w *nodeWorker) processNodeRequest(b *OSMPBF.PrimitiveBlock) {
 			lon += g.Dense.Lon[i]
 			lat += g.Dense.Lat[i]
 
-			w.putNode(id, int32(lon), int32(lat))
+			var mask uint64
+			if !w.Historical || i >= len(visible) || visible[i] {
+				mask = w.putNode(id, lon_offset + granularity * lon, lat_offset + granularity * lat)
+			}
+			if w.History != nil {
+				if i < len(timestamps) {
+					timestamp += timestamps[i]
+				}
+				w.putVersion(id, timestamp * date_granularity, mask, first)
+				first = false
+			}
 		}
 	}
+
+	w.lastBoundary = true
 }
 
-const (
-	SCALE float64 = 1.0 / 10000000.0
-	MAX_LAT int32 = int32(850511287)
-)
+// putVersion records the mask of a version of a node, for the history.
+func (w *nodeWorker) putVersion(id, timestamp int64, mask uint64, boundary bool) {
+	if len(w.lastVersions) > 0 && id != w.lastId {
+		w.flushHistory()
+	}
+	w.lastId = id
+	w.lastVersions = append(w.lastVersions, nodeVersion{Timestamp: timestamp, Mask: mask})
+	w.lastBoundary = w.lastBoundary || boundary
+}
+
+// flushHistory adds the versions of the last node seen to the history, if it
+// has moved between grid squares or might have more versions elsewhere.
+func (w *nodeWorker) flushHistory() {
+	if len(w.lastVersions) == 0 {
+		return
+	}
+
+	keep := w.lastBoundary
+	for _, v := range w.lastVersions {
+		keep = keep || v.Mask != w.lastVersions[0].Mask
+	}
+	if keep {
+		w.History[w.lastId] = append(w.History[w.lastId], w.lastVersions...)
+	}
+
+	w.lastVersions = w.lastVersions[:0]
+	w.lastBoundary = false
+}
+
+// Node locations are given to putNode in nanodegrees, which are SCALE degrees.
+const SCALE float64 = 1e-9
 
 func quadrant(coordRange [2]float64, coord float64) int {
-	i := 4.0 * (coord - coordRange[0]) / (coordRange[1] - coordRange[0])
-	if i >= 0.0 && i < 4.0 {
+	i := float64(GRID_SIZE) * (coord - coordRange[0]) / (coordRange[1] - coordRange[0])
+	if i >= 0.0 && i < float64(GRID_SIZE) {
 		return int(i)
 	}
 	return -1
 }
 
-func (w *nodeWorker) putNode(id int64, lon, lat int32) {
-	if lat > -MAX_LAT && lat < MAX_LAT {
-		p := geo.Point{float64(lon) * SCALE, float64(lat) * SCALE}
-		geo.Mercator.Project(&p)
-
-		x := quadrant(w.XRange, p.X())
-		y := quadrant(w.YRange, p.Y())
-
-		if x >= 0 && y >= 0 {
-			mask := uint32(1) << uint32(x + 4 * y)
-			w.Nodes.Append(id, mask)
+// putNode puts the node into the grid square which it's in, and returns the
+// mask of that square, or zero if it isn't in any.
+func (w *nodeWorker) putNode(id int64, lon, lat int64) uint64 {
+	lon_deg, lat_deg := float64(lon) * SCALE, float64(lat) * SCALE
+	mask, ok := w.Grid.Mask(lon_deg, lat_deg)
+	if !ok {
+		w.OutOfRange.example(id)
+		switch w.Policy {
+		case OUT_OF_RANGE_CLAMP:
+			w.OutOfRange.Clamped += 1
+			atomic.AddInt64(&metrics.Clamped, 1)
+			mask, _ = w.Grid.Mask(w.Grid.scheme.Clamp(lon_deg, lat_deg))
+
+		case OUT_OF_RANGE_POLAR:
+			// the polar file isn't clipped, as a region can't reach that far.
+			w.OutOfRange.Polar += 1
+			atomic.AddInt64(&metrics.Polar, 1)
+			w.Polar.Append(id, 1)
+			return 0
+
+		default:
+			w.OutOfRange.Rejected += 1
+			atomic.AddInt64(&metrics.Rejected, 1)
+			return 0
 		}
 	}
+
+	if mask != 0 {
+		w.Nodes.Append(id, mask)
+	}
+	return mask
 }
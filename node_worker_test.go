@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"reflect"
+	"testing"
+)
+
+// encodeNodes puts the locations of the nodes, in nanodegrees, into a block
+// with the given granularity and offsets, either as dense nodes or not.
+func encodeNodes(nodes []Node, granularity int32, lon_offset, lat_offset int64, dense bool) *OSMPBF.PrimitiveBlock {
+	p := &OSMPBF.PrimitiveBlock{Granularity: &granularity, LonOffset: &lon_offset, LatOffset: &lat_offset}
+	g := OSMPBF.PrimitiveGroup{}
+	var last_id, last_lon, last_lat int64
+	for _, n := range nodes {
+		lon := (n.Lon - lon_offset) / int64(granularity)
+		lat := (n.Lat - lat_offset) / int64(granularity)
+		if dense {
+			g.Dense.Id = append(g.Dense.Id, n.Id - last_id)
+			g.Dense.Lon = append(g.Dense.Lon, lon - last_lon)
+			g.Dense.Lat = append(g.Dense.Lat, lat - last_lat)
+			last_id, last_lon, last_lat = n.Id, lon, lat
+		} else {
+			g.Nodes = append(g.Nodes, OSMPBF.Node{Id: n.Id, Lon: lon, Lat: lat})
+		}
+	}
+	p.Primitivegroup = append(p.Primitivegroup, g)
+	return p
+}
+
+// granularityNodes are each in a different grid square of the world, and
+// would be in the wrong ones if the granularity or offsets were ignored.
+var granularityNodes = []Node{
+	{Id: 1, Lon: -100e9, Lat: -40e9},
+	{Id: 2, Lon: 100e9, Lat: 40e9},
+	{Id: 3, Lon: 10e9, Lat: 10e9},
+	{Id: 4, Lon: -1e9, Lat: 1e9},
+	{Id: 5, Lon: 170e9, Lat: -80e9},
+}
+
+func TestProcessNodeGranularity(t *testing.T) {
+	x_range, y_range := WEB_MERCATOR.Extent(Tile{0, 0, 0})
+	grid := tileGrid{scheme: WEB_MERCATOR, xRange: x_range, yRange: y_range, clipX: x_range, clipY: y_range}
+
+	expected := []uint64{1 << 4, 1 << 11, 1 << 10, 1 << 9, 1 << 3}
+	encodings := []struct {
+		granularity int32
+		lon_offset, lat_offset int64
+	}{
+		{100, 0, 0},
+		{1000, 0, 0},
+		// locations in nanodegrees don't fit in 32 bits.
+		{1, 0, 0},
+		{100, 3e9, -2e9},
+		{10000, -50e9, 45e9},
+	}
+
+	for _, e := range encodings {
+		for _, dense := range []bool{false, true} {
+			w := &nodeWorker{Nodes: NewMultiBlock(), Grid: grid, Polar: NewMultiBlock()}
+			w.processNodeRequest(encodeNodes(granularityNodes, e.granularity, e.lon_offset, e.lat_offset, dense))
+
+			for i, n := range granularityNodes {
+				if mask := w.Nodes.Lookup(n.Id); mask != expected[i] {
+					t.Errorf("Granularity %d, offsets %d, %d, dense %v: expected node %d to have mask %x, but got %x.",
+						e.granularity, e.lon_offset, e.lat_offset, dense, n.Id, expected[i], mask)
+				}
+			}
+			if w.OutOfRange.Total() != 0 {
+				t.Errorf("Granularity %d: expected no nodes out of range, but got %s.", e.granularity, &w.OutOfRange)
+			}
+		}
+	}
+}
+
+func TestProcessNodeDeleted(t *testing.T) {
+	x_range, y_range := WEB_MERCATOR.Extent(Tile{0, 0, 0})
+	grid := tileGrid{scheme: WEB_MERCATOR, xRange: x_range, yRange: y_range, clipX: x_range, clipY: y_range}
+
+	// node 1 is deleted at (0, 0), as most writers do, and node 2 at osmium's
+	// undefined coordinate, which can't be projected.
+	nodes := []Node{
+		{Id: 1, Lon: -100e9, Lat: -40e9},
+		{Id: 1, Lon: 0, Lat: 0},
+		{Id: 2, Lon: 100e9, Lat: 40e9},
+		{Id: 2, Lon: 214748364700, Lat: 214748364700},
+	}
+	visible := []bool{true, false, true, false}
+
+	for _, dense := range []bool{false, true} {
+		for _, historical := range []bool{false, true} {
+			p := encodeNodes(nodes, 100, 0, 0, dense)
+			g := &p.Primitivegroup[0]
+			if dense {
+				g.Dense.Denseinfo.Visible = visible
+			}
+			for i := range g.Nodes {
+				g.Nodes[i].Info = &OSMPBF.Info{Visible: visible[i]}
+			}
+			w := &nodeWorker{Nodes: NewMultiBlock(), Grid: grid, Polar: NewMultiBlock(), Historical: historical}
+			w.processNodeRequest(p)
+
+			// without the "HistoricalInformation" feature there's no visible
+			// flag, and everything is where it says it is.
+			expected := []uint64{1 << 4, 1 << 11}
+			var out_of_range int64
+			if !historical {
+				expected[0] = expected[0] | 1 << 10
+				out_of_range = 1
+			}
+			for i, id := range []int64{1, 2} {
+				if mask := w.Nodes.Lookup(id); mask != expected[i] {
+					t.Errorf("Dense %v, historical %v: expected node %d to have mask %x, but got %x.", dense, historical, id, expected[i], mask)
+				}
+			}
+			if w.OutOfRange.Total() != out_of_range {
+				t.Errorf("Dense %v, historical %v: expected %d nodes out of range, but got %s.", dense, historical, out_of_range, &w.OutOfRange)
+			}
+		}
+	}
+}
+
+func TestPutNodeOutOfRange(t *testing.T) {
+	x_range, y_range := WEB_MERCATOR.Extent(Tile{0, 0, 0})
+	grid := tileGrid{scheme: WEB_MERCATOR, xRange: x_range, yRange: y_range, clipX: x_range, clipY: y_range}
+
+	// a node near (0, 0), one past Mercator's reach near the north pole, one
+	// exactly on the antimeridian and one which isn't anywhere at all.
+	nodes := []struct {
+		id int64
+		lon, lat int64
+	}{
+		{1, 10000, 10000},
+		{2, 10000, 89000000000},
+		{3, 180000000000, -10000},
+		{4, 10000, 95000000000},
+	}
+
+	tests := []struct {
+		policy OutOfRangePolicy
+		masks [4]uint64
+		polar [4]uint64
+		stats OutOfRangeStats
+	}{
+		{OUT_OF_RANGE_REJECT, [4]uint64{1 << 10, 0, 0, 0}, [4]uint64{}, OutOfRangeStats{Rejected: 3, Examples: []int64{2, 3, 4}}},
+		{OUT_OF_RANGE_CLAMP, [4]uint64{1 << 10, 1 << 14, 1 << 7, 1 << 14}, [4]uint64{}, OutOfRangeStats{Clamped: 3, Examples: []int64{2, 3, 4}}},
+		{OUT_OF_RANGE_POLAR, [4]uint64{1 << 10, 0, 0, 0}, [4]uint64{0, 1, 1, 1}, OutOfRangeStats{Polar: 3, Examples: []int64{2, 3, 4}}},
+	}
+
+	for _, test := range tests {
+		w := &nodeWorker{
+			Nodes: NewMultiBlock(),
+			Grid: grid,
+			Policy: test.policy,
+			Polar: NewMultiBlock(),
+		}
+		for _, n := range nodes {
+			w.putNode(n.id, n.lon, n.lat)
+		}
+
+		for i, n := range nodes {
+			if mask := w.Nodes.Lookup(n.id); mask != test.masks[i] {
+				t.Errorf("Policy %s: expected node %d to have mask %x, but got %x.", test.policy, n.id, test.masks[i], mask)
+			}
+			if polar := w.Polar.Lookup(n.id); polar != test.polar[i] {
+				t.Errorf("Policy %s: expected node %d to have polar %d, but got %d.", test.policy, n.id, test.polar[i], polar)
+			}
+		}
+		if !reflect.DeepEqual(w.OutOfRange, test.stats) {
+			t.Errorf("Policy %s: expected stats %+v, but got %+v.", test.policy, test.stats, w.OutOfRange)
+		}
+	}
+}
+
+func TestOutOfRangePolicyFlag(t *testing.T) {
+	var p OutOfRangePolicy
+	for _, name := range []string{"reject", "clamp", "polar"} {
+		if err := p.Set(name); err != nil || p.String() != name {
+			t.Errorf("Expected to parse policy %q, but got %s, %v.", name, p, err)
+		}
+	}
+	if err := p.Set("ignore"); err == nil {
+		t.Errorf("Expected an error parsing an unknown policy.")
+	}
+}
+
+func TestNodeHistory(t *testing.T) {
+	w := &nodeWorker{Nodes: NewMultiBlock(), Polar: NewMultiBlock(), History: make(NodeHistory)}
+
+	// node 1 starts the block, so it's kept even though it hasn't moved, node
+	// 2 has moved and node 3 hasn't. node 4 ends the block.
+	w.putVersion(1, 1000, 1, true)
+	w.putVersion(2, 1000, 1, false)
+	w.putVersion(2, 2000, 2, false)
+	w.putVersion(3, 1000, 4, false)
+	w.putVersion(3, 2000, 4, false)
+	w.putVersion(4, 1000, 8, false)
+	w.lastBoundary = true
+	w.flushHistory()
+
+	expected := NodeHistory{
+		1: {{1000, 1}},
+		2: {{1000, 1}, {2000, 2}},
+		4: {{1000, 8}},
+	}
+	if !reflect.DeepEqual(w.History, expected) {
+		t.Errorf("Expected history %v, but got %v.", expected, w.History)
+	}
+
+	// the rest of node 4's versions were seen by another worker.
+	w.History.merge(NodeHistory{4: {{3000, 16}, {500, 8}}})
+	if mask, ok := w.History.MaskDuring(4, 0, 2000); !ok || mask != 8 {
+		t.Errorf("Expected node 4 to have mask 8 before time 2000, but got %d, %v.", mask, ok)
+	}
+	if mask, ok := w.History.MaskDuring(4, 2000, 4000); !ok || mask != 24 {
+		t.Errorf("Expected node 4 to have mask 24 after time 2000, but got %d, %v.", mask, ok)
+	}
+	if _, ok := w.History.MaskDuring(3, 0, 4000); ok {
+		t.Errorf("Expected node 3 not to be in the history.")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OsmChange is the contents of an osmChange file, as used for replication
+// diffs. The elements are sorted in the same order as in a PBF history file;
+// nodes, then ways, then relations, each by ID and then version. Deleted
+// versions aren't visible, and deleted nodes have no location.
+type OsmChange struct {
+	Nodes []Node
+	Ways []Way
+	Relations []Relation
+}
+
+// ReadOsmChangeFile reads an osmChange file, which is gunzipped if its name
+// ends in ".gz".
+func ReadOsmChangeFile(file_name string) (*OsmChange, error) {
+	file, err := os.Open(file_name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = bufio.NewReader(file)
+	if strings.HasSuffix(file_name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to gunzip %q: %s", file_name, err.Error())
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	c, err := ReadOsmChange(r)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %q: %s", file_name, err.Error())
+	}
+	return c, nil
+}
+
+// ReadOsmChange reads an osmChange document.
+func ReadOsmChange(r io.Reader) (*OsmChange, error) {
+	c := new(OsmChange)
+	d := xml.NewDecoder(r)
+
+	// the action is whichever of create, modify or delete the elements are
+	// inside, and the rest point into the element whose tags, nds or members
+	// are being read.
+	var action string
+	var tags *[]Tag
+	var refs *[]int64
+	var members *[]Member
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			attrs := newOscAttrs(t.Attr)
+			switch t.Name.Local {
+			case "osmChange":
+			case "create", "modify", "delete":
+				action = t.Name.Local
+
+			case "node":
+				n := Node{}
+				if err = attrs.element(&n.Id, &n.Info, action); err != nil {
+					return nil, err
+				}
+				if action != "delete" {
+					if n.Lon, err = attrs.coord("lon"); err != nil {
+						return nil, err
+					}
+					if n.Lat, err = attrs.coord("lat"); err != nil {
+						return nil, err
+					}
+				}
+				c.Nodes = append(c.Nodes, n)
+				last := &c.Nodes[len(c.Nodes) - 1]
+				tags, refs, members = &last.Tags, nil, nil
+
+			case "way":
+				w := Way{}
+				if err = attrs.element(&w.Id, &w.Info, action); err != nil {
+					return nil, err
+				}
+				c.Ways = append(c.Ways, w)
+				last := &c.Ways[len(c.Ways) - 1]
+				tags, refs, members = &last.Tags, &last.Refs, nil
+
+			case "relation":
+				rel := Relation{}
+				if err = attrs.element(&rel.Id, &rel.Info, action); err != nil {
+					return nil, err
+				}
+				c.Relations = append(c.Relations, rel)
+				last := &c.Relations[len(c.Relations) - 1]
+				tags, refs, members = &last.Tags, nil, &last.Members
+
+			case "tag":
+				if tags == nil {
+					return nil, fmt.Errorf("Found a tag outside of an element.")
+				}
+				*tags = append(*tags, Tag{Key: attrs["k"], Value: attrs["v"]})
+
+			case "nd":
+				if refs == nil {
+					return nil, fmt.Errorf("Found a nd outside of a way.")
+				}
+				ref, err := attrs.int("ref")
+				if err != nil {
+					return nil, err
+				}
+				*refs = append(*refs, ref)
+
+			case "member":
+				if members == nil {
+					return nil, fmt.Errorf("Found a member outside of a relation.")
+				}
+				m, err := attrs.member()
+				if err != nil {
+					return nil, err
+				}
+				*members = append(*members, m)
+
+			default:
+				// anything else, like bounds, isn't needed.
+				if err = d.Skip(); err != nil {
+					return nil, err
+				}
+			}
+
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "node", "way", "relation":
+				tags, refs, members = nil, nil, nil
+			case "create", "modify", "delete":
+				action = ""
+			}
+		}
+	}
+
+	sort.Stable(nodesById(c.Nodes))
+	sort.Stable(waysById(c.Ways))
+	sort.Stable(relationsById(c.Relations))
+	return c, nil
+}
+
+type oscAttrs map[string]string
+
+func newOscAttrs(attrs []xml.Attr) oscAttrs {
+	a := make(oscAttrs)
+	for _, attr := range attrs {
+		a[attr.Name.Local] = attr.Value
+	}
+	return a
+}
+
+func (a oscAttrs) int(name string) (int64, error) {
+	v, err := strconv.ParseInt(a[name], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad %s attribute %q.", name, a[name])
+	}
+	return v, nil
+}
+
+// coord parses a longitude or latitude into nanodegrees.
+func (a oscAttrs) coord(name string) (int64, error) {
+	v, err := strconv.ParseFloat(a[name], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad %s attribute %q.", name, a[name])
+	}
+	return int64(math.Round(v * 1e9)), nil
+}
+
+// element parses the ID and metadata which all elements have. Everything but
+// deletions is visible, unless it says otherwise.
+func (a oscAttrs) element(id *int64, info *Info, action string) error {
+	if action == "" {
+		return fmt.Errorf("Found an element outside of create, modify or delete.")
+	}
+
+	var err error
+	if *id, err = a.int("id"); err != nil {
+		return err
+	}
+	version, err := a.int("version")
+	if err != nil {
+		return err
+	}
+	info.Version = int32(version)
+
+	if ts, ok := a["timestamp"]; ok {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return fmt.Errorf("Bad timestamp %q.", ts)
+		}
+		info.Timestamp = t.UnixNano() / int64(time.Millisecond)
+	}
+	if _, ok := a["changeset"]; ok {
+		if info.Changeset, err = a.int("changeset"); err != nil {
+			return err
+		}
+	}
+	if _, ok := a["uid"]; ok {
+		uid, err := a.int("uid")
+		if err != nil {
+			return err
+		}
+		info.Uid = int32(uid)
+	}
+	info.User = a["user"]
+
+	info.Visible = action != "delete"
+	if v, ok := a["visible"]; ok {
+		info.Visible = v == "true"
+	}
+	return nil
+}
+
+func (a oscAttrs) member() (Member, error) {
+	m := Member{Role: a["role"]}
+	switch a["type"] {
+	case "node":
+		m.Type = OSMPBF.Relation_NODE
+	case "way":
+		m.Type = OSMPBF.Relation_WAY
+	case "relation":
+		m.Type = OSMPBF.Relation_RELATION
+	default:
+		return m, fmt.Errorf("Bad member type %q.", a["type"])
+	}
+
+	var err error
+	m.Id, err = a.int("ref")
+	return m, err
+}
+
+type nodesById []Node
+
+func (a nodesById) Len() int {
+	return len(a)
+}
+func (a nodesById) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a nodesById) Less(i, j int) bool {
+	return a[i].Id < a[j].Id || (a[i].Id == a[j].Id && a[i].Info.Version < a[j].Info.Version)
+}
+
+type waysById []Way
+
+func (a waysById) Len() int {
+	return len(a)
+}
+func (a waysById) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a waysById) Less(i, j int) bool {
+	return a[i].Id < a[j].Id || (a[i].Id == a[j].Id && a[i].Info.Version < a[j].Info.Version)
+}
+
+type relationsById []Relation
+
+func (a relationsById) Len() int {
+	return len(a)
+}
+func (a relationsById) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a relationsById) Less(i, j int) bool {
+	return a[i].Id < a[j].Id || (a[i].Id == a[j].Id && a[i].Info.Version < a[j].Info.Version)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"strings"
+	"testing"
+)
+
+const TEST_OSC = `<?xml version="1.0" encoding="UTF-8"?>
+<osmChange version="0.6" generator="test">
+  <modify>
+    <way id="7" version="3" timestamp="2020-01-02T03:04:05Z" uid="1" user="bob" changeset="101">
+      <nd ref="2"/>
+      <nd ref="1"/>
+      <tag k="highway" v="path"/>
+    </way>
+  </modify>
+  <create>
+    <node id="2" version="1" timestamp="2020-01-02T03:04:05Z" uid="1" user="bob" changeset="101" lat="51.5" lon="-0.1234567">
+      <tag k="name" v="foo"/>
+    </node>
+    <relation id="3" version="1" timestamp="2020-01-02T03:04:05Z" uid="1" user="bob" changeset="101">
+      <member type="way" ref="7" role="outer"/>
+      <member type="node" ref="2" role=""/>
+    </relation>
+  </create>
+  <delete>
+    <node id="1" version="5" timestamp="2020-01-02T03:04:06Z" uid="2" user="alice" changeset="102"/>
+  </delete>
+</osmChange>
+`
+
+func TestReadOsmChange(t *testing.T) {
+	c, err := ReadOsmChange(strings.NewReader(TEST_OSC))
+	if err != nil {
+		t.Fatalf("Unable to read osmChange: %s", err.Error())
+	}
+
+	// the elements are sorted, so the deleted node comes first.
+	if len(c.Nodes) != 2 || c.Nodes[0].Id != 1 || c.Nodes[1].Id != 2 {
+		t.Fatalf("Expected nodes 1 & 2, but got %+v.", c.Nodes)
+	}
+	deleted := Info{Version: 5, Timestamp: 1577934246000, Changeset: 102, Uid: 2, User: "alice", Visible: false}
+	if n := c.Nodes[0]; n.Info != deleted || n.Lon != 0 || n.Lat != 0 {
+		t.Errorf("Unexpected deleted node: %+v", n)
+	}
+	created := Info{Version: 1, Timestamp: 1577934245000, Changeset: 101, Uid: 1, User: "bob", Visible: true}
+	if n := c.Nodes[1]; n.Info != created || n.Lon != -123456700 || n.Lat != 51500000000 || len(n.Tags) != 1 || n.Tags[0] != (Tag{"name", "foo"}) {
+		t.Errorf("Unexpected created node: %+v", n)
+	}
+
+	if len(c.Ways) != 1 || len(c.Ways[0].Refs) != 2 || c.Ways[0].Refs[0] != 2 || c.Ways[0].Info.Version != 3 || len(c.Ways[0].Tags) != 1 {
+		t.Errorf("Unexpected ways: %+v", c.Ways)
+	}
+	expected := []Member{{OSMPBF.Relation_WAY, 7, "outer"}, {OSMPBF.Relation_NODE, 2, ""}}
+	if len(c.Relations) != 1 || len(c.Relations[0].Members) != 2 ||
+		c.Relations[0].Members[0] != expected[0] || c.Relations[0].Members[1] != expected[1] {
+		t.Errorf("Unexpected relations: %+v", c.Relations)
+	}
+
+	if _, err = ReadOsmChange(strings.NewReader(`<osmChange><node id="1" version="1"/></osmChange>`)); err == nil {
+		t.Errorf("Expected an error for a node outside of create, modify or delete.")
+	}
+}
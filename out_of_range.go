@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// OutOfRangePolicy is what happens to nodes which can't be projected onto the
+// grid, either because they're too near the poles for Mercator or because
+// their location isn't a valid longitude and latitude at all. These still
+// belong in the history, so it's up to the user what's done with them.
+type OutOfRangePolicy int
+
+const (
+	// Leave the nodes out of the grid, and count them.
+	OUT_OF_RANGE_REJECT OutOfRangePolicy = iota
+
+	// Move the nodes to the nearest point which can be projected, which puts
+	// them in the squares along the edge of the world.
+	OUT_OF_RANGE_CLAMP
+
+	// Write the nodes to a separate "polar" file alongside the tiles.
+	OUT_OF_RANGE_POLAR
+)
+
+var outOfRangePolicyNames = []string{"reject", "clamp", "polar"}
+
+func (p OutOfRangePolicy) String() string {
+	if int(p) < len(outOfRangePolicyNames) {
+		return outOfRangePolicyNames[p]
+	}
+	return fmt.Sprintf("OutOfRangePolicy(%d)", int(p))
+}
+
+// Set parses the name of a policy, so that it can be used as a flag.
+func (p *OutOfRangePolicy) Set(s string) error {
+	for i, name := range outOfRangePolicyNames {
+		if s == name {
+			*p = OutOfRangePolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown out of range policy %q, expected one of %v.", s, outOfRangePolicyNames)
+}
+
+// Number of example node IDs to keep in OutOfRangeStats.
+const MAX_OUT_OF_RANGE_EXAMPLES = 10
+
+// OutOfRangeStats counts the out of range nodes and what was done with them.
+// Each version of a node is counted separately.
+type OutOfRangeStats struct {
+	Clamped, Polar, Rejected int64
+
+	// The lowest IDs of the out of range nodes, to have somewhere to start
+	// looking.
+	Examples []int64
+}
+
+func (s *OutOfRangeStats) Total() int64 {
+	return s.Clamped + s.Polar + s.Rejected
+}
+
+func (s *OutOfRangeStats) example(id int64) {
+	if len(s.Examples) < MAX_OUT_OF_RANGE_EXAMPLES {
+		s.Examples = append(s.Examples, id)
+	}
+}
+
+// Add merges in the counts and examples from another set of stats.
+func (s *OutOfRangeStats) Add(o *OutOfRangeStats) {
+	s.Clamped += o.Clamped
+	s.Polar += o.Polar
+	s.Rejected += o.Rejected
+
+	seen := make(map[int64]bool)
+	var examples []int64
+	for _, id := range append(append([]int64(nil), s.Examples...), o.Examples...) {
+		if !seen[id] {
+			seen[id] = true
+			examples = append(examples, id)
+		}
+	}
+	sort.Sort(int64slice(examples))
+	if len(examples) > MAX_OUT_OF_RANGE_EXAMPLES {
+		examples = examples[:MAX_OUT_OF_RANGE_EXAMPLES]
+	}
+	s.Examples = examples
+}
+
+func (s *OutOfRangeStats) String() string {
+	return fmt.Sprintf("%d nodes were out of range; %d clamped, %d in the polar file and %d rejected, including %v",
+		s.Total(), s.Clamped, s.Polar, s.Rejected, s.Examples)
+}
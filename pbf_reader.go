@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/mapzen/neatlacoche/OSMPBF"
+	"github.com/ulikunitz/xz/lzma"
 	"io"
 	"os"
 	"runtime"
@@ -18,8 +22,24 @@ type Unmarshaller interface {
 	Unmarshal(data []byte) error
 }
 
+// Limits on the sizes of blob headers and blobs, from the PBF format spec.
+// These stop a corrupt length from causing a huge allocation.
+const (
+	MAX_BLOB_HEADER_SIZE = 64 * 1024
+	MAX_BLOB_SIZE = 32 * 1024 * 1024
+)
+
 type PBFReader struct {
-	file *os.File
+	// Where the blobs are read from; either a file, which lets the data of
+	// several blobs be read in parallel, or a stream which is read in order.
+	blobs blobSource
+	closer io.Closer
+
+	// Index of the next blob which ReadBlocks will read.
+	nextIndex int
+
+	// Size of the file in bytes, or zero for a stream.
+	size int64
 }
 
 func NewPBFReader(file_name string) (reader *PBFReader, err error) {
@@ -27,19 +47,154 @@ func NewPBFReader(file_name string) (reader *PBFReader, err error) {
 	if err != nil {
 		return
 	}
-	reader = new(PBFReader)
-	reader.file = file
+	reader = &PBFReader{blobs: &fileSource{file: file}, closer: file, nextIndex: 1}
+	if info, err := file.Stat(); err == nil {
+		reader.size = info.Size()
+	}
 	return
 }
 
+// Size returns the size of the file in bytes, or zero if the reader is reading
+// a stream and the size isn't known.
+func (r *PBFReader) Size() int64 {
+	return r.size
+}
+
+// NewPBFStreamReader returns a reader for a stream which can't seek, such as the
+// standard input or a pipe from a decompressor. The blobs are read one after
+// the other, but are still decoded in parallel. The stream is closed with the
+// reader if it's an io.Closer.
+func NewPBFStreamReader(stream io.Reader) *PBFReader {
+	reader := &PBFReader{blobs: &streamSource{r: bufio.NewReaderSize(stream, 1 << 20)}, nextIndex: 1}
+	if closer, ok := stream.(io.Closer); ok {
+		reader.closer = closer
+	}
+	return reader
+}
+
+// SeekBlob moves the reader to the start of the blob at the given offset, which
+// must be the index'th blob in the file, so that ReadBlocks starts from there.
+// This is used to resume reading from a position recorded by BlockOrError.Next,
+// and should be called after the header block has been read. Streams can only
+// skip forwards.
+func (r *PBFReader) SeekBlob(offset int64, index int) error {
+	if index < 1 {
+		return fmt.Errorf("SeekBlob: Blob index %d is not a data blob.", index)
+	}
+	err := r.blobs.seek(offset)
+	if err != nil {
+		return fmt.Errorf("SeekBlob: Unable to seek to offset %d: %s", offset, err.Error())
+	}
+	r.nextIndex = index
+	return nil
+}
+
 func (r *PBFReader) Close() {
-	r.file.Close()
+	if r.closer != nil {
+		r.closer.Close()
+	}
+}
+
+// blobSource reads the blobs of a PBF file in order.
+type blobSource interface {
+	// next reads the header of the next blob, or returns io.EOF at the end of
+	// the file. As well as the header, it returns the offsets of the blob and
+	// the one after it, and a function to get the blob's data. That can be
+	// called from another goroutine while the following blobs are read.
+	next() (header OSMPBF.BlobHeader, blob_offset, next_offset int64, data func() ([]byte, error), err error)
+
+	// seek moves to the blob at the offset.
+	seek(offset int64) error
+}
+
+// fileSource skips over the data of each blob, which is read later with
+// ReadAt so that several can be read at once.
+type fileSource struct {
+	file *os.File
+}
+
+func (f *fileSource) next() (header OSMPBF.BlobHeader, blob_offset, next_offset int64, data func() ([]byte, error), err error) {
+	blob_offset, err = f.file.Seek(0, 1) // get current offset
+	if err != nil {
+		err = fmt.Errorf("ReadBlobHeader: Could not get current offset: %s\n", err.Error())
+		return
+	}
+
+	header, size, err := readBlobHeader(f.file)
+	if err != nil {
+		return
+	}
+
+	data_offset := blob_offset + size
+	next_offset, err = f.file.Seek(int64(header.Datasize), 1)
+	if err != nil {
+		err = fmt.Errorf("ReadBlobHeader: Could not skip to next header: %s\n", err.Error())
+		return
+	}
+
+	data_size := header.Datasize
+	data = func() ([]byte, error) {
+		buf := make([]byte, data_size, data_size)
+		_, err := f.file.ReadAt(buf, data_offset)
+		if err != nil {
+			return nil, fmt.Errorf("ReadBlob: Unable to read blob: %s\n", err.Error())
+		}
+		return buf, nil
+	}
+	return
+}
+
+func (f *fileSource) seek(offset int64) error {
+	_, err := f.file.Seek(offset, 0)
+	return err
+}
+
+// streamSource reads the data of each blob along with its header, keeping
+// track of the offset itself.
+type streamSource struct {
+	r *bufio.Reader
+	offset int64
+}
+
+func (s *streamSource) next() (header OSMPBF.BlobHeader, blob_offset, next_offset int64, data func() ([]byte, error), err error) {
+	blob_offset = s.offset
+
+	header, size, err := readBlobHeader(s.r)
+	s.offset += size
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, header.Datasize, header.Datasize)
+	n, err := io.ReadFull(s.r, buf)
+	s.offset += int64(n)
+	if err != nil {
+		err = fmt.Errorf("ReadBlob: Unable to read blob: %s\n", err.Error())
+		return
+	}
+
+	next_offset = s.offset
+	data = func() ([]byte, error) {
+		return buf, nil
+	}
+	return
+}
+
+func (s *streamSource) seek(offset int64) error {
+	if offset < s.offset {
+		return fmt.Errorf("Unable to seek backwards in a stream, from offset %d.", s.offset)
+	}
+	n, err := io.CopyN(io.Discard, s.r, offset - s.offset)
+	s.offset += n
+	return err
 }
 
-func readBlobHeader(file *os.File) (header OSMPBF.BlobHeader, data_offset int64, err error) {
+// readBlobHeader reads the length-prefixed header of a blob, returning the
+// number of bytes read.
+func readBlobHeader(r io.Reader) (header OSMPBF.BlobHeader, size int64, err error) {
 	var length uint32 = 0
 
-	err = binary.Read(file, binary.BigEndian, &length)
+	err = binary.Read(r, binary.BigEndian, &length)
 	if err == io.EOF {
 		return
 
@@ -47,9 +202,16 @@ func readBlobHeader(file *os.File) (header OSMPBF.BlobHeader, data_offset int64,
 		err = fmt.Errorf("ReadBlobHeader: Could not read next blob header length: %s\n", err.Error())
 		return
 	}
+	size = 4
+
+	if length > MAX_BLOB_HEADER_SIZE {
+		err = fmt.Errorf("ReadBlobHeader: Blob header length %d is larger than the maximum of %d.\n", length, MAX_BLOB_HEADER_SIZE)
+		return
+	}
 
 	buf := make([]byte, length, length)
-	_, err = io.ReadFull(file, buf)
+	n, err := io.ReadFull(r, buf)
+	size += int64(n)
 	if err != nil {
 		err = fmt.Errorf("ReadBlobHeader: Could not read blob header: %s\n", err.Error())
 		return
@@ -61,60 +223,118 @@ func readBlobHeader(file *os.File) (header OSMPBF.BlobHeader, data_offset int64,
 		return
 	}
 
-	data_offset, err = file.Seek(0, 1) // get current offset
-	if err != nil {
-		err = fmt.Errorf("ReadBlobHeader: Could not get current offset: %s\n", err.Error())
-		return
-	}
-
-	_, err = file.Seek(int64(header.Datasize), 1)
-	if err != nil {
-		err = fmt.Errorf("ReadBlobHeader: Could not skip to next header: %s\n", err.Error())
+	if header.Datasize < 0 || header.Datasize > MAX_BLOB_SIZE {
+		err = fmt.Errorf("ReadBlobHeader: Blob size %d is outside the allowed range, up to %d.\n", header.Datasize, MAX_BLOB_SIZE)
 		return
 	}
 
 	return
 }
 
-func readBlob(file *os.File, data_size int32, offset int64, obj Unmarshaller) error {
-	buf := make([]byte, data_size, data_size)
-	_, err := file.ReadAt(buf, offset)
-	if err != nil {
-		return fmt.Errorf("ReadBlob: Unable to read first blob: %s\n", err.Error())
+// BlobStats records how the data in a blob was compressed.
+type BlobStats struct {
+	// One of "none", "zlib", "lzma", "lz4" or "zstd".
+	Compression string
+
+	// Sizes of the data before and after decompression.
+	CompressedSize, RawSize int
+}
+
+// Ratio returns the compression ratio of the blob, which is the uncompressed
+// size divided by the compressed size.
+func (s BlobStats) Ratio() float64 {
+	if s.CompressedSize == 0 {
+		return 1
 	}
+	return float64(s.RawSize) / float64(s.CompressedSize)
+}
+
+// zstdDecoder is shared between the goroutines decoding blobs, as DecodeAll is
+// safe to use concurrently.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAX_BLOB_SIZE))
 
+func decodeBlob(buf []byte, obj Unmarshaller) (stats BlobStats, err error) {
 	var blob OSMPBF.Blob
 	err = blob.Unmarshal(buf)
 	if err != nil {
-		return fmt.Errorf("ReadBlob: Unable to unmarshal Blob: %s\n", err.Error())
+		err = fmt.Errorf("ReadBlob: Unable to unmarshal Blob: %s\n", err.Error())
+		return
 	}
 
 	if len(blob.Raw) > 0 {
+		stats = BlobStats{Compression: "none", CompressedSize: len(blob.Raw), RawSize: len(blob.Raw)}
 		err = obj.Unmarshal(blob.Raw)
+		if err != nil {
+			err = fmt.Errorf("ReadBlob: Unable to decode block: %s\n", err.Error())
+		}
+		return
+	}
 
-	} else if len(blob.ZlibData) > 0 {
-		raw_reader := bytes.NewReader(blob.ZlibData)
-		zlib_reader, err := zlib.NewReader(raw_reader)
+	if blob.RawSize < 0 || blob.RawSize > MAX_BLOB_SIZE {
+		err = fmt.Errorf("ReadBlob: Uncompressed size %d is outside the allowed range, up to %d.\n", blob.RawSize, MAX_BLOB_SIZE)
+		return
+	}
+	raw := make([]byte, blob.RawSize, blob.RawSize)
+
+	switch {
+	case len(blob.ZlibData) > 0:
+		stats.Compression = "zlib"
+		stats.CompressedSize = len(blob.ZlibData)
+		var zlib_reader io.ReadCloser
+		zlib_reader, err = zlib.NewReader(bytes.NewReader(blob.ZlibData))
 		if err == nil {
-			buf := make([]byte, blob.RawSize, blob.RawSize)
-			_, err = io.ReadFull(zlib_reader, buf)
-			if err == nil {
-				err = obj.Unmarshal(buf)
-			}
+			_, err = io.ReadFull(zlib_reader, raw)
 		}
 
-	} else {
-		return fmt.Errorf("ReadBlob: Unsupported compression type in block, this program only currently supports uncompressed and gzip compressed blobs.")
+	case len(blob.LzmaData) > 0:
+		stats.Compression = "lzma"
+		stats.CompressedSize = len(blob.LzmaData)
+		var lzma_reader *lzma.Reader
+		lzma_reader, err = lzma.NewReader(bytes.NewReader(blob.LzmaData))
+		if err == nil {
+			_, err = io.ReadFull(lzma_reader, raw)
+		}
+
+	case len(blob.Lz4Data) > 0:
+		stats.Compression = "lz4"
+		stats.CompressedSize = len(blob.Lz4Data)
+		err = lz4DecodeBlock(raw, blob.Lz4Data)
+
+	case len(blob.ZstdData) > 0:
+		stats.Compression = "zstd"
+		stats.CompressedSize = len(blob.ZstdData)
+		raw, err = zstdDecoder.DecodeAll(blob.ZstdData, raw[:0])
+		if err == nil && len(raw) != int(blob.RawSize) {
+			err = fmt.Errorf("Uncompressed size was %d, but expected %d.", len(raw), blob.RawSize)
+		}
+
+	default:
+		err = fmt.Errorf("ReadBlob: Unsupported compression type in block, this program only supports uncompressed, zlib, lzma, lz4 and zstd compressed blobs.")
+		return
 	}
+	stats.RawSize = len(raw)
+
 	if err != nil {
-		return fmt.Errorf("ReadBlob: Unable to decode header block: %s\n", err.Error())
+		err = fmt.Errorf("ReadBlob: Unable to decompress %s blob: %s\n", stats.Compression, err.Error())
+		return
 	}
 
-	return nil
+	err = obj.Unmarshal(raw)
+	if err != nil {
+		err = fmt.Errorf("ReadBlob: Unable to decode block: %s\n", err.Error())
+	}
+
+	return
 }
 
 func (r *PBFReader) ReadHeaderBlock() (header_block *OSMPBF.HeaderBlock, err error) {
-	header, offset, err := readBlobHeader(r.file)
+	defer func() {
+		if err != nil {
+			err = &BlobError{Offset: 0, Index: 0, Err: err}
+		}
+	}()
+
+	header, _, _, data, err := r.blobs.next()
 	if err != nil {
 		err = fmt.Errorf("ReadHeaderBlock: Unable to read PBF file header: %s\n", err.Error())
 		return
@@ -125,9 +345,13 @@ func (r *PBFReader) ReadHeaderBlock() (header_block *OSMPBF.HeaderBlock, err err
 	}
 
 	header_block = new(OSMPBF.HeaderBlock)
-	err = readBlob(r.file, header.Datasize, offset, header_block)
+	buf, err := data()
+	if err == nil {
+		_, err = decodeBlob(buf, header_block)
+	}
 	if err != nil {
 		err = fmt.Errorf("ReadHeaderBlock: could not read Blob: %s", err.Error())
+		return
 	}
 
 	for _, required_feature := range header_block.RequiredFeatures {
@@ -142,58 +366,156 @@ func (r *PBFReader) ReadHeaderBlock() (header_block *OSMPBF.HeaderBlock, err err
 	return
 }
 
+// PeekHeaderBlock reads the header block at the start of a buffered stream
+// without consuming it, so that the stream can still be read from the start.
+// The whole header blob has to fit in the buffer, which it does unless it's
+// unusually big.
+func PeekHeaderBlock(r *bufio.Reader) (*OSMPBF.HeaderBlock, error) {
+	buf, err := r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("PeekHeaderBlock: Unable to read blob header length: %s", err.Error())
+	}
+	length := int(binary.BigEndian.Uint32(buf))
+	if length > MAX_BLOB_HEADER_SIZE {
+		return nil, fmt.Errorf("PeekHeaderBlock: Blob header length %d is larger than the maximum of %d.", length, MAX_BLOB_HEADER_SIZE)
+	}
+
+	buf, err = r.Peek(4 + length)
+	if err != nil {
+		return nil, fmt.Errorf("PeekHeaderBlock: Unable to read blob header: %s", err.Error())
+	}
+	var header OSMPBF.BlobHeader
+	err = header.Unmarshal(buf[4:])
+	if err != nil {
+		return nil, fmt.Errorf("PeekHeaderBlock: Unable to unmarshal blob header: %s", err.Error())
+	}
+
+	buf, err = r.Peek(4 + length + int(header.Datasize))
+	if err != nil {
+		return nil, fmt.Errorf("PeekHeaderBlock: Unable to read header blob: %s", err.Error())
+	}
+
+	return NewPBFStreamReader(bytes.NewReader(buf)).ReadHeaderBlock()
+}
+
+// BlobError is an error which happened while reading or processing a blob,
+// recording where in the file the blob was.
+type BlobError struct {
+	// Offset of the start of the blob's header in the file.
+	Offset int64
+
+	// Index of the blob in the file, where the header block is zero.
+	Index int
+
+	Err error
+}
+
+func (e *BlobError) Error() string {
+	return fmt.Sprintf("Blob %d at offset %d: %s", e.Index, e.Offset, e.Err.Error())
+}
+
+func (e *BlobError) Unwrap() error {
+	return e.Err
+}
+
 type BlockOrError struct {
 	Primitives *OSMPBF.PrimitiveBlock
 	Err        error
+
+	// Position of the blob which the block came from, as in BlobError.
+	Offset int64
+	Index int
+
+	// Offset of the blob after this one, which is only set on the last block
+	// decoded from each blob. Reading can be resumed from there with SeekBlob,
+	// using the index after this one.
+	Next int64
+
+	// How the blob was compressed, which is the same for every block decoded
+	// from it.
+	Stats BlobStats
 }
 
-func (r *PBFReader) ReadBlocks() <-chan BlockOrError {
+// ReadBlocks reads and decodes the data blocks in parallel, returning them in
+// file order on the channel. Reading stops after the first error, which is
+// returned as a *BlobError, or when the context is cancelled. Either way, the
+// channel is closed once all the goroutines have stopped sending to it.
+func (r *PBFReader) ReadBlocks(ctx context.Context) <-chan BlockOrError {
 	queue := make(chan chan BlockOrError, runtime.NumCPU())
 	out := make(chan BlockOrError, runtime.NumCPU())
 
-	go readBlockConsumer(queue, out)
-	go readBlockProducer(r.file, queue)
+	go readBlockConsumer(ctx, queue, out)
+	go readBlockProducer(ctx, r.blobs, r.nextIndex, queue)
 
 	return out
 }
 
-func readBlockConsumer(in <-chan chan BlockOrError, out chan<- BlockOrError) {
+func readBlockConsumer(ctx context.Context, in <-chan chan BlockOrError, out chan<- BlockOrError) {
 	defer close(out)
 
 	for ch := range in {
 		for block_or_error := range ch {
-			out <- block_or_error
+			select {
+			case out <- block_or_error:
+			case <-ctx.Done():
+				// the producer and the block goroutines are still reading the
+				// file, so they're waited for before the channel is closed.
+				for range ch {
+				}
+				for ch := range in {
+					for range ch {
+					}
+				}
+				return
+			}
 		}
 	}
 }
 
-func chanError(err error) chan BlockOrError {
+func chanError(ctx context.Context, err error, offset int64, index int) chan BlockOrError {
 	ch := make(chan BlockOrError)
-	go func(e error, c chan BlockOrError) { ch <- BlockOrError{Err: e} }(err, ch)
+	go func() {
+		defer close(ch)
+		select {
+		case ch <- BlockOrError{Err: &BlobError{Offset: offset, Index: index, Err: err}, Offset: offset, Index: index}:
+		case <-ctx.Done():
+		}
+	}()
 	return ch
 }
 
-func readBlockProducer(file *os.File, out chan<- chan BlockOrError) {
+func readBlockProducer(ctx context.Context, blobs blobSource, index int, out chan<- chan BlockOrError) {
 	defer close(out)
 
-	for {
-		header, offset, err := readBlobHeader(file)
+	for ; ; index += 1 {
+		var ch chan BlockOrError
+		header, blob_offset, next, data, err := blobs.next()
 		if err == io.EOF {
 			break
 
 		} else if err != nil {
-			out <- chanError(fmt.Errorf("ReadBlocks: Unable to read PBF file header: %s\n", err.Error()))
-			return
+			ch = chanError(ctx, fmt.Errorf("ReadBlocks: Unable to read PBF file header: %s\n", err.Error()), blob_offset, index)
+
+		} else if header.Type != "OSMData" {
+			ch = chanError(ctx, fmt.Errorf("ReadBlocks: Expected data blob in PBF file, but it was a %q.\n", header.Type), blob_offset, index)
+
+		} else {
+			ch = make(chan BlockOrError)
+			go readDataBlock(ctx, data, ch, blob_offset, index, next)
 		}
 
-		if header.Type != "OSMData" {
-			out <- chanError(fmt.Errorf("ReadBlocks: Expected data blob in PBF file, but it was a %q.\n", header.Type))
+		select {
+		case out <- ch:
+		case <-ctx.Done():
+			// nothing will read the block, but it still has to finish.
+			for range ch {
+			}
 			return
 		}
 
-		ch := make(chan BlockOrError)
-		go readDataBlock(file, header.Datasize, offset, ch)
-		out <- ch
+		if err != nil || header.Type != "OSMData" {
+			return
+		}
 	}
 }
 
@@ -260,13 +582,31 @@ func primBlockSplit(p *OSMPBF.PrimitiveBlock) (nodes, ways, rels *OSMPBF.Primiti
 	return
 }
 
-func readDataBlock(file *os.File, data_size int32, offset int64, ch chan<- BlockOrError) {
+func readDataBlock(ctx context.Context, data func() ([]byte, error), out chan<- BlockOrError, blob_offset int64, index int, next int64) {
 	block := new(OSMPBF.PrimitiveBlock)
-	defer close(ch)
+	var stats BlobStats
+	defer close(out)
 
-	err := readBlob(file, data_size, offset, block)
+	// send returns false if the reader has been cancelled, and nothing more
+	// should be sent.
+	send := func(block_or_error BlockOrError) bool {
+		block_or_error.Offset = blob_offset
+		block_or_error.Index = index
+		block_or_error.Stats = stats
+		select {
+		case out <- block_or_error:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	buf, err := data()
+	if err == nil {
+		stats, err = decodeBlob(buf, block)
+	}
 	if err != nil {
-		ch <- BlockOrError{Err: err}
+		send(BlockOrError{Err: &BlobError{Offset: blob_offset, Index: index, Err: err}})
 
 	} else {
 		nodes, ways, rels := primCount(block)
@@ -283,18 +623,24 @@ func readDataBlock(file *os.File, data_size int32, offset int64, ch chan<- Block
 		}
 
 		if numTypes <= 1 {
-			ch <- BlockOrError{Primitives: block}
+			send(BlockOrError{Primitives: block, Next: next})
 
 		} else {
+			var blocks []*OSMPBF.PrimitiveBlock
 			nodeBlock, wayBlock, relBlock := primBlockSplit(block)
-			if nodeBlock != nil {
-				ch <- BlockOrError{Primitives: nodeBlock}
-			}
-			if wayBlock != nil {
-				ch <- BlockOrError{Primitives: wayBlock}
+			for _, b := range []*OSMPBF.PrimitiveBlock{nodeBlock, wayBlock, relBlock} {
+				if b != nil {
+					blocks = append(blocks, b)
+				}
 			}
-			if relBlock != nil {
-				ch <- BlockOrError{Primitives: relBlock}
+			for i, b := range blocks {
+				block_or_error := BlockOrError{Primitives: b}
+				if i == len(blocks) - 1 {
+					block_or_error.Next = next
+				}
+				if !send(block_or_error) {
+					return
+				}
 			}
 		}
 	}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"github.com/ulikunitz/xz/lzma"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// lz4Literals encodes data as an LZ4 block with a single sequence of literals
+// and no matches, which is valid if not very compressed.
+func lz4Literals(data []byte) []byte {
+	block := []byte{0xf0}
+	n := len(data) - 15
+	for ; n >= 255; n -= 255 {
+		block = append(block, 255)
+	}
+	block = append(block, byte(n))
+	return append(block, data...)
+}
+
+func TestLZ4DecodeBlock(t *testing.T) {
+	// "abc", then a match of 9 bytes from 3 back, which overlaps itself, then a
+	// final literal.
+	src := []byte{0x35, 'a', 'b', 'c', 3, 0, 0x10, 'X'}
+	dst := make([]byte, 13)
+	if err := lz4DecodeBlock(dst, src); err != nil {
+		t.Fatalf("Unable to decode LZ4 block: %s", err.Error())
+	}
+	if string(dst) != "abcabcabcabcX" {
+		t.Errorf("Expected LZ4 block to decode to %q, but got %q.", "abcabcabcabcX", dst)
+	}
+
+	long := bytes.Repeat([]byte("0123456789"), 100)
+	dst = make([]byte, len(long))
+	if err := lz4DecodeBlock(dst, lz4Literals(long)); err != nil {
+		t.Fatalf("Unable to decode LZ4 block: %s", err.Error())
+	}
+	if !bytes.Equal(dst, long) {
+		t.Errorf("Expected long LZ4 literals to decode unchanged.")
+	}
+
+	bad := map[string][]byte{
+		"truncated": src[:4],
+		"zero offset": {0x35, 'a', 'b', 'c', 0, 0, 0x10, 'X'},
+		"offset before start": {0x35, 'a', 'b', 'c', 4, 0, 0x10, 'X'},
+		"too long": {0x35, 'a', 'b', 'c', 3, 0, 0x20, 'X', 'Y'},
+		"too short": {0x35, 'a', 'b', 'c', 3, 0},
+	}
+	for name, src := range bad {
+		if err := lz4DecodeBlock(make([]byte, 13), src); err == nil {
+			t.Errorf("Expected an error decoding a %s LZ4 block.", name)
+		}
+	}
+}
+
+func TestDecodeBlobCompression(t *testing.T) {
+	b := newBlockBuilder()
+	for i := int64(1); i <= 100; i += 1 {
+		b.node(&Node{Id: i, Lon: i * 1000, Lat: -i * 1000, Tags: []Tag{{"name", "foo"}}, Info: Info{Version: 1, Visible: true}})
+	}
+	raw, err := b.build().Marshal()
+	if err != nil {
+		t.Fatalf("Unable to marshal block: %s", err.Error())
+	}
+
+	var zlib_data, lzma_data bytes.Buffer
+	zw := zlib.NewWriter(&zlib_data)
+	zw.Write(raw)
+	zw.Close()
+	lw, err := lzma.NewWriter(&lzma_data)
+	if err != nil {
+		t.Fatalf("Unable to create LZMA writer: %s", err.Error())
+	}
+	lw.Write(raw)
+	lw.Close()
+	enc, _ := zstd.NewWriter(nil)
+	zstd_data := enc.EncodeAll(raw, nil)
+	enc.Close()
+
+	blobs := map[string]OSMPBF.Blob{
+		"none": {Raw: raw},
+		"zlib": {RawSize: int32(len(raw)), ZlibData: zlib_data.Bytes()},
+		"lzma": {RawSize: int32(len(raw)), LzmaData: lzma_data.Bytes()},
+		"lz4": {RawSize: int32(len(raw)), Lz4Data: lz4Literals(raw)},
+		"zstd": {RawSize: int32(len(raw)), ZstdData: zstd_data},
+	}
+	for name, blob := range blobs {
+		buf, err := blob.Marshal()
+		if err != nil {
+			t.Fatalf("Unable to marshal %s blob: %s", name, err.Error())
+		}
+
+		block := new(OSMPBF.PrimitiveBlock)
+		stats, err := decodeBlob(buf, block)
+		if err != nil {
+			t.Fatalf("Unable to decode %s blob: %s", name, err.Error())
+		}
+		if n, _, _ := primCount(block); n != 100 {
+			t.Errorf("Expected 100 nodes in %s blob, but got %d.", name, n)
+		}
+		if stats.Compression != name || stats.RawSize != len(raw) {
+			t.Errorf("Expected %s blob with %d raw bytes, but got %#v.", name, len(raw), stats)
+		}
+		if name != "none" && name != "lz4" && stats.Ratio() <= 1 {
+			t.Errorf("Expected %s blob to be compressed, but the ratio was %f.", name, stats.Ratio())
+		}
+
+		// a blob which claims to be bigger than it is should be an error.
+		if name != "none" {
+			blob.RawSize += 1
+			buf, _ = blob.Marshal()
+			if _, err := decodeBlob(buf, new(OSMPBF.PrimitiveBlock)); err == nil {
+				t.Errorf("Expected an error decoding a %s blob with the wrong raw size.", name)
+			}
+		}
+	}
+}
+
+func TestPeekHeaderBlock(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	header := NewHeaderBlock(Tile{2, 2, 1}.BBox(), true)
+	w, err := NewPBFWriter(in, header)
+	if err != nil {
+		t.Fatalf("Unable to create %q: %s", in, err.Error())
+	}
+	w.WriteNode(&Node{Id: 1, Info: Info{Visible: true}})
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close %q: %s", in, err.Error())
+	}
+	data, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatalf("Unable to read %q: %s", in, err.Error())
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	peeked, err := PeekHeaderBlock(r)
+	if err != nil {
+		t.Fatalf("Unable to peek at header block: %s", err.Error())
+	}
+	if *peeked.Bbox != *header.Bbox {
+		t.Errorf("Expected peeked bbox %v, but got %v.", header.Bbox, peeked.Bbox)
+	}
+
+	// the whole stream should still be there to read.
+	rest, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(rest, data) {
+		t.Errorf("Expected peeking not to consume the stream, but %d of %d bytes were left.", len(rest), len(data))
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Limits on the size of each block. The PBF format recommends no more than
+// 8000 entities in a single block, and no more than 16MB of uncompressed data,
+// which keeps well clear of the MAX_BLOB_SIZE that readers will accept.
+const (
+	MAX_BLOCK_ENTITIES = 8000
+	MAX_BLOCK_SIZE = 16 * 1024 * 1024
+)
+
+// PBFWriter is the counterpart to PBFReader. It accumulates nodes, ways and
+// relations into PrimitiveBlocks, each of which only contains a single kind of
+// element, and writes them out as compressed blobs. Nodes are always written
+// as DenseNodes.
+//
+// Blocks are marshalled and compressed in parallel, in the background, and
+// written to the file in order.
+type PBFWriter struct {
+	file *os.File
+
+	// Block currently being accumulated, and the kind of element in it.
+	block *blockBuilder
+	kind int
+
+	// Each block is encoded on its own goroutine, which sends the result on its
+	// own channel. Those are queued in order for writeLoop, which writes them
+	// out to the file and closes done once the queue is closed.
+	queue chan chan encodedBlob
+	done chan struct{}
+
+	// The first error from writing, which is returned from Flush or Close.
+	mutex sync.Mutex
+	err error
+}
+
+type encodedBlob struct {
+	data []byte
+	err error
+}
+
+// NewHeaderBlock returns a header block for a file written by PBFWriter,
+// covering the bounding box, if it isn't nil. The file should have the
+// "HistoricalInformation" feature if it contains deleted versions.
+func NewHeaderBlock(bbox *OSMPBF.HeaderBBox, historical bool) *OSMPBF.HeaderBlock {
+	header := &OSMPBF.HeaderBlock{
+		Bbox: bbox,
+		RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"},
+		Writingprogram: proto.String("neatlacoche"),
+	}
+	if historical {
+		header.RequiredFeatures = append(header.RequiredFeatures, "HistoricalInformation")
+	}
+	return header
+}
+
+// NewPBFWriter creates (or truncates) the file and writes the header block to
+// it. The "OsmSchema-V0.6" and "DenseNodes" features are added to the header
+// if they're missing, as everything the writer writes needs them.
+func NewPBFWriter(file_name string, header *OSMPBF.HeaderBlock) (writer *PBFWriter, err error) {
+	file, err := os.Create(file_name)
+	if err != nil {
+		return
+	}
+
+	full_header := *header
+	full_header.RequiredFeatures = nil
+	for _, feature := range []string{"OsmSchema-V0.6", "DenseNodes"} {
+		if !hasFeature(header, feature) {
+			full_header.RequiredFeatures = append(full_header.RequiredFeatures, feature)
+		}
+	}
+	full_header.RequiredFeatures = append(full_header.RequiredFeatures, header.RequiredFeatures...)
+
+	data, err := full_header.Marshal()
+	if err != nil {
+		file.Close()
+		err = fmt.Errorf("NewPBFWriter: Unable to marshal header block: %s\n", err.Error())
+		return
+	}
+
+	err = writeBlob(file, "OSMHeader", data)
+	if err != nil {
+		file.Close()
+		return
+	}
+
+	writer = new(PBFWriter)
+	writer.file = file
+	writer.block = newBlockBuilder()
+	writer.kind = PKIND_NODE
+	writer.queue = make(chan chan encodedBlob, runtime.NumCPU())
+	writer.done = make(chan struct{})
+	go writer.writeLoop()
+	return
+}
+
+func (w *PBFWriter) writeLoop() {
+	defer close(w.done)
+
+	// after an error, the rest of the queue is still drained, but not
+	// written, so that Close can finish.
+	for ch := range w.queue {
+		blob := <-ch
+		err := blob.err
+		if err == nil && w.error() == nil {
+			_, err = w.file.Write(blob.data)
+			if err != nil {
+				err = fmt.Errorf("WriteBlob: Unable to write blob: %s\n", err.Error())
+			}
+		}
+		if err != nil {
+			w.setError(err)
+		}
+	}
+}
+
+func (w *PBFWriter) error() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+func (w *PBFWriter) setError(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Close flushes any buffered elements, waits for them to be written and closes
+// the file.
+func (w *PBFWriter) Close() error {
+	w.Flush()
+	close(w.queue)
+	<-w.done
+
+	err := w.error()
+	cerr := w.file.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Flush sends any buffered elements off to be written to the file as a single
+// block. This happens in the background, so an error writing the block might
+// only be returned by a later call, or by Close.
+func (w *PBFWriter) Flush() error {
+	if w.block.count == 0 {
+		return w.error()
+	}
+
+	block := w.block
+	w.block = newBlockBuilder()
+
+	// this waits if there are already as many blocks in flight as CPUs.
+	ch := make(chan encodedBlob, 1)
+	w.queue <- ch
+	go func() {
+		data, err := block.build().Marshal()
+		if err != nil {
+			ch <- encodedBlob{err: fmt.Errorf("PBFWriter: Unable to marshal primitive block: %s\n", err.Error())}
+			return
+		}
+		if len(data) > MAX_BLOB_SIZE {
+			ch <- encodedBlob{err: fmt.Errorf("PBFWriter: Block of %d elements is %d bytes, which is larger than the maximum of %d.\n", block.count, len(data), MAX_BLOB_SIZE)}
+			return
+		}
+		data, err = encodeBlob("OSMData", data)
+		ch <- encodedBlob{data: data, err: err}
+	}()
+
+	return w.error()
+}
+
+// startElement makes sure there's room in the current block for an element of
+// the given kind, flushing the block if it's full or has a different kind of
+// element in it.
+func (w *PBFWriter) startElement(kind int) error {
+	if kind != w.kind || w.block.count >= MAX_BLOCK_ENTITIES || w.block.size >= MAX_BLOCK_SIZE {
+		err := w.Flush()
+		if err != nil {
+			return err
+		}
+		w.kind = kind
+	}
+	w.block.count += 1
+	return nil
+}
+
+func (w *PBFWriter) WriteNode(n *Node) error {
+	err := w.startElement(PKIND_NODE)
+	if err != nil {
+		return err
+	}
+
+	w.block.node(n)
+	return nil
+}
+
+func (w *PBFWriter) WriteWay(way *Way) error {
+	err := w.startElement(PKIND_WAY)
+	if err != nil {
+		return err
+	}
+
+	b := w.block
+	keys, vals := b.tags(way.Tags)
+	refs := make([]int64, len(way.Refs))
+	var last int64
+	for i, ref := range way.Refs {
+		refs[i] = ref - last
+		last = ref
+	}
+
+	b.ways = append(b.ways, OSMPBF.Way{
+		Id: way.Id,
+		Keys: keys,
+		Vals: vals,
+		Info: b.info(&way.Info),
+		Refs: refs,
+	})
+	b.size += 32 + 8 * len(keys) + 5 * len(refs)
+	return nil
+}
+
+func (w *PBFWriter) WriteRelation(r *Relation) error {
+	err := w.startElement(PKIND_REL)
+	if err != nil {
+		return err
+	}
+
+	b := w.block
+	keys, vals := b.tags(r.Tags)
+	roles := make([]int32, len(r.Members))
+	memids := make([]int64, len(r.Members))
+	types := make([]OSMPBF.Relation_MemberType, len(r.Members))
+	var last int64
+	for i, m := range r.Members {
+		roles[i] = int32(b.str(m.Role))
+		memids[i] = m.Id - last
+		types[i] = m.Type
+		last = m.Id
+	}
+
+	id := r.Id
+	b.rels = append(b.rels, OSMPBF.Relation{
+		Id: &id,
+		Keys: keys,
+		Vals: vals,
+		Info: b.info(&r.Info),
+		RolesSid: roles,
+		Memids: memids,
+		Types: types,
+	})
+	b.size += 32 + 8 * len(keys) + 10 * len(memids)
+	return nil
+}
+
+// blockBuilder accumulates elements and the string table which they reference
+// for a single PrimitiveBlock.
+type blockBuilder struct {
+	strings [][]byte
+	stringIdx map[string]uint32
+
+	dense OSMPBF.DenseNodes
+	ways []OSMPBF.Way
+	rels []OSMPBF.Relation
+	count int
+
+	// The previous dense node's values, which each node's are delta coded
+	// against.
+	last struct {
+		id int64
+		timestamp, changeset int64
+		uid, userSid int32
+	}
+
+	// The dense nodes' locations, in nanodegrees, which are only coded once
+	// the block is built. The granularity is the largest which divides all of
+	// them, up to the default, so that they're written exactly whatever the
+	// granularity and offsets of the blocks they were read from.
+	lons, lats []int64
+	granularity int64
+
+	// An estimate of the size of the block once it's marshalled, erring on
+	// the large side.
+	size int
+}
+
+func newBlockBuilder() *blockBuilder {
+	b := new(blockBuilder)
+
+	// the first entry in the string table is always the empty string, as index
+	// zero is used as a delimiter in dense nodes.
+	b.strings = [][]byte{[]byte{}}
+	b.stringIdx = map[string]uint32{"": 0}
+	b.granularity = int64(DEFAULT_GRANULARITY)
+	return b
+}
+
+func (b *blockBuilder) str(s string) uint32 {
+	if idx, ok := b.stringIdx[s]; ok {
+		return idx
+	}
+	idx := uint32(len(b.strings))
+	b.strings = append(b.strings, []byte(s))
+	b.stringIdx[s] = idx
+	b.size += len(s) + 4
+	return idx
+}
+
+func (b *blockBuilder) tags(tags []Tag) (keys, vals []uint32) {
+	if len(tags) == 0 {
+		return
+	}
+	keys = make([]uint32, len(tags))
+	vals = make([]uint32, len(tags))
+	for i, t := range tags {
+		keys[i] = b.str(t.Key)
+		vals[i] = b.str(t.Value)
+	}
+	return
+}
+
+func (b *blockBuilder) info(i *Info) *OSMPBF.Info {
+	return &OSMPBF.Info{
+		Version: i.Version,
+		Timestamp: i.Timestamp / int64(DEFAULT_DATE_GRANULARITY),
+		Changeset: i.Changeset,
+		Uid: i.Uid,
+		UserSid: b.str(i.User),
+		Visible: i.Visible,
+	}
+}
+
+// node appends a node to the dense nodes, with the IDs and the metadata other
+// than the version and visible flag delta coded against the previous node. The
+// locations are coded by build.
+func (b *blockBuilder) node(n *Node) {
+	d := &b.dense
+	last := &b.last
+
+	d.Id = append(d.Id, n.Id - last.id)
+	last.id = n.Id
+	b.lons = append(b.lons, n.Lon)
+	b.lats = append(b.lats, n.Lat)
+	b.granularity = gcd(gcd(b.granularity, n.Lon), n.Lat)
+
+	for _, t := range n.Tags {
+		d.KeysVals = append(d.KeysVals, int32(b.str(t.Key)), int32(b.str(t.Value)))
+	}
+	d.KeysVals = append(d.KeysVals, 0)
+
+	di := &d.Denseinfo
+	timestamp := n.Info.Timestamp / int64(DEFAULT_DATE_GRANULARITY)
+	user_sid := int32(b.str(n.Info.User))
+	di.Version = append(di.Version, n.Info.Version)
+	di.Timestamp = append(di.Timestamp, timestamp - last.timestamp)
+	di.Changeset = append(di.Changeset, n.Info.Changeset - last.changeset)
+	di.Uid = append(di.Uid, n.Info.Uid - last.uid)
+	di.UserSid = append(di.UserSid, user_sid - last.userSid)
+	di.Visible = append(di.Visible, n.Info.Visible)
+	last.timestamp, last.changeset, last.uid, last.userSid = timestamp, n.Info.Changeset, n.Info.Uid, user_sid
+
+	b.size += 48 + 8 * len(n.Tags)
+}
+
+func (b *blockBuilder) build() *OSMPBF.PrimitiveBlock {
+	p := new(OSMPBF.PrimitiveBlock)
+	p.Strings = b.strings
+
+	if len(b.dense.Id) > 0 {
+		if b.granularity != int64(DEFAULT_GRANULARITY) {
+			granularity := int32(b.granularity)
+			p.Granularity = &granularity
+		}
+		b.dense.Lon = deltaCode(b.lons, b.granularity)
+		b.dense.Lat = deltaCode(b.lats, b.granularity)
+		p.Primitivegroup = append(p.Primitivegroup, OSMPBF.PrimitiveGroup{Dense: b.dense})
+	}
+	if len(b.ways) > 0 {
+		p.Primitivegroup = append(p.Primitivegroup, OSMPBF.PrimitiveGroup{Ways: b.ways})
+	}
+	if len(b.rels) > 0 {
+		p.Primitivegroup = append(p.Primitivegroup, OSMPBF.PrimitiveGroup{Relations: b.rels})
+	}
+
+	return p
+}
+
+// deltaCode returns the values in units of the granularity, each one coded as
+// the difference from the one before.
+func deltaCode(values []int64, granularity int64) []int64 {
+	deltas := make([]int64, len(values))
+	var last int64
+	for i, v := range values {
+		deltas[i] = v / granularity - last
+		last = v / granularity
+	}
+	return deltas
+}
+
+// gcd returns the greatest common divisor of a and b, which is a if b is zero.
+func gcd(a, b int64) int64 {
+	if a < 0 {
+		a = -a
+	}
+	if b < 0 {
+		b = -b
+	}
+	for b != 0 {
+		a, b = b, a % b
+	}
+	return a
+}
+
+// encodeBlob compresses the data and frames it, along with its BlobHeader, in
+// the way which readBlobHeader expects.
+func encodeBlob(blob_type string, data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zlib_writer := zlib.NewWriter(&compressed)
+	_, err := zlib_writer.Write(data)
+	if err == nil {
+		err = zlib_writer.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("WriteBlob: Unable to compress blob: %s\n", err.Error())
+	}
+
+	blob := OSMPBF.Blob{
+		RawSize: int32(len(data)),
+		ZlibData: compressed.Bytes(),
+	}
+	blob_data, err := blob.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("WriteBlob: Unable to marshal blob: %s\n", err.Error())
+	}
+
+	header := OSMPBF.BlobHeader{
+		Type: blob_type,
+		Datasize: int32(len(blob_data)),
+	}
+	header_data, err := header.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("WriteBlob: Unable to marshal blob header: %s\n", err.Error())
+	}
+
+	var framed bytes.Buffer
+	framed.Grow(4 + len(header_data) + len(blob_data))
+	binary.Write(&framed, binary.BigEndian, uint32(len(header_data)))
+	framed.Write(header_data)
+	framed.Write(blob_data)
+
+	return framed.Bytes(), nil
+}
+
+// writeBlob compresses the data and writes it out, along with its BlobHeader.
+func writeBlob(w io.Writer, blob_type string, data []byte) error {
+	framed, err := encodeBlob(blob_type, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(framed)
+	if err != nil {
+		return fmt.Errorf("WriteBlob: Unable to write blob: %s\n", err.Error())
+	}
+
+	return nil
+}
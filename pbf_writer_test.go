@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPBFWriterRoundTrip(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "out.osm.pbf")
+	header := NewHeaderBlock(Tile{2, 1, 1}.BBox(), true)
+	header.OsmosisReplicationSequenceNumber = proto.Int64(1234)
+	header.OsmosisReplicationBaseUrl = proto.String("https://planet.openstreetmap.org/replication/minute")
+	w, err := NewPBFWriter(file_name, header)
+	if err != nil {
+		t.Fatalf("Unable to create %q: %s", file_name, err.Error())
+	}
+
+	// enough nodes to need several blocks, with a mix of tags, users and
+	// deleted versions, and locations either side of zero.
+	var nodes []Node
+	for i := int64(1); i <= 2 * MAX_BLOCK_ENTITIES + 10; i += 1 {
+		n := Node{
+			Id: i * 3,
+			Lon: (i % 360 - 180) * 1e9 + i * 100,
+			Lat: (i % 170 - 85) * 1e9 - i * 100,
+			Info: Info{Version: int32(i % 5 + 1), Timestamp: 1000 * (1e6 - i), Changeset: i / 3, Uid: int32(i % 7), User: fmt.Sprintf("user%d", i % 7), Visible: i % 11 != 0},
+		}
+		if i % 4 == 0 {
+			n.Tags = []Tag{{"amenity", "cafe"}, {"name", fmt.Sprintf("Cafe %d", i)}}
+		}
+		nodes = append(nodes, n)
+		if err = w.WriteNode(&n); err != nil {
+			t.Fatalf("Unable to write node: %s", err.Error())
+		}
+	}
+	ways := []Way{{Id: 5, Refs: []int64{3, 9, 6, 3}, Tags: []Tag{{"highway", "path"}}, Info: Info{Version: 2, Timestamp: 5000, User: "bob", Visible: true}}}
+	rels := []Relation{{Id: 7, Members: []Member{{Type: 1, Id: 5, Role: "outer"}, {Type: 0, Id: 3, Role: ""}}, Info: Info{Version: 1, Visible: false}}}
+	w.WriteWay(&ways[0])
+	w.WriteRelation(&rels[0])
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close %q: %s", file_name, err.Error())
+	}
+
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		t.Fatalf("Unable to open %q: %s", file_name, err.Error())
+	}
+	defer reader.Close()
+	read_header, err := reader.ReadHeaderBlock()
+	if err != nil {
+		t.Fatalf("Unable to read header: %s", err.Error())
+	}
+	for _, feature := range []string{"OsmSchema-V0.6", "DenseNodes", "HistoricalInformation"} {
+		if !hasFeature(read_header, feature) {
+			t.Errorf("Expected header to have the %q feature, but it had %v.", feature, read_header.RequiredFeatures)
+		}
+	}
+	if !reflect.DeepEqual(read_header.Bbox, header.Bbox) {
+		t.Errorf("Expected header bbox %v, but got %v.", header.Bbox, read_header.Bbox)
+	}
+	if read_header.GetOsmosisReplicationSequenceNumber() != 1234 || read_header.GetOsmosisReplicationBaseUrl() != header.GetOsmosisReplicationBaseUrl() {
+		t.Errorf("Expected replication fields to be kept, but got %v.", read_header)
+	}
+
+	var read_nodes []Node
+	var read_ways []Way
+	var read_rels []Relation
+	for block := range reader.ReadBlocks(context.Background()) {
+		if block.Err != nil {
+			t.Fatalf("Unable to read block: %s", block.Err.Error())
+		}
+		for _, g := range block.Primitives.Primitivegroup {
+			if len(g.Nodes) > 0 {
+				t.Errorf("Expected only dense nodes, but got %d plain ones.", len(g.Nodes))
+			}
+		}
+		if n, w, r := primCount(block.Primitives); n + w + r > MAX_BLOCK_ENTITIES {
+			t.Errorf("Expected no more than %d elements in a block, but got %d.", MAX_BLOCK_ENTITIES, n + w + r)
+		}
+		n, w, r, err := DecodeBlock(block.Primitives, true)
+		if err != nil {
+			t.Fatalf("Unable to decode block: %s", err.Error())
+		}
+		read_nodes = append(read_nodes, n...)
+		read_ways = append(read_ways, w...)
+		read_rels = append(read_rels, r...)
+	}
+
+	if !reflect.DeepEqual(read_nodes, nodes) {
+		t.Errorf("Expected %d nodes to be read back unchanged, but got %d different ones.", len(nodes), len(read_nodes))
+	}
+	if !reflect.DeepEqual(read_ways, ways) {
+		t.Errorf("Expected ways %v, but got %v.", ways, read_ways)
+	}
+	if !reflect.DeepEqual(read_rels, rels) {
+		t.Errorf("Expected relations %v, but got %v.", rels, read_rels)
+	}
+}
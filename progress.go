@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Where progress reports are written as JSON, one per line, as well as being
+// logged. Nil means they're only logged.
+var progress_output io.Writer
+
+// Progress keeps track of a pass over a file, and reports how it's getting on
+// every -progress-interval, and whenever the kind of element being read
+// changes. It's only updated by the goroutine reading the file.
+type Progress struct {
+	Tile Tile
+	Pass string
+
+	// Kind of element being read, one of PKIND_*, or -1 before the first
+	// block.
+	Kind int
+
+	// Size of the file, which is zero if it's a stream, and how far through it
+	// the last block read was.
+	FileSize int64
+	BytesRead int64
+
+	// Where the first block read was, which isn't the start of the file if
+	// the pass was resumed from a checkpoint.
+	startBytes int64
+
+	Blobs int64
+	Elements [3]int64
+
+	start time.Time
+	lastReport time.Time
+	interval time.Duration
+
+	// Returns the memory used by the Sorter's MultiBlocks, which is only
+	// called when there's a report to make.
+	memory func() int
+}
+
+// ProgressReport is what's reported, either as a log line or as JSON.
+type ProgressReport struct {
+	Time time.Time `json:"time"`
+	Tile string `json:"tile"`
+	Pass string `json:"pass"`
+	Kind string `json:"kind,omitempty"`
+	Done bool `json:"done"`
+
+	BytesRead int64 `json:"bytes_read"`
+	FileSize int64 `json:"file_size,omitempty"`
+	Blobs int64 `json:"blobs"`
+	BlobsPerSecond float64 `json:"blobs_per_second"`
+	Nodes int64 `json:"nodes"`
+	Ways int64 `json:"ways"`
+	Relations int64 `json:"relations"`
+	MemoryUsage int `json:"memory_bytes"`
+
+	Elapsed float64 `json:"elapsed_seconds"`
+	// Estimated seconds until the pass is done, which is only known if the
+	// file size is.
+	ETA *float64 `json:"eta_seconds,omitempty"`
+}
+
+// newProgress starts tracking a pass over the file which the reader is
+// reading. The memory function can be nil if there's no Sorter to report on.
+func newProgress(tile Tile, pass string, reader *PBFReader, memory func() int) *Progress {
+	now := time.Now()
+	return &Progress{
+		Tile: tile,
+		Pass: pass,
+		Kind: -1,
+		FileSize: reader.Size(),
+		start: now,
+		lastReport: now,
+		interval: *progress_interval,
+		memory: memory,
+	}
+}
+
+// Block counts a block which has been read, and reports if a report is due.
+func (p *Progress) Block(block BlockOrError) {
+	nodes, ways, rels := primCount(block.Primitives)
+	p.Elements[PKIND_NODE] += int64(nodes)
+	p.Elements[PKIND_WAY] += int64(ways)
+	p.Elements[PKIND_REL] += int64(rels)
+
+	// blocks are only ever of one kind once they're read, but empty ones
+	// don't change it.
+	kind := p.Kind
+	switch {
+	case rels > 0:
+		kind = PKIND_REL
+	case ways > 0:
+		kind = PKIND_WAY
+	case nodes > 0:
+		kind = PKIND_NODE
+	}
+
+	// the blob is only finished with at its last block.
+	p.BytesRead = block.Offset
+	if block.Next != 0 {
+		p.BytesRead = block.Next
+		p.Blobs += 1
+	}
+
+	if p.Kind == -1 {
+		p.startBytes = block.Offset
+	}
+	changed := kind != p.Kind && p.Kind != -1
+	p.Kind = kind
+	if changed || (p.interval > 0 && time.Since(p.lastReport) >= p.interval) {
+		p.report(false)
+	}
+}
+
+// Done reports that the pass is complete.
+func (p *Progress) Done() {
+	if p.FileSize > 0 {
+		p.BytesRead = p.FileSize
+	}
+	p.report(true)
+}
+
+// Report returns the progress so far.
+func (p *Progress) Report(done bool) *ProgressReport {
+	now := time.Now()
+	r := &ProgressReport{
+		Time: now.UTC(),
+		Tile: p.Tile.String(),
+		Pass: p.Pass,
+		Done: done,
+		BytesRead: p.BytesRead,
+		FileSize: p.FileSize,
+		Blobs: p.Blobs,
+		Nodes: p.Elements[PKIND_NODE],
+		Ways: p.Elements[PKIND_WAY],
+		Relations: p.Elements[PKIND_REL],
+		Elapsed: now.Sub(p.start).Seconds(),
+	}
+	if p.Kind >= 0 {
+		r.Kind = PKIND_NAMES[p.Kind]
+	}
+	if r.Elapsed > 0 {
+		r.BlobsPerSecond = float64(p.Blobs) / r.Elapsed
+	}
+	if p.memory != nil {
+		r.MemoryUsage = p.memory()
+	}
+
+	// assume the rest of the file will be read as quickly as the start was.
+	if read := p.BytesRead - p.startBytes; p.FileSize > 0 && read > 0 {
+		eta := r.Elapsed * float64(p.FileSize - p.BytesRead) / float64(read)
+		if eta < 0 {
+			eta = 0
+		}
+		r.ETA = &eta
+	}
+	return r
+}
+
+func (p *Progress) report(done bool) {
+	p.lastReport = time.Now()
+	if p.interval <= 0 {
+		return
+	}
+
+	r := p.Report(done)
+	log.Printf("%s\n", r)
+	if progress_output != nil {
+		// a broken progress stream shouldn't stop the split.
+		if err := json.NewEncoder(progress_output).Encode(r); err != nil {
+			log.Printf("Unable to write progress: %s\n", err.Error())
+		}
+	}
+}
+
+// String returns the report as a log line.
+func (r *ProgressReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Tile %s, %s", r.Tile, r.Pass)
+	if r.Done {
+		fmt.Fprintf(&b, " done")
+	} else if r.Kind != "" {
+		fmt.Fprintf(&b, " reading %ss", r.Kind)
+	}
+	fmt.Fprintf(&b, ": %s", formatBytes(r.BytesRead))
+	if r.FileSize > 0 {
+		fmt.Fprintf(&b, " of %s (%.1f%%)", formatBytes(r.FileSize), 100 * float64(r.BytesRead) / float64(r.FileSize))
+	}
+	fmt.Fprintf(&b, ", %d blobs at %.1f/s, %d nodes, %d ways and %d relations, %s of MultiBlocks",
+		r.Blobs, r.BlobsPerSecond, r.Nodes, r.Ways, r.Relations, formatBytes(int64(r.MemoryUsage)))
+	if r.ETA != nil && !r.Done {
+		fmt.Fprintf(&b, ", ETA %s", (time.Duration(*r.ETA) * time.Second).Round(time.Second))
+	}
+	fmt.Fprintf(&b, ".")
+	return b.String()
+}
+
+// formatBytes returns a number of bytes in the largest binary unit which is
+// at least one.
+func formatBytes(n int64) string {
+	const UNITS = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n) / 1024, 0
+	for value >= 1024 && unit < len(UNITS) - 1 {
+		value /= 1024
+		unit += 1
+	}
+	return fmt.Sprintf("%.1f %ciB", value, UNITS[unit])
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/mapzen/neatlacoche/fixture"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	opts := fixture.DefaultOptions()
+	h := fixture.Generate(opts)
+	data, err := h.Encode(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	if err = os.WriteFile(in, data, 0644); err != nil {
+		t.Fatalf("Unable to write fixture: %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	*progress_interval, progress_output = time.Hour, &buf
+	defer func() { *progress_interval, progress_output = 0, nil }()
+
+	sorter, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	sorter.Close()
+
+	// the interval is too long for any reports except when the kind changes
+	// and at the end. the way completion pass is reported too, after the
+	// first pass.
+	var reports []ProgressReport
+	for dec := json.NewDecoder(&buf); dec.More(); {
+		var r ProgressReport
+		if err = dec.Decode(&r); err != nil {
+			t.Fatalf("Unable to decode progress report: %s", err.Error())
+		}
+		if r.Pass == "first pass" {
+			reports = append(reports, r)
+		}
+	}
+	var kinds []string
+	for _, r := range reports {
+		kinds = append(kinds, r.Kind)
+	}
+	if len(reports) != 3 || kinds[0] != "way" || kinds[1] != "relation" || !reports[2].Done {
+		t.Fatalf("Expected reports as ways and relations start and when done, but got %v.", kinds)
+	}
+
+	last := reports[2]
+	if last.Tile != "0/0/0" {
+		t.Errorf("Expected tile 0/0/0, but got %q.", last.Tile)
+	}
+	if last.BytesRead != int64(len(data)) || last.FileSize != int64(len(data)) {
+		t.Errorf("Expected %d bytes read of %d, but got %d of %d.", len(data), len(data), last.BytesRead, last.FileSize)
+	}
+	if last.Nodes != int64(len(h.Nodes)) || last.Ways != int64(len(h.Ways)) || last.Relations != int64(len(h.Relations)) {
+		t.Errorf("Expected %d nodes, %d ways and %d relations, but got %d, %d and %d.",
+			len(h.Nodes), len(h.Ways), len(h.Relations), last.Nodes, last.Ways, last.Relations)
+	}
+	if last.MemoryUsage <= 0 || last.ETA == nil || *last.ETA != 0 {
+		t.Errorf("Expected some memory used and no time left, but got %+v.", last)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0: "0 B",
+		1023: "1023 B",
+		1536: "1.5 KiB",
+		48 << 30: "48.0 GiB",
+	} {
+		if s := formatBytes(n); s != expected {
+			t.Errorf("Expected %d bytes to be %q, but got %q.", n, expected, s)
+		}
+	}
+}
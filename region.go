@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// How far, as a fraction of the width of the world, a region can stick out of a
+// tile and still be counted as inside it, which allows for rounding in the bbox.
+const REGION_EDGE = 1e-9
+
+// Region is a box of longitude and latitude, in degrees, which the tiling is
+// restricted to.
+type Region struct {
+	Left, Bottom, Right, Top float64
+}
+
+// ParseRegion parses a region in the usual "left,bottom,right,top" format.
+func ParseRegion(s string) (*Region, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Expected a bbox of the form left,bottom,right,top but got %q.", s)
+	}
+
+	var coords [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse bbox coordinate %q: %s", part, err.Error())
+		}
+		coords[i] = v
+	}
+
+	r := &Region{Left: coords[0], Bottom: coords[1], Right: coords[2], Top: coords[3]}
+	if !r.valid() {
+		return nil, fmt.Errorf("The bbox %q is empty or outside the world.", s)
+	}
+	return r, nil
+}
+
+// RegionFromHeader returns the region covered by a PBF file header's bbox, or
+// nil if it doesn't have a usable one. Boxes which cross the antimeridian
+// aren't supported, so they are ignored too.
+func RegionFromHeader(bbox *OSMPBF.HeaderBBox) *Region {
+	if bbox == nil {
+		return nil
+	}
+	r := &Region{
+		Left: float64(bbox.Left) / 1e9,
+		Bottom: float64(bbox.Bottom) / 1e9,
+		Right: float64(bbox.Right) / 1e9,
+		Top: float64(bbox.Top) / 1e9,
+	}
+	if !r.valid() {
+		return nil
+	}
+	return r
+}
+
+func (r *Region) valid() bool {
+	return r.Left >= -180 && r.Right <= 180 && r.Left < r.Right &&
+		r.Bottom >= -90 && r.Top <= 90 && r.Bottom < r.Top
+}
+
+// Extent returns the range of the tiling scheme's coordinates covered by the
+// region, in the same way as TilingScheme.Extent. Anything which the scheme
+// can't project, such as the poles in Mercator, is cut off.
+func (r *Region) Extent(scheme TilingScheme) (xRange, yRange [2]float64) {
+	x0, y0, _ := scheme.Project(scheme.Clamp(r.Left, r.Bottom))
+	x1, y1, _ := scheme.Project(scheme.Clamp(r.Right, r.Top))
+	xRange = [2]float64{x0, x1}
+	yRange = [2]float64{y0, y1}
+	return
+}
+
+// Tile returns the smallest tile which covers the whole region, and which can
+// be split into tiles at the given zoom, to start the tiling from. That's the
+// world tile if nothing smaller will do.
+func (r *Region) Tile(scheme TilingScheme, zoom int) Tile {
+	x_range, y_range := r.Extent(scheme)
+	world_x, world_y := scheme.Extent(Tile{0, 0, 0})
+	edge_x := REGION_EDGE * (world_x[1] - world_x[0])
+	edge_y := REGION_EDGE * (world_y[1] - world_y[0])
+
+	tile := Tile{0, 0, 0}
+	for z := GRID_ZOOM_STEP; z < zoom; z += GRID_ZOOM_STEP {
+		n := int64(1) << uint(z)
+		index := func(v, world_size float64) int64 {
+			i := int64(math.Floor(v * float64(n) / world_size))
+			if i < 0 {
+				return 0
+			} else if i >= n {
+				return n - 1
+			}
+			return i
+		}
+
+		// the edges are brought in a little, so that a region which is on tile
+		// boundaries, give or take rounding, doesn't need the tiles next to it.
+		width, height := world_x[1] - world_x[0], world_y[1] - world_y[0]
+		x0 := index(x_range[0] - world_x[0] + edge_x, width)
+		x1 := index(x_range[1] - world_x[0] - edge_x, width)
+		y0 := index(world_y[1] - y_range[1] + edge_y, height)
+		y1 := index(world_y[1] - y_range[0] - edge_y, height)
+		if x0 != x1 || y0 != y1 {
+			break
+		}
+		tile = Tile{Z: z, X: int(x0), Y: int(y0)}
+	}
+
+	return tile
+}
+
+// HeaderBBox returns the region in nanodegrees, as used in the PBF file header.
+func (r *Region) HeaderBBox() *OSMPBF.HeaderBBox {
+	return &OSMPBF.HeaderBBox{
+		Left: int64(math.Round(r.Left * 1e9)),
+		Right: int64(math.Round(r.Right * 1e9)),
+		Top: int64(math.Round(r.Top * 1e9)),
+		Bottom: int64(math.Round(r.Bottom * 1e9)),
+	}
+}
+
+func (r *Region) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", r.Left, r.Bottom, r.Right, r.Top)
+}
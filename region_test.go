@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestParseRegion(t *testing.T) {
+	r, err := ParseRegion("-0.5, 51.25,0.25,51.75")
+	if err != nil {
+		t.Fatalf("Unable to parse region: %s", err.Error())
+	}
+	if *r != (Region{-0.5, 51.25, 0.25, 51.75}) {
+		t.Errorf("Unexpected region %v.", r)
+	}
+
+	for _, bad := range []string{"", "1,2,3", "a,b,c,d", "10,0,5,1", "0,10,1,5", "-181,0,0,1", "0,0,1,91"} {
+		if _, err := ParseRegion(bad); err == nil {
+			t.Errorf("Expected an error parsing region %q.", bad)
+		}
+	}
+}
+
+func TestRegionTile(t *testing.T) {
+	tests := []struct {
+		region Region
+		zoom int
+		tile Tile
+	}{
+		// the whole world, or anything crossing the equator and meridian, can
+		// only start from the top.
+		{Region{-180, -90, 180, 90}, 8, Tile{0, 0, 0}},
+		{Region{-1, -1, 1, 1}, 8, Tile{0, 0, 0}},
+
+		// London.
+		{Region{-0.5, 51.25, -0.1, 51.75}, 16, Tile{6, 31, 21}},
+		{Region{-0.5, 51.25, -0.1, 51.75}, 4, Tile{2, 1, 1}},
+
+		// the start tile has to be above the target zoom.
+		{Region{5, 5, 15, 15}, 2, Tile{0, 0, 0}},
+		{Region{5, 5, 15, 15}, 4, Tile{2, 2, 1}},
+	}
+
+	for _, test := range tests {
+		if tile := test.region.Tile(WEB_MERCATOR, test.zoom); tile != test.tile {
+			t.Errorf("Expected region %s at zoom %d to start from %s, but got %s.", &test.region, test.zoom, test.tile, tile)
+		}
+	}
+
+	// a tile's own bbox should start from the tile itself.
+	for _, tile := range []Tile{{2, 1, 1}, {4, 8, 7}, {6, 63, 0}} {
+		r := RegionFromHeader(tile.BBox())
+		if r == nil {
+			t.Fatalf("Expected tile %s to have a usable bbox, but got %v.", tile, tile.BBox())
+		}
+		if got := r.Tile(WEB_MERCATOR, tile.Z + GRID_ZOOM_STEP); got != tile {
+			t.Errorf("Expected the bbox of tile %s to start from itself, but got %s.", tile, got)
+		}
+	}
+}
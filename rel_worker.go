@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"sync/atomic"
+)
+
+// memberRef is a reference from a relation to one of its members.
+type memberRef struct {
+	Type OSMPBF.Relation_MemberType
+	Id int64
+}
+
+type relWorker struct {
+	Relations *MultiBlock
+	// Map of relation member IDs to the relations which they are a member of.
+	// The masks of relation members aren't known until all the relations have
+	// been seen, so these are resolved afterwards by resolveSubRelations.
+	Parents map[int64][]int64
+	// Maps of node and way IDs to the grid squares they need to be in, in
+	// addition to their own, so that every relation they're part of is
+	// complete.
+	ExtraNodes, ExtraWays map[int64]uint64
+	// The node and way members of relations which have relation members. The
+	// masks of these relations can grow when the relation members are
+	// resolved, and then their other members need to grow too.
+	Members map[int64][]memberRef
+	Id int
+	Nodes, Ways *MultiBlock
+
+	// As in the wayWorker, the members of all the versions of the last relation
+	// seen, and their masks, which can't be checked until all its versions have
+	// been seen.
+	lastId int64
+	lastMask uint64
+	lastMembers []memberRef
+	lastMemberMasks []uint64
+	lastHasRelations bool
+
+	// As in the wayWorker, the first and last relations of each block are kept
+	// as seams, as their versions might be split across blocks.
+	Seams []relSeam
+	firstInBlock bool
+	lastIsSeam bool
+}
+
+// relSeam is a relation at the start or end of a block, with the squares of
+// the versions of it in that block, and their node and way members and the
+// members' own squares.
+type relSeam struct {
+	Id int64
+	Mask uint64
+	Members []memberRef
+	MemberMasks []uint64
+	HasRelations bool
+}
+
+func relWorkerLoop(ctx context.Context, workQueue chan chan *OSMPBF.PrimitiveBlock, quitChan chan bool, i int, resultChan chan chan *workerResult, nodes, ways *MultiBlock, spill *BlockSpill) {
+	w := &relWorker{
+		Relations: NewMultiBlock(),
+		Parents: map[int64][]int64{},
+		ExtraNodes: map[int64]uint64{},
+		ExtraWays: map[int64]uint64{},
+		Members: map[int64][]memberRef{},
+		Id: i,
+		Nodes: nodes,
+		Ways: ways,
+	}
+	w.Relations.Spill = spill
+	requestQueue := make(chan *OSMPBF.PrimitiveBlock)
+
+	for {
+		atomic.AddInt64(&metrics.IdleWorkers, 1)
+		select {
+		case workQueue <- requestQueue:
+		case ch := <-resultChan:
+			w.flushExtraMembers()
+			ch <- w.result()
+
+		case <-quitChan:
+			atomic.AddInt64(&metrics.IdleWorkers, -1)
+			return
+
+		case <-ctx.Done():
+			atomic.AddInt64(&metrics.IdleWorkers, -1)
+			return
+		}
+		atomic.AddInt64(&metrics.IdleWorkers, -1)
+
+		select {
+		case work := <-requestQueue:
+			w.processRelRequest(work)
+
+		case ch := <-resultChan:
+			w.flushExtraMembers()
+			ch <- w.result()
+
+		case <-quitChan:
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *relWorker) result() *workerResult {
+	return &workerResult{
+		Elements: w.Relations,
+		ExtraNodes: w.ExtraNodes,
+		ExtraWays: w.ExtraWays,
+		Parents: w.Parents,
+		Members: w.Members,
+		RelSeams: w.Seams,
+	}
+}
+
+func (w *relWorker) processRelRequest(b *OSMPBF.PrimitiveBlock) {
+	w.firstInBlock = true
+	for _, g := range b.Primitivegroup {
+		for _, r := range g.Relations {
+			w.putRelation(*r.Id, r.Memids, r.Types)
+		}
+	}
+
+	// the last relation might carry on in the next block, which another worker
+	// could see, so it's finished here as a seam.
+	if !w.firstInBlock {
+		w.lastIsSeam = true
+	}
+	w.flushExtraMembers()
+}
+
+// putRelation sets the mask of the relation to cover all of its node and way
+// members. Relation members are recorded, but their contribution isn't known
+// until later.
+func (w *relWorker) putRelation(id int64, memids []int64, types []OSMPBF.Relation_MemberType) {
+	if id != w.lastId || w.firstInBlock {
+		w.flushExtraMembers()
+		w.lastId = id
+		w.lastIsSeam = w.firstInBlock
+		w.firstInBlock = false
+	}
+
+	mask := uint64(0)
+	var memid int64
+
+	for i, delta := range memids {
+		memid += delta
+
+		switch types[i] {
+		case OSMPBF.Relation_NODE:
+			m := w.Nodes.Lookup(memid)
+			mask = mask | m
+			w.lastMembers = append(w.lastMembers, memberRef{Type: types[i], Id: memid})
+			w.lastMemberMasks = append(w.lastMemberMasks, m)
+
+		case OSMPBF.Relation_WAY:
+			m := w.Ways.Lookup(memid)
+			mask = mask | m
+			w.lastMembers = append(w.lastMembers, memberRef{Type: types[i], Id: memid})
+			w.lastMemberMasks = append(w.lastMemberMasks, m)
+
+		case OSMPBF.Relation_RELATION:
+			w.lastHasRelations = true
+			// versions of the same relation are contiguous, so checking the last
+			// parent is enough to avoid most duplicates.
+			parents := w.Parents[memid]
+			if len(parents) == 0 || parents[len(parents)-1] != id {
+				w.Parents[memid] = append(parents, id)
+			}
+		}
+	}
+
+	w.Relations.Append(id, mask)
+	w.lastMask = w.lastMask | mask
+}
+
+// flushExtraMembers records any node and way members of the last relation seen
+// which need to be in extra grid squares, so that each version of the relation
+// is complete in every square it's in.
+func (w *relWorker) flushExtraMembers() {
+	for i, m := range w.lastMembers {
+		m_mask := w.lastMemberMasks[i]
+		if m_mask != w.lastMask {
+			extra := w.ExtraNodes
+			if m.Type == OSMPBF.Relation_WAY {
+				extra = w.ExtraWays
+			}
+			extra[m.Id] = extra[m.Id] | (w.lastMask & ^m_mask)
+		}
+	}
+
+	if w.lastHasRelations && len(w.lastMembers) > 0 {
+		w.Members[w.lastId] = append([]memberRef(nil), w.lastMembers...)
+	}
+
+	if w.lastIsSeam {
+		w.Seams = append(w.Seams, relSeam{
+			Id: w.lastId,
+			Mask: w.lastMask,
+			Members: append([]memberRef(nil), w.lastMembers...),
+			MemberMasks: append([]uint64(nil), w.lastMemberMasks...),
+			HasRelations: w.lastHasRelations,
+		})
+		w.lastIsSeam = false
+	}
+
+	w.lastMask = 0
+	w.lastMembers = w.lastMembers[:0]
+	w.lastMemberMasks = w.lastMemberMasks[:0]
+	w.lastHasRelations = false
+}
+
+// resolveSubRelations works out the extra grid squares that each relation
+// needs because of its relation members. A relation is put in every square
+// that any of its members, however deeply nested, is in. This is done once all
+// the relations have been seen, as members can have higher IDs than the
+// relation which they are in, and can form cycles.
+//
+// The masks of relations only ever grow, so propagating them from members to
+// parents until nothing changes is guaranteed to terminate, even when there are
+// cycles. Relation members which aren't in the file contribute nothing.
+//
+// The returned map contains the new masks of any relations which have changed.
+func resolveSubRelations(rels *MultiBlock, parents map[int64][]int64) map[int64]uint64 {
+	masks := make(map[int64]uint64)
+	mask := func(id int64) uint64 {
+		m, ok := masks[id]
+		if !ok {
+			m = rels.Lookup(id)
+			masks[id] = m
+		}
+		return m
+	}
+
+	queue := make([]int64, 0, len(parents))
+	for child, _ := range parents {
+		queue = append(queue, child)
+	}
+
+	changed := make(map[int64]uint64)
+	for len(queue) > 0 {
+		child := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		child_mask := mask(child)
+
+		for _, parent := range parents[child] {
+			parent_mask := mask(parent)
+			if parent_mask | child_mask != parent_mask {
+				masks[parent] = parent_mask | child_mask
+				changed[parent] = parent_mask | child_mask
+				// the parent might itself be a member of other relations, which
+				// will need to be updated too.
+				if _, ok := parents[parent]; ok {
+					queue = append(queue, parent)
+				}
+			}
+		}
+	}
+
+	return changed
+}
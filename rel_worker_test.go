@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSubRelations(t *testing.T) {
+	rels := NewMultiBlock()
+	// relation 1 contains relation 4, a forward reference. relations 2 and 3
+	// contain each other, and 3 also contains 1. relation 5 contains a relation
+	// which isn't in the file.
+	rels.Append(1, 1)
+	rels.Append(2, 2)
+	rels.Append(3, 4)
+	rels.Append(4, 8)
+	rels.Append(5, 16)
+	parents := map[int64][]int64{
+		4: {1},
+		1: {3},
+		2: {3},
+		3: {2},
+		6: {5},
+	}
+
+	rels.Merge(NewMultiBlockFromMap(resolveSubRelations(rels, parents)))
+
+	expected := map[int64]uint64{1: 9, 2: 15, 3: 15, 4: 8, 5: 16, 6: 0}
+	for id, mask := range expected {
+		val := rels.Lookup(id)
+		if val != mask {
+			t.Errorf("Expected relation %d to have mask %d, but got %d.", id, mask, val)
+		}
+	}
+}
+
+func TestPutRelation(t *testing.T) {
+	nodes := NewMultiBlock()
+	nodes.Append(1, 1)
+	nodes.Append(2, 2)
+	ways := NewMultiBlock()
+	ways.Append(1, 4)
+
+	w := &relWorker{
+		Relations: NewMultiBlock(),
+		Parents: map[int64][]int64{},
+		ExtraNodes: map[int64]uint64{},
+		ExtraWays: map[int64]uint64{},
+		Members: map[int64][]memberRef{},
+		Nodes: nodes,
+		Ways: ways,
+	}
+	// member IDs are delta-coded, so these are node 2, way 1 and relation 7.
+	types := []OSMPBF.Relation_MemberType{OSMPBF.Relation_NODE, OSMPBF.Relation_WAY, OSMPBF.Relation_RELATION}
+	w.putRelation(10, []int64{2, -1, 6}, types)
+	// the second version drops the way, but the node still needs to be in its
+	// square.
+	w.putRelation(10, []int64{2}, types[:1])
+	w.flushExtraMembers()
+
+	if val := w.Relations.Lookup(10); val != 6 {
+		t.Errorf("Expected relation mask 6, but got %d.", val)
+	}
+	if len(w.Parents[7]) != 1 || w.Parents[7][0] != 10 {
+		t.Errorf("Expected relation 7 to have parent 10, but got %v.", w.Parents[7])
+	}
+	if w.ExtraNodes[2] != 4 || w.ExtraWays[1] != 2 || len(w.ExtraNodes) != 1 || len(w.ExtraWays) != 1 {
+		t.Errorf("Expected node 2 to need square 4 and way 1 square 2, but got %v and %v.", w.ExtraNodes, w.ExtraWays)
+	}
+	if len(w.Members[10]) != 3 {
+		t.Errorf("Expected the node and way members of relation 10 to be kept, but got %v.", w.Members[10])
+	}
+}
+
+
+// writeRelSeamInput writes a history file with a relation whose two versions
+// are in different blocks, and each use a node in a different grid square. The
+// second version also has a relation member, whose node is in a third square.
+func writeRelSeamInput(t *testing.T, in string) {
+	header := &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}
+	w, err := NewPBFWriter(in, header)
+	if err != nil {
+		t.Fatalf("Unable to create input file: %s", err.Error())
+	}
+
+	w.WriteNode(&Node{Id: 1, Lon: -100e9, Lat: -40e9, Info: Info{Version: 1, Visible: true}})
+	w.WriteNode(&Node{Id: 2, Lon: 100e9, Lat: 40e9, Info: Info{Version: 1, Visible: true}})
+	w.WriteNode(&Node{Id: 3, Lon: 100e9, Lat: -40e9, Info: Info{Version: 1, Visible: true}})
+	for id := int64(1); id < MAX_BLOCK_ENTITIES; id += 1 {
+		w.WriteRelation(&Relation{Id: id, Members: []Member{{OSMPBF.Relation_NODE, 1, ""}}, Info: Info{Version: 1, Visible: true}})
+	}
+	w.WriteRelation(&Relation{Id: MAX_BLOCK_ENTITIES, Members: []Member{{OSMPBF.Relation_NODE, 1, ""}}, Info: Info{Version: 1, Visible: true}})
+	w.WriteRelation(&Relation{Id: MAX_BLOCK_ENTITIES, Members: []Member{{OSMPBF.Relation_NODE, 2, ""}, {OSMPBF.Relation_RELATION, MAX_BLOCK_ENTITIES + 1, ""}}, Info: Info{Version: 2, Visible: true}})
+	w.WriteRelation(&Relation{Id: MAX_BLOCK_ENTITIES + 1, Members: []Member{{OSMPBF.Relation_NODE, 3, ""}}, Info: Info{Version: 1, Visible: true}})
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close input file: %s", err.Error())
+	}
+}
+
+func TestRelationSeams(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	writeRelSeamInput(t, in)
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+
+	check := func(name string, sorter *Sorter) {
+		mask := sorter.Nodes.Lookup(1) | sorter.Nodes.Lookup(2) | sorter.Nodes.Lookup(3)
+		if val := sorter.Relations.Lookup(MAX_BLOCK_ENTITIES); val != mask {
+			t.Errorf("%s: expected the split relation to have mask %#x, but got %#x.", name, mask, val)
+		}
+		// both the node members need to be in every square of the split
+		// relation, including the one from its relation member.
+		for id := int64(1); id <= 2; id += 1 {
+			if val := sorter.Nodes.Lookup(id); val != mask {
+				t.Errorf("%s: expected node %d to be in every square of the split relation, %#x, but got %#x.", name, id, mask, val)
+			}
+		}
+	}
+
+	// plenty of workers, so that the two blocks are very unlikely to go to
+	// the same one.
+	for i := 0; i < 5; i += 1 {
+		reader := openTestInput(t, in)
+		sorter, _ := NewSorter(context.Background(), 8, x_range, y_range)
+		blocks := appendAll(t, reader, sorter)
+		reader.Close()
+		if err := sorter.Finish(); err != nil {
+			t.Fatalf("Unable to finish sorting: %s", err.Error())
+		}
+		check("Sorted", sorter)
+		sorter.Close()
+
+		// the seams have to survive a checkpoint between the two blocks.
+		reader = openTestInput(t, in)
+		sorter, _ = NewSorter(context.Background(), 8, x_range, y_range)
+		var buf bytes.Buffer
+		for _, b := range blocks {
+			if err := sorter.Append(b.Primitives); err != nil {
+				t.Fatalf("Unable to append block: %s", err.Error())
+			}
+			if _, _, r := primCount(b.Primitives); r > 2 {
+				if err := sorter.Checkpoint(&buf, b.Next, b.Index + 1); err != nil {
+					t.Fatalf("Unable to checkpoint: %s", err.Error())
+				}
+				break
+			}
+		}
+		sorter.Close()
+
+		sorter, offset, index, err := ResumeSorter(context.Background(), &buf, 8, x_range, y_range, SorterOptions{})
+		if err != nil {
+			t.Fatalf("Unable to resume: %s", err.Error())
+		}
+		if err = reader.SeekBlob(offset, index); err != nil {
+			t.Fatalf("Unable to seek to blob %d: %s", index, err.Error())
+		}
+		appendAll(t, reader, sorter)
+		reader.Close()
+		if err = sorter.Finish(); err != nil {
+			t.Fatalf("Unable to finish sorting: %s", err.Error())
+		}
+		check("Resumed", sorter)
+		sorter.Close()
+	}
+}
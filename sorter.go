@@ -1,19 +1,30 @@
 package main
 
 import (
+	"context"
 	"github.com/mapzen/neatlacoche/OSMPBF"
 	"fmt"
+	"sync"
+	"sync/atomic"
 )
 
 // Sorter handles sorting nodes, ways and relations into one or many grid
 // squares in a concurrent fashion.
 type Sorter struct {
+	// All the worker goroutines stop when this is cancelled, after which the
+	// Sorter can only be closed.
+	ctx context.Context
+	cancel context.CancelFunc
+
+	// Tracks the worker goroutines, so that Close can wait for them to stop.
+	wg sync.WaitGroup
+
 	// Quit channels for each of the workers
 	workers []chan bool
 
 	// Channels to receive back the results of the worker computation; a map of
 	// the item IDs to their grid square(s).
-	results []chan chan *MultiBlock
+	results []chan chan *workerResult
 
 	// Channel of workers which are ready to start work.
 	workQueue chan chan *OSMPBF.PrimitiveBlock
@@ -25,35 +36,193 @@ type Sorter struct {
 	// The global maps of item IDs to their grids. Once a kind has been completed,
 	// a read-only copy of the whole data structure is kept here and referenced by
 	// later kind computations.
-	Nodes, Ways *MultiBlock
+	Nodes, Ways, Relations *MultiBlock
+
+	// Results collected from the workers of the current kind by a Checkpoint,
+	// which have to be merged with the rest when the kind is complete.
+	partial *MultiBlock
+
+	// Map of relation IDs to the relations which they are members of, and the
+	// node and way members of relations which have relation members, collected
+	// from the relation workers.
+	relParents map[int64][]int64
+	relMembers map[int64][]memberRef
+
+	// Extra grid squares which nodes and ways need to be in so that the ways and
+	// relations which use them are complete. These are collected from the
+	// workers, and merged in once all the kinds have been computed, so that they
+	// don't affect the masks of the elements which use them.
+	extraNodes, extraWays map[int64]uint64
+
+	// Extra grid squares for nodes from the way workers, which there are far
+	// more of than from the relation workers.
+	wayExtraNodes *MultiBlock
+
+	// The ways at the start and end of each block, collected from the way
+	// workers, and matched up by joinWaySeams once all the ways have been
+	// seen.
+	waySeams map[int64][]waySeam
+
+	// The same for relations, matched up by joinRelSeams.
+	relSeams map[int64][]relSeam
+
+	// Extra grid squares for nodes, found by completeWays.
+	completionNodes map[int64]uint64
+
+	// Keeps the frozen Blocks of all the MultiBlocks, including the workers',
+	// within the memory budget, if there is one.
+	spill *BlockSpill
 
 	// Number of processes to run.
 	numProcs int
 
-	// Range in X & Y coordinates to use for the grid.
+	// Tiling scheme which the nodes are projected with, and the range in its
+	// X & Y coordinates to use for the grid.
+	scheme TilingScheme
 	xRange, yRange [2]float64
+
+	// Range in X & Y coordinates outside which nodes aren't put in any grid
+	// square, which is the same as the grid unless it's clipped to a region.
+	clipX, clipY [2]float64
+
+	// What to do with nodes which can't be projected onto the grid.
+	policy OutOfRangePolicy
+
+	// IDs of the nodes which were out of range and go in the polar file, and
+	// counts of all the out of range nodes.
+	Polar *MultiBlock
+	OutOfRange OutOfRangeStats
+
+	// In time-aware mode, the versions of the nodes which have moved between
+	// grid squares, which the way workers use to match each version of a way
+	// with where its nodes were at the time. It's dropped once the ways are
+	// done.
+	timeAware bool
+	nodeHistory NodeHistory
+
+	// Whether the input has deleted versions, which don't have a location.
+	historical bool
 }
 
-// NewSorter sets up a new Sorter and starts its worker goroutines.
-func NewSorter(numProcs int, xRange, yRange [2]float64) (*Sorter, error) {
+// SorterOptions are the optional settings for a Sorter.
+type SorterOptions struct {
+	// If given, only the nodes inside the region are sorted into grid
+	// squares. The rest are left out, unless they're needed to complete a way
+	// or relation.
+	Clip *Region
+
+	// What to do with nodes which can't be projected onto the grid.
+	OutOfRange OutOfRangePolicy
+
+	// The tiling scheme which the grid's ranges are in, which is Web Mercator
+	// if not given.
+	Scheme TilingScheme
+
+	// If set, each version of a way only goes into the grid squares which its
+	// nodes were in while it was current, rather than every square they've
+	// ever been in. This needs timestamps on the nodes and ways.
+	TimeAware bool
+
+	// Set if the input has the "HistoricalInformation" feature, so that its
+	// deleted versions of nodes, which have no location, aren't put in any
+	// grid square.
+	Historical bool
+
+	// If non-zero, the approximate number of bytes which the frozen Blocks of
+	// the Sorter's MultiBlocks may use. Beyond that, the least recently used
+	// ones are written to a spill file in SpillDir, and read back in when
+	// they're needed.
+	MemoryBudget int
+	SpillDir string
+}
+
+// NewSorter sets up a new Sorter and starts its worker goroutines, which run
+// until the Sorter is closed or the context is cancelled.
+func NewSorter(ctx context.Context, numProcs int, xRange, yRange [2]float64) (*Sorter, error) {
+	s := newSorter(ctx, numProcs, xRange, yRange)
+	s.startWorkers(PKIND_NODE)
+	return s, nil
+}
+
+// NewSorterWithOptions is like NewSorter, but with the optional settings.
+func NewSorterWithOptions(ctx context.Context, numProcs int, xRange, yRange [2]float64, opts SorterOptions) (*Sorter, error) {
+	s := newSorter(ctx, numProcs, xRange, yRange)
+	if opts.Scheme != nil {
+		s.scheme = opts.Scheme
+	}
+	if opts.Clip != nil {
+		s.clipX, s.clipY = opts.Clip.Extent(s.scheme)
+	}
+	s.policy = opts.OutOfRange
+	s.timeAware = opts.TimeAware
+	if s.timeAware {
+		s.nodeHistory = make(NodeHistory)
+	}
+	s.historical = opts.Historical
+	if opts.MemoryBudget > 0 {
+		spill, err := NewBlockSpill(opts.SpillDir, opts.MemoryBudget)
+		if err != nil {
+			s.cancel()
+			return nil, err
+		}
+		s.spill = spill
+		s.partial.Spill, s.Polar.Spill, s.wayExtraNodes.Spill = spill, spill, spill
+	}
+	s.startWorkers(PKIND_NODE)
+	return s, nil
+}
+
+// newSorter sets up a Sorter at the start of the nodes, but doesn't start any
+// workers.
+func newSorter(ctx context.Context, numProcs int, xRange, yRange [2]float64) *Sorter {
 	s := new(Sorter)
+	s.ctx, s.cancel = context.WithCancel(ctx)
 	s.workQueue = make(chan chan *OSMPBF.PrimitiveBlock)
 	s.numProcs = numProcs
+	s.scheme = WEB_MERCATOR
 	s.xRange = xRange
 	s.yRange = yRange
+	s.clipX = xRange
+	s.clipY = yRange
 	s.lastKind = PKIND_NODE
-
-	s.startNodesWorkers()
-
-	return s, nil
+	s.partial = NewMultiBlock()
+	s.Polar = NewMultiBlock()
+	s.relParents = make(map[int64][]int64)
+	s.relMembers = make(map[int64][]memberRef)
+	s.extraNodes = make(map[int64]uint64)
+	s.extraWays = make(map[int64]uint64)
+	s.wayExtraNodes = NewMultiBlock()
+	s.waySeams = make(map[int64][]waySeam)
+	s.relSeams = make(map[int64][]relSeam)
+	return s
 }
 
-// Close cleans up the worker goroutines associated with this Sorter.
+// Close stops the worker goroutines associated with this Sorter, and waits for
+// them to finish. If there's a memory budget, then the spill file is removed,
+// and the MultiBlocks can't be used any more.
 func (s *Sorter) Close() {
-	for _, ch := range s.workers {
-		ch <- true
-	}
+	s.cancel()
+	s.wg.Wait()
+	s.workers = nil
+	s.results = nil
 	close(s.workQueue)
+	if s.spill != nil {
+		s.spill.Close()
+	}
+}
+
+// startWorker runs a worker loop in a goroutine which Close will wait for.
+func (s *Sorter) startWorker(loop func(quitChan chan bool, resultChan chan chan *workerResult)) {
+	quitChan := make(chan bool)
+	resultChan := make(chan chan *workerResult)
+	s.workers = append(s.workers, quitChan)
+	s.results = append(s.results, resultChan)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		loop(quitChan, resultChan)
+	}()
 }
 
 const (
@@ -69,92 +238,461 @@ var PKIND_NAMES = [...]string{"node", "way", "relation"}
 // primitive block, the PBF reader should ensure that we are given a different
 // block for each. This allows us to stop at a block boundary to collect the
 // results of the previous kind computation.
-func primitiveBlockKind(p *OSMPBF.PrimitiveBlock) int {
+func primitiveBlockKind(p *OSMPBF.PrimitiveBlock) (int, error) {
 	nodes, ways, rels := primCount(p)
 
 	if nodes > 0 {
 		if ways > 0 || rels > 0 {
-			panic(fmt.Sprintf("Block has %d nodes, but also %d ways and %d relations. Can only handle blocks containing a single type.", nodes, ways, rels))
+			return 0, fmt.Errorf("Block has %d nodes, but also %d ways and %d relations. Can only handle blocks containing a single type.", nodes, ways, rels)
 		}
-		return PKIND_NODE
+		return PKIND_NODE, nil
 
 	} else if ways > 0 {
 		if rels > 0 {
-			panic(fmt.Sprintf("Block has %d ways, but also %d relations. Can only handle blocks containing a single type.", ways, rels))
+			return 0, fmt.Errorf("Block has %d ways, but also %d relations. Can only handle blocks containing a single type.", ways, rels)
 		}
-		return PKIND_WAY
+		return PKIND_WAY, nil
 
 	} else {
-		return PKIND_REL
+		return PKIND_REL, nil
 	}
 }
 
+// workerResult is what each worker hands back when the results of a kind
+// computation are collected.
+type workerResult struct {
+	// Map of the item IDs to their grid square(s).
+	Elements *MultiBlock
+
+	// Maps of node and way IDs to the extra grid squares they need to be in so
+	// that the ways and relations which use them are complete.
+	ExtraNodes, ExtraWays map[int64]uint64
+
+	// The extra grid squares for nodes, and the ways at the start and end of
+	// each block, only from way workers.
+	WayExtraNodes *MultiBlock
+	Seams []waySeam
+
+	// The relations at the start and end of each block, only from relation
+	// workers.
+	RelSeams []relSeam
+
+	// Map of relation IDs to the relations which they are members of, and the
+	// node and way members of relations which have relation members. Only
+	// filled in by relation workers.
+	Parents map[int64][]int64
+	Members map[int64][]memberRef
+
+	// The nodes which were out of range, only from node workers.
+	Polar *MultiBlock
+	OutOfRange OutOfRangeStats
+
+	// The versions of the nodes which moved, only from node workers in
+	// time-aware mode.
+	History NodeHistory
+}
+
+// Finish collects the results of the last kind computation, which Append only
+// does when it sees the next kind, and adds the extra nodes and ways needed to
+// make the ways and relations complete. It must be called after the last block
+// has been appended, and before Nodes, Ways or Relations are used. Any kind
+// which wasn't present in the input is left as an empty MultiBlock.
+func (s *Sorter) Finish() error {
+	var err error
+	if s.lastKind == PKIND_NODE {
+		s.Nodes = s.takePartial()
+		err = s.collect(s.Nodes)
+	}
+	if s.lastKind == PKIND_WAY {
+		s.Ways = s.takePartial()
+		err = s.collect(s.Ways)
+		s.joinWaySeams()
+	}
+	if s.lastKind == PKIND_REL {
+		err = s.collectRelations()
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.Nodes == nil {
+		s.Nodes = NewMultiBlock()
+	}
+	if s.Ways == nil {
+		s.Ways = NewMultiBlock()
+	}
+	if s.Relations == nil {
+		s.Relations = NewMultiBlock()
+	}
+
+	s.Nodes.Merge(NewMultiBlockFromMap(s.extraNodes))
+	s.Nodes.Merge(s.wayExtraNodes)
+	s.Ways.Merge(NewMultiBlockFromMap(s.extraWays))
+	s.extraNodes = nil
+	s.wayExtraNodes = nil
+	s.nodeHistory = nil
+
+	return s.spillErr()
+}
+
+// MemoryUsage returns the approximate number of bytes used by the MultiBlocks
+// which have been collected from the workers. The workers' own MultiBlocks
+// aren't counted until they're collected, at the end of each kind or by a
+// checkpoint.
+func (s *Sorter) MemoryUsage() int {
+	total := 0
+	for _, mb := range []*MultiBlock{s.Nodes, s.Ways, s.Relations, s.Polar, s.partial, s.wayExtraNodes} {
+		if mb != nil {
+			total += mb.MemoryUsage()
+		}
+	}
+	return total
+}
+
+// NeedsWayCompletion returns true if some ways were put into extra grid squares
+// because of the relations they're in. The nodes of those ways also need to be
+// in the extra squares, but the Sorter doesn't keep the ways' nodes, so the
+// way blocks need to be passed to CompleteWays.
+func (s *Sorter) NeedsWayCompletion() bool {
+	return len(s.extraWays) > 0
+}
+
+// CompleteWays looks through a block for ways which were put into extra grid
+// squares by Finish, and records extra squares for their nodes so that they
+// are complete. Blocks which don't contain ways are ignored.
+func (s *Sorter) CompleteWays(p *OSMPBF.PrimitiveBlock) {
+	if s.completionNodes == nil {
+		s.completionNodes = make(map[int64]uint64)
+	}
+
+	for _, g := range p.Primitivegroup {
+		for _, way := range g.Ways {
+			if _, ok := s.extraWays[way.Id]; !ok {
+				continue
+			}
+
+			mask := s.Ways.Lookup(way.Id)
+			var ref int64
+			for _, delta := range way.Refs {
+				ref += delta
+				nd_mask := s.Nodes.Lookup(ref)
+				if nd_mask | mask != nd_mask {
+					s.completionNodes[ref] = s.completionNodes[ref] | (mask & ^nd_mask)
+				}
+			}
+		}
+	}
+}
+
+// FinishWayCompletion merges the extra node grid squares found by CompleteWays
+// into Nodes.
+func (s *Sorter) FinishWayCompletion() {
+	s.Nodes.Merge(NewMultiBlockFromMap(s.completionNodes))
+	s.completionNodes = nil
+	s.extraWays = nil
+}
+
 // collect results from a kind computation and merge together to make a single,
 // global (and constant) map which will be referenced in later computations.
 // Also shuts down the workers associated with the current kind.
-func (s *Sorter) collect(mb *MultiBlock) {
+func (s *Sorter) collect(mb *MultiBlock) error {
 	// send a ping to all workers to collect results
-	ch := make(chan *MultiBlock)
+	ch := make(chan *workerResult)
 	for i, r := range s.results {
-		r <- ch
-		rmb := <-ch
-		mb.Merge(rmb)
-		s.workers[i] <- true
+		var res *workerResult
+		select {
+		case r <- ch:
+			res = <-ch
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+
+		mb.Merge(res.Elements)
+		if res.Polar != nil {
+			s.Polar.Merge(res.Polar)
+		}
+		s.OutOfRange.Add(&res.OutOfRange)
+		if res.History != nil {
+			s.nodeHistory.merge(res.History)
+		}
+		mergeExtra(s.extraNodes, res.ExtraNodes)
+		if res.WayExtraNodes != nil {
+			s.wayExtraNodes.Merge(res.WayExtraNodes)
+		}
+		for _, seam := range res.Seams {
+			s.waySeams[seam.Id] = append(s.waySeams[seam.Id], seam)
+		}
+		for _, seam := range res.RelSeams {
+			s.relSeams[seam.Id] = append(s.relSeams[seam.Id], seam)
+		}
+		mergeExtra(s.extraWays, res.ExtraWays)
+		for child, parents := range res.Parents {
+			s.relParents[child] = append(s.relParents[child], parents...)
+		}
+		for id, members := range res.Members {
+			s.relMembers[id] = append(s.relMembers[id], members...)
+		}
+		select {
+		case s.workers[i] <- true:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
 	}
 	s.results = nil
 	s.workers = nil
+
+	return s.spillErr()
+}
+
+// spillErr returns the first error from the spill file, if there is one. The
+// workers can't stop for it, so it's checked whenever their results are
+// collected.
+func (s *Sorter) spillErr() error {
+	if s.spill == nil {
+		return nil
+	}
+	return s.spill.Err()
+}
+
+// takePartial returns the results which have already been collected for the
+// current kind, leaving an empty MultiBlock for the next one.
+func (s *Sorter) takePartial() *MultiBlock {
+	mb := s.partial
+	s.partial = NewMultiBlock()
+	s.partial.Spill = s.spill
+	return mb
+}
+
+// mergeExtra ORs the extra grid squares from src into dst.
+func mergeExtra(dst, src map[int64]uint64) {
+	for id, mask := range src {
+		dst[id] = dst[id] | mask
+	}
+}
+
+// joinWaySeams finds the ways whose versions were split across blocks, and so
+// could have been seen by different workers, and puts the nodes of each part
+// into the squares of the others. The ways' own masks are already right, as
+// the workers' results are OR-ed together.
+func (s *Sorter) joinWaySeams() {
+	extra := 0
+	for _, seams := range s.waySeams {
+		if len(seams) < 2 {
+			continue
+		}
+
+		mask := uint64(0)
+		for _, seam := range seams {
+			mask = mask | seam.Mask
+		}
+		for _, seam := range seams {
+			if seam.Mask == mask {
+				continue
+			}
+			for i, n := range seam.Refs {
+				if e := mask & ^(seam.RefMasks[i] | seam.Mask); e != 0 {
+					s.extraNodes[n] = s.extraNodes[n] | e
+					extra += 1
+				}
+			}
+		}
+	}
+	if extra > 0 {
+		atomic.AddInt64(&metrics.ExtraNodes, int64(extra))
+	}
+	s.waySeams = make(map[int64][]waySeam)
+}
+
+// joinRelSeams does the same as joinWaySeams for relations, putting the node
+// and way members of each part of a split relation into the squares of the
+// others. If any part has relation members, then the node and way members of
+// the other parts are kept too, so that they grow with the relation when its
+// relation members are resolved.
+func (s *Sorter) joinRelSeams() {
+	for id, seams := range s.relSeams {
+		if len(seams) < 2 {
+			continue
+		}
+
+		mask := uint64(0)
+		has_relations := false
+		for _, seam := range seams {
+			mask = mask | seam.Mask
+			has_relations = has_relations || seam.HasRelations
+		}
+		for _, seam := range seams {
+			if has_relations && !seam.HasRelations {
+				s.relMembers[id] = append(s.relMembers[id], seam.Members...)
+			}
+			if seam.Mask == mask {
+				continue
+			}
+			for i, m := range seam.Members {
+				extra := s.extraNodes
+				if m.Type == OSMPBF.Relation_WAY {
+					extra = s.extraWays
+				}
+				if e := mask & ^(seam.MemberMasks[i] | seam.Mask); e != 0 {
+					extra[m.Id] = extra[m.Id] | e
+				}
+			}
+		}
+	}
+	s.relSeams = make(map[int64][]relSeam)
+}
+
+// startWorkers starts the workers for a kind, which need the results of the
+// kinds before it.
+func (s *Sorter) startWorkers(kind int) {
+	switch kind {
+	case PKIND_NODE:
+		s.startNodesWorkers()
+	case PKIND_WAY:
+		s.startWaysWorkers(s.Nodes, s.nodeHistory)
+	case PKIND_REL:
+		s.startRelationsWorkers(s.Nodes, s.Ways)
+	}
 }
 
 func (s *Sorter) startNodesWorkers() {
 	for i := 0; i < s.numProcs; i += 1 {
-		quitChan := make(chan bool)
-		resultChan := make(chan chan *MultiBlock)
-		go nodeWorkerLoop(s.workQueue, quitChan, i, s.xRange, s.yRange, resultChan)
-		s.workers = append(s.workers, quitChan)
-		s.results = append(s.results, resultChan)
+		i := i
+		grid := tileGrid{scheme: s.scheme, xRange: s.xRange, yRange: s.yRange, clipX: s.clipX, clipY: s.clipY}
+		s.startWorker(func(quitChan chan bool, resultChan chan chan *workerResult) {
+			nodeWorkerLoop(s.ctx, s.workQueue, quitChan, i, grid, s.policy, s.timeAware, s.historical, resultChan, s.spill)
+		})
+	}
+}
+
+func (s *Sorter) startWaysWorkers(nodes *MultiBlock, history NodeHistory) {
+	for i := 0; i < s.numProcs; i += 1 {
+		i := i
+		s.startWorker(func(quitChan chan bool, resultChan chan chan *workerResult) {
+			wayWorkerLoop(s.ctx, s.workQueue, quitChan, i, resultChan, nodes, history, s.spill)
+		})
 	}
 }
 
-func (s *Sorter) startWaysWorkers(nodes *MultiBlock) {
+func (s *Sorter) startRelationsWorkers(nodes, ways *MultiBlock) {
 	for i := 0; i < s.numProcs; i += 1 {
-		quitChan := make(chan bool)
-		resultChan := make(chan chan *MultiBlock)
-		go wayWorkerLoop(s.workQueue, quitChan, i, resultChan, nodes)
-		s.workers = append(s.workers, quitChan)
-		s.results = append(s.results, resultChan)
+		i := i
+		s.startWorker(func(quitChan chan bool, resultChan chan chan *workerResult) {
+			relWorkerLoop(s.ctx, s.workQueue, quitChan, i, resultChan, nodes, ways, s.spill)
+		})
+	}
+}
+
+// collectRelations collects the results of the relation workers and then adds
+// in the grid squares of each relation's relation members.
+//
+// Relation members are also put into all the squares of the relations they're
+// in, so that each relation is complete. However, this doesn't go any deeper;
+// the members of a relation member only go into its own squares. This is
+// similar to osmium's "smart" extract strategy, and avoids pulling whole
+// continents of data into every square which a route master touches.
+func (s *Sorter) collectRelations() error {
+	s.Relations = s.takePartial()
+	err := s.collect(s.Relations)
+	if err != nil {
+		return err
 	}
+	s.joinRelSeams()
+
+	changed := resolveSubRelations(s.Relations, s.relParents)
+	mask := func(id int64) uint64 {
+		if m, ok := changed[id]; ok {
+			return m
+		}
+		return s.Relations.Lookup(id)
+	}
+
+	// relations which have grown need their node and way members to grow with
+	// them.
+	for id, rel_mask := range changed {
+		for _, m := range s.relMembers[id] {
+			extra, elements := s.extraNodes, s.Nodes
+			if m.Type == OSMPBF.Relation_WAY {
+				extra, elements = s.extraWays, s.Ways
+			}
+			if e := rel_mask & ^elements.Lookup(m.Id); e != 0 {
+				extra[m.Id] = extra[m.Id] | e
+			}
+		}
+	}
+
+	extra := make(map[int64]uint64)
+	for child, parents := range s.relParents {
+		child_mask := mask(child)
+		for _, parent := range parents {
+			if e := mask(parent) & ^child_mask; e != 0 {
+				extra[child] = extra[child] | e
+			}
+		}
+	}
+
+	s.Relations.Merge(NewMultiBlockFromMap(changed))
+	s.Relations.Merge(NewMultiBlockFromMap(extra))
+	s.relParents = nil
+	s.relMembers = nil
+
+	return nil
 }
 
 // Appends a block to the Sorter, sending it to an appropriate worker for
 // computation.
 func (s *Sorter) Append(p *OSMPBF.PrimitiveBlock) error {
-	kind := primitiveBlockKind(p)
+	kind, err := primitiveBlockKind(p)
+	if err != nil {
+		return err
+	}
+	nodes, ways, rels := primCount(p)
+	atomic.AddInt64(&metrics.Elements[kind], int64(nodes + ways + rels))
 
 	if kind != s.lastKind {
 		if kind < s.lastKind {
-			return fmt.Errorf("Block kind %q cannot follow kind %d, they must occur in order.", PKIND_NAMES[kind], PKIND_NAMES[s.lastKind])
+			return fmt.Errorf("Block kind %q cannot follow kind %q, they must occur in order.", PKIND_NAMES[kind], PKIND_NAMES[s.lastKind])
 		}
 
 		if (s.lastKind == PKIND_NODE) {
-			s.Nodes = NewMultiBlock()
-			s.collect(s.Nodes)
+			s.Nodes = s.takePartial()
+			err = s.collect(s.Nodes)
+			if err != nil {
+				return err
+			}
 		}
 		if (kind == PKIND_WAY) {
-			s.startWaysWorkers(s.Nodes)
+			s.startWaysWorkers(s.Nodes, s.nodeHistory)
 		}
 		if (s.lastKind == PKIND_WAY) {
-			s.Ways = NewMultiBlock()
-			s.collect(s.Ways)
-			// TODO collect extra nodes as well
+			s.Ways = s.takePartial()
+			err = s.collect(s.Ways)
+			if err != nil {
+				return err
+			}
+			s.joinWaySeams()
+			s.nodeHistory = nil
+		}
+		if (kind == PKIND_REL) {
+			// there might not have been any ways in the file.
+			if s.Ways == nil {
+				s.Ways = NewMultiBlock()
+			}
+			s.startRelationsWorkers(s.Nodes, s.Ways)
 		}
 		// start up new workers
 		s.lastKind = kind
 	}
 
-	// TODO: handle relations, currently we ignore them
-	if kind != PKIND_REL {
-		req := <-s.workQueue
-		req <- p
+	select {
+	case req := <-s.workQueue:
+		select {
+		case req <- p:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+
+	case <-s.ctx.Done():
+		return s.ctx.Err()
 	}
 
 	return nil
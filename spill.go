@@ -0,0 +1,357 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockSpill keeps the frozen Blocks of MultiBlocks within a memory budget, by
+// writing the least recently used ones out to a file and reading them back in
+// when they're next needed. Frozen Blocks never change, so each one is only
+// written once, however many times it's evicted.
+//
+// A MultiBlock with a Spill wraps each Block it freezes in a spilledBlock,
+// which loads the Block if it's been evicted whenever it's used. The Blocks of
+// one MultiBlock are often used by many goroutines, so a resident Block is
+// only looked up under a read lock, and marked as used rather than moved in
+// the LRU list. This makes the order approximate, as eviction gives the Blocks
+// which have been used since it last saw them a second chance.
+//
+// Lookups have no way to return an error, so if the file can't be written or
+// read, the first error is kept and returned by Err. Blocks which can't be
+// written stay resident, over the budget, and Blocks which can't be read back
+// are all zeros.
+type BlockSpill struct {
+	mu sync.RWMutex
+	file *os.File
+	err error
+
+	// Offset at which the next evicted Block is written.
+	end int64
+
+	// Approximate bytes which the resident Blocks may use, and do use.
+	budget int
+	resident int
+
+	// The resident Blocks, most recently used at the front.
+	lru *list.List
+
+	// Number of Blocks written to and read from the file.
+	Evictions, Loads int64
+}
+
+// NewBlockSpill creates a spill file in the directory, which is removed when
+// the BlockSpill is closed. The budget is in bytes.
+func NewBlockSpill(dir string, budget int) (*BlockSpill, error) {
+	file, err := os.CreateTemp(dir, "spill-*.blocks")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create spill file: %s", err.Error())
+	}
+	return &BlockSpill{file: file, budget: budget, lru: list.New()}, nil
+}
+
+// Close removes the spill file. Any Blocks which were evicted can't be used
+// afterwards.
+func (s *BlockSpill) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := s.file.Name()
+	err := s.file.Close()
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	s.lru.Init()
+	s.resident = 0
+	return err
+}
+
+// Resident returns the approximate number of bytes used by the resident
+// Blocks.
+func (s *BlockSpill) Resident() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.resident
+}
+
+// Err returns the first error writing to or reading from the spill file.
+func (s *BlockSpill) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// add starts keeping track of a frozen Block, which might evict others.
+func (s *BlockSpill) add(block Block) Block {
+	if sb, ok := block.(*spilledBlock); ok {
+		if sb.spill == s {
+			return sb
+		}
+		block = unspill(sb)
+	}
+	sb := &spilledBlock{spill: s, enc: block.Encoding(), length: block.Len(), size: block.MemoryUsage(), offset: -1}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb.block = block
+	sb.elem = s.lru.PushFront(sb)
+	s.resident += sb.size
+	s.evict(sb)
+	return sb
+}
+
+// get returns the Block, loading it from the file if it was evicted, and
+// marks it as used.
+func (s *BlockSpill) get(sb *spilledBlock) Block {
+	s.mu.RLock()
+	block := sb.block
+	s.mu.RUnlock()
+	if block != nil {
+		atomic.StoreInt32(&sb.used, 1)
+		return block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(sb)
+}
+
+// load is get with the lock held.
+func (s *BlockSpill) load(sb *spilledBlock) Block {
+	if sb.block != nil {
+		if sb.elem != nil {
+			s.lru.MoveToFront(sb.elem)
+		}
+		return sb.block
+	}
+
+	raw := make([]byte, sb.bytes())
+	if _, err := s.file.ReadAt(raw, sb.offset); err != nil {
+		if s.err == nil {
+			s.err = fmt.Errorf("Unable to read Block back from spill file %q: %s", s.file.Name(), err.Error())
+		}
+		raw = make([]byte, sb.bytes())
+	}
+	if sb.enc.Wide {
+		sb.block = &WideBlock{frozen: true, enc: sb.enc, Values: decodeWords64(raw, false)}
+	} else {
+		sb.block = &PackedBlock{frozen: true, enc: sb.enc, length: sb.length, Values: decodeWords32(raw, false)}
+	}
+	s.Loads += 1
+
+	atomic.StoreInt32(&sb.used, 0)
+	sb.elem = s.lru.PushFront(sb)
+	s.resident += sb.size
+	s.evict(sb)
+	return sb.block
+}
+
+// release stops keeping track of the Block, loading it if needed, and returns
+// it. It must be called with the lock held.
+func (s *BlockSpill) release(sb *spilledBlock) Block {
+	block := s.load(sb)
+	if sb.elem != nil {
+		s.lru.Remove(sb.elem)
+		sb.elem = nil
+		s.resident -= sb.size
+	}
+	return block
+}
+
+// evict writes out the least recently used Blocks until the resident ones fit
+// in the budget, apart from keep, which has just been used. Once there's been
+// an error, nothing more is evicted. It must be called with the lock held.
+func (s *BlockSpill) evict(keep *spilledBlock) {
+	// Lookups can mark Blocks as used while this goes round, so each Block only
+	// gets one second chance.
+	chances := s.lru.Len()
+	for s.resident > s.budget && s.err == nil {
+		e := s.lru.Back()
+		sb := e.Value.(*spilledBlock)
+		if sb == keep {
+			return
+		}
+		if atomic.SwapInt32(&sb.used, 0) != 0 && chances > 0 {
+			chances -= 1
+			s.lru.MoveToFront(e)
+			continue
+		}
+
+		if sb.offset < 0 {
+			packed, wide := blockWords(sb.block)
+			raw := make([]byte, 0, sb.bytes())
+			for _, v := range packed {
+				raw = binary.LittleEndian.AppendUint32(raw, v)
+			}
+			for _, v := range wide {
+				raw = binary.LittleEndian.AppendUint64(raw, v)
+			}
+			if _, err := s.file.WriteAt(raw, s.end); err != nil {
+				if s.err == nil {
+					s.err = fmt.Errorf("Unable to write Block to spill file %q: %s", s.file.Name(), err.Error())
+				}
+				return
+			}
+			sb.offset = s.end
+			s.end += int64(len(raw))
+		}
+
+		s.lru.Remove(e)
+		sb.elem = nil
+		sb.block = nil
+		s.resident -= sb.size
+		s.Evictions += 1
+	}
+}
+
+// ByteSize is a number of bytes, which can be given as a flag with a K, M or G
+// suffix for kibibytes, mebibytes or gibibytes.
+type ByteSize int64
+
+func (b ByteSize) String() string {
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *ByteSize) Set(s string) error {
+	shift := 0
+	if n := len(s); n > 0 {
+		switch s[n - 1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		}
+		if shift > 0 {
+			s = s[:n - 1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64 >> shift {
+		return fmt.Errorf("Expected a number of bytes, optionally followed by K, M or G.")
+	}
+	*b = ByteSize(v << shift)
+	return nil
+}
+
+// spilledBlock is a frozen Block which a BlockSpill can evict. Every method
+// uses the Block itself, loading it first if it's been evicted, so it can be
+// used in place of the Block anywhere.
+type spilledBlock struct {
+	spill *BlockSpill
+	enc *BlockEncoding
+	length uint32
+	size int
+
+	// These are only used with the spill's lock held. The Block is nil while
+	// it's evicted, and elem is its place in the LRU list while it's resident.
+	block Block
+	elem *list.Element
+
+	// Set, atomically, when the resident Block is used.
+	used int32
+
+	// Where the Block was written in the spill file, or -1 if it hasn't been.
+	offset int64
+}
+
+// bytes returns the size of the Block's words in the spill file.
+func (b *spilledBlock) bytes() int {
+	if b.enc.Wide {
+		return 8 * int(b.length)
+	}
+	if b.length > b.enc.fullLength {
+		return 4 * int(b.enc.fullLength)
+	}
+	return 4 * int(b.length)
+}
+
+func (b *spilledBlock) Append(id uint32, val uint64) {
+	checkAppend(b, id, val)
+}
+
+func (b *spilledBlock) Lookup(id uint32) uint64 {
+	return b.spill.get(b).Lookup(id)
+}
+
+func (b *spilledBlock) UnAppend() (idx uint32, val uint64) {
+	panic("Attempt to unappend from a frozen Block, which is not allowed.")
+}
+
+func (b *spilledBlock) Reset() {
+	panic("Attempt to reset a frozen Block, which is not allowed.")
+}
+
+func (b *spilledBlock) Copy() Block {
+	return b.spill.get(b).Copy()
+}
+
+func (b *spilledBlock) CopyFrom(block2 Block) {
+	panic("Attempt to copy into a frozen Block, which is not allowed.")
+}
+
+func (b *spilledBlock) Iterator() Iterator {
+	return b.spill.get(b).Iterator()
+}
+
+func (b *spilledBlock) ResetAndMergeFrom(block1, block2 Block) {
+	panic("Attempt to merge into a frozen Block, which is not allowed.")
+}
+
+func (b *spilledBlock) Len() uint32 {
+	return b.length
+}
+
+func (b *spilledBlock) Frozen() bool {
+	return true
+}
+
+// MemoryUsage is only the size of the Block while it's resident.
+func (b *spilledBlock) MemoryUsage() int {
+	b.spill.mu.RLock()
+	defer b.spill.mu.RUnlock()
+	if b.block == nil {
+		return 0
+	}
+	return b.size
+}
+
+func (b *spilledBlock) Encoding() *BlockEncoding {
+	return b.enc
+}
+
+// The Iterator uses the Block itself, so these are only here to implement the
+// interface.
+func (b *spilledBlock) valid(idx int) bool {
+	return b.spill.get(b).valid(idx)
+}
+
+func (b *spilledBlock) index(idx int) uint32 {
+	return b.spill.get(b).index(idx)
+}
+
+func (b *spilledBlock) value(idx int) uint64 {
+	return b.spill.get(b).value(idx)
+}
+
+func (b *spilledBlock) next(idx int) int {
+	return b.spill.get(b).next(idx)
+}
+
+// unspill returns the Block itself if it's a spilledBlock, and stops its spill
+// keeping track of it.
+func unspill(block Block) Block {
+	if sb, ok := block.(*spilledBlock); ok {
+		sb.spill.mu.Lock()
+		defer sb.spill.mu.Unlock()
+		return sb.spill.release(sb)
+	}
+	return block
+}
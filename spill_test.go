@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/mapzen/neatlacoche/fixture"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockSpill(t *testing.T) {
+	for _, enc := range testEncodings {
+		spill, err := NewBlockSpill(t.TempDir(), 1 << 12)
+		if err != nil {
+			t.Fatalf("Unable to create spill: %s", err.Error())
+		}
+
+		ids, vals := idDistribution("planet", enc, 100000)
+		mb, spilled := NewMultiBlockWithEncoding(enc), NewMultiBlockWithEncoding(enc)
+		spilled.Spill = spill
+		for i, id := range ids {
+			mb.Append(id, vals[i])
+			spilled.Append(id, vals[i])
+		}
+		// all the IDs fit in one block of the wider encodings.
+		if len(mb.Blocks) > 1 && spill.Evictions == 0 || spill.Resident() > 1 << 12 + mb.Current.MemoryUsage() {
+			t.Errorf("Encoding %s: expected blocks to be evicted to stay in the budget, but %d are resident after %d evictions.", enc.Name, spill.Resident(), spill.Evictions)
+		}
+
+		for i, id := range ids {
+			if val := spilled.Lookup(id); val != vals[i] {
+				t.Fatalf("Encoding %s: expected lookup %d to return %d, but got %d.", enc.Name, id, vals[i], val)
+			}
+		}
+		if len(mb.Blocks) > 1 && spill.Loads == 0 {
+			t.Errorf("Encoding %s: expected evicted blocks to be read back.", enc.Name)
+		}
+
+		// writing and merging go through the evicted blocks too.
+		var expected, actual bytes.Buffer
+		mb.WriteTo(&expected)
+		spilled.WriteTo(&actual)
+		if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+			t.Errorf("Encoding %s: expected the spilled MultiBlock to be written the same.", enc.Name)
+		}
+		other := NewMultiBlockWithEncoding(enc)
+		for _, id := range ids {
+			other.Append(id, 1)
+		}
+		spilled.Merge(other)
+		for i, id := range ids {
+			if val := spilled.Lookup(id); val != vals[i] | 1 {
+				t.Fatalf("Encoding %s: after merging, expected lookup %d to return %d, but got %d.", enc.Name, id, vals[i] | 1, val)
+			}
+		}
+
+		name := spill.file.Name()
+		if err = spill.Close(); err != nil {
+			t.Errorf("Unable to close spill: %s", err.Error())
+		}
+		if _, err = os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("Expected spill file %q to be removed, but got %v.", name, err)
+		}
+	}
+}
+
+func TestBlockSpillError(t *testing.T) {
+	spill, err := NewBlockSpill(t.TempDir(), 16)
+	if err != nil {
+		t.Fatalf("Unable to create spill: %s", err.Error())
+	}
+	defer spill.Close()
+
+	ids, vals := idDistribution("extract", DEFAULT_ENCODING, 100000)
+	half := len(ids) / 2
+	mb := NewMultiBlock()
+	mb.Spill = spill
+	for i := 0; i < half; i += 1 {
+		mb.Append(ids[i], vals[i])
+	}
+	if spill.Evictions == 0 || spill.Err() != nil {
+		t.Fatalf("Expected blocks to be evicted without an error, but got %d evictions and %v.", spill.Evictions, spill.Err())
+	}
+
+	// once the file is unusable, the blocks which were evicted can't be read
+	// back, and the rest have to stay resident, but nothing panics.
+	spill.file.Close()
+	for i := half; i < len(ids); i += 1 {
+		mb.Append(ids[i], vals[i])
+	}
+	for i, id := range ids {
+		mb.Lookup(id)
+		if i >= half && mb.Lookup(id) != vals[i] {
+			t.Fatalf("Expected lookup %d to return %d after the spill failed, but got %d.", id, vals[i], mb.Lookup(id))
+		}
+	}
+	if spill.Err() == nil {
+		t.Errorf("Expected the spill to have an error once its file was closed.")
+	}
+}
+
+func TestSorterSpillError(t *testing.T) {
+	opts := fixture.DefaultOptions()
+	opts.IdSpacing = 100000
+	data, err := fixture.Bytes(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	if err = os.WriteFile(in, data, 0644); err != nil {
+		t.Fatalf("Unable to write fixture: %s", err.Error())
+	}
+
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+	sorter, err := NewSorterWithOptions(context.Background(), 2, x_range, y_range, SorterOptions{MemoryBudget: 16, SpillDir: dir})
+	if err != nil {
+		t.Fatalf("Unable to create sorter: %s", err.Error())
+	}
+	defer sorter.Close()
+	sorter.spill.file.Close()
+
+	reader := openTestInput(t, in)
+	defer reader.Close()
+	err = readBlocks(context.Background(), reader, func(block BlockOrError) error {
+		return sorter.Append(block.Primitives)
+	})
+	if err == nil {
+		err = sorter.Finish()
+	}
+	if err == nil {
+		t.Errorf("Expected an error from the first pass when the spill file can't be written.")
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for s, expected := range map[string]ByteSize{"0": 0, "512": 512, "64K": 64 << 10, "24G": 24 << 30, "1m": 1 << 20} {
+		var b ByteSize
+		if err := b.Set(s); err != nil || b != expected {
+			t.Errorf("Expected %q to be %d bytes, but got %d, %v.", s, expected, b, err)
+		}
+	}
+	for _, s := range []string{"", "G", "-1", "1T", "99999999999G"} {
+		var b ByteSize
+		if err := b.Set(s); err == nil {
+			t.Errorf("Expected %q not to be a size, but got %d.", s, b)
+		}
+	}
+}
+
+func TestFirstPassMemoryBudget(t *testing.T) {
+	// the elements are far enough apart that each one has its own block.
+	opts := fixture.DefaultOptions()
+	opts.IdSpacing = 100000
+	data, err := fixture.Bytes(opts)
+	if err != nil {
+		t.Fatalf("Unable to encode fixture: %s", err.Error())
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	if err = os.WriteFile(in, data, 0644); err != nil {
+		t.Fatalf("Unable to write fixture: %s", err.Error())
+	}
+
+	expected, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass failed: %s", err.Error())
+	}
+	defer expected.Close()
+
+	sorter, err := FirstPass(context.Background(), in, Tile{0, 0, 0}, SorterOptions{MemoryBudget: 16, SpillDir: dir}, CheckpointOptions{})
+	if err != nil {
+		t.Fatalf("First pass with a memory budget failed: %s", err.Error())
+	}
+
+	if sorter.spill == nil || sorter.spill.Evictions == 0 {
+		sorter.Close()
+		t.Fatalf("Expected blocks to be spilled with a 16 byte budget.")
+	}
+	if a, b := dumpSorter(sorter), dumpSorter(expected); !bytes.Equal(a, b) {
+		t.Errorf("Expected the same results with a memory budget, but got:\n%s\ninstead of:\n%s", a, b)
+	}
+
+	// the spill file goes with the Sorter.
+	sorter.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "spill-*")); len(files) > 0 {
+		t.Errorf("Expected the spill file to be removed, but found %v.", files)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// KindStats counts the elements of one kind in a file.
+type KindStats struct {
+	// Each version is counted separately, and IDs are counted once however
+	// many versions they have.
+	Versions, Deleted, Ids int64
+	MinId, MaxId int64
+
+	// Range of the versions' timestamps, in milliseconds.
+	MinTimestamp, MaxTimestamp int64
+
+	lastId int64
+}
+
+func (s *KindStats) add(id int64, info *Info) {
+	if s.Versions == 0 {
+		s.MinId, s.MaxId = id, id
+		s.MinTimestamp, s.MaxTimestamp = math.MaxInt64, math.MinInt64
+	}
+	s.Versions += 1
+	if !info.Visible {
+		s.Deleted += 1
+	}
+	// versions of the same element are together, so it's only a new ID if
+	// it's different from the last one.
+	if s.Versions == 1 || id != s.lastId {
+		s.Ids += 1
+	}
+	s.lastId = id
+	if id < s.MinId {
+		s.MinId = id
+	}
+	if id > s.MaxId {
+		s.MaxId = id
+	}
+	if info.Timestamp < s.MinTimestamp {
+		s.MinTimestamp = info.Timestamp
+	}
+	if info.Timestamp > s.MaxTimestamp {
+		s.MaxTimestamp = info.Timestamp
+	}
+}
+
+// FileStats counts the elements of each kind in a file, indexed by PKIND_*.
+type FileStats struct {
+	Blocks int64
+	Kinds [3]KindStats
+}
+
+// ReadFileStats reads the whole file and counts its elements.
+func ReadFileStats(ctx context.Context, file_name string) (*FileStats, error) {
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %q: %s", file_name, err.Error())
+	}
+	defer reader.Close()
+
+	header, err := reader.ReadHeaderBlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read header block of %q: %s", file_name, err.Error())
+	}
+	historical := hasFeature(header, "HistoricalInformation")
+
+	stats := &FileStats{}
+	err = readBlocks(ctx, reader, func(block BlockOrError) error {
+		nodes, ways, rels, err := DecodeBlock(block.Primitives, historical)
+		if err != nil {
+			return err
+		}
+		stats.Blocks += 1
+		for i := range nodes {
+			stats.Kinds[PKIND_NODE].add(nodes[i].Id, &nodes[i].Info)
+		}
+		for i := range ways {
+			stats.Kinds[PKIND_WAY].add(ways[i].Id, &ways[i].Info)
+		}
+		for i := range rels {
+			stats.Kinds[PKIND_REL].add(rels[i].Id, &rels[i].Info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %q: %s", file_name, err.Error())
+	}
+	return stats, nil
+}
+
+// Print writes the stats as a table, one line per kind.
+func (s *FileStats) Print(w io.Writer) {
+	fmt.Fprintf(w, "  %d blocks\n", s.Blocks)
+	for kind, k := range s.Kinds {
+		if k.Versions == 0 {
+			fmt.Fprintf(w, "  %-9s none\n", PKIND_NAMES[kind] + "s")
+			continue
+		}
+		fmt.Fprintf(w, "  %-9s %d versions of %d IDs from %d to %d, %d deleted, from %s to %s\n",
+			PKIND_NAMES[kind] + "s", k.Versions, k.Ids, k.MinId, k.MaxId, k.Deleted,
+			formatTimestamp(k.MinTimestamp), formatTimestamp(k.MaxTimestamp))
+	}
+}
+
+func formatTimestamp(ms int64) string {
+	return time.Unix(0, ms * int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
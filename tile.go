@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"path/filepath"
+)
+
+// Each pass splits a tile into a GRID_SIZE x GRID_SIZE grid of squares, which
+// are the tiles GRID_ZOOM_STEP zoom levels below it. There needs to be one bit
+// for each square in the Block values.
+const (
+	GRID_SIZE = 4
+	GRID_ZOOM_STEP = 2 // = log2(GRID_SIZE)
+)
+
+// Tile is one of the tiles of a TilingScheme, numbered in the usual "XYZ"
+// scheme, with (0, 0) in the north-west corner.
+type Tile struct {
+	Z, X, Y int
+}
+
+// Extent returns the range of Mercator X and Y coordinates covered by the tile.
+func (t Tile) Extent() (xRange, yRange [2]float64) {
+	return WEB_MERCATOR.Extent(t)
+}
+
+// BBox returns the extent of the tile in nanodegrees of longitude and
+// latitude, as used in the PBF file header.
+func (t Tile) BBox() *OSMPBF.HeaderBBox {
+	return WEB_MERCATOR.Bounds(t).HeaderBBox()
+}
+
+// Child returns the tile for one of the grid squares which the tile is split
+// into. Squares are numbered as in nodeWorker.putNode; x + GRID_SIZE * y, with
+// y increasing northwards.
+func (t Tile) Child(square int) Tile {
+	x := square % GRID_SIZE
+	y := square / GRID_SIZE
+	return Tile{
+		Z: t.Z + GRID_ZOOM_STEP,
+		X: t.X * GRID_SIZE + x,
+		Y: t.Y * GRID_SIZE + (GRID_SIZE - 1 - y),
+	}
+}
+
+// FileName returns the name of the file which the tile's data is written to,
+// under the output directory.
+func (t Tile) FileName(out_dir string) string {
+	return t.path(out_dir, "osm.pbf")
+}
+
+// CheckpointFileName returns the name of the file which checkpoints of the
+// first pass over the tile are written to, next to the tile's own file.
+func (t Tile) CheckpointFileName(out_dir string) string {
+	return t.path(out_dir, "checkpoint")
+}
+
+// PolarFileName returns the name of the file which the nodes that couldn't be
+// projected onto the tile's grid are written to, with the out of range policy
+// "polar".
+func (t Tile) PolarFileName(out_dir string) string {
+	return t.path(out_dir, "polar.osm.pbf")
+}
+
+// IndexFileName returns the name of the file which the grid squares of each
+// element of a kind are saved to when the tile is split, so that updates can
+// be applied to its children.
+func (t Tile) IndexFileName(out_dir string, kind int) string {
+	return t.path(out_dir, PKIND_NAMES[kind] + "s.idx")
+}
+
+func (t Tile) path(out_dir, ext string) string {
+	return filepath.Join(out_dir, fmt.Sprintf("%d", t.Z), fmt.Sprintf("%d", t.X), fmt.Sprintf("%d.%s", t.Y, ext))
+}
+
+func (t Tile) String() string {
+	return fmt.Sprintf("%d/%d/%d", t.Z, t.X, t.Y)
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestTileExtent(t *testing.T) {
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+	if x_range != [2]float64{-MERC_MAX, MERC_MAX} || y_range != [2]float64{-MERC_MAX, MERC_MAX} {
+		t.Errorf("Expected the zoom 0 tile to cover the world, but got %v, %v.", x_range, y_range)
+	}
+
+	// tile 2/1/0 is the second from the west on the northern edge.
+	x_range, y_range = Tile{2, 1, 0}.Extent()
+	if x_range != [2]float64{-MERC_MAX / 2, 0} || y_range != [2]float64{MERC_MAX / 2, MERC_MAX} {
+		t.Errorf("Unexpected extent for tile 2/1/0: %v, %v.", x_range, y_range)
+	}
+}
+
+func TestTileChild(t *testing.T) {
+	tests := []struct {
+		parent Tile
+		square int
+		child Tile
+	}{
+		{Tile{0, 0, 0}, 0, Tile{2, 0, 3}},
+		{Tile{0, 0, 0}, 15, Tile{2, 3, 0}},
+		{Tile{2, 1, 2}, 1, Tile{4, 5, 11}},
+	}
+
+	for _, test := range tests {
+		child := test.parent.Child(test.square)
+		if child != test.child {
+			t.Errorf("Expected square %d of %s to be %s, but got %s.", test.square, test.parent, test.child, child)
+		}
+
+		// the child should be inside the parent, in the right square.
+		x_range, y_range := test.parent.Extent()
+		cx_range, cy_range := child.Extent()
+		x := quadrant(x_range, (cx_range[0] + cx_range[1]) / 2)
+		y := quadrant(y_range, (cy_range[0] + cy_range[1]) / 2)
+		if x + GRID_SIZE * y != test.square {
+			t.Errorf("Expected %s to be in square %d of %s, but it was in %d.", child, test.square, test.parent, x + GRID_SIZE * y)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/go.geo"
+	"math"
+)
+
+// TilingScheme is the way that tiles cover the world. Each scheme projects
+// longitude and latitude into its own coordinates, which the tiles of each zoom
+// level then divide up evenly, with tile (0, 0) in the north-west corner.
+type TilingScheme interface {
+	// Name is used to pick the scheme with the -tiling flag.
+	Name() string
+
+	// Project converts a point in degrees to the scheme's coordinates. If the
+	// scheme can't tile the point, then ok is false.
+	Project(lon, lat float64) (x, y float64, ok bool)
+
+	// Clamp moves a point which can't be projected to the nearest point which
+	// can.
+	Clamp(lon, lat float64) (float64, float64)
+
+	// Extent returns the range of the scheme's coordinates covered by a tile.
+	Extent(t Tile) (xRange, yRange [2]float64)
+
+	// Bounds returns the box of longitude and latitude covered by a tile.
+	Bounds(t Tile) *Region
+}
+
+var (
+	WEB_MERCATOR TilingScheme = webMercator{}
+	GEOGRAPHIC TilingScheme = geographic{}
+)
+
+// All the schemes, in the order in which they're numbered in checkpoints.
+var tilingSchemes = []TilingScheme{WEB_MERCATOR, GEOGRAPHIC}
+
+func tilingSchemeIndex(scheme TilingScheme) int {
+	for i, s := range tilingSchemes {
+		if s == scheme {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("Tiling scheme %q isn't in the list.", scheme.Name()))
+}
+
+func tilingSchemeNames() []string {
+	var names []string
+	for _, s := range tilingSchemes {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// TilingSchemeByName returns the scheme with the name.
+func TilingSchemeByName(name string) (TilingScheme, error) {
+	for _, s := range tilingSchemes {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown tiling scheme %q, expected one of %v.", name, tilingSchemeNames())
+}
+
+// Half the width of the world in spherical Mercator meters.
+const MERC_MAX = 20037508.34
+
+// Spherical Mercator doesn't reach the poles, and this is the latitude at which
+// it becomes square.
+const MERC_MAX_LAT = 85.0511287798
+
+// webMercator is the usual "XYZ" scheme of web maps, using spherical Mercator,
+// which covers the world with square tiles but leaves out the poles.
+type webMercator struct{}
+
+func (webMercator) Name() string {
+	return "mercator"
+}
+
+func (webMercator) Project(lon, lat float64) (x, y float64, ok bool) {
+	if lon < -180 || lon >= 180 || lat <= -MERC_MAX_LAT || lat >= MERC_MAX_LAT {
+		return 0, 0, false
+	}
+	p := geo.Point{lon, lat}
+	geo.Mercator.Project(&p)
+	return p.X(), p.Y(), true
+}
+
+func (webMercator) Clamp(lon, lat float64) (float64, float64) {
+	return clampFloat(lon, -180, 180 - 1e-7), clampFloat(lat, -MERC_MAX_LAT + 1e-7, MERC_MAX_LAT - 1e-7)
+}
+
+func (webMercator) Extent(t Tile) (xRange, yRange [2]float64) {
+	return gridExtent(t, [2]float64{-MERC_MAX, MERC_MAX}, [2]float64{-MERC_MAX, MERC_MAX})
+}
+
+func (m webMercator) Bounds(t Tile) *Region {
+	x_range, y_range := m.Extent(t)
+	sw := geo.Point{x_range[0], y_range[0]}
+	ne := geo.Point{x_range[1], y_range[1]}
+	geo.Mercator.Inverse(&sw)
+	geo.Mercator.Inverse(&ne)
+	return &Region{Left: sw.X(), Bottom: sw.Y(), Right: ne.X(), Top: ne.Y()}
+}
+
+// geographic divides plain longitude and latitude (EPSG:4326) evenly, so the
+// tiles are twice as wide as they are tall, but it reaches the poles.
+type geographic struct{}
+
+func (geographic) Name() string {
+	return "geographic"
+}
+
+func (geographic) Project(lon, lat float64) (x, y float64, ok bool) {
+	if lon < -180 || lon >= 180 || lat < -90 || lat >= 90 {
+		return 0, 0, false
+	}
+	return lon, lat, true
+}
+
+func (geographic) Clamp(lon, lat float64) (float64, float64) {
+	return clampFloat(lon, -180, math.Nextafter(180, 0)), clampFloat(lat, -90, math.Nextafter(90, 0))
+}
+
+func (geographic) Extent(t Tile) (xRange, yRange [2]float64) {
+	return gridExtent(t, [2]float64{-180, 180}, [2]float64{-90, 90})
+}
+
+func (g geographic) Bounds(t Tile) *Region {
+	x_range, y_range := g.Extent(t)
+	return &Region{Left: x_range[0], Bottom: y_range[0], Right: x_range[1], Top: y_range[1]}
+}
+
+// gridExtent divides the world's ranges evenly between the tiles at the
+// tile's zoom.
+func gridExtent(t Tile, worldX, worldY [2]float64) (xRange, yRange [2]float64) {
+	n := float64(int64(1) << uint(t.Z))
+	width := (worldX[1] - worldX[0]) / n
+	height := (worldY[1] - worldY[0]) / n
+	xRange[0] = worldX[0] + width * float64(t.X)
+	xRange[1] = xRange[0] + width
+	yRange[1] = worldY[1] - height * float64(t.Y)
+	yRange[0] = yRange[1] - height
+	return
+}
+
+func clampFloat(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+// tileGrid is the grid of squares which a tile is split into, in a tiling
+// scheme.
+type tileGrid struct {
+	scheme TilingScheme
+
+	// Range of the scheme's coordinates covered by the grid, and outside of
+	// which points aren't put in any square. That's the same as the grid
+	// unless it's clipped to a region.
+	xRange, yRange [2]float64
+	clipX, clipY [2]float64
+}
+
+// Mask returns the bit for the grid square which the point, in degrees, is in,
+// or zero if it's not in any of them. If the scheme can't project the point,
+// then ok is false.
+func (g *tileGrid) Mask(lon, lat float64) (mask uint64, ok bool) {
+	x, y, ok := g.scheme.Project(lon, lat)
+	if !ok {
+		return 0, false
+	}
+	if x < g.clipX[0] || x > g.clipX[1] || y < g.clipY[0] || y > g.clipY[1] {
+		return 0, true
+	}
+
+	i := quadrant(g.xRange, x)
+	j := quadrant(g.yRange, y)
+	if i < 0 || j < 0 {
+		return 0, true
+	}
+	return uint64(1) << uint(i + GRID_SIZE * j), true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGeographicTiles(t *testing.T) {
+	// the world tile is twice as wide as it's tall, and its children split it
+	// up evenly.
+	if r := GEOGRAPHIC.Bounds(Tile{0, 0, 0}); *r != (Region{-180, -90, 180, 90}) {
+		t.Errorf("Expected the zoom 0 tile to cover the world, but got %v.", r)
+	}
+	if r := GEOGRAPHIC.Bounds(Tile{2, 1, 0}); *r != (Region{-90, 45, 0, 90}) {
+		t.Errorf("Unexpected bounds for tile 2/1/0: %v.", r)
+	}
+
+	// the region is tiled in the same way as Mercator, but with the tiles which
+	// the scheme has there.
+	region := &Region{10, 50, 20, 55}
+	if tile := region.Tile(GEOGRAPHIC, 8); tile != (Tile{4, 8, 3}) {
+		t.Errorf("Expected region %s to start from 4/8/3, but got %s.", region, tile)
+	}
+}
+
+func TestSchemeBoundsMatchExtent(t *testing.T) {
+	for _, scheme := range tilingSchemes {
+		for _, tile := range []Tile{{0, 0, 0}, {2, 3, 1}, {6, 40, 17}} {
+			r := scheme.Bounds(tile)
+			x_range, y_range := r.Extent(scheme)
+			ex_range, ey_range := scheme.Extent(tile)
+			for i := 0; i < 2; i += 1 {
+				if math.Abs(x_range[i] - ex_range[i]) > 1e-6 * math.Abs(ex_range[1] - ex_range[0]) ||
+					math.Abs(y_range[i] - ey_range[i]) > 1e-6 * math.Abs(ey_range[1] - ey_range[0]) {
+					t.Errorf("Scheme %s: expected the bounds of %s to project to %v, %v, but got %v, %v.",
+						scheme.Name(), tile, ex_range, ey_range, x_range, y_range)
+				}
+			}
+		}
+	}
+}
+
+func TestTileGridMask(t *testing.T) {
+	tests := []struct {
+		scheme TilingScheme
+		lon, lat float64
+		mask uint64
+		ok bool
+	}{
+		{WEB_MERCATOR, 0.01, 0.01, 1 << 10, true},
+		{WEB_MERCATOR, -179, 80, 1 << 12, true},
+		{WEB_MERCATOR, 0, 89, 0, false},
+		{WEB_MERCATOR, 180, 0, 0, false},
+
+		// geographic reaches all the way to the poles.
+		{GEOGRAPHIC, 0.01, 0.01, 1 << 10, true},
+		{GEOGRAPHIC, 0, 89.99, 1 << 14, true},
+		{GEOGRAPHIC, -180, -90, 1 << 0, true},
+		{GEOGRAPHIC, 0, 90, 0, false},
+		{GEOGRAPHIC, 0, 95, 0, false},
+	}
+
+	for _, test := range tests {
+		x_range, y_range := test.scheme.Extent(Tile{0, 0, 0})
+		grid := tileGrid{scheme: test.scheme, xRange: x_range, yRange: y_range, clipX: x_range, clipY: y_range}
+		mask, ok := grid.Mask(test.lon, test.lat)
+		if mask != test.mask || ok != test.ok {
+			t.Errorf("Scheme %s: expected %g,%g to have mask %x, %v, but got %x, %v.",
+				test.scheme.Name(), test.lon, test.lat, test.mask, test.ok, mask, ok)
+		}
+	}
+}
+
+func TestTilingSchemeByName(t *testing.T) {
+	for _, scheme := range tilingSchemes {
+		s, err := TilingSchemeByName(scheme.Name())
+		if err != nil || s != scheme {
+			t.Errorf("Expected to find scheme %q, but got %v, %v.", scheme.Name(), s, err)
+		}
+	}
+	if _, err := TilingSchemeByName("s2"); err == nil {
+		t.Errorf("Expected an error for an unknown scheme.")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+)
+
+// Number of (ID, value) pairs which an UnorderedMultiBlock buffers before
+// sorting them into a run.
+const UNORDERED_RUN_LENGTH = 1 << 16
+
+// UnorderedMultiBlock is a mapping from IDs to grid square bitmasks, like a
+// MultiBlock, but which can be added to in any order. This is what the extra
+// squares for way nodes need, as the refs of ways come in whatever order the
+// ways use them, and there are far too many of them to keep in a map.
+//
+// Pairs are buffered until there are UNORDERED_RUN_LENGTH of them, then sorted
+// and appended to a MultiBlock, which is a "run". The runs are merged like a
+// binary counter; each run has a level, and whenever two runs have the same
+// level they're merged into one at the next level up. This keeps the number of
+// runs down to the log of the number of pairs, and each pair is only merged
+// that many times. All the values for an ID are OR-ed together, the same as
+// appending them to a MultiBlock.
+type UnorderedMultiBlock struct {
+	// Pairs added since the last run was made, in the order they were added.
+	pending []idVal
+
+	// The runs, oldest and largest first, and their levels.
+	runs []*MultiBlock
+	levels []int
+
+	// How the runs' Blocks are packed.
+	Encoding *BlockEncoding
+
+	// If set, the frozen Blocks of the runs are kept within the Spill's memory
+	// budget.
+	Spill *BlockSpill
+}
+
+type idVal struct {
+	id int64
+	val uint64
+}
+
+// Implement the sort.Interface interface for slices of idVals, sorting them by
+// ID.
+type idValSlice []idVal
+func (a idValSlice) Len() int {
+	return len(a)
+}
+func (a idValSlice) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a idValSlice) Less(i, j int) bool {
+	return a[i].id < a[j].id
+}
+
+// NewUnorderedMultiBlock returns an empty UnorderedMultiBlock in the default
+// encoding.
+func NewUnorderedMultiBlock() *UnorderedMultiBlock {
+	return &UnorderedMultiBlock{Encoding: DEFAULT_ENCODING}
+}
+
+// Add an (ID, grid square) in any order.
+func (u *UnorderedMultiBlock) Add(id int64, val uint64) {
+	if u.pending == nil {
+		u.pending = make([]idVal, 0, UNORDERED_RUN_LENGTH)
+	}
+	u.pending = append(u.pending, idVal{id, val})
+	if len(u.pending) >= UNORDERED_RUN_LENGTH {
+		u.flush()
+	}
+}
+
+// flush sorts the pending pairs into a new run, and merges it with the runs
+// before it which are at the same level.
+func (u *UnorderedMultiBlock) flush() {
+	if len(u.pending) == 0 {
+		return
+	}
+
+	sort.Sort(idValSlice(u.pending))
+	run := NewMultiBlockWithEncoding(u.Encoding)
+	run.Spill = u.Spill
+	for _, p := range u.pending {
+		run.Append(p.id, p.val)
+	}
+	u.pending = u.pending[:0]
+
+	level := 0
+	for n := len(u.runs); n > 0 && u.levels[n - 1] == level; n -= 1 {
+		u.runs[n - 1].Merge(run)
+		run = u.runs[n - 1]
+		u.runs = u.runs[:n - 1]
+		u.levels = u.levels[:n - 1]
+		level += 1
+	}
+	u.runs = append(u.runs, run)
+	u.levels = append(u.levels, level)
+}
+
+// MultiBlock merges everything which has been added into a single MultiBlock,
+// and empties the UnorderedMultiBlock.
+func (u *UnorderedMultiBlock) MultiBlock() *MultiBlock {
+	u.flush()
+	u.pending = nil
+
+	if len(u.runs) == 0 {
+		mb := NewMultiBlockWithEncoding(u.Encoding)
+		mb.Spill = u.Spill
+		return mb
+	}
+
+	// the first run is the largest, so the others are merged into it.
+	mb := u.runs[0]
+	for _, run := range u.runs[1:] {
+		mb.Merge(run)
+	}
+	u.runs = nil
+	u.levels = nil
+	return mb
+}
+
+// MemoryUsage returns the approximate number of bytes used by the pending
+// pairs and the runs.
+func (u *UnorderedMultiBlock) MemoryUsage() int {
+	total := 16 * cap(u.pending)
+	for _, run := range u.runs {
+		total += run.MemoryUsage()
+	}
+	return total
+}
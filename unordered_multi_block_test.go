@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+func TestUnorderedMultiBlock(t *testing.T) {
+	ids, vals := idDistribution("extract", DEFAULT_ENCODING, 3 * UNORDERED_RUN_LENGTH)
+	refs := wayRefOrder(ids)
+
+	u := NewUnorderedMultiBlock()
+	expected := make(map[int64]uint64)
+	for i, id := range refs {
+		// the same node gets different squares from each of its ways.
+		val := vals[i % len(vals)] | uint64(1) << uint(i % 3)
+		u.Add(id, val)
+		expected[id] = expected[id] | val
+	}
+
+	// every run which has been sorted is at a different level.
+	if len(u.runs) > 3 {
+		t.Errorf("Expected at most 3 runs after %d pairs, but got %d at levels %v.", len(refs), len(u.runs), u.levels)
+	}
+	for i := 1; i < len(u.levels); i += 1 {
+		if u.levels[i] >= u.levels[i - 1] {
+			t.Errorf("Expected runs to be in descending levels, but got %v.", u.levels)
+		}
+	}
+	if u.MemoryUsage() <= 0 {
+		t.Errorf("Expected some memory to be used, but got %d.", u.MemoryUsage())
+	}
+
+	mb := u.MultiBlock()
+	count := 0
+	mb.Each(func(id int64, val uint64) {
+		if val != expected[id] {
+			t.Errorf("Expected ID %d to have value %d, but got %d.", id, expected[id], val)
+		}
+		count += 1
+	})
+	if count != len(expected) {
+		t.Errorf("Expected %d IDs, but got %d.", len(expected), count)
+	}
+
+	// it's emptied, and can be used again.
+	if u.MemoryUsage() != 0 {
+		t.Errorf("Expected no memory to be used once emptied, but got %d.", u.MemoryUsage())
+	}
+	u.Add(10, 2)
+	u.Add(5, 1)
+	u.Add(10, 4)
+	mb = u.MultiBlock()
+	if mb.Lookup(5) != 1 || mb.Lookup(10) != 6 || mb.Lookup(7) != 0 {
+		t.Errorf("Expected 5: 1 and 10: 6, but got %d and %d.", mb.Lookup(5), mb.Lookup(10))
+	}
+
+	if mb = NewUnorderedMultiBlock().MultiBlock(); len(mb.Blocks) != 0 || mb.LastVal != 0 {
+		t.Errorf("Expected an empty MultiBlock, but got %d Blocks.", len(mb.Blocks))
+	}
+}
+
+// wayRefOrder returns the IDs in the order that way refs might use them. Most
+// ways use nodes which are near each other in ID order, but in any order, and
+// many nodes are junctions which are used again by another way, often much
+// later on.
+func wayRefOrder(ids []int64) []int64 {
+	r := rand.New(rand.NewSource(1))
+	refs := make([]int64, 0, len(ids) + len(ids) / 4)
+
+	for start := 0; start < len(ids); {
+		end := start + 2 + r.Intn(30)
+		if end > len(ids) {
+			end = len(ids)
+		}
+		way := ids[start:end]
+		for _, i := range r.Perm(len(way)) {
+			refs = append(refs, way[i])
+		}
+		for i := 0; i < len(way) / 4; i += 1 {
+			refs = append(refs, ids[r.Intn(len(ids))])
+		}
+		start = end
+	}
+
+	return refs
+}
+
+// heapAlloc returns the bytes of allocated heap objects, after a collection so
+// that only the live ones are counted.
+func heapAlloc() int64 {
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	return int64(mem.HeapAlloc)
+}
+
+// extractExtraNodes sorts the nodes of a history extract into the grid of the
+// tile which it would be split from, and returns the extra grid squares which
+// its ways give their nodes, in the order that the way workers find them.
+func extractExtraNodes(b *testing.B, file_name string) []idVal {
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		b.Fatalf("Unable to open %q: %s", file_name, err.Error())
+	}
+	defer reader.Close()
+	header, err := reader.ReadHeaderBlock()
+	if err != nil {
+		b.Fatalf("Unable to read header of %q: %s", file_name, err.Error())
+	}
+	historical := hasFeature(header, "HistoricalInformation")
+
+	tile := Tile{0, 0, 0}
+	if region := RegionFromHeader(header.Bbox); region != nil {
+		tile = region.Tile(WEB_MERCATOR, 32)
+	}
+	x_range, y_range := WEB_MERCATOR.Extent(tile)
+	sorter, err := NewSorterWithOptions(context.Background(), numWorkers(), x_range, y_range, SorterOptions{Historical: historical})
+	if err != nil {
+		b.Fatalf("Unable to construct a Sorter: %s", err.Error())
+	}
+	defer sorter.Close()
+
+	// the same as wayWorker.flushExtraNodes, for each way and all its versions.
+	var pairs []idVal
+	var last_id int64
+	var mask uint64
+	var refs []int64
+	var masks []uint64
+	flush := func() {
+		for i, ref := range refs {
+			if masks[i] != mask {
+				pairs = append(pairs, idVal{ref, mask & ^masks[i]})
+			}
+		}
+		mask, refs, masks = 0, refs[:0], masks[:0]
+	}
+
+	err = readBlocks(context.Background(), reader, func(block BlockOrError) error {
+		kind, err := primitiveBlockKind(block.Primitives)
+		if err != nil {
+			return err
+		}
+		// the nodes are all in the Sorter once it's been given something else.
+		if sorter.Nodes == nil {
+			if err = sorter.Append(block.Primitives); err != nil {
+				return err
+			}
+		}
+		if kind != PKIND_WAY {
+			return nil
+		}
+
+		_, ways, _, err := DecodeBlock(block.Primitives, historical)
+		if err != nil {
+			return err
+		}
+		for _, w := range ways {
+			if w.Id != last_id {
+				flush()
+				last_id = w.Id
+			}
+			for _, ref := range w.Refs {
+				nd_mask := sorter.Nodes.Lookup(ref)
+				mask = mask | nd_mask
+				refs = append(refs, ref)
+				masks = append(masks, nd_mask)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("Unable to read %q: %s", file_name, err.Error())
+	}
+	flush()
+
+	return pairs
+}
+
+var bench_extract = flag.String("extract", "", "A history extract for BenchmarkExtraNodes to use, as well as its synthetic IDs.")
+
+// BenchmarkExtraNodes compares a map with an UnorderedMultiBlock for the extra
+// grid squares of way nodes, reporting the heap used by each per ID once all
+// the refs have been added. The IDs are the same distributions as the
+// MultiBlock benchmarks, in the order given by wayRefOrder, and the extra
+// squares from a real extract can be added with -extract.
+func BenchmarkExtraNodes(b *testing.B) {
+	const n = 1000000
+
+	for _, kind := range []string{"extract", "planet"} {
+		ids, vals := idDistribution(kind, DEFAULT_ENCODING, n)
+		refs := wayRefOrder(ids)
+		pairs := make([]idVal, len(refs))
+		for j, id := range refs {
+			pairs[j] = idVal{id, vals[j % n]}
+		}
+		benchmarkExtraNodes(b, kind, pairs)
+	}
+
+	if *bench_extract != "" {
+		benchmarkExtraNodes(b, "file", extractExtraNodes(b, *bench_extract))
+	}
+}
+
+func benchmarkExtraNodes(b *testing.B, kind string, pairs []idVal) {
+	distinct := make(map[int64]bool)
+	for _, p := range pairs {
+		distinct[p.id] = true
+	}
+	n := len(distinct)
+
+	b.Run("map/" + kind, func(b *testing.B) {
+		var used int64
+		for i := 0; i < b.N; i += 1 {
+			b.StopTimer()
+			before := heapAlloc()
+			b.StartTimer()
+			m := make(map[int64]uint64)
+			for _, p := range pairs {
+				m[p.id] = m[p.id] | p.val
+			}
+			b.StopTimer()
+			used = heapAlloc() - before
+			b.StartTimer()
+			runtime.KeepAlive(m)
+		}
+		b.ReportMetric(float64(used) / float64(n), "bytes/id")
+	})
+
+	b.Run("runs/" + kind, func(b *testing.B) {
+		var used int64
+		for i := 0; i < b.N; i += 1 {
+			b.StopTimer()
+			before := heapAlloc()
+			b.StartTimer()
+			u := NewUnorderedMultiBlock()
+			for _, p := range pairs {
+				u.Add(p.id, p.val)
+			}
+			b.StopTimer()
+			used = heapAlloc() - before
+			b.StartTimer()
+			u.MultiBlock()
+		}
+		b.ReportMetric(float64(used) / float64(n), "bytes/id")
+	})
+}
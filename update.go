@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"log"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the file, in the output directory, which records how the tiles were
+// split and which replication diffs have been applied to them.
+const STATE_FILE_NAME = "state.txt"
+
+// TilingState is everything needed to carry on applying replication diffs to a
+// set of tiles split with -updatable. It's saved as key=value lines, in the
+// same style as the state.txt files which go alongside replication diffs.
+type TilingState struct {
+	// The last diff applied, or where the input file said it was up to.
+	SequenceNumber int64
+	Timestamp time.Time
+
+	// The tile which the splitting started from, the region it was clipped to,
+	// if any, and the zoom of the tiles which were written.
+	Root Tile
+	Clip *Region
+	Zoom int
+
+	Scheme TilingScheme
+	OutOfRange OutOfRangePolicy
+}
+
+// SaveTilingState writes the state to the output directory, replacing any state
+// which was there before.
+func SaveTilingState(out_dir string, s *TilingState) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "sequenceNumber=%d\n", s.SequenceNumber)
+	if !s.Timestamp.IsZero() {
+		fmt.Fprintf(&b, "timestamp=%s\n", strings.Replace(s.Timestamp.UTC().Format(time.RFC3339), ":", "\\:", -1))
+	}
+	fmt.Fprintf(&b, "tile=%s\n", s.Root)
+	if s.Clip != nil {
+		fmt.Fprintf(&b, "bbox=%g,%g,%g,%g\n", s.Clip.Left, s.Clip.Bottom, s.Clip.Right, s.Clip.Top)
+	}
+	fmt.Fprintf(&b, "zoom=%d\n", s.Zoom)
+	fmt.Fprintf(&b, "tiling=%s\n", s.Scheme.Name())
+	fmt.Fprintf(&b, "outOfRange=%s\n", s.OutOfRange)
+
+	file_name := filepath.Join(out_dir, STATE_FILE_NAME)
+	err := os.WriteFile(file_name + ".tmp", []byte(b.String()), 0644)
+	if err == nil {
+		err = os.Rename(file_name + ".tmp", file_name)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write state file %q: %s", file_name, err.Error())
+	}
+	return nil
+}
+
+// LoadTilingState reads the state saved in the output directory.
+func LoadTilingState(out_dir string) (*TilingState, error) {
+	values, err := readStateFile(filepath.Join(out_dir, STATE_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TilingState{Scheme: WEB_MERCATOR}
+	for key, value := range values {
+		switch key {
+		case "sequenceNumber":
+			s.SequenceNumber, err = strconv.ParseInt(value, 10, 64)
+		case "timestamp":
+			s.Timestamp, err = time.Parse(time.RFC3339, value)
+		case "tile":
+			_, err = fmt.Sscanf(value, "%d/%d/%d", &s.Root.Z, &s.Root.X, &s.Root.Y)
+		case "bbox":
+			s.Clip, err = ParseRegion(value)
+		case "zoom":
+			s.Zoom, err = strconv.Atoi(value)
+		case "tiling":
+			s.Scheme, err = TilingSchemeByName(value)
+		case "outOfRange":
+			err = s.OutOfRange.Set(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad %s %q in the state file: %s", key, value, err.Error())
+		}
+	}
+	if s.Zoom <= s.Root.Z {
+		return nil, fmt.Errorf("The state file doesn't say which zoom the tiles were split to.")
+	}
+	return s, nil
+}
+
+// readStateFile reads the key=value lines of a state file, skipping comments
+// and unescaping the colons which Java properties files escape.
+func readStateFile(file_name string) (map[string]string, error) {
+	file, err := os.Open(file_name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad line %q in state file %q.", line, file_name)
+		}
+		values[parts[0]] = strings.Replace(parts[1], "\\:", ":", -1)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// saveIndexes writes the grid squares which the Sorter put each element of the
+// tile into, so that the tile's children can be found again when updating.
+func saveIndexes(sorter *Sorter, tile Tile, out_dir string) error {
+	for kind, mb := range []*MultiBlock{sorter.Nodes, sorter.Ways, sorter.Relations} {
+		err := writeIndexFile(tile.IndexFileName(out_dir, kind), mb)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIndexFile writes the MultiBlock to a temporary file, which then
+// replaces the index, so that an interrupted write doesn't leave it corrupt.
+func writeIndexFile(file_name string, mb *MultiBlock) error {
+	err := os.MkdirAll(filepath.Dir(file_name), 0755)
+	if err != nil {
+		return fmt.Errorf("Unable to create directory for index %q: %s", file_name, err.Error())
+	}
+	file, err := os.Create(file_name + ".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create index %q: %s", file_name, err.Error())
+	}
+	w := bufio.NewWriter(file)
+	_, err = mb.WriteTo(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file_name + ".tmp", file_name)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write index %q: %s", file_name, err.Error())
+	}
+	return nil
+}
+
+// readIndexFile maps an index written by writeIndexFile, as only a few of its
+// Blocks are likely to be looked at. The error is left as it is if the index
+// doesn't exist, so that it can be checked with os.IsNotExist.
+func readIndexFile(file_name string) (*MappedMultiBlock, error) {
+	if _, err := os.Stat(file_name); err != nil {
+		return nil, err
+	}
+
+	mb, err := OpenMappedMultiBlock(file_name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read index %q: %s", file_name, err.Error())
+	}
+	return mb, nil
+}
+
+// diffFile is one of the replication diffs found in a directory. Its sequence
+// number comes from its path, as in the usual 000/123/456.osc.gz layout.
+type diffFile struct {
+	Sequence int64
+	FileName string
+}
+
+// findDiffs returns the osmChange files in the directory, or any of its
+// subdirectories, which come after the given sequence number, in order. Files
+// whose paths aren't a sequence number are ignored.
+func findDiffs(dir string, after int64) ([]diffFile, error) {
+	var diffs []diffFile
+	seen := make(map[int64]string)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		var rel string
+		for _, ext := range []string{".osc.gz", ".osc"} {
+			if strings.HasSuffix(path, ext) {
+				rel, err = filepath.Rel(dir, strings.TrimSuffix(path, ext))
+				break
+			}
+		}
+		if rel == "" || err != nil {
+			return err
+		}
+
+		sequence, err := strconv.ParseInt(strings.Replace(rel, string(filepath.Separator), "", -1), 10, 64)
+		if err != nil || sequence <= after {
+			return nil
+		}
+		if other, ok := seen[sequence]; ok {
+			return fmt.Errorf("Both %q and %q have sequence number %d.", other, path, sequence)
+		}
+		seen[sequence] = path
+		diffs = append(diffs, diffFile{Sequence: sequence, FileName: path})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Sequence < diffs[j].Sequence })
+	return diffs, nil
+}
+
+// diffTimestamp returns the time from the state file which goes alongside a
+// diff, if there is one.
+func diffTimestamp(diff diffFile) (time.Time, bool) {
+	base := strings.TrimSuffix(strings.TrimSuffix(diff.FileName, ".gz"), ".osc")
+	values, err := readStateFile(base + ".state.txt")
+	if err != nil {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339, values["timestamp"])
+	return ts, err == nil
+}
+
+// ApplyDiffs applies the replication diffs in the directory which are newer
+// than the tiles in the output directory, which must have been split with
+// -updatable. Each diff is applied in full, and then the state file is updated,
+// so if it's interrupted then it can be run again to carry on. If db isn't nil,
+// then the elements of each diff are stored in it too, before the state file
+// is updated.
+func ApplyDiffs(ctx context.Context, diff_dir string, out_dir string, db *Database) error {
+	state, err := LoadTilingState(out_dir)
+	if err != nil {
+		return fmt.Errorf("Unable to load the tiling state, were the tiles split with -updatable? %s", err.Error())
+	}
+	diffs, err := findDiffs(diff_dir, state.SequenceNumber)
+	if err != nil {
+		return fmt.Errorf("Unable to find diffs in %q: %s", diff_dir, err.Error())
+	}
+	if len(diffs) == 0 {
+		log.Printf("No diffs after sequence number %d to apply.\n", state.SequenceNumber)
+		return nil
+	}
+
+	u := newUpdater(out_dir, state)
+	defer u.close()
+	if idx, err := u.index(state.Root); err != nil || idx == nil {
+		return fmt.Errorf("Unable to load the index of tile %s, were the tiles split with -updatable? %v", state.Root, err)
+	}
+
+	for _, diff := range diffs {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		c, err := ReadOsmChangeFile(diff.FileName)
+		if err != nil {
+			return err
+		}
+		state.SequenceNumber = diff.Sequence
+		if ts, ok := diffTimestamp(diff); ok {
+			state.Timestamp = ts
+		}
+
+		tiles, err := u.apply(c)
+		if err != nil {
+			return fmt.Errorf("Unable to apply diff %q: %s", diff.FileName, err.Error())
+		}
+		if db != nil {
+			b := db.StartBatch()
+			err = b.PutChange(c)
+			if err == nil {
+				err = db.Write(b)
+			}
+			if err != nil {
+				return fmt.Errorf("Unable to store diff %q in the database: %s", diff.FileName, err.Error())
+			}
+		}
+		if err = SaveTilingState(out_dir, state); err != nil {
+			return err
+		}
+		log.Printf("Applied diff %d, with %d nodes, %d ways and %d relations, to %d tiles.\n",
+			diff.Sequence, len(c.Nodes), len(c.Ways), len(c.Relations), len(tiles))
+	}
+	if u.outOfRange > 0 {
+		log.Printf("%d node versions in the diffs were out of range, and not written to any tile.\n", u.outOfRange)
+	}
+
+	return nil
+}
+
+// leafSet is a set of tiles at the output zoom.
+type leafSet map[Tile]bool
+
+// add puts all the tiles of the other set into this one, and returns whether
+// there were any which weren't already in it.
+func (s leafSet) add(o leafSet) bool {
+	grew := false
+	for t := range o {
+		if !s[t] {
+			s[t] = true
+			grew = true
+		}
+	}
+	return grew
+}
+
+func (s leafSet) sorted() []Tile {
+	tiles := make([]Tile, 0, len(s))
+	for t := range s {
+		tiles = append(tiles, t)
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		a, b := tiles[i], tiles[j]
+		return a.X < b.X || (a.X == b.X && a.Y < b.Y)
+	})
+	return tiles
+}
+
+// tileIndex is the grid squares of a split tile's elements, as saved by
+// saveIndexes, and the squares which they've been added to since.
+type tileIndex struct {
+	elements [3]*MultiBlock
+	added [3]map[int64]uint64
+	dirty bool
+}
+
+func (x *tileIndex) lookup(kind int, id int64) uint64 {
+	return x.elements[kind].Lookup(id) | x.added[kind][id]
+}
+
+// tileContents is all the versions of the elements in an output tile, with
+// the ways which use each node and the relations which use each member, so
+// that they can follow the elements into other tiles.
+type tileContents struct {
+	header *OSMPBF.HeaderBlock
+	nodes []Node
+	ways []Way
+	rels []Relation
+
+	nodeWays map[int64][]int64
+	memberRels [3]map[int64][]int64
+}
+
+// versions returns the indexes of the versions of an element in the contents.
+func (c *tileContents) versions(kind int, id int64) (start, end int) {
+	var n int
+	var at func(i int) int64
+	switch kind {
+	case PKIND_NODE:
+		n, at = len(c.nodes), func(i int) int64 { return c.nodes[i].Id }
+	case PKIND_WAY:
+		n, at = len(c.ways), func(i int) int64 { return c.ways[i].Id }
+	default:
+		n, at = len(c.rels), func(i int) int64 { return c.rels[i].Id }
+	}
+	start = sort.Search(n, func(i int) bool { return at(i) >= id })
+	end = sort.Search(n, func(i int) bool { return at(i) > id })
+	return
+}
+
+// memberKind converts a relation member's type into the kind of its element.
+func memberKind(t OSMPBF.Relation_MemberType) int {
+	switch t {
+	case OSMPBF.Relation_NODE:
+		return PKIND_NODE
+	case OSMPBF.Relation_WAY:
+		return PKIND_WAY
+	}
+	return PKIND_REL
+}
+
+// updater applies diffs to tiles. The indexes are kept between diffs, but the
+// contents of the tiles are re-read for each one.
+//
+// Each element of a diff is placed in the tiles it was already in, along with
+// any new tiles for its new versions. As in the first pass, the nodes and
+// members of ways and relations follow them into their tiles, and existing
+// ways and relations follow their nodes and members into new tiles. Elements
+// put into new tiles take all their old versions with them.
+//
+// Only the output tiles and their indexes are updated; intermediate tiles and
+// polar files aren't, and the versions of ways aren't matched to their nodes'
+// history as with -time-aware.
+type updater struct {
+	outDir string
+	state *TilingState
+	indexes map[Tile]*tileIndex
+	// the mapped index files, which are closed by close. writeIndexFile
+	// replaces the files rather than writing over them, so the mappings are
+	// still valid after saveIndexes.
+	mapped []*MappedMultiBlock
+
+	// these are for the diff being applied; the tiles each element is in, both
+	// before and after the diff.
+	contents map[Tile]*tileContents
+	old [3]map[int64]leafSet
+	placements [3]map[int64]leafSet
+
+	outOfRange int64
+}
+
+func newUpdater(out_dir string, state *TilingState) *updater {
+	return &updater{outDir: out_dir, state: state, indexes: make(map[Tile]*tileIndex)}
+}
+
+// close unmaps the indexes, after which the updater can't be used.
+func (u *updater) close() {
+	for _, mb := range u.mapped {
+		mb.Close()
+	}
+	u.mapped = nil
+	u.indexes = nil
+}
+
+// index loads the index of a tile, or returns nil if the tile wasn't split.
+func (u *updater) index(tile Tile) (*tileIndex, error) {
+	if idx, ok := u.indexes[tile]; ok {
+		return idx, nil
+	}
+
+	idx := &tileIndex{}
+	for kind := range idx.elements {
+		mb, err := readIndexFile(tile.IndexFileName(u.outDir, kind))
+		if os.IsNotExist(err) {
+			u.indexes[tile] = nil
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		u.mapped = append(u.mapped, mb)
+		idx.elements[kind] = mb.MultiBlock
+		idx.added[kind] = make(map[int64]uint64)
+	}
+	u.indexes[tile] = idx
+	return idx, nil
+}
+
+// markIndexes adds a tile to the indexes of all the tiles above it, creating
+// them for tiles which weren't split before.
+func (u *updater) markIndexes(kind int, id int64, leaf Tile) error {
+	for z := u.state.Root.Z; z < leaf.Z; z += GRID_ZOOM_STEP {
+		shift := uint(leaf.Z - z)
+		tile := Tile{z, leaf.X >> shift, leaf.Y >> shift}
+		child := Tile{z + GRID_ZOOM_STEP, leaf.X >> (shift - GRID_ZOOM_STEP), leaf.Y >> (shift - GRID_ZOOM_STEP)}
+		square := (child.X - tile.X * GRID_SIZE) + GRID_SIZE * (GRID_SIZE - 1 - (child.Y - tile.Y * GRID_SIZE))
+
+		idx, err := u.index(tile)
+		if err != nil {
+			return err
+		}
+		if idx == nil {
+			idx = &tileIndex{}
+			for k := range idx.elements {
+				idx.elements[k] = NewMultiBlock()
+				idx.added[k] = make(map[int64]uint64)
+			}
+			u.indexes[tile] = idx
+		}
+		bit := uint64(1) << uint(square)
+		if idx.lookup(kind, id) & bit == 0 {
+			idx.added[kind][id] |= bit
+			idx.dirty = true
+		}
+	}
+	return nil
+}
+
+// saveIndexes merges the squares added to each index and writes it out again.
+func (u *updater) saveIndexes() error {
+	for tile, idx := range u.indexes {
+		if idx == nil || !idx.dirty {
+			continue
+		}
+		for kind := range idx.elements {
+			if len(idx.added[kind]) > 0 {
+				idx.elements[kind].Merge(NewMultiBlockFromMap(idx.added[kind]))
+				idx.added[kind] = make(map[int64]uint64)
+			}
+			err := writeIndexFile(tile.IndexFileName(u.outDir, kind), idx.elements[kind])
+			if err != nil {
+				return err
+			}
+		}
+		idx.dirty = false
+	}
+	return nil
+}
+
+// leaves returns the output tiles which the indexes say an element is in.
+func (u *updater) leaves(kind int, id int64) (leafSet, error) {
+	leaves := make(leafSet)
+	err := u.descend(u.state.Root, kind, id, leaves)
+	return leaves, err
+}
+
+func (u *updater) descend(tile Tile, kind int, id int64, leaves leafSet) error {
+	idx, err := u.index(tile)
+	if err != nil || idx == nil {
+		return err
+	}
+	mask := idx.lookup(kind, id)
+	for square := 0; square < GRID_SIZE * GRID_SIZE; square += 1 {
+		if mask & (uint64(1) << uint(square)) == 0 {
+			continue
+		}
+		child := tile.Child(square)
+		if child.Z >= u.state.Zoom {
+			leaves[child] = true
+		} else if err = u.descend(child, kind, id, leaves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leafAt returns the output tile for a node's location, using the same grids
+// as splitting did, or false if it's out of range and the policy isn't to
+// clamp it.
+func (u *updater) leafAt(n *Node) (Tile, bool) {
+	scheme := u.state.Scheme
+	lon, lat := float64(n.Lon) / 1e9, float64(n.Lat) / 1e9
+	tile := u.state.Root
+	for tile.Z < u.state.Zoom {
+		x_range, y_range := scheme.Extent(tile)
+		grid := tileGrid{scheme: scheme, xRange: x_range, yRange: y_range, clipX: x_range, clipY: y_range}
+		if tile == u.state.Root && u.state.Clip != nil {
+			grid.clipX, grid.clipY = u.state.Clip.Extent(scheme)
+		}
+
+		mask, ok := grid.Mask(lon, lat)
+		if !ok {
+			if u.state.OutOfRange != OUT_OF_RANGE_CLAMP {
+				u.outOfRange += 1
+				return Tile{}, false
+			}
+			lon, lat = scheme.Clamp(lon, lat)
+			mask, ok = grid.Mask(lon, lat)
+		}
+		if !ok || mask == 0 {
+			// outside the clip region.
+			return Tile{}, false
+		}
+		tile = tile.Child(bits.TrailingZeros64(mask))
+	}
+	return tile, true
+}
+
+// placement returns the tiles an element will be in after the diff, starting
+// from the tiles it's in now.
+func (u *updater) placement(kind int, id int64) (leafSet, error) {
+	if p, ok := u.placements[kind][id]; ok {
+		return p, nil
+	}
+	old, err := u.leaves(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	p := make(leafSet)
+	p.add(old)
+	u.old[kind][id] = old
+	u.placements[kind][id] = p
+	return p, nil
+}
+
+// gained returns the tiles which an element wasn't in before the diff.
+func (u *updater) gained(kind int, id int64) leafSet {
+	gained := make(leafSet)
+	for t := range u.placements[kind][id] {
+		if !u.old[kind][id][t] {
+			gained[t] = true
+		}
+	}
+	return gained
+}
+
+// tile loads the contents of an output tile, which is empty if the tile hasn't
+// been written yet.
+func (u *updater) tile(leaf Tile) (*tileContents, error) {
+	if c, ok := u.contents[leaf]; ok {
+		return c, nil
+	}
+
+	c := &tileContents{nodeWays: make(map[int64][]int64)}
+	for kind := range c.memberRels {
+		c.memberRels[kind] = make(map[int64][]int64)
+	}
+	u.contents[leaf] = c
+
+	file_name := leaf.FileName(u.outDir)
+	if _, err := os.Stat(file_name); os.IsNotExist(err) {
+		return c, nil
+	}
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %q: %s", file_name, err.Error())
+	}
+	defer reader.Close()
+
+	c.header, err = reader.ReadHeaderBlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read header block of %q: %s", file_name, err.Error())
+	}
+	historical := hasFeature(c.header, "HistoricalInformation")
+	err = readBlocks(context.Background(), reader, func(block BlockOrError) error {
+		nodes, ways, rels, err := DecodeBlock(block.Primitives, historical)
+		c.nodes = append(c.nodes, nodes...)
+		c.ways = append(c.ways, ways...)
+		c.rels = append(c.rels, rels...)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %q: %s", file_name, err.Error())
+	}
+
+	for _, w := range c.ways {
+		for _, ref := range w.Refs {
+			c.nodeWays[ref] = append(c.nodeWays[ref], w.Id)
+		}
+	}
+	for _, r := range c.rels {
+		for _, m := range r.Members {
+			kind := memberKind(m.Type)
+			c.memberRels[kind][m.Id] = append(c.memberRels[kind][m.Id], r.Id)
+		}
+	}
+	return c, nil
+}
+
+// users returns the ways or relations in the element's old tiles which use it.
+func (u *updater) users(kind int, id int64, way_users bool) ([]int64, error) {
+	var ids []int64
+	for _, leaf := range u.old[kind][id].sorted() {
+		c, err := u.tile(leaf)
+		if err != nil {
+			return nil, err
+		}
+		if way_users {
+			ids = append(ids, c.nodeWays[id]...)
+		} else {
+			ids = append(ids, c.memberRels[kind][id]...)
+		}
+	}
+	return ids, nil
+}
+
+// oldContents returns one of the tiles which an element was in before the
+// diff, which has all its old versions, or nil if it's new.
+func (u *updater) oldContents(kind int, id int64) (*tileContents, error) {
+	leaves := u.old[kind][id].sorted()
+	if len(leaves) == 0 {
+		return nil, nil
+	}
+	return u.tile(leaves[0])
+}
+
+// apply places all the elements of the diff, writes them to their tiles and
+// updates the indexes, returning the tiles which were written.
+func (u *updater) apply(c *OsmChange) ([]Tile, error) {
+	u.contents = make(map[Tile]*tileContents)
+	for kind := range u.placements {
+		u.old[kind] = make(map[int64]leafSet)
+		u.placements[kind] = make(map[int64]leafSet)
+	}
+
+	// new versions of nodes go wherever they are now, as well as wherever
+	// they've been before. deleted versions don't have a location.
+	for i := range c.Nodes {
+		n := &c.Nodes[i]
+		p, err := u.placement(PKIND_NODE, n.Id)
+		if err != nil {
+			return nil, err
+		}
+		if n.Info.Visible {
+			if leaf, ok := u.leafAt(n); ok {
+				p[leaf] = true
+			}
+		}
+	}
+
+	// new versions of ways go wherever their nodes are, and existing ways
+	// follow their nodes into new tiles.
+	var ways []int64
+	for i := range c.Ways {
+		w := &c.Ways[i]
+		p, err := u.placement(PKIND_WAY, w.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range w.Refs {
+			np, err := u.placement(PKIND_NODE, ref)
+			if err != nil {
+				return nil, err
+			}
+			p.add(np)
+		}
+		ways = append(ways, w.Id)
+	}
+	for id := range u.placements[PKIND_NODE] {
+		gained := u.gained(PKIND_NODE, id)
+		if len(gained) == 0 {
+			continue
+		}
+		users, err := u.users(PKIND_NODE, id, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, way_id := range users {
+			p, err := u.placement(PKIND_WAY, way_id)
+			if err != nil {
+				return nil, err
+			}
+			p.add(gained)
+			ways = append(ways, way_id)
+		}
+	}
+
+	// the same goes for relations and their members.
+	for i := range c.Relations {
+		r := &c.Relations[i]
+		p, err := u.placement(PKIND_REL, r.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range r.Members {
+			mp, err := u.placement(memberKind(m.Type), m.Id)
+			if err != nil {
+				return nil, err
+			}
+			p.add(mp)
+		}
+	}
+	for kind := PKIND_NODE; kind <= PKIND_WAY; kind += 1 {
+		for id := range u.placements[kind] {
+			gained := u.gained(kind, id)
+			if len(gained) == 0 {
+				continue
+			}
+			users, err := u.users(kind, id, false)
+			if err != nil {
+				return nil, err
+			}
+			for _, rel_id := range users {
+				p, err := u.placement(PKIND_REL, rel_id)
+				if err != nil {
+					return nil, err
+				}
+				p.add(gained)
+			}
+		}
+	}
+
+	// relations follow their sub-relations too, all the way up, as they do in
+	// the first pass. parents are in the old tiles or the diff.
+	diff_parents := make(map[int64][]int64)
+	for i := range c.Relations {
+		for _, m := range c.Relations[i].Members {
+			if memberKind(m.Type) == PKIND_REL {
+				diff_parents[m.Id] = append(diff_parents[m.Id], c.Relations[i].Id)
+			}
+		}
+	}
+	var queue []int64
+	for _, id := range sortedIds(u.placements[PKIND_REL]) {
+		if len(u.gained(PKIND_REL, id)) > 0 {
+			queue = append(queue, id)
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[len(queue) - 1]
+		queue = queue[:len(queue) - 1]
+		parents, err := u.users(PKIND_REL, id, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range append(parents, diff_parents[id]...) {
+			p, err := u.placement(PKIND_REL, parent)
+			if err != nil {
+				return nil, err
+			}
+			if p.add(u.placements[PKIND_REL][id]) {
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	// members follow their relations into all their tiles, and then nodes
+	// follow their ways, including ways which are only there because of a
+	// relation.
+	for _, id := range sortedIds(u.placements[PKIND_REL]) {
+		err := u.complete(c, PKIND_REL, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range sortedIds(u.placements[PKIND_WAY]) {
+		err := u.complete(c, PKIND_WAY, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return u.write(c)
+}
+
+func sortedIds(m map[int64]leafSet) []int64 {
+	ids := make([]int64, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Sort(int64slice(ids))
+	return ids
+}
+
+// complete puts the nodes or members of every version of a way or relation,
+// old and new, into all the tiles which it's in.
+func (u *updater) complete(c *OsmChange, kind int, id int64) error {
+	p := u.placements[kind][id]
+	if len(p) == 0 {
+		return nil
+	}
+
+	old, err := u.oldContents(kind, id)
+	if err != nil {
+		return err
+	}
+
+	var refs []int64
+	var members []Member
+	if kind == PKIND_WAY {
+		start, end := sort.Search(len(c.Ways), func(i int) bool { return c.Ways[i].Id >= id }), 0
+		for end = start; end < len(c.Ways) && c.Ways[end].Id == id; end += 1 {
+			refs = append(refs, c.Ways[end].Refs...)
+		}
+		if old != nil {
+			start, end = old.versions(kind, id)
+			for _, w := range old.ways[start:end] {
+				refs = append(refs, w.Refs...)
+			}
+		}
+		for _, ref := range refs {
+			members = append(members, Member{Type: OSMPBF.Relation_NODE, Id: ref})
+		}
+
+	} else {
+		start, end := sort.Search(len(c.Relations), func(i int) bool { return c.Relations[i].Id >= id }), 0
+		for end = start; end < len(c.Relations) && c.Relations[end].Id == id; end += 1 {
+			members = append(members, c.Relations[end].Members...)
+		}
+		if old != nil {
+			start, end = old.versions(kind, id)
+			for _, r := range old.rels[start:end] {
+				members = append(members, r.Members...)
+			}
+		}
+	}
+
+	for _, m := range members {
+		mp, err := u.placement(memberKind(m.Type), m.Id)
+		if err != nil {
+			return err
+		}
+		mp.add(p)
+	}
+	return nil
+}
+
+// leafUpdate is what's being added to an output tile.
+type leafUpdate struct {
+	nodes []Node
+	ways []Way
+	rels []Relation
+}
+
+// write adds the new versions of each element to all its tiles, and its old
+// versions to the tiles it's gained, then rewrites those tiles.
+func (u *updater) write(c *OsmChange) ([]Tile, error) {
+	updates := make(map[Tile]*leafUpdate)
+	get := func(leaf Tile) *leafUpdate {
+		if updates[leaf] == nil {
+			updates[leaf] = &leafUpdate{}
+		}
+		return updates[leaf]
+	}
+
+	for i := range c.Nodes {
+		for leaf := range u.placements[PKIND_NODE][c.Nodes[i].Id] {
+			get(leaf).nodes = append(get(leaf).nodes, c.Nodes[i])
+		}
+	}
+	for i := range c.Ways {
+		for leaf := range u.placements[PKIND_WAY][c.Ways[i].Id] {
+			get(leaf).ways = append(get(leaf).ways, c.Ways[i])
+		}
+	}
+	for i := range c.Relations {
+		for leaf := range u.placements[PKIND_REL][c.Relations[i].Id] {
+			get(leaf).rels = append(get(leaf).rels, c.Relations[i])
+		}
+	}
+
+	for kind := range u.placements {
+		for _, id := range sortedIds(u.placements[kind]) {
+			gained := u.gained(kind, id)
+			if len(gained) == 0 {
+				continue
+			}
+			old, err := u.oldContents(kind, id)
+			if err != nil {
+				return nil, err
+			}
+			for leaf := range gained {
+				if err = u.markIndexes(kind, id, leaf); err != nil {
+					return nil, err
+				}
+				if old == nil {
+					continue
+				}
+				start, end := old.versions(kind, id)
+				lu := get(leaf)
+				switch kind {
+				case PKIND_NODE:
+					lu.nodes = append(lu.nodes, old.nodes[start:end]...)
+				case PKIND_WAY:
+					lu.ways = append(lu.ways, old.ways[start:end]...)
+				default:
+					lu.rels = append(lu.rels, old.rels[start:end]...)
+				}
+			}
+		}
+	}
+
+	// the tiles are all read before any of them are written, as the old
+	// versions might come from tiles which are being rewritten.
+	for leaf := range updates {
+		if _, err := u.tile(leaf); err != nil {
+			return nil, err
+		}
+	}
+	tiles := make(leafSet)
+	for leaf := range updates {
+		tiles[leaf] = true
+	}
+	for _, leaf := range tiles.sorted() {
+		if err := u.writeTile(leaf, updates[leaf]); err != nil {
+			return nil, err
+		}
+	}
+
+	return tiles.sorted(), u.saveIndexes()
+}
+
+// writeTile merges the update into the tile's contents and rewrites its file.
+// Versions which are already in the tile are replaced, so applying the same
+// diff twice doesn't duplicate anything.
+func (u *updater) writeTile(leaf Tile, lu *leafUpdate) error {
+	c, err := u.tile(leaf)
+	if err != nil {
+		return err
+	}
+
+	header := c.header
+	if header == nil {
+		header = NewHeaderBlock(u.state.Scheme.Bounds(leaf).HeaderBBox(), true)
+	} else if !hasFeature(header, "HistoricalInformation") {
+		header.RequiredFeatures = append(header.RequiredFeatures, "HistoricalInformation")
+	}
+	sequence, timestamp := u.state.SequenceNumber, u.state.Timestamp.Unix()
+	header.OsmosisReplicationSequenceNumber = &sequence
+	if !u.state.Timestamp.IsZero() {
+		header.OsmosisReplicationTimestamp = &timestamp
+	}
+
+	type key struct {
+		id int64
+		version int32
+	}
+	nodes := append(append([]Node{}, lu.nodes...), c.nodes...)
+	seen := make(map[key]bool)
+	n := 0
+	for _, node := range nodes {
+		if k := (key{node.Id, node.Info.Version}); !seen[k] {
+			seen[k] = true
+			nodes[n] = node
+			n += 1
+		}
+	}
+	nodes = nodes[:n]
+	sort.Stable(nodesById(nodes))
+
+	ways := append(append([]Way{}, lu.ways...), c.ways...)
+	seen = make(map[key]bool)
+	n = 0
+	for _, way := range ways {
+		if k := (key{way.Id, way.Info.Version}); !seen[k] {
+			seen[k] = true
+			ways[n] = way
+			n += 1
+		}
+	}
+	ways = ways[:n]
+	sort.Stable(waysById(ways))
+
+	rels := append(append([]Relation{}, lu.rels...), c.rels...)
+	seen = make(map[key]bool)
+	n = 0
+	for _, rel := range rels {
+		if k := (key{rel.Id, rel.Info.Version}); !seen[k] {
+			seen[k] = true
+			rels[n] = rel
+			n += 1
+		}
+	}
+	rels = rels[:n]
+	sort.Stable(relationsById(rels))
+
+	file_name := leaf.FileName(u.outDir)
+	err = os.MkdirAll(filepath.Dir(file_name), 0755)
+	if err != nil {
+		return fmt.Errorf("Unable to create directory for tile %q: %s", file_name, err.Error())
+	}
+	w, err := NewPBFWriter(file_name + ".tmp", header)
+	if err != nil {
+		return fmt.Errorf("Unable to create tile %q: %s", file_name, err.Error())
+	}
+	for i := range nodes {
+		if err == nil {
+			err = w.WriteNode(&nodes[i])
+		}
+	}
+	for i := range ways {
+		if err == nil {
+			err = w.WriteWay(&ways[i])
+		}
+	}
+	for i := range rels {
+		if err == nil {
+			err = w.WriteRelation(&rels[i])
+		}
+	}
+	cerr := w.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file_name + ".tmp", file_name)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write tile %q: %s", file_name, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TEST_DIFF moves node 3 from (10, 10) to (-101, 20), which is in tile 4/3/7,
+// and adds node 4 next to node 2, with a way between them. Node 3 is moved by
+// user 1 in changeset 13.
+const TEST_DIFF = `<?xml version="1.0" encoding="UTF-8"?>
+<osmChange version="0.6">
+  <modify>
+    <node id="3" version="3" timestamp="2020-01-01T00:00:00Z" changeset="13" uid="1" user="bob" lat="20" lon="-101"/>
+  </modify>
+  <create>
+    <node id="4" version="1" timestamp="2020-01-01T00:00:00Z" lat="40.1" lon="100.1"/>
+    <way id="3" version="1" timestamp="2020-01-01T00:00:00Z">
+      <nd ref="4"/>
+      <nd ref="2"/>
+    </way>
+  </create>
+</osmChange>
+`
+
+func elementIds(nodes []Node, ways []Way, rels []Relation) (node_ids, way_ids, rel_ids []int64) {
+	for _, n := range nodes {
+		node_ids = append(node_ids, n.Id)
+	}
+	for _, w := range ways {
+		way_ids = append(way_ids, w.Id)
+	}
+	for _, r := range rels {
+		rel_ids = append(rel_ids, r.Id)
+	}
+	return
+}
+
+func equalIds(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyDiffs(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+
+	out := filepath.Join(dir, "out")
+	if err := SplitRegion(context.Background(), in, nil, 4, out, SplitOptions{Updatable: true}); err != nil {
+		t.Fatalf("Split failed: %s", err.Error())
+	}
+
+	diffs := filepath.Join(dir, "diffs")
+	os.MkdirAll(filepath.Join(diffs, "000", "000"), 0755)
+	if err := os.WriteFile(filepath.Join(diffs, "000", "000", "001.osc"), []byte(TEST_DIFF), 0644); err != nil {
+		t.Fatalf("Unable to write diff: %s", err.Error())
+	}
+	os.WriteFile(filepath.Join(diffs, "000", "000", "001.state.txt"), []byte("sequenceNumber=1\ntimestamp=2020-01-01T00\\:01\\:00Z\n"), 0644)
+	os.WriteFile(filepath.Join(diffs, "notes.osc"), []byte("not a diff"), 0644)
+
+	check := func() {
+		// node 3 takes its old versions, and the way and relations using it,
+		// into its new tile. relation 2 brings node 1 along with it.
+		node_ids, way_ids, rel_ids := elementIds(readTile(t, filepath.Join(out, "4", "3", "7.osm.pbf")))
+		if !equalIds(node_ids, []int64{1, 1, 3, 3, 3}) || !equalIds(way_ids, []int64{2}) || !equalIds(rel_ids, []int64{1, 2}) {
+			t.Errorf("Unexpected elements in tile 4/3/7: nodes %v, ways %v, relations %v.", node_ids, way_ids, rel_ids)
+		}
+
+		// the new version of node 3 is still written to its old tiles.
+		node_ids, way_ids, _ = elementIds(readTile(t, filepath.Join(out, "4", "8", "7.osm.pbf")))
+		if !equalIds(node_ids, []int64{1, 1, 3, 3, 3}) || !equalIds(way_ids, []int64{2}) {
+			t.Errorf("Unexpected elements in tile 4/8/7: nodes %v, ways %v.", node_ids, way_ids)
+		}
+
+		node_ids, way_ids, _ = elementIds(readTile(t, filepath.Join(out, "4", "12", "6.osm.pbf")))
+		if !equalIds(node_ids, []int64{1, 1, 2, 2, 4}) || !equalIds(way_ids, []int64{1, 3}) {
+			t.Errorf("Unexpected elements in tile 4/12/6: nodes %v, ways %v.", node_ids, way_ids)
+		}
+
+		state, err := LoadTilingState(out)
+		if err != nil {
+			t.Fatalf("Unable to load state: %s", err.Error())
+		}
+		if state.SequenceNumber != 1 || state.Timestamp.Unix() != 1577836860 {
+			t.Errorf("Expected the state to be at diff 1, but got %+v.", state)
+		}
+
+		// the indexes should lead to the new tiles.
+		u := newUpdater(out, state)
+		leaves, err := u.leaves(PKIND_NODE, 3)
+		u.close()
+		if err != nil || len(leaves) != 3 || !leaves[Tile{4, 3, 7}] || !leaves[Tile{4, 8, 7}] {
+			t.Errorf("Expected node 3 to be indexed in tile 4/3/7, but got %v, %v.", leaves, err)
+		}
+	}
+
+	db, err := OpenDatabase(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatalf("Unable to open database: %s", err.Error())
+	}
+	defer db.Close()
+	if err = ApplyDiffs(context.Background(), diffs, out, db); err != nil {
+		t.Fatalf("Applying diffs failed: %s", err.Error())
+	}
+	check()
+
+	// the database has the elements of the diff.
+	nodes, err := db.NodeVersions(3)
+	if err != nil || len(nodes) != 1 || nodes[0].Info.Version != 3 || nodes[0].Info.User != "bob" {
+		t.Errorf("Expected version 3 of node 3 by bob in the database, but got %+v, %v.", nodes, err)
+	}
+	if refs, err := db.GetWayNodes(3, 1); err != nil || !equalIds(refs, []int64{4, 2}) {
+		t.Errorf("Expected way 3 to have nodes [4 2] in the database, but got %v, %v.", refs, err)
+	}
+	if c, err := db.GetChangeset(13); err != nil || c.Uid != 1 {
+		t.Errorf("Expected changeset 13 by user 1 in the database, but got %+v, %v.", c, err)
+	}
+
+	header, err := readHeaderBlock(filepath.Join(out, "4", "3", "7.osm.pbf"))
+	if err != nil || header.GetOsmosisReplicationSequenceNumber() != 1 || !hasFeature(header, "HistoricalInformation") {
+		t.Errorf("Unexpected header for tile 4/3/7: %+v, %v", header, err)
+	}
+
+	// applying the same diff again, as if the state hadn't been saved, doesn't
+	// change anything.
+	state, _ := LoadTilingState(out)
+	state.SequenceNumber = 0
+	if err = SaveTilingState(out, state); err != nil {
+		t.Fatalf("Unable to save state: %s", err.Error())
+	}
+	if err = ApplyDiffs(context.Background(), diffs, out, nil); err != nil {
+		t.Fatalf("Applying diffs again failed: %s", err.Error())
+	}
+	check()
+}
+
+// TEST_SUB_RELATION_DIFFS adds relation 3 with relation 1 as its member, and
+// then moves node 3, which relation 1 uses through way 2, to tile 4/3/7.
+var TEST_SUB_RELATION_DIFFS = []string{`<?xml version="1.0" encoding="UTF-8"?>
+<osmChange version="0.6">
+  <create>
+    <relation id="3" version="1" timestamp="2020-01-01T00:00:00Z">
+      <member type="relation" ref="1" role=""/>
+    </relation>
+  </create>
+</osmChange>
+`, `<?xml version="1.0" encoding="UTF-8"?>
+<osmChange version="0.6">
+  <modify>
+    <node id="3" version="3" timestamp="2020-01-01T00:01:00Z" lat="20" lon="-101"/>
+  </modify>
+</osmChange>
+`}
+
+func TestApplySubRelationDiff(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.osm.pbf")
+	writeTestInput(t, in)
+
+	out := filepath.Join(dir, "out")
+	if err := SplitRegion(context.Background(), in, nil, 4, out, SplitOptions{Updatable: true}); err != nil {
+		t.Fatalf("Split failed: %s", err.Error())
+	}
+
+	diffs := filepath.Join(dir, "diffs")
+	os.MkdirAll(filepath.Join(diffs, "000", "000"), 0755)
+	for i, diff := range TEST_SUB_RELATION_DIFFS {
+		if err := os.WriteFile(filepath.Join(diffs, "000", "000", fmt.Sprintf("%03d.osc", i + 1)), []byte(diff), 0644); err != nil {
+			t.Fatalf("Unable to write diff: %s", err.Error())
+		}
+	}
+	if err := ApplyDiffs(context.Background(), diffs, out, nil); err != nil {
+		t.Fatalf("Applying diffs failed: %s", err.Error())
+	}
+
+	// relation 3 follows relation 1 into the new tile of node 3.
+	_, _, rel_ids := elementIds(readTile(t, filepath.Join(out, "4", "3", "7.osm.pbf")))
+	if !equalIds(rel_ids, []int64{1, 2, 3}) {
+		t.Errorf("Unexpected relations in tile 4/3/7: %v.", rel_ids)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Maximum number of problems reported for each tile, as a broken tile tends to
+// have lots of the same problem.
+const MAX_VERIFY_PROBLEMS = 20
+
+// VerifyTile reads a tile and checks that it's in the order the splitter
+// writes, nodes then ways then relations, each by ID and version, and that the
+// nodes of its ways and the node and way members of its relations are all in
+// it too. The problems found are returned; an error means it couldn't be read.
+func VerifyTile(ctx context.Context, file_name string) ([]string, error) {
+	reader, err := NewPBFReader(file_name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %q: %s", file_name, err.Error())
+	}
+	defer reader.Close()
+
+	header, err := reader.ReadHeaderBlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read header block: %s", err.Error())
+	}
+	historical := hasFeature(header, "HistoricalInformation")
+
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		if len(problems) < MAX_VERIFY_PROBLEMS {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	// the last element seen, to check the order.
+	last_kind, last_id, last_version := PKIND_NODE, int64(0), int32(0)
+	first := true
+	next := func(kind int, id int64, version int32) {
+		if !first && (kind < last_kind || (kind == last_kind &&
+			(id < last_id || (id == last_id && version <= last_version)))) {
+			report("%s %d v%d is out of order, after %s %d v%d.",
+				PKIND_NAMES[kind], id, version, PKIND_NAMES[last_kind], last_id, last_version)
+		}
+		first = false
+		last_kind, last_id, last_version = kind, id, version
+	}
+
+	// which nodes and ways there are, and which ones are needed by the ways
+	// and relations.
+	var present, needed [2]map[int64]bool
+	for kind := range present {
+		present[kind] = make(map[int64]bool)
+		needed[kind] = make(map[int64]bool)
+	}
+
+	err = readBlocks(ctx, reader, func(block BlockOrError) error {
+		nodes, ways, rels, err := DecodeBlock(block.Primitives, historical)
+		if err != nil {
+			return err
+		}
+		for _, n := range nodes {
+			next(PKIND_NODE, n.Id, n.Info.Version)
+			present[PKIND_NODE][n.Id] = true
+		}
+		for _, w := range ways {
+			next(PKIND_WAY, w.Id, w.Info.Version)
+			present[PKIND_WAY][w.Id] = true
+			for _, ref := range w.Refs {
+				needed[PKIND_NODE][ref] = true
+			}
+		}
+		for _, r := range rels {
+			next(PKIND_REL, r.Id, r.Info.Version)
+			for _, m := range r.Members {
+				if kind := memberKind(m.Type); kind != PKIND_REL {
+					needed[kind][m.Id] = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return problems, err
+	}
+
+	for kind := range needed {
+		missing := 0
+		ids := sortedKeys(len(needed[kind]), func(f func(int64)) {
+			for id := range needed[kind] {
+				f(id)
+			}
+		})
+		for _, id := range ids {
+			if !present[kind][id] {
+				if missing < MAX_VERIFY_PROBLEMS {
+					report("%s %d is used, but isn't in the tile.", PKIND_NAMES[kind], id)
+				}
+				missing += 1
+			}
+		}
+		if missing > MAX_VERIFY_PROBLEMS {
+			problems = append(problems, fmt.Sprintf("%d %ss are missing in all.", missing, PKIND_NAMES[kind]))
+		}
+	}
+	return problems, nil
+}
@@ -1,74 +1,216 @@
 package main
 
 import (
+	"context"
 	"github.com/mapzen/neatlacoche/OSMPBF"
-	"fmt"
+	"math"
+	"sync/atomic"
 )
 
 type wayWorker struct {
 	Ways *MultiBlock
-	ExtraNodes map[int64]uint32
+	// Node IDs and the grid squares they need to be in, in addition to their
+	// own, so that every way they're part of is complete. There can be a lot
+	// of these, so they're kept in Blocks rather than a map.
+	ExtraNodes *UnorderedMultiBlock
 	Id int
 	Nodes *MultiBlock
+
+	// Every version of a way goes into all the grid squares of all its versions,
+	// so its nodes can't be checked until the last version has been seen. These
+	// hold the refs of all the versions of the last way seen, and their masks.
+	lastId int64
+	lastMask uint64
+	lastRefs []int64
+	lastRefMasks []uint64
+
+	// The versions of a way which are split across two blocks can be seen by
+	// different workers, which would miss each other's squares. So the first
+	// and last ways of each block are kept as seams, which the Sorter matches
+	// up once all the ways have been seen. firstInBlock is set until the first
+	// way of a block is seen, and lastIsSeam while the last way seen is a seam.
+	Seams []waySeam
+	firstInBlock bool
+	lastIsSeam bool
+
+	// Only in time-aware mode. The history of the nodes which have moved, and
+	// the timestamp of each version of the last way seen, with the index in
+	// lastRefs of its first ref. Each version's mask is worked out once the
+	// next version's timestamp is known, from where its nodes were while it
+	// was current.
+	History NodeHistory
+	lastVersions []wayVersion
+}
+
+type wayVersion struct {
+	timestamp int64
+	start int
 }
 
-func wayWorkerLoop(workQueue chan chan *OSMPBF.PrimitiveBlock, quitChan chan bool, i int, resultChan chan chan *MultiBlock, nodes *MultiBlock) {
+// waySeam is a way at the start or end of a block, with the squares of the
+// versions of it in that block, and their refs and the refs' own squares.
+type waySeam struct {
+	Id int64
+	Mask uint64
+	Refs []int64
+	RefMasks []uint64
+}
+
+func wayWorkerLoop(ctx context.Context, workQueue chan chan *OSMPBF.PrimitiveBlock, quitChan chan bool, i int, resultChan chan chan *workerResult, nodes *MultiBlock, history NodeHistory, spill *BlockSpill) {
 	w := &wayWorker{
 		Ways: NewMultiBlock(),
-		ExtraNodes: map[int64]uint32{},
+		ExtraNodes: NewUnorderedMultiBlock(),
 		Id: i,
 		Nodes: nodes,
+		History: history,
 	}
+	w.Ways.Spill = spill
+	w.ExtraNodes.Spill = spill
 	requestQueue := make(chan *OSMPBF.PrimitiveBlock)
 
 	for {
+		atomic.AddInt64(&metrics.IdleWorkers, 1)
 		select {
 		case workQueue <- requestQueue:
 		case ch := <-resultChan:
-			fmt.Printf("way_worker[%d]: %d\n", i, len(w.ExtraNodes))
-			ch <- w.Ways
+			w.flushExtraNodes()
+			ch <- &workerResult{Elements: w.Ways, WayExtraNodes: w.ExtraNodes.MultiBlock(), Seams: w.Seams}
 
 		case <-quitChan:
+			atomic.AddInt64(&metrics.IdleWorkers, -1)
+			return
+
+		case <-ctx.Done():
+			atomic.AddInt64(&metrics.IdleWorkers, -1)
 			return
 		}
+		atomic.AddInt64(&metrics.IdleWorkers, -1)
 
 		select {
 		case work := <-requestQueue:
 			w.processWayRequest(work)
 
 		case ch := <-resultChan:
-			fmt.Printf("way_worker[%d]: %d\n", i, len(w.ExtraNodes))
-			ch <- w.Ways
+			w.flushExtraNodes()
+			ch <- &workerResult{Elements: w.Ways, WayExtraNodes: w.ExtraNodes.MultiBlock(), Seams: w.Seams}
 
 		case <-quitChan:
 			return
+
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
 func (w *wayWorker) processWayRequest(b *OSMPBF.PrimitiveBlock) {
+	// timestamps are kept in milliseconds, whatever the block's granularity.
+	granularity := int64(b.GetDateGranularity())
+
+	w.firstInBlock = true
 	for _, g := range b.Primitivegroup {
 		for _, way := range g.Ways {
-			w.putWay(way.Id, way.Refs)
+			w.putWay(way.Id, way.Info.GetTimestamp() * granularity, way.Refs)
 		}
 	}
+
+	// the last way might carry on in the next block, which another worker
+	// could see, so it's finished here as a seam.
+	if len(w.lastRefs) > 0 {
+		w.lastIsSeam = true
+	}
+	w.flushExtraNodes()
 }
 
-func (w *wayWorker) putWay(id int64, nds []int64) {
-	mask := uint32(0)
-	nd_masks := make([]uint32, len(nds))
+// putWay sets the mask of the way to cover all of its nodes. The refs are
+// delta-coded, as they are in the PBF. The timestamp, in milliseconds, is only
+// used in time-aware mode.
+func (w *wayWorker) putWay(id, timestamp int64, deltas []int64) {
+	if id != w.lastId || w.firstInBlock {
+		w.flushExtraNodes()
+		w.lastId = id
+		w.lastIsSeam = w.firstInBlock
+		w.firstInBlock = false
+	}
+	if w.History != nil {
+		w.lastVersions = append(w.lastVersions, wayVersion{timestamp: timestamp, start: len(w.lastRefs)})
+	}
+
+	mask := uint64(0)
+	var ref int64
 
-	for i, n := range nds {
-		nd_masks[i] = w.Nodes.Lookup(n)
-		mask = mask | nd_masks[i]
+	for _, delta := range deltas {
+		ref += delta
+		nd_mask := w.Nodes.Lookup(ref)
+		mask = mask | nd_mask
+		w.lastRefs = append(w.lastRefs, ref)
+		w.lastRefMasks = append(w.lastRefMasks, nd_mask)
 	}
 
-	w.Ways.Append(id, mask)
+	if w.History == nil {
+		w.Ways.Append(id, mask)
+		w.lastMask = w.lastMask | mask
+	}
+}
+
+// putVersions sets the mask of each version of the last way seen to cover
+// only the grid squares which its nodes were in while it was current.
+func (w *wayWorker) putVersions() {
+	for i, v := range w.lastVersions {
+		end := len(w.lastRefs)
+		to := int64(math.MaxInt64)
+		if i + 1 < len(w.lastVersions) {
+			end = w.lastVersions[i + 1].start
+			to = w.lastVersions[i + 1].timestamp
+		}
+
+		mask := uint64(0)
+		for j := v.start; j < end; j += 1 {
+			nd_mask, ok := w.History.MaskDuring(w.lastRefs[j], v.timestamp, to)
+			if !ok {
+				nd_mask = w.lastRefMasks[j]
+			}
+			mask = mask | nd_mask
+		}
+
+		w.Ways.Append(w.lastId, mask)
+		w.lastMask = w.lastMask | mask
+	}
 
-	for i, n := range nds {
-		nd_mask := nd_masks[i]
-		if nd_mask != mask {
-			w.ExtraNodes[n] = w.ExtraNodes[n] | (mask & ^nd_mask)
+	w.lastVersions = w.lastVersions[:0]
+}
+
+// flushExtraNodes records any nodes of the last way seen which need to be in
+// extra grid squares, so that each version of the way is complete in every
+// square it's in.
+func (w *wayWorker) flushExtraNodes() {
+	if w.History != nil {
+		w.putVersions()
+	}
+
+	extra := 0
+	for i, n := range w.lastRefs {
+		nd_mask := w.lastRefMasks[i]
+		if nd_mask != w.lastMask {
+			w.ExtraNodes.Add(n, w.lastMask & ^nd_mask)
+			extra += 1
 		}
 	}
+	if extra > 0 {
+		atomic.AddInt64(&metrics.ExtraNodes, int64(extra))
+	}
+
+	if w.lastIsSeam {
+		w.Seams = append(w.Seams, waySeam{
+			Id: w.lastId,
+			Mask: w.lastMask,
+			Refs: append([]int64(nil), w.lastRefs...),
+			RefMasks: append([]uint64(nil), w.lastRefMasks...),
+		})
+		w.lastIsSeam = false
+	}
+
+	w.lastMask = 0
+	w.lastRefs = w.lastRefs[:0]
+	w.lastRefMasks = w.lastRefMasks[:0]
 }
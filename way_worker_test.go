@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/mapzen/neatlacoche/OSMPBF"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutWay(t *testing.T) {
+	nodes := NewMultiBlock()
+	nodes.Append(1, 1)
+	nodes.Append(2, 2)
+	nodes.Append(3, 4)
+
+	w := &wayWorker{Ways: NewMultiBlock(), ExtraNodes: NewUnorderedMultiBlock(), Nodes: nodes}
+	// refs are delta-coded, so the first version is nodes 1 & 2 and the second
+	// is nodes 2 & 3.
+	w.putWay(1, 0, []int64{1, 1})
+	w.putWay(1, 0, []int64{2, 1})
+	w.putWay(2, 0, []int64{3})
+	w.flushExtraNodes()
+
+	if val := w.Ways.Lookup(1); val != 7 {
+		t.Errorf("Expected way 1 to have mask 7, but got %d.", val)
+	}
+	if val := w.Ways.Lookup(2); val != 4 {
+		t.Errorf("Expected way 2 to have mask 4, but got %d.", val)
+	}
+
+	// every node of every version of way 1 needs to be in all of its squares,
+	// but way 2 doesn't need any extra nodes.
+	expected := map[int64]uint64{1: 6, 2: 5, 3: 3}
+	extra := extraNodesMap(w)
+	if len(extra) != len(expected) {
+		t.Errorf("Expected %d extra nodes, but got %v.", len(expected), extra)
+	}
+	for id, mask := range expected {
+		if extra[id] != mask {
+			t.Errorf("Expected extra node %d to have mask %d, but got %d.", id, mask, extra[id])
+		}
+	}
+}
+
+func TestPutWayTimeAware(t *testing.T) {
+	nodes := NewMultiBlock()
+	nodes.Append(1, 3)
+	nodes.Append(2, 4)
+
+	// node 1 was in square 0 until it moved to square 1 at time 2000, while
+	// node 2 never moved.
+	history := NodeHistory{1: {{1000, 1}, {2000, 2}}}
+
+	w := &wayWorker{Ways: NewMultiBlock(), ExtraNodes: NewUnorderedMultiBlock(), Nodes: nodes, History: history}
+	w.putWay(1, 1000, []int64{1, 1})
+	w.putWay(1, 1500, []int64{1})
+	w.putWay(2, 3000, []int64{1, 1})
+	w.putWay(3, 500, []int64{1})
+	w.flushExtraNodes()
+
+	// the first version of way 1 is only around before node 1 moves, and the
+	// second version is still current when it does. way 3 is older than node
+	// 1, so it falls back to everywhere node 1 has been.
+	expected := map[int64]uint64{1: 7, 2: 6, 3: 3}
+	for id, mask := range expected {
+		if val := w.Ways.Lookup(id); val != mask {
+			t.Errorf("Expected way %d to have mask %d, but got %d.", id, mask, val)
+		}
+	}
+
+	// the nodes still need to be in every square of the ways they're in.
+	if extra := extraNodesMap(w); len(extra) != 2 || extra[1] != 4 || extra[2] != 3 {
+		t.Errorf("Expected extra nodes 1: 4 and 2: 3, but got %v.", extra)
+	}
+}
+
+// extraNodesMap collects the worker's extra nodes into a map.
+func extraNodesMap(w *wayWorker) map[int64]uint64 {
+	extra := make(map[int64]uint64)
+	w.ExtraNodes.MultiBlock().Each(func(id int64, val uint64) {
+		extra[id] = val
+	})
+	return extra
+}
+
+// writeSeamInput writes a history file with a way whose two versions are in
+// different blocks, and each use a node in a different grid square.
+func writeSeamInput(t *testing.T, in string) {
+	header := &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}
+	w, err := NewPBFWriter(in, header)
+	if err != nil {
+		t.Fatalf("Unable to create input file: %s", err.Error())
+	}
+
+	w.WriteNode(&Node{Id: 1, Lon: -100e9, Lat: -40e9, Info: Info{Version: 1, Visible: true}})
+	w.WriteNode(&Node{Id: 2, Lon: 100e9, Lat: 40e9, Info: Info{Version: 1, Visible: true}})
+	for id := int64(1); id < MAX_BLOCK_ENTITIES; id += 1 {
+		w.WriteWay(&Way{Id: id, Refs: []int64{1}, Info: Info{Version: 1, Visible: true}})
+	}
+	w.WriteWay(&Way{Id: MAX_BLOCK_ENTITIES, Refs: []int64{1}, Info: Info{Version: 1, Visible: true}})
+	w.WriteWay(&Way{Id: MAX_BLOCK_ENTITIES, Refs: []int64{2}, Info: Info{Version: 2, Visible: true}})
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unable to close input file: %s", err.Error())
+	}
+}
+
+func TestWaySeams(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.osm.pbf")
+	writeSeamInput(t, in)
+	x_range, y_range := Tile{0, 0, 0}.Extent()
+
+	check := func(name string, sorter *Sorter) {
+		mask := sorter.Nodes.Lookup(1) | sorter.Nodes.Lookup(2)
+		if val := sorter.Ways.Lookup(MAX_BLOCK_ENTITIES); val != mask {
+			t.Errorf("%s: expected the split way to have mask %#x, but got %#x.", name, mask, val)
+		}
+		for id := int64(1); id <= 2; id += 1 {
+			if val := sorter.Nodes.Lookup(id); val != mask {
+				t.Errorf("%s: expected node %d to be in every square of the split way, %#x, but got %#x.", name, id, mask, val)
+			}
+		}
+	}
+
+	// plenty of workers, so that the two blocks are very unlikely to go to
+	// the same one.
+	for i := 0; i < 5; i += 1 {
+		reader := openTestInput(t, in)
+		sorter, _ := NewSorter(context.Background(), 8, x_range, y_range)
+		blocks := appendAll(t, reader, sorter)
+		reader.Close()
+		if err := sorter.Finish(); err != nil {
+			t.Fatalf("Unable to finish sorting: %s", err.Error())
+		}
+		check("Sorted", sorter)
+		sorter.Close()
+
+		// the seams have to survive a checkpoint between the two blocks.
+		reader = openTestInput(t, in)
+		sorter, _ = NewSorter(context.Background(), 8, x_range, y_range)
+		var buf bytes.Buffer
+		for _, b := range blocks {
+			if err := sorter.Append(b.Primitives); err != nil {
+				t.Fatalf("Unable to append block: %s", err.Error())
+			}
+			if n, w, _ := primCount(b.Primitives); n == 0 && w > 1 {
+				if err := sorter.Checkpoint(&buf, b.Next, b.Index + 1); err != nil {
+					t.Fatalf("Unable to checkpoint: %s", err.Error())
+				}
+				break
+			}
+		}
+		sorter.Close()
+
+		sorter, offset, index, err := ResumeSorter(context.Background(), &buf, 8, x_range, y_range, SorterOptions{})
+		if err != nil {
+			t.Fatalf("Unable to resume: %s", err.Error())
+		}
+		if err = reader.SeekBlob(offset, index); err != nil {
+			t.Fatalf("Unable to seek to blob %d: %s", index, err.Error())
+		}
+		appendAll(t, reader, sorter)
+		reader.Close()
+		if err = sorter.Finish(); err != nil {
+			t.Fatalf("Unable to finish sorting: %s", err.Error())
+		}
+		check("Resumed", sorter)
+		sorter.Close()
+	}
+}